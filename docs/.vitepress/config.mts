@@ -37,7 +37,11 @@ export default defineConfig({
                 text: 'Configuration', base: '/docs/configuration', items: [
                     {text: 'Configure Opengist', link: '/configure'},
                     {text: 'Admin panel', link: '/admin-panel'},
+                    {text: 'Databases', link: '/databases'},
                     {text: 'OAuth Providers', link: '/oauth-providers'},
+                    {text: 'LDAP', link: '/ldap'},
+                    {text: 'Captcha', link: '/captcha'},
+                    {text: 'Email', link: '/email'},
                     {text: 'Custom assets', link: '/custom-assets'},
                     {text: 'Custom links', link: '/custom-links'},
                     {text: 'Cheat Sheet', link: '/cheat-sheet'},
@@ -48,8 +52,22 @@ export default defineConfig({
                     {text: 'Init via Git', link: '/init-via-git'},
                     {text: 'Embed Gist', link: '/embed'},
                     {text: 'Gist as JSON', link: '/gist-json'},
+                    {text: 'Public gists feed', link: '/gists-feed'},
+                    {text: 'Atom feeds', link: '/atom-feeds'},
                     {text: 'Import Gists from Github', link: '/import-from-github-gist'},
                     {text: 'Git push options', link: '/git-push-options'},
+                    {text: 'Branches', link: '/branches'},
+                    {text: 'Versions', link: '/versions'},
+                    {text: 'Languages', link: '/languages'},
+                    {text: 'ZIP archives', link: '/zip-archives'},
+                    {text: 'Access tokens', link: '/access-tokens'},
+                    {text: 'Gists API', link: '/gists-api'},
+                    {text: 'App login', link: '/app-login'},
+                    {text: 'Two-factor authentication', link: '/two-factor'},
+                    {text: 'Passkeys', link: '/passkeys'},
+                    {text: 'Trash', link: '/trash'},
+                    {text: 'Topics', link: '/topics'},
+                    {text: 'Webhooks', link: '/webhooks'},
                 ], collapsed: false
             },
             {
@@ -60,7 +78,9 @@ export default defineConfig({
                         {text: 'Traefik', link: '/traefik-reverse-proxy'},
                     ], collapsed: true},
                     {text: 'Fail2ban', link: '/fail2ban-setup'},
+                    {text: 'Rate limiting', link: '/rate-limiting'},
                     {text: 'Healthcheck', link: '/healthcheck'},
+                    {text: 'Metrics', link: '/metrics'},
                 ], collapsed: false
             },
             {
@@ -1,6 +1,7 @@
 package actions
 
 import (
+	"context"
 	"github.com/rs/zerolog/log"
 	"github.com/thomiceli/opengist/internal/config"
 	"github.com/thomiceli/opengist/internal/db"
@@ -8,8 +9,8 @@ import (
 	"github.com/thomiceli/opengist/internal/index"
 	"os"
 	"path/filepath"
-	"strings"
 	"sync"
+	"time"
 )
 
 type ActionStatus struct {
@@ -23,6 +24,8 @@ const (
 	SyncGistPreviews
 	ResetHooks
 	IndexGists
+	PurgeTrash
+	DeleteExpiredGists
 )
 
 var (
@@ -73,6 +76,10 @@ func Run(actionType int) {
 		functionToRun = resetHooks
 	case IndexGists:
 		functionToRun = indexGists
+	case PurgeTrash:
+		functionToRun = purgeTrash
+	case DeleteExpiredGists:
+		functionToRun = deleteExpiredGists
 	default:
 		log.Error().Msg("Unknown action type")
 	}
@@ -89,8 +96,8 @@ func syncReposFromFS() {
 	}
 	for _, gist := range gists {
 		// if repository does not exist, delete gist from database
-		if _, err := os.Stat(git.RepositoryPath(gist.User.Username, gist.Uuid)); err != nil && !os.IsExist(err) {
-			if err2 := gist.Delete(); err2 != nil {
+		if _, err := os.Stat(git.RepositoryPath(gist.Uuid)); err != nil && !os.IsExist(err) {
+			if err2 := gist.Purge(); err2 != nil {
 				log.Error().Err(err2).Msgf("Cannot delete gist %d", gist.ID)
 			}
 		}
@@ -99,28 +106,57 @@ func syncReposFromFS() {
 
 func syncReposFromDB() {
 	log.Info().Msg("Syncing repositories from database...")
-	entries, err := filepath.Glob(filepath.Join(config.GetHomeDir(), "repos", "*", "*"))
+	entries, err := filepath.Glob(filepath.Join(config.GetHomeDir(), git.ReposDirectory, "*"))
 	if err != nil {
 		log.Error().Err(err).Msg("Cannot read repos directories")
 		return
 	}
 
-	for _, e := range entries {
-		path := strings.Split(e, string(os.PathSeparator))
-		gist, _ := db.GetGist(path[len(path)-2], path[len(path)-1])
+	// the forks of a gist deleted with its owner are not linked to it anymore, any repository may borrow its objects
+	uuids := make([]string, len(entries))
+	for i, e := range entries {
+		uuids[i] = filepath.Base(e)
+	}
+
+	for _, uuid := range uuids {
+		gist, _ := db.GetGistByUuid(uuid)
 
 		if gist.ID == 0 {
-			if err := git.DeleteRepository(path[len(path)-2], path[len(path)-1]); err != nil {
-				log.Error().Err(err).Msgf("Cannot delete repository %s/%s", path[len(path)-2], path[len(path)-1])
+			if err := git.DeleteRepository(uuid, uuids); err != nil {
+				log.Error().Err(err).Msgf("Cannot delete repository %s", uuid)
 			}
 		}
 	}
 }
 
 func gitGcRepos() {
+	GcRepos(false)
+}
+
+// GcRepos runs git gc on the repositories modified since their last garbage collection,
+// or on every repository if aggressive is set
+func GcRepos(aggressive bool) {
 	log.Info().Msg("Garbage collecting all repositories...")
-	if err := git.GcRepos(); err != nil {
-		log.Error().Err(err).Msg("Error garbage collecting repositories")
+	gists, err := db.GetAllGistsRows()
+	if err != nil {
+		log.Error().Err(err).Msg("Cannot get gists")
+		return
+	}
+
+	for _, gist := range gists {
+		if !aggressive && gist.LastGcAt >= gist.UpdatedAt {
+			continue
+		}
+
+		log.Info().Msg("Running git gc for repository " + git.RepositoryPath(gist.Uuid))
+		if err = git.GC(gist.Uuid, aggressive); err != nil {
+			log.Warn().Err(err).Msgf("Cannot run git gc for gist %d", gist.ID)
+			continue
+		}
+
+		if err = gist.SetLastGcNow(); err != nil {
+			log.Error().Err(err).Msgf("Cannot update last gc time for gist %d", gist.ID)
+		}
 	}
 }
 
@@ -141,16 +177,16 @@ func syncGistPreviews() {
 
 func resetHooks() {
 	log.Info().Msg("Resetting Git server hooks for all repositories...")
-	entries, err := filepath.Glob(filepath.Join(config.GetHomeDir(), "repos", "*", "*"))
+	entries, err := filepath.Glob(filepath.Join(config.GetHomeDir(), git.ReposDirectory, "*"))
 	if err != nil {
 		log.Error().Err(err).Msg("Cannot read repos directories")
 		return
 	}
 
 	for _, e := range entries {
-		path := strings.Split(e, string(os.PathSeparator))
-		if err := git.CreateDotGitFiles(path[len(path)-2], path[len(path)-1]); err != nil {
-			log.Error().Err(err).Msgf("Cannot reset hooks for repository %s/%s", path[len(path)-2], path[len(path)-1])
+		uuid := filepath.Base(e)
+		if err := git.CreateDotGitFiles(uuid); err != nil {
+			log.Error().Err(err).Msgf("Cannot reset hooks for repository %s", uuid)
 		}
 	}
 }
@@ -175,3 +211,57 @@ func indexGists() {
 		}
 	}
 }
+
+func purgeTrash() {
+	if config.C.GistTrashRetention == 0 {
+		return
+	}
+
+	gists, err := db.GetExpiredTrashedGists()
+	if err != nil {
+		log.Error().Err(err).Msg("Cannot get trashed gists")
+		return
+	}
+
+	for _, gist := range gists {
+		log.Info().Msgf("Purging gist %d from the trash", gist.ID)
+		if err = gist.Purge(); err != nil {
+			log.Error().Err(err).Msgf("Cannot purge gist %d", gist.ID)
+		}
+	}
+}
+
+func deleteExpiredGists() {
+	gists, err := db.GetExpiredGists()
+	if err != nil {
+		log.Error().Err(err).Msg("Cannot get expired gists")
+		return
+	}
+
+	for _, gist := range gists {
+		log.Info().Msgf("Deleting expired gist %d", gist.ID)
+		if err = gist.Purge(); err != nil {
+			log.Error().Err(err).Msgf("Cannot delete gist %d", gist.ID)
+			continue
+		}
+		gist.RemoveFromIndex()
+	}
+}
+
+// RunPeriodicActions deletes for good the gists whose trash retention expired and the expired gists, every hour until
+// the context is done
+func RunPeriodicActions(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		Run(PurgeTrash)
+		Run(DeleteExpiredGists)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
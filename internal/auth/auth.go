@@ -1,11 +1,18 @@
 package auth
 
+import "github.com/thomiceli/opengist/internal/config"
+
 type AuthInfoProvider interface {
 	RequireLogin() (bool, error)
 	AllowGistsWithoutLogin() (bool, error)
 }
 
 func ShouldAllowUnauthenticatedGistAccess(prov AuthInfoProvider, isSingleGistAccess bool) (bool, error) {
+	// a private instance overrides the admin settings, nothing is served to anonymous users
+	if config.C.PrivateInstance {
+		return false, nil
+	}
+
 	require, err := prov.RequireLogin()
 	if err != nil {
 		return false, err
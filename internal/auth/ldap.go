@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/thomiceli/opengist/internal/config"
+)
+
+const ldapTimeout = 10 * time.Second
+
+// LdapUser is a directory entry whose credentials were checked against the LDAP server
+type LdapUser struct {
+	DN       string
+	Username string
+	Email    string
+}
+
+// LdapEnabled reports whether users can log in with their directory credentials
+func LdapEnabled() bool {
+	return config.C.LdapUrl != ""
+}
+
+// LdapUserFilter returns the filter matching the entry of the user, the username is escaped so it cannot change the
+// meaning of the filter
+func LdapUserFilter(username string) string {
+	return fmt.Sprintf(config.C.LdapUserFilter, ldap.EscapeFilter(username))
+}
+
+// LdapAuthenticate searches the entry of the user with the bind account of the config, then binds as this entry with
+// the password to check it. It returns nil if there is no such entry or if the password is wrong.
+func LdapAuthenticate(username string, password string) (*LdapUser, error) {
+	// most servers accept a bind with an empty password as an anonymous one, it must not log the user in
+	if username == "" || password == "" {
+		return nil, nil
+	}
+
+	conn, err := ldapDial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if config.C.LdapBindDn != "" {
+		if err = conn.Bind(config.C.LdapBindDn, config.C.LdapBindPassword); err != nil {
+			return nil, fmt.Errorf("cannot bind to the LDAP server with the search account: %w", err)
+		}
+	}
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		config.C.LdapSearchBase,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(ldapTimeout.Seconds()), false,
+		LdapUserFilter(username),
+		[]string{config.C.LdapAttrUsername, config.C.LdapAttrEmail},
+		nil,
+	))
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf("the LDAP user filter matches more than one entry for %s", username)
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot search the LDAP server: %w", err)
+	}
+	if len(result.Entries) != 1 {
+		return nil, nil
+	}
+	entry := result.Entries[0]
+
+	if err = conn.Bind(entry.DN, password); ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot bind to the LDAP server as %s: %w", entry.DN, err)
+	}
+
+	user := &LdapUser{
+		DN:       entry.DN,
+		Username: entry.GetAttributeValue(config.C.LdapAttrUsername),
+		Email:    entry.GetAttributeValue(config.C.LdapAttrEmail),
+	}
+	if user.Username == "" {
+		return nil, fmt.Errorf("the LDAP entry %s has no %s attribute", entry.DN, config.C.LdapAttrUsername)
+	}
+	return user, nil
+}
+
+func ldapDial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(config.C.LdapUrl, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}))
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to the LDAP server: %w", err)
+	}
+	conn.SetTimeout(ldapTimeout)
+
+	if config.C.LdapStartTls {
+		serverUrl, _ := url.Parse(config.C.LdapUrl)
+		if err = conn.StartTLS(&tls.Config{ServerName: serverUrl.Hostname()}); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("cannot start TLS with the LDAP server: %w", err)
+		}
+	}
+	return conn, nil
+}
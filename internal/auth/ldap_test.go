@@ -0,0 +1,20 @@
+package auth
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thomiceli/opengist/internal/config"
+)
+
+func TestLdapUserFilter(t *testing.T) {
+	require.NoError(t, config.InitConfig("", io.Discard))
+
+	require.Equal(t, "(uid=thomas)", LdapUserFilter("thomas"))
+	require.Equal(t, `(uid=\2a)`, LdapUserFilter("*"), "Wildcards should not match every entry")
+	require.Equal(t, `(uid=\2a\29\28uid=\2a)`, LdapUserFilter("*)(uid=*"), "Usernames should not change the filter")
+
+	config.C.LdapUserFilter = "(&(objectClass=user)(sAMAccountName=%s))"
+	require.Equal(t, "(&(objectClass=user)(sAMAccountName=thomas))", LdapUserFilter("thomas"))
+}
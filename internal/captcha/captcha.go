@@ -0,0 +1,89 @@
+// Package captcha checks that the forms open to anonymous users are filled by humans, with hCaptcha, Cloudflare
+// Turnstile or a proof-of-work challenge solved by the browser
+package captcha
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	Off         = "off"
+	HCaptcha    = "hcaptcha"
+	Turnstile   = "turnstile"
+	ProofOfWork = "pow"
+)
+
+// VerifyURLs are the endpoints the tokens of the third-party providers are checked against
+var VerifyURLs = map[string]string{
+	HCaptcha:  "https://api.hcaptcha.com/siteverify",
+	Turnstile: "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+}
+
+// ResponseFields are the form fields the widgets of the third-party providers put their token in
+var ResponseFields = map[string]string{
+	HCaptcha:  "h-captcha-response",
+	Turnstile: "cf-turnstile-response",
+}
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// VerifyToken asks the provider whether the token given by its widget is valid
+func VerifyToken(provider, secret, token, remoteIp string) (bool, error) {
+	if token == "" {
+		return false, nil
+	}
+
+	res, err := httpClient.PostForm(VerifyURLs[provider], url.Values{
+		"secret":   {secret},
+		"response": {token},
+		"remoteip": {remoteIp},
+	})
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	var body struct {
+		Success bool `json:"success"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return false, err
+	}
+	return body.Success, nil
+}
+
+// NewChallenge returns a random challenge for the proof-of-work, it has to be kept server side until it is answered
+func NewChallenge() (string, error) {
+	randomBytes := make([]byte, 16)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(randomBytes), nil
+}
+
+// VerifyProofOfWork reports whether the SHA-256 hash of the challenge followed by the nonce starts with at least
+// difficulty zero bits
+func VerifyProofOfWork(challenge, nonce string, difficulty int) bool {
+	if challenge == "" || nonce == "" {
+		return false
+	}
+	return leadingZeroBits(sha256.Sum256([]byte(challenge+nonce))) >= difficulty
+}
+
+func leadingZeroBits(hash [32]byte) int {
+	count := 0
+	for _, b := range hash {
+		if b != 0 {
+			return count + bits.LeadingZeros8(b)
+		}
+		count += 8
+	}
+	return count
+}
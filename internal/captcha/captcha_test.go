@@ -0,0 +1,53 @@
+package captcha
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyProofOfWork(t *testing.T) {
+	challenge, err := NewChallenge()
+	require.NoError(t, err)
+	require.Len(t, challenge, 32)
+
+	nonce := 0
+	for !VerifyProofOfWork(challenge, strconv.Itoa(nonce), 8) {
+		nonce++
+	}
+	require.True(t, VerifyProofOfWork(challenge, strconv.Itoa(nonce), 8))
+	require.False(t, VerifyProofOfWork("", strconv.Itoa(nonce), 8))
+	require.False(t, VerifyProofOfWork(challenge, "", 0))
+
+	require.Equal(t, 256, leadingZeroBits([32]byte{}))
+	require.Equal(t, 11, leadingZeroBits([32]byte{0, 0x1f}))
+}
+
+func TestVerifyToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "secret", r.FormValue("secret"))
+		require.Equal(t, "192.0.2.1", r.FormValue("remoteip"))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"success":` + strconv.FormatBool(r.FormValue("response") == "good") + `}`))
+	}))
+	defer server.Close()
+
+	previous := VerifyURLs[Turnstile]
+	VerifyURLs[Turnstile] = server.URL
+	defer func() { VerifyURLs[Turnstile] = previous }()
+
+	ok, err := VerifyToken(Turnstile, "secret", "good", "192.0.2.1")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ok, err = VerifyToken(Turnstile, "secret", "bad", "192.0.2.1")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	ok, err = VerifyToken(Turnstile, "secret", "", "192.0.2.1")
+	require.NoError(t, err)
+	require.False(t, ok)
+}
@@ -0,0 +1,22 @@
+package cli
+
+import (
+	"github.com/thomiceli/opengist/internal/actions"
+	"github.com/urfave/cli/v2"
+)
+
+var CmdGc = cli.Command{
+	Name:  "gc",
+	Usage: "Garbage collect the Git repositories modified since their last garbage collection",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "aggressive",
+			Usage: "Run an aggressive garbage collection on every repository",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		initialize(ctx)
+		actions.GcRepos(ctx.Bool("aggressive"))
+		return nil
+	},
+}
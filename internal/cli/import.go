@@ -0,0 +1,57 @@
+package cli
+
+import (
+	"fmt"
+	"github.com/thomiceli/opengist/internal/db"
+	"github.com/thomiceli/opengist/internal/importer"
+	"github.com/urfave/cli/v2"
+)
+
+var CmdImport = cli.Command{
+	Name:  "import",
+	Usage: "Import gists from other services",
+	Subcommands: []*cli.Command{
+		&CmdImportGithub,
+	},
+}
+
+var CmdImportGithub = cli.Command{
+	Name:      "github",
+	Usage:     "Import the gists of a GitHub user for a given user",
+	ArgsUsage: "[username] [github username]",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "token",
+			Usage:   "GitHub token, to import the secret gists of its owner as well",
+			EnvVars: []string{"GITHUB_TOKEN"},
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		initialize(ctx)
+		if ctx.NArg() < 1 {
+			return fmt.Errorf("username is required")
+		}
+		username := ctx.Args().Get(0)
+
+		user, err := db.GetUserByUsername(username)
+		if err != nil {
+			fmt.Printf("Cannot get user %s: %s\n", username, err)
+			return err
+		}
+
+		result, err := importer.ImportGithubGists(user, &importer.GithubImportDTO{
+			Username: ctx.Args().Get(1),
+			Token:    ctx.String("token"),
+		})
+		if err != nil {
+			fmt.Printf("Cannot fetch the gists from GitHub: %s\n", err)
+			return err
+		}
+
+		for id, err := range result.Failed {
+			fmt.Printf("Cannot import GitHub gist %s: %s\n", id, err)
+		}
+		fmt.Printf("%d gists imported for user %s.\n", len(result.Imported), username)
+		return nil
+	},
+}
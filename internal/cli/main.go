@@ -3,14 +3,19 @@ package cli
 import (
 	"fmt"
 	"github.com/rs/zerolog/log"
+	"github.com/thomiceli/opengist/internal/actions"
 	"github.com/thomiceli/opengist/internal/config"
 	"github.com/thomiceli/opengist/internal/db"
 	"github.com/thomiceli/opengist/internal/git"
 	"github.com/thomiceli/opengist/internal/index"
+	"github.com/thomiceli/opengist/internal/mailer"
 	"github.com/thomiceli/opengist/internal/memdb"
+	"github.com/thomiceli/opengist/internal/ratelimit"
 	"github.com/thomiceli/opengist/internal/ssh"
 	"github.com/thomiceli/opengist/internal/web"
+	"github.com/thomiceli/opengist/internal/webhook"
 	"github.com/urfave/cli/v2"
+	"net/url"
 	"os"
 	"os/signal"
 	"path"
@@ -38,6 +43,8 @@ var CmdStart = cli.Command{
 
 		go web.NewServer(os.Getenv("OG_DEV") == "1", path.Join(config.GetHomeDir(), "sessions")).Start()
 		go ssh.Start()
+		go actions.RunPeriodicActions(stopCtx)
+		go webhook.Run(stopCtx)
 
 		<-stopCtx.Done()
 		shutdown()
@@ -57,7 +64,7 @@ func App() error {
 	app.Usage = "A self-hosted pastebin powered by Git."
 	app.HelpName = "opengist"
 
-	app.Commands = []*cli.Command{&CmdVersion, &CmdStart, &CmdHook, &CmdAdmin}
+	app.Commands = []*cli.Command{&CmdVersion, &CmdStart, &CmdHook, &CmdAdmin, &CmdGc, &CmdImport, &CmdMigrate}
 	app.DefaultCommand = CmdStart.Name
 	app.Flags = []cli.Flag{
 		&ConfigFlag,
@@ -108,8 +115,14 @@ func Initialize(ctx *cli.Context) {
 	if err := os.MkdirAll(filepath.Join(homePath, "custom"), 0755); err != nil {
 		log.Fatal().Err(err).Send()
 	}
-	log.Info().Msg("Database file: " + filepath.Join(homePath, config.C.DBFilename))
-	if err := db.Setup(filepath.Join(homePath, config.C.DBFilename), false); err != nil {
+	if config.C.DBUri != "" {
+		if dbUrl, err := url.Parse(config.C.DBUri); err == nil {
+			log.Info().Msg("Database: " + dbUrl.Redacted())
+		}
+	} else {
+		log.Info().Msg("Database file: " + filepath.Join(homePath, config.C.DBFilename))
+	}
+	if err := db.Setup(databaseUri(), false); err != nil {
 		log.Fatal().Err(err).Msg("Failed to initialize database")
 	}
 
@@ -117,6 +130,14 @@ func Initialize(ctx *cli.Context) {
 		log.Fatal().Err(err).Msg("Failed to initialize in memory database")
 	}
 
+	if config.C.RateLimitEnabled {
+		if err := ratelimit.Setup(config.C.RateLimitRedisUrl); err != nil {
+			log.Fatal().Err(err).Msg("Failed to initialize rate limiter")
+		}
+	}
+
+	mailer.Setup()
+
 	if config.C.IndexEnabled {
 		log.Info().Msg("Index directory: " + filepath.Join(homePath, config.C.IndexDirname))
 		index.Init(filepath.Join(homePath, config.C.IndexDirname))
@@ -137,6 +158,14 @@ func shutdown() {
 	log.Info().Msg("Shutdown complete")
 }
 
+// databaseUri returns the URI of the database server if one is set, the path of the SQLite file otherwise
+func databaseUri() string {
+	if config.C.DBUri != "" {
+		return config.C.DBUri
+	}
+	return filepath.Join(config.GetHomeDir(), config.C.DBFilename)
+}
+
 func createSymlink(homePath string, configPath string) error {
 	if err := os.MkdirAll(filepath.Join(homePath, "symlinks"), 0755); err != nil {
 		return err
@@ -0,0 +1,98 @@
+package cli
+
+import (
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"github.com/thomiceli/opengist/internal/config"
+	"github.com/thomiceli/opengist/internal/db"
+	"github.com/urfave/cli/v2"
+	"io"
+	"time"
+)
+
+var CmdMigrate = cli.Command{
+	Name:  "migrate",
+	Usage: "Manage the migrations of the database",
+	Subcommands: []*cli.Command{
+		&CmdMigrateStatus,
+		&CmdMigrateUp,
+		&CmdMigrateDown,
+	},
+}
+
+var CmdMigrateStatus = cli.Command{
+	Name:  "status",
+	Usage: "List the migrations and when they were applied",
+	Action: func(ctx *cli.Context) error {
+		openDatabase(ctx)
+
+		statuses, err := db.GetMigrationStatuses()
+		if err != nil {
+			fmt.Printf("Cannot get the migrations: %s\n", err)
+			return err
+		}
+
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.AppliedAt > 0 {
+				appliedAt = time.Unix(status.AppliedAt, 0).Format(time.RFC3339)
+			}
+			fmt.Printf("%-40s %s\n", status.ID, appliedAt)
+		}
+		return nil
+	},
+}
+
+var CmdMigrateUp = cli.Command{
+	Name:  "up",
+	Usage: "Apply the pending migrations, which is also done when Opengist starts",
+	Action: func(ctx *cli.Context) error {
+		openDatabase(ctx)
+
+		if err := db.Migrate(); err != nil {
+			fmt.Printf("Cannot migrate the database: %s\n", err)
+			return err
+		}
+
+		fmt.Println("The database is up to date.")
+		return nil
+	},
+}
+
+var CmdMigrateDown = cli.Command{
+	Name:      "down",
+	Usage:     "Revert the migrations applied after the given one, before downgrading Opengist to the release shipping it",
+	ArgsUsage: "[migration]",
+	Action: func(ctx *cli.Context) error {
+		openDatabase(ctx)
+		if ctx.NArg() < 1 {
+			return fmt.Errorf("migration is required")
+		}
+
+		reverted, err := db.RollbackMigrations(ctx.Args().Get(0))
+		for _, id := range reverted {
+			fmt.Printf("Migration %s has been reverted.\n", id)
+		}
+		if err != nil {
+			fmt.Printf("Cannot revert the migrations: %s\n", err)
+			return err
+		}
+
+		if len(reverted) == 0 {
+			fmt.Println("No migration to revert.")
+		}
+		return nil
+	},
+}
+
+// openDatabase opens the database without applying its pending migrations
+func openDatabase(ctx *cli.Context) {
+	if err := config.InitConfig(ctx.String("config"), io.Discard); err != nil {
+		panic(err)
+	}
+	config.InitLog()
+
+	if err := db.Open(databaseUri(), false); err != nil {
+		log.Fatal().Err(err).Msg("Failed to open database")
+	}
+}
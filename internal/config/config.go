@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"io"
+	"net"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -30,16 +31,74 @@ type config struct {
 	ExternalUrl  string `yaml:"external-url" env:"OG_EXTERNAL_URL"`
 	OpengistHome string `yaml:"opengist-home" env:"OG_OPENGIST_HOME"`
 	DBFilename   string `yaml:"db-filename" env:"OG_DB_FILENAME"`
+	DBUri        string `yaml:"db-uri" env:"OG_DB_URI"`
 	IndexEnabled bool   `yaml:"index.enabled" env:"OG_INDEX_ENABLED"`
 	IndexDirname string `yaml:"index.dirname" env:"OG_INDEX_DIRNAME"`
 
-	GitDefaultBranch string `yaml:"git.default-branch" env:"OG_GIT_DEFAULT_BRANCH"`
+	PrivateInstance    bool `yaml:"private-instance" env:"OG_PRIVATE_INSTANCE"`
+	DisableSignup      bool `yaml:"disable-signup" env:"OG_DISABLE_SIGNUP"`
+	DisableInvitations bool `yaml:"disable-invitations" env:"OG_DISABLE_INVITATIONS"`
+
+	ReservedUsernames string `yaml:"reserved-usernames" env:"OG_RESERVED_USERNAMES"`
+
+	PreviewLines int `yaml:"preview.lines" env:"OG_PREVIEW_LINES"`
+
+	PaginationPageSize int `yaml:"pagination.page-size" env:"OG_PAGINATION_PAGE_SIZE"`
+
+	GistMaxFiles          int    `yaml:"gist.max-files" env:"OG_GIST_MAX_FILES"`
+	GistUrlFormat         string `yaml:"gist.url-format" env:"OG_GIST_URL_FORMAT"`
+	GistAllowedExtensions string `yaml:"gist.allowed-extensions" env:"OG_GIST_ALLOWED_EXTENSIONS"`
+	GistBlockedExtensions string `yaml:"gist.blocked-extensions" env:"OG_GIST_BLOCKED_EXTENSIONS"`
+	GistSecretScanning    string `yaml:"gist.secret-scanning" env:"OG_GIST_SECRET_SCANNING"`
+	GistDefaultVisibility string `yaml:"gist.default-visibility" env:"OG_GIST_DEFAULT_VISIBILITY"`
+	GistTrashRetention    int    `yaml:"gist.trash-retention" env:"OG_GIST_TRASH_RETENTION"`
+
+	GitDefaultBranch      string `yaml:"git.default-branch" env:"OG_GIT_DEFAULT_BRANCH"`
+	GitDefaultAuthorName  string `yaml:"git.default-author-name" env:"OG_GIT_DEFAULT_AUTHOR_NAME"`
+	GitDefaultAuthorEmail string `yaml:"git.default-author-email" env:"OG_GIT_DEFAULT_AUTHOR_EMAIL"`
+	GitTimeout            int    `yaml:"git.timeout" env:"OG_GIT_TIMEOUT"`
+	GitSharedForkObjects  bool   `yaml:"git.shared-fork-objects" env:"OG_GIT_SHARED_FORK_OBJECTS"`
 
 	SqliteJournalMode string `yaml:"sqlite.journal-mode" env:"OG_SQLITE_JOURNAL_MODE"`
 
-	HttpHost string `yaml:"http.host" env:"OG_HTTP_HOST"`
-	HttpPort string `yaml:"http.port" env:"OG_HTTP_PORT"`
-	HttpGit  bool   `yaml:"http.git-enabled" env:"OG_HTTP_GIT_ENABLED"`
+	HttpHost               string `yaml:"http.host" env:"OG_HTTP_HOST"`
+	HttpPort               string `yaml:"http.port" env:"OG_HTTP_PORT"`
+	HttpGit                bool   `yaml:"http.git-enabled" env:"OG_HTTP_GIT_ENABLED"`
+	HttpCorsAllowedOrigins string `yaml:"http.cors-allowed-origins" env:"OG_HTTP_CORS_ALLOWED_ORIGINS"`
+	HttpTrustedProxies     string `yaml:"http.trusted-proxies" env:"OG_HTTP_TRUSTED_PROXIES"`
+	HttpCompression        bool   `yaml:"http.compression" env:"OG_HTTP_COMPRESSION"`
+
+	JwtAccessTokenExpiry  int `yaml:"jwt.access-token-expiry" env:"OG_JWT_ACCESS_TOKEN_EXPIRY"`
+	JwtRefreshTokenExpiry int `yaml:"jwt.refresh-token-expiry" env:"OG_JWT_REFRESH_TOKEN_EXPIRY"`
+
+	MetricsEnabled  bool   `yaml:"metrics.enabled" env:"OG_METRICS_ENABLED"`
+	MetricsUsername string `yaml:"metrics.username" env:"OG_METRICS_USERNAME"`
+	MetricsPassword string `yaml:"metrics.password" env:"OG_METRICS_PASSWORD"`
+
+	RateLimitEnabled  bool   `yaml:"ratelimit.enabled" env:"OG_RATELIMIT_ENABLED"`
+	RateLimitRedisUrl string `yaml:"ratelimit.redis-url" env:"OG_RATELIMIT_REDIS_URL"`
+	RateLimitLogin    int    `yaml:"ratelimit.login" env:"OG_RATELIMIT_LOGIN"`
+	RateLimitCreate   int    `yaml:"ratelimit.create" env:"OG_RATELIMIT_CREATE"`
+	RateLimitGit      int    `yaml:"ratelimit.git" env:"OG_RATELIMIT_GIT"`
+	RateLimitSearch   int    `yaml:"ratelimit.search" env:"OG_RATELIMIT_SEARCH"`
+
+	CaptchaProvider      string `yaml:"captcha.provider" env:"OG_CAPTCHA_PROVIDER"`
+	CaptchaSiteKey       string `yaml:"captcha.site-key" env:"OG_CAPTCHA_SITE_KEY"`
+	CaptchaSecretKey     string `yaml:"captcha.secret-key" env:"OG_CAPTCHA_SECRET_KEY"`
+	CaptchaPowDifficulty int    `yaml:"captcha.pow-difficulty" env:"OG_CAPTCHA_POW_DIFFICULTY"`
+	CaptchaLogin         bool   `yaml:"captcha.login" env:"OG_CAPTCHA_LOGIN"`
+
+	SmtpHost     string `yaml:"smtp.host" env:"OG_SMTP_HOST"`
+	SmtpPort     string `yaml:"smtp.port" env:"OG_SMTP_PORT"`
+	SmtpUsername string `yaml:"smtp.username" env:"OG_SMTP_USERNAME"`
+	SmtpPassword string `yaml:"smtp.password" env:"OG_SMTP_PASSWORD"`
+	SmtpFrom     string `yaml:"smtp.from" env:"OG_SMTP_FROM"`
+
+	EmailVerification   bool `yaml:"email.verification" env:"OG_EMAIL_VERIFICATION"`
+	EmailRestrictPublic bool `yaml:"email.restrict-public" env:"OG_EMAIL_RESTRICT_PUBLIC"`
+
+	WebhookEnabled    bool `yaml:"webhook.enabled" env:"OG_WEBHOOK_ENABLED"`
+	WebhookAllowLocal bool `yaml:"webhook.allow-local" env:"OG_WEBHOOK_ALLOW_LOCAL"`
 
 	SshGit            bool   `yaml:"ssh.git-enabled" env:"OG_SSH_GIT_ENABLED"`
 	SshHost           string `yaml:"ssh.host" env:"OG_SSH_HOST"`
@@ -64,6 +123,15 @@ type config struct {
 	OIDCSecret       string `yaml:"oidc.secret" env:"OG_OIDC_SECRET"`
 	OIDCDiscoveryUrl string `yaml:"oidc.discovery-url" env:"OG_OIDC_DISCOVERY_URL"`
 
+	LdapUrl          string `yaml:"ldap.url" env:"OG_LDAP_URL"`
+	LdapStartTls     bool   `yaml:"ldap.start-tls" env:"OG_LDAP_START_TLS"`
+	LdapBindDn       string `yaml:"ldap.bind-dn" env:"OG_LDAP_BIND_DN"`
+	LdapBindPassword string `yaml:"ldap.bind-password" env:"OG_LDAP_BIND_PASSWORD"`
+	LdapSearchBase   string `yaml:"ldap.search-base" env:"OG_LDAP_SEARCH_BASE"`
+	LdapUserFilter   string `yaml:"ldap.user-filter" env:"OG_LDAP_USER_FILTER"`
+	LdapAttrUsername string `yaml:"ldap.attr-username" env:"OG_LDAP_ATTR_USERNAME"`
+	LdapAttrEmail    string `yaml:"ldap.attr-email" env:"OG_LDAP_ATTR_EMAIL"`
+
 	CustomLogo    string       `yaml:"custom.logo" env:"OG_CUSTOM_LOGO"`
 	CustomFavicon string       `yaml:"custom.favicon" env:"OG_CUSTOM_FAVICON"`
 	StaticLinks   []StaticLink `yaml:"custom.static-links" env:"OG_CUSTOM_STATIC_LINK"`
@@ -84,11 +152,41 @@ func configWithDefaults() (*config, error) {
 	c.IndexEnabled = true
 	c.IndexDirname = "opengist.index"
 
+	c.PreviewLines = 10
+
+	c.PaginationPageSize = 10
+
+	c.GistMaxFiles = 100
+	c.GistUrlFormat = "uuid"
+	c.GistSecretScanning = "off"
+	c.GistDefaultVisibility = "public"
+	c.GistTrashRetention = 30
+
+	c.GitDefaultAuthorName = "Opengist"
+	c.GitDefaultAuthorEmail = "opengist@localhost"
+	c.GitTimeout = 60
+
 	c.SqliteJournalMode = "WAL"
 
 	c.HttpHost = "0.0.0.0"
 	c.HttpPort = "6157"
 	c.HttpGit = true
+	c.HttpCompression = true
+
+	c.JwtAccessTokenExpiry = 15
+	c.JwtRefreshTokenExpiry = 30
+
+	c.RateLimitLogin = 10
+	c.RateLimitCreate = 20
+	c.RateLimitGit = 120
+	c.RateLimitSearch = 60
+
+	c.CaptchaProvider = "off"
+	c.CaptchaPowDifficulty = 18
+
+	c.SmtpPort = "587"
+
+	c.WebhookEnabled = true
 
 	c.SshGit = true
 	c.SshHost = "0.0.0.0"
@@ -100,6 +198,10 @@ func configWithDefaults() (*config, error) {
 	c.GiteaUrl = "https://gitea.com"
 	c.GiteaName = "Gitea"
 
+	c.LdapUserFilter = "(uid=%s)"
+	c.LdapAttrUsername = "uid"
+	c.LdapAttrEmail = "mail"
+
 	return c, nil
 }
 
@@ -131,6 +233,8 @@ func InitConfig(configPath string, out io.Writer) error {
 		return err
 	}
 
+	c.ExternalUrl = strings.TrimSuffix(c.ExternalUrl, "/")
+
 	C = c
 
 	if err = os.Setenv("OG_OPENGIST_HOME_INTERNAL", GetHomeDir()); err != nil {
@@ -282,6 +386,13 @@ func loadConfigFromEnv(c *config, out io.Writer) error {
 			}
 			v.Field(i).SetBool(boolVal)
 			envVars = append(envVars, tag)
+		case reflect.Int:
+			intVal, err := strconv.Atoi(envValue)
+			if err != nil {
+				return err
+			}
+			v.Field(i).SetInt(int64(intVal))
+			envVars = append(envVars, tag)
 		case reflect.Slice:
 			if v.Type().Field(i).Type.Elem().Kind() == reflect.Struct {
 				prefix := strings.ToUpper(tag) + "_"
@@ -348,5 +459,169 @@ func checks(c *config) error {
 		return err
 	}
 
+	if c.LdapUrl != "" {
+		ldapUrl, err := url.Parse(c.LdapUrl)
+		if err != nil {
+			return err
+		}
+		if ldapUrl.Scheme != "ldap" && ldapUrl.Scheme != "ldaps" {
+			return fmt.Errorf("ldap.url must start with ldap:// or ldaps://")
+		}
+		if strings.Count(c.LdapUserFilter, "%s") != 1 {
+			return fmt.Errorf("ldap.user-filter must hold the %%s placeholder of the username once")
+		}
+	}
+
+	if c.PaginationPageSize < 1 || c.PaginationPageSize > 100 {
+		return fmt.Errorf("pagination.page-size must be between 1 and 100")
+	}
+
+	if c.GistMaxFiles < 1 {
+		return fmt.Errorf("gist.max-files must be at least 1")
+	}
+
+	switch c.GistUrlFormat {
+	case "uuid", "short", "slug":
+	default:
+		return fmt.Errorf("gist.url-format must be one of uuid, short or slug")
+	}
+
+	switch c.GistSecretScanning {
+	case "off", "warn", "reject":
+	default:
+		return fmt.Errorf("gist.secret-scanning must be one of off, warn or reject")
+	}
+
+	switch c.GistDefaultVisibility {
+	case "public", "unlisted", "private":
+	default:
+		return fmt.Errorf("gist.default-visibility must be one of public, unlisted or private")
+	}
+
+	if c.GistTrashRetention < 0 {
+		return fmt.Errorf("gist.trash-retention must be positive")
+	}
+
+	if c.GitTimeout < 1 {
+		return fmt.Errorf("git.timeout must be at least 1")
+	}
+
+	if c.JwtAccessTokenExpiry < 1 || c.JwtRefreshTokenExpiry < 1 {
+		return fmt.Errorf("jwt.access-token-expiry and jwt.refresh-token-expiry must be at least 1")
+	}
+
+	switch c.CaptchaProvider {
+	case "off", "pow":
+	case "hcaptcha", "turnstile":
+		if c.CaptchaSiteKey == "" || c.CaptchaSecretKey == "" {
+			return fmt.Errorf("captcha.site-key and captcha.secret-key must be set to use %s", c.CaptchaProvider)
+		}
+	default:
+		return fmt.Errorf("captcha.provider must be one of off, hcaptcha, turnstile or pow")
+	}
+
+	if c.CaptchaPowDifficulty < 1 || c.CaptchaPowDifficulty > 32 {
+		return fmt.Errorf("captcha.pow-difficulty must be between 1 and 32")
+	}
+
+	if c.SmtpHost != "" && c.SmtpFrom == "" {
+		return fmt.Errorf("smtp.from must be set to send emails")
+	}
+
+	if c.EmailVerification && c.SmtpHost == "" {
+		return fmt.Errorf("email.verification needs smtp.host to send the verification links")
+	}
+
+	for _, origin := range c.CorsAllowedOrigins() {
+		if origin != "*" && !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") {
+			return fmt.Errorf("http.cors-allowed-origins must hold * or origins starting with http:// or https://, got %q", origin)
+		}
+	}
+
+	if _, err := c.TrustedProxies(); err != nil {
+		return err
+	}
+
 	return nil
 }
+
+// CorsAllowedOrigins returns the origins listed in http.cors-allowed-origins, none if cross-origin requests are off
+func (c *config) CorsAllowedOrigins() []string {
+	var origins []string
+	for _, origin := range strings.Split(c.HttpCorsAllowedOrigins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, strings.TrimSuffix(origin, "/"))
+		}
+	}
+	return origins
+}
+
+// TrustedProxies returns the IP ranges listed in http.trusted-proxies, an address without a mask is a range of its own
+func (c *config) TrustedProxies() ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, proxy := range strings.Split(c.HttpTrustedProxies, ",") {
+		if proxy = strings.TrimSpace(proxy); proxy == "" {
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+
+		_, ipRange, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("http.trusted-proxies must hold IP addresses or ranges, got %q", proxy)
+		}
+		proxies = append(proxies, ipRange)
+	}
+	return proxies, nil
+}
+
+// BasePath returns the path of the external URL, without trailing slash. It is empty unless Opengist is served under
+// a subpath of a domain, e.g. /opengist for https://example.com/opengist
+func (c *config) BasePath() string {
+	u, err := url.Parse(c.ExternalUrl)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(u.Path, "/")
+}
+
+// FileExtensionAllowed reports whether a file of this name can be added to a gist according to
+// gist.allowed-extensions and gist.blocked-extensions. The extension is compared case-insensitively, the blocklist
+// wins over the allowlist and a file without extension is refused only when an allowlist is set.
+func (c *config) FileExtensionAllowed(filename string) bool {
+	ext := strings.ToLower(filepath.Ext(filename))
+
+	if ext != "" && slices.Contains(extensionsList(c.GistBlockedExtensions), ext) {
+		return false
+	}
+
+	allowed := extensionsList(c.GistAllowedExtensions)
+	return len(allowed) == 0 || slices.Contains(allowed, ext)
+}
+
+// UsernameReserved reports whether the username is listed in reserved-usernames, compared case-insensitively. The
+// names used by the routes are reserved in any case.
+func (c *config) UsernameReserved(username string) bool {
+	for _, name := range strings.Split(c.ReservedUsernames, ",") {
+		if name = strings.TrimSpace(name); name != "" && strings.EqualFold(name, username) {
+			return true
+		}
+	}
+	return false
+}
+
+// extensionsList splits a comma separated list of extensions, lowercased and with a leading dot
+func extensionsList(list string) []string {
+	var extensions []string
+	for _, ext := range strings.Split(list, ",") {
+		if ext = strings.ToLower(strings.TrimSpace(ext)); ext != "" {
+			extensions = append(extensions, "."+strings.TrimPrefix(ext, "."))
+		}
+	}
+	return extensions
+}
@@ -5,7 +5,7 @@ import (
 )
 
 type AdminSetting struct {
-	Key   string `gorm:"uniqueIndex"`
+	Key   string `gorm:"uniqueIndex;size:255"`
 	Value string
 }
 
@@ -19,7 +19,8 @@ const (
 
 func GetSetting(key string) (string, error) {
 	var setting AdminSetting
-	err := db.Where("key = ?", key).First(&setting).Error
+	// key is a reserved word in MySQL, the condition is built from the struct to get the column quoted
+	err := db.Where(&AdminSetting{Key: key}).First(&setting).Error
 	return setting.Value, err
 }
 
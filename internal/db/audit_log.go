@@ -0,0 +1,60 @@
+package db
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	AuditGistCreated             = "gist-created"
+	AuditGistForked              = "gist-forked"
+	AuditGistDeleted             = "gist-deleted"
+	AuditGistRestored            = "gist-restored"
+	AuditGistVisibilityChanged   = "gist-visibility-changed"
+	AuditGistCollaboratorAdded   = "gist-collaborator-added"
+	AuditGistCollaboratorRemoved = "gist-collaborator-removed"
+)
+
+// AuditLog records a sensitive action done on a gist. The names of the actor and of the gist are copied, and there is
+// no foreign key, so the entry outlives them.
+type AuditLog struct {
+	ID        uint `gorm:"primaryKey"`
+	ActorID   uint `gorm:"index"` // 0 if no user is behind the action
+	ActorName string
+	Action    string `gorm:"index;size:255"`
+	GistID    uint   `gorm:"index"`
+	GistName  string // <owner>/<identifier> at the time of the action
+	Metadata  string // JSON object of the details of the action
+	CreatedAt int64
+}
+
+// AddAuditLog records the action of the actor on the gist, actor can be nil and metadata holds the details
+func AddAuditLog(actor *User, action string, gist *Gist, metadata map[string]any) error {
+	entry := &AuditLog{
+		Action:    action,
+		GistID:    gist.ID,
+		GistName:  gist.User.Username + "/" + gist.Identifier(),
+		Metadata:  "{}",
+		CreatedAt: time.Now().Unix(),
+	}
+
+	if actor != nil {
+		entry.ActorID = actor.ID
+		entry.ActorName = actor.Username
+	}
+
+	if len(metadata) > 0 {
+		data, err := json.Marshal(metadata)
+		if err != nil {
+			return err
+		}
+		entry.Metadata = string(data)
+	}
+
+	return db.Create(entry).Error
+}
+
+// GetAuditLogs returns a page of the audit logs, newest first, and their total count
+func GetAuditLogs(page Page) ([]*AuditLog, int64, error) {
+	return paginate[AuditLog](db, page, "id desc")
+}
@@ -0,0 +1,47 @@
+package db
+
+import (
+	"time"
+)
+
+// GistCollaborator grants write access on a gist to a user who is not its owner
+type GistCollaborator struct {
+	GistID    uint `gorm:"primaryKey"`
+	Gist      Gist `validate:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+	UserID    uint `gorm:"primaryKey"`
+	User      User `validate:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+	CreatedAt int64
+}
+
+func (gist *Gist) GetCollaborators() ([]*User, error) {
+	var users []*User
+	err := db.
+		Joins("JOIN gist_collaborators ON gist_collaborators.user_id = users.id").
+		Where("gist_collaborators.gist_id = ?", gist.ID).
+		Order("gist_collaborators.created_at asc").
+		Find(&users).Error
+
+	return users, err
+}
+
+func (gist *Gist) IsCollaborator(userId uint) (bool, error) {
+	var count int64
+	err := db.Model(&GistCollaborator{}).
+		Where("gist_id = ? AND user_id = ?", gist.ID, userId).
+		Count(&count).Error
+	return count > 0, err
+}
+
+func (gist *Gist) AddCollaborator(user *User) error {
+	return db.Create(&GistCollaborator{
+		GistID:    gist.ID,
+		UserID:    user.ID,
+		CreatedAt: time.Now().Unix(),
+	}).Error
+}
+
+func (gist *Gist) RemoveCollaborator(userId uint) error {
+	return db.
+		Where("gist_id = ? AND user_id = ?", gist.ID, userId).
+		Delete(&GistCollaborator{}).Error
+}
@@ -0,0 +1,91 @@
+package db
+
+import (
+	"time"
+)
+
+// Comment is a message left by a user under a gist, its body is written in Markdown
+type Comment struct {
+	ID        uint `gorm:"primaryKey"`
+	GistID    uint `gorm:"index"`
+	Gist      Gist `validate:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+	UserID    uint
+	User      User `validate:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+	Body      string
+	CreatedAt int64
+	UpdatedAt int64
+}
+
+// GetComments returns the comments of the gist, the oldest first
+func (gist *Gist) GetComments() ([]*Comment, error) {
+	var comments []*Comment
+	err := db.Preload("User").
+		Where("gist_id = ?", gist.ID).
+		Order("created_at asc, id asc").
+		Find(&comments).Error
+
+	return comments, err
+}
+
+func (gist *Gist) CountComments() (int64, error) {
+	var count int64
+	err := db.Model(&Comment{}).
+		Where("gist_id = ?", gist.ID).
+		Count(&count).Error
+	return count, err
+}
+
+func (gist *Gist) GetCommentByID(commentID string) (*Comment, error) {
+	comment := new(Comment)
+	err := db.Preload("User").
+		Where("gist_id = ? AND id = ?", gist.ID, commentID).
+		First(comment).Error
+
+	return comment, err
+}
+
+func (comment *Comment) Create() error {
+	return db.Create(&comment).Error
+}
+
+func (comment *Comment) Update() error {
+	return db.Model(&comment).Update("body", comment.Body).Error
+}
+
+func (comment *Comment) Delete() error {
+	return db.Delete(&comment).Error
+}
+
+// IsEdited reports whether the comment was changed after being posted
+func (comment *Comment) IsEdited() bool {
+	return comment.UpdatedAt > comment.CreatedAt
+}
+
+// CanEdit reports whether the user can change the comment, only its author can
+func (comment *Comment) CanEdit(user *User) bool {
+	return user != nil && comment.UserID == user.ID
+}
+
+// CanDelete reports whether the user can delete the comment, the owner of the gist can moderate the comments
+func (comment *Comment) CanDelete(user *User, gist *Gist) bool {
+	return comment.CanEdit(user) || gist.CanManage(user)
+}
+
+// -- DTO -- //
+
+type CommentDTO struct {
+	Body    string `validate:"required,max=10000" form:"body"`
+	NoWatch bool   `form:"nowatch"` // commenting watches the gist unless it is set
+}
+
+func (dto *CommentDTO) ToComment(gist *Gist, user *User) *Comment {
+	now := time.Now().Unix()
+	return &Comment{
+		GistID:    gist.ID,
+		UserID:    user.ID,
+		User:      *user,
+		Body:      dto.Body,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+}
@@ -0,0 +1,132 @@
+package db
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"github.com/thomiceli/opengist/internal/config"
+)
+
+// ContentValidator checks the files of a gist before Opengist commits them, whether they come from the web interface,
+// a template or a restored revision. Files pushed through Git are not checked.
+type ContentValidator interface {
+	// Validate returns the issues found in the file, none if it can be committed as is
+	Validate(file FileDTO) []ContentIssue
+}
+
+// ContentIssue is a problem found by a ContentValidator in a file. A rejecting issue prevents the commit, any other
+// is logged as a warning.
+type ContentIssue struct {
+	Filename string
+	Message  string
+	Reject   bool
+}
+
+// ContentRejectedError is returned when committing files a ContentValidator rejected, nothing is written in this case
+type ContentRejectedError struct {
+	Issues []ContentIssue
+}
+
+func (e *ContentRejectedError) Error() string {
+	messages := make([]string, 0, len(e.Issues))
+	for _, issue := range e.Issues {
+		messages = append(messages, issue.Filename+": "+issue.Message)
+	}
+	return strings.Join(messages, ", ")
+}
+
+var (
+	contentValidatorsMu sync.RWMutex
+	contentValidators   []ContentValidator
+)
+
+// RegisterContentValidator adds a validator run on the files of every commit, in the order of registration.
+// The returned function removes it.
+func RegisterContentValidator(validator ContentValidator) func() {
+	contentValidatorsMu.Lock()
+	defer contentValidatorsMu.Unlock()
+	contentValidators = append(contentValidators, validator)
+
+	return func() {
+		contentValidatorsMu.Lock()
+		defer contentValidatorsMu.Unlock()
+		for i, v := range contentValidators {
+			if v == validator {
+				contentValidators = append(contentValidators[:i:i], contentValidators[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// validateContent runs the registered validators on the files, it returns a ContentRejectedError holding the
+// rejecting issues if there are any
+func (gist *Gist) validateContent(files []FileDTO) error {
+	contentValidatorsMu.RLock()
+	validators := append([]ContentValidator(nil), contentValidators...)
+	contentValidatorsMu.RUnlock()
+
+	var rejected []ContentIssue
+	for _, file := range files {
+		for _, validator := range validators {
+			for _, issue := range validator.Validate(file) {
+				if issue.Filename == "" {
+					issue.Filename = file.Filename
+				}
+				if issue.Reject {
+					rejected = append(rejected, issue)
+				} else {
+					log.Warn().Msgf("Content warning for gist %s, file %s: %s", gist.Uuid, issue.Filename, issue.Message)
+				}
+			}
+		}
+	}
+
+	if len(rejected) > 0 {
+		return &ContentRejectedError{Issues: rejected}
+	}
+	return nil
+}
+
+// -- Secret scanner -- //
+
+// secretPatterns match the credentials most commonly pasted by mistake
+var secretPatterns = []struct {
+	name  string
+	regex *regexp.Regexp
+}{
+	{"AWS access key", regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"GitHub token", regexp.MustCompile(`\b(gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})\b`)},
+	{"GitLab token", regexp.MustCompile(`\bglpat-[A-Za-z0-9_-]{20,}\b`)},
+	{"Slack token", regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}\b`)},
+	{"Stripe secret key", regexp.MustCompile(`\b[sr]k_live_[A-Za-z0-9]{20,}\b`)},
+	{"Google API key", regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}\b`)},
+	{"private key", regexp.MustCompile(`-----BEGIN ([A-Z]+ )*PRIVATE KEY-----`)},
+}
+
+// secretScanner looks for secrets in the files according to gist.secret-scanning, it is registered by default
+type secretScanner struct{}
+
+func (secretScanner) Validate(file FileDTO) []ContentIssue {
+	mode := config.C.GistSecretScanning
+	if mode != "warn" && mode != "reject" {
+		return nil
+	}
+
+	var issues []ContentIssue
+	for _, pattern := range secretPatterns {
+		if pattern.regex.MatchString(file.Content) {
+			issues = append(issues, ContentIssue{
+				Message: "possible " + pattern.name,
+				Reject:  mode == "reject",
+			})
+		}
+	}
+	return issues
+}
+
+func init() {
+	RegisterContentValidator(secretScanner{})
+}
@@ -0,0 +1,83 @@
+package db
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"io"
+	"path"
+
+	"github.com/thomiceli/opengist/internal/git"
+)
+
+// ExportedGist is the metadata of a gist written in the manifest of an export
+type ExportedGist struct {
+	Folder      string   `json:"folder"`
+	Uuid        string   `json:"uuid"`
+	URL         string   `json:"url,omitempty"`
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Visibility  string   `json:"visibility"`
+	Files       []string `json:"files"`
+	CreatedAt   int64    `json:"created_at"`
+	UpdatedAt   int64    `json:"updated_at"`
+}
+
+// ExportAll writes a zip of all the gists of the user, private ones included, to w. Each gist has its own folder
+// holding its latest files and a gists.json manifest describes them. The archive is streamed one gist at a time.
+func (user *User) ExportAll(w io.Writer) error {
+	var gists []*Gist
+	if err := db.Where("user_id = ?", user.ID).Order("id asc").Find(&gists).Error; err != nil {
+		return err
+	}
+
+	zipWriter := zip.NewWriter(w)
+
+	manifest := make([]ExportedGist, 0, len(gists))
+	for _, gist := range gists {
+		exported := ExportedGist{
+			Folder:      gist.Identifier(),
+			Uuid:        gist.Uuid,
+			URL:         gist.URL,
+			Title:       gist.Title,
+			Description: gist.Description,
+			Visibility:  gist.VisibilityStr(),
+			Files:       []string{},
+			CreatedAt:   gist.CreatedAt,
+			UpdatedAt:   gist.UpdatedAt,
+		}
+
+		files, err := gist.Files("HEAD", false)
+		if err != nil && !errors.As(err, new(*git.RevisionNotFoundError)) {
+			return err
+		}
+
+		for _, file := range files {
+			f, err := zipWriter.CreateHeader(&zip.FileHeader{
+				Name:   path.Join(exported.Folder, file.Filename),
+				Method: zip.Deflate,
+			})
+			if err != nil {
+				return err
+			}
+			if _, err = io.WriteString(f, file.Content); err != nil {
+				return err
+			}
+			exported.Files = append(exported.Files, file.Filename)
+		}
+
+		manifest = append(manifest, exported)
+	}
+
+	f, err := zipWriter.Create("gists.json")
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(manifest); err != nil {
+		return err
+	}
+
+	return zipWriter.Close()
+}
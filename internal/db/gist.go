@@ -1,19 +1,44 @@
 package db
 
 import (
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"math/rand"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/alecthomas/chroma/v2"
-	"github.com/alecthomas/chroma/v2/lexers"
 	"github.com/dustin/go-humanize"
+	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
+	"github.com/thomiceli/opengist/internal/config"
 	"github.com/thomiceli/opengist/internal/git"
 	"github.com/thomiceli/opengist/internal/index"
+	"github.com/thomiceli/opengist/internal/metrics"
+	"golang.org/x/text/unicode/norm"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// GistExpirations are the delays after which a gist can be set to expire on creation
+var GistExpirations = map[string]time.Duration{
+	"1h": time.Hour,
+	"1d": 24 * time.Hour,
+	"1w": 7 * 24 * time.Hour,
+}
+
+var (
+	// ErrForksDisabled is returned when forking a gist whose author does not allow it
+	ErrForksDisabled = errors.New("forks are disabled for this gist")
+	// ErrForkNotAllowed is returned when forking a private gist the user cannot read
+	ErrForkNotAllowed = errors.New("the gist cannot be read by the user forking it")
+	// ErrGistOwnerNotFound is returned when saving a gist whose user does not exist
+	ErrGistOwnerNotFound = errors.New("the owner of the gist does not exist")
 )
 
 type Visibility int
@@ -66,6 +91,7 @@ type Gist struct {
 	Uuid            string
 	Title           string
 	URL             string
+	Slug            string `gorm:"index;size:255"`
 	Preview         string
 	PreviewFilename string
 	Description     string
@@ -73,13 +99,21 @@ type Gist struct {
 	UserID          uint
 	User            User
 	NbFiles         int
+	Size            int64 // total size of the files at HEAD, refreshed on each commit
 	NbLikes         int
 	NbForks         int
 	CreatedAt       int64
 	UpdatedAt       int64
-
-	Likes    []User `gorm:"many2many:likes;constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
-	Forked   *Gist  `gorm:"foreignKey:ForkedID;constraint:OnUpdate:CASCADE,OnDelete:SET NULL"`
+	LastGcAt        int64
+	Template        bool
+	AllowForks      bool           `gorm:"default:true"`
+	Locked          bool           // read-only, nobody can edit the gist nor push to it until it is unlocked
+	DeletedAt       gorm.DeletedAt `gorm:"index"` // set while the gist is in the trash of its owner
+	ExpiresAt       int64          `gorm:"index"` // 0 if the gist never expires, it is hidden then deleted once expired
+
+	Likes    []User  `gorm:"many2many:likes;constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+	Topics   []Topic `gorm:"many2many:gist_topics;constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+	Forked   *Gist   `gorm:"foreignKey:ForkedID;constraint:OnUpdate:CASCADE,OnDelete:SET NULL"`
 	ForkedID uint
 }
 
@@ -89,7 +123,24 @@ type Like struct {
 	CreatedAt int64
 }
 
+// BeforeCreate refuses a gist whose owner does not exist, not every SQLite database enforces the foreign keys
+func (gist *Gist) BeforeCreate(tx *gorm.DB) error {
+	var count int64
+	if err := tx.Model(&User{}).Where("id = ?", gist.UserID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrGistOwnerNotFound
+	}
+	return nil
+}
+
 func (gist *Gist) BeforeDelete(tx *gorm.DB) error {
+	// the fork counter was already decremented when the gist was moved to the trash
+	if gist.DeletedAt.Valid {
+		return nil
+	}
+
 	// Decrement fork counter if the gist was forked
 	err := tx.Model(&Gist{}).
 		Omit("updated_at").
@@ -100,9 +151,82 @@ func (gist *Gist) BeforeDelete(tx *gorm.DB) error {
 
 func GetGist(user string, gistUuid string) (*Gist, error) {
 	gist := new(Gist)
+	err := db.Preload("User").Preload("Forked.User").Preload("Topics", orderTopics).
+		Where("(gists.uuid = ? OR gists.url = ? OR gists.slug = ?) AND lower(users.username) = lower(?)", gistUuid, gistUuid, gistUuid, user).
+		Joins("join users on gists.user_id = users.id").
+		First(&gist).Error
+
+	return gist, err
+}
+
+// GetGistsByRefs looks up the gists of the refs in a single query and returns them in the same order, with nil for
+// the gists that do not exist or that the current user cannot see. Private gists are visible to their writers only.
+func GetGistsByRefs(refs []GistRefDTO, currentUser *User) ([]*Gist, error) {
+	results := make([]*Gist, len(refs))
+	if len(refs) == 0 {
+		return results, nil
+	}
+
+	conditions := make([]string, 0, len(refs))
+	args := make([]interface{}, 0, len(refs)*4)
+	for _, ref := range refs {
+		conditions = append(conditions, "(lower(users.username) = lower(?) AND (gists.uuid = ? OR gists.url = ? OR gists.slug = ?))")
+		args = append(args, ref.User, ref.Gist, ref.Gist, ref.Gist)
+	}
+
+	var gists []*Gist
 	err := db.Preload("User").Preload("Forked.User").
-		Where("(gists.uuid = ? OR gists.url = ?) AND users.username like ?", gistUuid, gistUuid, user).
 		Joins("join users on gists.user_id = users.id").
+		Where(strings.Join(conditions, " OR "), args...).
+		Find(&gists).Error
+	if err != nil {
+		return nil, err
+	}
+
+	// the private gists the current user collaborates on, the ones they own are visible anyway
+	collaborations := make(map[uint]bool)
+	if currentUser != nil {
+		var privateIds []uint
+		for _, gist := range gists {
+			if gist.Private == PrivateVisibility && gist.UserID != currentUser.ID {
+				privateIds = append(privateIds, gist.ID)
+			}
+		}
+		if len(privateIds) > 0 {
+			var collaboratorIds []uint
+			err = db.Model(&GistCollaborator{}).
+				Where("user_id = ? AND gist_id in ?", currentUser.ID, privateIds).
+				Pluck("gist_id", &collaboratorIds).Error
+			if err != nil {
+				return nil, err
+			}
+			for _, id := range collaboratorIds {
+				collaborations[id] = true
+			}
+		}
+	}
+
+	for i, ref := range refs {
+		for _, gist := range gists {
+			// the username is matched regardless of its case, like in the query
+			if !strings.EqualFold(gist.User.Username, ref.User) ||
+				(gist.Uuid != ref.Gist && gist.URL != ref.Gist && gist.Slug != ref.Gist) {
+				continue
+			}
+			if gist.Private == PrivateVisibility && !gist.CanManage(currentUser) && !collaborations[gist.ID] {
+				continue
+			}
+			results[i] = gist
+			break
+		}
+	}
+	return results, nil
+}
+
+func GetGistByUuid(gistUuid string) (*Gist, error) {
+	gist := new(Gist)
+	err := db.Preload("User").Preload("Forked.User").
+		Where("gists.uuid = ?", gistUuid).
 		First(&gist).Error
 
 	return gist, err
@@ -110,69 +234,229 @@ func GetGist(user string, gistUuid string) (*Gist, error) {
 
 func GetGistByID(gistId string) (*Gist, error) {
 	gist := new(Gist)
-	err := db.Preload("User").Preload("Forked.User").
+	err := db.Preload("User").Preload("Forked.User").Preload("Topics", orderTopics).
 		Where("gists.id = ?", gistId).
 		First(&gist).Error
 
 	return gist, err
 }
 
-func GetAllGistsForCurrentUser(currentUserId uint, offset int, sort string, order string) ([]*Gist, error) {
-	var gists []*Gist
-	err := db.Preload("User").Preload("Forked.User").
-		Where("gists.private = 0 or gists.user_id = ?", currentUserId).
-		Limit(11).
-		Offset(offset * 10).
-		Order(sort + "_at " + order).
-		Find(&gists).Error
+// liteGistColumns are the columns needed to render a gist in a listing, the description is left out as it can be long
+var liteGistColumns = []string{
+	"gists.id", "gists.uuid", "gists.url", "gists.slug", "gists.title", "gists.preview", "gists.preview_filename",
+	"gists.private", "gists.user_id", "gists.forked_id", "gists.nb_files", "gists.size", "gists.nb_likes",
+	"gists.nb_forks", "gists.created_at", "gists.updated_at",
+}
 
-	return gists, err
+// selectGistColumns restricts the statement to liteGistColumns in lite mode, or loads whole gists otherwise
+func selectGistColumns(statement *gorm.DB, lite bool) *gorm.DB {
+	if lite {
+		return statement.Select(liteGistColumns)
+	}
+	return statement
 }
 
-func GetAllGists(offset int) ([]*Gist, error) {
-	var gists []*Gist
-	err := db.Preload("User").
-		Limit(11).
-		Offset(offset * 10).
-		Order("id asc").
-		Find(&gists).Error
+// TimeRange restricts a listing to the gists created, or updated, between Since and Until. Both bounds are Unix
+// timestamps included in the range, a zero bound is left open.
+type TimeRange struct {
+	Updated bool
+	Since   int64
+	Until   int64
+}
 
-	return gists, err
+// Valid reports whether the range is not reversed
+func (r TimeRange) Valid() bool {
+	return r.Since == 0 || r.Until == 0 || r.Since <= r.Until
 }
 
-func GetAllGistsFromSearch(currentUserId uint, query string, offset int, sort string, order string) ([]*Gist, error) {
-	var gists []*Gist
-	err := db.Preload("User").Preload("Forked.User").
+func (r TimeRange) where(statement *gorm.DB) *gorm.DB {
+	column := "gists.created_at"
+	if r.Updated {
+		column = "gists.updated_at"
+	}
+
+	if r.Since != 0 {
+		statement = statement.Where(column+" >= ?", r.Since)
+	}
+	if r.Until != 0 {
+		statement = statement.Where(column+" <= ?", r.Until)
+	}
+	return statement
+}
+
+func allGistsStatement(currentUserId uint, language string, timeRange TimeRange) *gorm.DB {
+	return withLanguage(timeRange.where(db.Where("(gists.private = 0 or gists.user_id = ?)", currentUserId)), language)
+}
+
+// GetAllGistsForCurrentUser returns a page of the gists visible by the current user and their total count, only the
+// ones having a file in the language if it is not empty
+func GetAllGistsForCurrentUser(currentUserId uint, page Page, sort string, order string, language string, timeRange TimeRange) ([]*Gist, int64, error) {
+	defer metrics.ListingQueryDuration.ObserveSince(time.Now(), "all")
+	return paginate[Gist](allGistsStatement(currentUserId, language, timeRange).Preload("User").Preload("Forked.User"),
+		page, "gists."+sort+"_at "+order)
+}
+
+// GetAllGists returns a page of all the gists, private ones included, whose title, description or owner matches the
+// query, all of them if it is empty, and their total count
+func GetAllGists(page Page, lite bool, timeRange TimeRange, query string) ([]*Gist, int64, error) {
+	statement := timeRange.where(selectGistColumns(db, lite))
+	if query != "" {
+		pattern := "%" + escapeLike(query) + "%"
+		statement = statement.Where("(lower(gists.title) like lower(?) escape ? or lower(gists.description) like lower(?) escape ? or gists.user_id in (?))",
+			pattern, likeEscape, pattern, likeEscape,
+			db.Model(&User{}).Select("id").Where("lower(username) like lower(?) escape ?", pattern, likeEscape))
+	}
+	return paginate[Gist](statement.Preload("User"), page, "gists.id asc")
+}
+
+func searchStatement(currentUserId uint, query string) *gorm.DB {
+	pattern := "%" + escapeLike(query) + "%"
+	return db.
 		Where("((gists.private = 0) or (gists.private > 0 and gists.user_id = ?))", currentUserId).
-		Where("gists.title like ? or gists.description like ?", "%"+query+"%", "%"+query+"%").
-		Limit(11).
-		Offset(offset * 10).
-		Order("gists." + sort + "_at " + order).
-		Find(&gists).Error
+		Where("(lower(gists.title) like lower(?) escape ? or lower(gists.description) like lower(?) escape ?)",
+			pattern, likeEscape, pattern, likeEscape)
+}
 
-	return gists, err
+// GetAllGistsFromSearch returns a page of the gists visible by the current user whose title or description matches
+// the query, and their total count
+func GetAllGistsFromSearch(currentUserId uint, query string, page Page, sort string, order string) ([]*Gist, int64, error) {
+	defer metrics.ListingQueryDuration.ObserveSince(time.Now(), "search")
+	return paginate[Gist](searchStatement(currentUserId, query).Preload("User").Preload("Forked.User"),
+		page, "gists."+sort+"_at "+order)
 }
 
-func gistsFromUserStatement(fromUserId uint, currentUserId uint) *gorm.DB {
-	return db.Preload("User").Preload("Forked.User").
+func gistsFromUserStatement(fromUserId uint, currentUserId uint, topic string, language string, timeRange TimeRange) *gorm.DB {
+	return withLanguage(withTopic(timeRange.where(db.Preload("User").Preload("Forked.User").
 		Where("((gists.private = 0) or (gists.private > 0 and gists.user_id = ?))", currentUserId).
 		Where("users.id = ?", fromUserId).
-		Joins("join users on gists.user_id = users.id")
+		Joins("join users on gists.user_id = users.id")), topic), language)
+}
+
+// GetGistSuggestions returns up to 10 gists visible by the current user whose title or description matches the query,
+// without loading anything else than what is needed to link to them
+func GetGistSuggestions(currentUserId uint, query string) ([]*GistSuggestionDTO, error) {
+	var suggestions []*GistSuggestionDTO
+	pattern := "%" + escapeLike(query) + "%"
+	err := db.Model(&Gist{}).
+		Select("gists.id, gists.uuid, gists.url, gists.slug, gists.title, users.username").
+		Joins("join users on gists.user_id = users.id").
+		Where("((gists.private = 0) or (gists.private > 0 and gists.user_id = ?))", currentUserId).
+		Where("(lower(gists.title) like lower(?) escape ? or lower(gists.description) like lower(?) escape ?)",
+			pattern, likeEscape, pattern, likeEscape).
+		Limit(10).
+		Order("gists.updated_at desc").
+		Scan(&suggestions).Error
+
+	return suggestions, err
+}
+
+// likeEscape is the escape character of the LIKE patterns, given as a parameter since MySQL reads a backslash in a
+// string literal as an escape of its own
+const likeEscape = `\`
+
+// escapeLike escapes the wildcards of a string matched with LIKE, so its % and _ are matched as is
+func escapeLike(s string) string {
+	return strings.NewReplacer(likeEscape, likeEscape+likeEscape, "%", likeEscape+"%", "_", likeEscape+"_").Replace(s)
+}
+
+// GistCursor points at the last gist of a page in the public feed, ordered by last update then id, newest first
+type GistCursor struct {
+	UpdatedAt int64
+	ID        uint
+}
+
+// String encodes the cursor as base64url("<updated_at>:<id>"), clients should treat it as opaque
+func (cursor *GistCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", cursor.UpdatedAt, cursor.ID)))
+}
+
+func ParseGistCursor(encoded string) (*GistCursor, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	updatedAt, id, found := strings.Cut(string(decoded), ":")
+	if !found {
+		return nil, fmt.Errorf("invalid cursor %q", encoded)
+	}
+
+	cursor := new(GistCursor)
+	if cursor.UpdatedAt, err = strconv.ParseInt(updatedAt, 10, 64); err != nil {
+		return nil, err
+	}
+	parsedId, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	cursor.ID = uint(parsedId)
+
+	return cursor, nil
+}
+
+// GetRandomPublicGist returns a random public gist, picked at a random offset rather than by sorting the whole table.
+// It returns gorm.ErrRecordNotFound if there are no public gists.
+func GetRandomPublicGist() (*Gist, error) {
+	var count int64
+	if err := db.Model(&Gist{}).Where("gists.private = 0").Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	gist := new(Gist)
+	err := db.Preload("User").
+		Where("gists.private = 0").
+		Offset(rand.Intn(int(count))).
+		First(&gist).Error
+
+	return gist, err
 }
 
-func GetAllGistsFromUser(fromUserId uint, currentUserId uint, offset int, sort string, order string) ([]*Gist, error) {
+// GetGistsAfterCursor returns up to limit public gists coming after the cursor, or from the start of the feed if the
+// cursor is nil. The returned cursor points at the last gist of the page and is nil once the feed is exhausted.
+// In lite mode only liteGistColumns are loaded.
+func GetGistsAfterCursor(cursor *GistCursor, limit int, lite bool, timeRange TimeRange) ([]*Gist, *GistCursor, error) {
+	defer metrics.ListingQueryDuration.ObserveSince(time.Now(), "feed")
 	var gists []*Gist
-	err := gistsFromUserStatement(fromUserId, currentUserId).Limit(11).
-		Offset(offset * 10).
-		Order("gists." + sort + "_at " + order).
+	statement := timeRange.where(selectGistColumns(db, lite).Preload("User").
+		Where("gists.private = 0"))
+
+	if cursor != nil {
+		statement = statement.Where("gists.updated_at < ? or (gists.updated_at = ? and gists.id < ?)",
+			cursor.UpdatedAt, cursor.UpdatedAt, cursor.ID)
+	}
+
+	err := statement.
+		Order("gists.updated_at desc").
+		Order("gists.id desc").
+		Limit(limit + 1).
 		Find(&gists).Error
+	if err != nil {
+		return nil, nil, err
+	}
 
-	return gists, err
+	if len(gists) <= limit {
+		return gists, nil, nil
+	}
+
+	gists = gists[:limit]
+	last := gists[limit-1]
+	return gists, &GistCursor{UpdatedAt: last.UpdatedAt, ID: last.ID}, nil
 }
 
-func CountAllGistsFromUser(fromUserId uint, currentUserId uint) (int64, error) {
+// GetAllGistsFromUser returns a page of the gists of a user visible by the current user and their total count, only
+// the ones tagged with the topic and having a file in the language if they are not empty
+func GetAllGistsFromUser(fromUserId uint, currentUserId uint, page Page, sort string, order string, lite bool, topic string, language string, timeRange TimeRange) ([]*Gist, int64, error) {
+	defer metrics.ListingQueryDuration.ObserveSince(time.Now(), "from_user")
+	return paginate[Gist](selectGistColumns(gistsFromUserStatement(fromUserId, currentUserId, topic, language, timeRange), lite),
+		page, "gists."+sort+"_at "+order)
+}
+
+func CountAllGistsFromUser(fromUserId uint, currentUserId uint, topic string, language string, timeRange TimeRange) (int64, error) {
 	var count int64
-	err := gistsFromUserStatement(fromUserId, currentUserId).Model(&Gist{}).Count(&count).Error
+	err := gistsFromUserStatement(fromUserId, currentUserId, topic, language, timeRange).Model(&Gist{}).Count(&count).Error
 	return count, err
 }
 
@@ -184,13 +468,10 @@ func likedStatement(fromUserId uint, currentUserId uint) *gorm.DB {
 		Joins("join users on likes.user_id = users.id")
 }
 
-func GetAllGistsLikedByUser(fromUserId uint, currentUserId uint, offset int, sort string, order string) ([]*Gist, error) {
-	var gists []*Gist
-	err := likedStatement(fromUserId, currentUserId).Limit(11).
-		Offset(offset * 10).
-		Order("gists." + sort + "_at " + order).
-		Find(&gists).Error
-	return gists, err
+// GetAllGistsLikedByUser returns a page of the gists liked by a user visible by the current user and their total count
+func GetAllGistsLikedByUser(fromUserId uint, currentUserId uint, page Page, sort string, order string) ([]*Gist, int64, error) {
+	defer metrics.ListingQueryDuration.ObserveSince(time.Now(), "liked")
+	return paginate[Gist](likedStatement(fromUserId, currentUserId), page, "gists."+sort+"_at "+order)
 }
 
 func CountAllGistsLikedByUser(fromUserId uint, currentUserId uint) (int64, error) {
@@ -199,6 +480,25 @@ func CountAllGistsLikedByUser(fromUserId uint, currentUserId uint) (int64, error
 	return count, err
 }
 
+// GetTrendingGists returns the public gists ranked by the likes they received in the last days, the most liked
+// first. Gists without any like in the window are left out.
+func GetTrendingGists(days int, offset int) ([]*Gist, error) {
+	defer metrics.ListingQueryDuration.ObserveSince(time.Now(), "trending")
+	since := time.Now().AddDate(0, 0, -days).Unix()
+
+	var gists []*Gist
+	err := db.Preload("User").
+		Joins("join likes on likes.gist_id = gists.id and likes.created_at >= ?", since).
+		Where("gists.private = ?", PublicVisibility).
+		Group("gists.id").
+		Order("count(likes.user_id) desc, gists.id desc").
+		Limit(11).
+		Offset(offset * 10).
+		Find(&gists).Error
+
+	return gists, err
+}
+
 func forkedStatement(fromUserId uint, currentUserId uint) *gorm.DB {
 	return db.Preload("User").Preload("Forked.User").
 		Where("gists.forked_id is not null and ((gists.private = 0) or (gists.private > 0 and gists.user_id = ?))", currentUserId).
@@ -206,13 +506,10 @@ func forkedStatement(fromUserId uint, currentUserId uint) *gorm.DB {
 		Joins("join users on gists.user_id = users.id")
 }
 
-func GetAllGistsForkedByUser(fromUserId uint, currentUserId uint, offset int, sort string, order string) ([]*Gist, error) {
-	var gists []*Gist
-	err := forkedStatement(fromUserId, currentUserId).Limit(11).
-		Offset(offset * 10).
-		Order("gists." + sort + "_at " + order).
-		Find(&gists).Error
-	return gists, err
+// GetAllGistsForkedByUser returns a page of the forks of a user visible by the current user and their total count
+func GetAllGistsForkedByUser(fromUserId uint, currentUserId uint, page Page, sort string, order string) ([]*Gist, int64, error) {
+	defer metrics.ListingQueryDuration.ObserveSince(time.Now(), "forked")
+	return paginate[Gist](forkedStatement(fromUserId, currentUserId), page, "gists."+sort+"_at "+order)
 }
 
 func CountAllGistsForkedByUser(fromUserId uint, currentUserId uint) (int64, error) {
@@ -233,7 +530,7 @@ func GetAllGistsRows() ([]*Gist, error) {
 func GetAllGistsVisibleByUser(userId uint) ([]uint, error) {
 	var gists []uint
 
-	err := db.Table("gists").
+	err := db.Model(&Gist{}).
 		Where("gists.private = 0 or gists.user_id = ?", userId).
 		Pluck("gists.id", &gists).Error
 
@@ -250,29 +547,308 @@ func GetAllGistsByIds(ids []uint) ([]*Gist, error) {
 }
 
 func (gist *Gist) Create() error {
+	if err := gist.setSlug(); err != nil {
+		return err
+	}
+
 	// avoids foreign key constraint error because the default value in the struct is 0
-	return db.Omit("forked_id").Create(&gist).Error
+	allowForks := gist.AllowForks
+	if err := db.Omit("forked_id").Create(&gist).Error; err != nil {
+		return err
+	}
+
+	if err := gist.keepDisallowedForks(allowForks); err != nil {
+		return err
+	}
+
+	if err := AddAuditLog(&gist.User, AuditGistCreated, gist, map[string]any{
+		"visibility": gist.VisibilityStr(),
+	}); err != nil {
+		return err
+	}
+
+	metrics.GistsCreated.Inc()
+	return nil
+}
+
+// CreateWithFiles initializes the repository of a new gist, commits the files if there are any, then saves the gist in
+// database. If a step fails, what the former ones stored is removed so no gist is left without repository, nor the
+// other way round.
+func (gist *Gist) CreateWithFiles(files []FileDTO, author *User) error {
+	if err := gist.InitRepository(); err != nil {
+		return err
+	}
+
+	if len(files) > 0 {
+		if err := gist.AddAndCommitFiles(&files, author); err != nil {
+			gist.rollbackCreation()
+			return err
+		}
+	}
+
+	if err := gist.Create(); err != nil {
+		gist.rollbackCreation()
+		return err
+	}
+	return gist.SetLanguages(filesFromDTOs(files))
 }
 
-func (gist *Gist) CreateForked() error {
-	return db.Create(&gist).Error
+// CreateFork saves the fork in database then clones the repository of its parent, at the given revision or at the
+// latest one if it is empty. The fork is removed if the clone fails.
+func (gist *Gist) CreateFork(parent *Gist, revision string) error {
+	if err := gist.CreateForked(); err != nil {
+		gist.rollbackCreation()
+		return err
+	}
+
+	var err error
+	if revision == "" {
+		err = parent.ForkClone(gist.Uuid)
+	} else {
+		err = parent.ForkCloneAt(gist.Uuid, revision)
+	}
+	if err != nil {
+		gist.rollbackCreation()
+		return err
+	}
+	return nil
+}
+
+// rollbackCreation removes the repository and the database row of a gist whose creation failed. Errors are only
+// logged, the one of the creation is the one to report.
+func (gist *Gist) rollbackCreation() {
+	if err := gist.DeleteRepository(); err != nil {
+		log.Error().Err(err).Msgf("Cannot remove the repository of gist %s after a failed creation", gist.Uuid)
+	}
+
+	if gist.ID == 0 {
+		return
+	}
+	// deleted for good, a gist that was never created must not end up in the trash of its owner
+	if err := db.Unscoped().Delete(&gist).Error; err != nil {
+		log.Error().Err(err).Msgf("Cannot remove gist %s after a failed creation", gist.Uuid)
+	}
+	gist.ID = 0
+}
+
+// CreateForked saves the fork in database. The parent has to be readable by the author of the fork, and the fork of a
+// private gist is kept private so its content cannot be published by someone the author only shared it with.
+func (gist *Gist) CreateForked() error {
+	parent := new(Gist)
+	if err := db.First(&parent, gist.ForkedID).Error; err != nil {
+		return err
+	}
+	if !parent.CanRead(&User{ID: gist.UserID}) {
+		return ErrForkNotAllowed
+	}
+	if parent.Private == PrivateVisibility {
+		gist.Private = PrivateVisibility
+	}
+
+	if err := gist.setSlug(); err != nil {
+		return err
+	}
+
+	allowForks := gist.AllowForks
+	if err := db.Create(&gist).Error; err != nil {
+		return err
+	}
+
+	if err := gist.keepDisallowedForks(allowForks); err != nil {
+		return err
+	}
+
+	if err := AddAuditLog(&gist.User, AuditGistForked, gist, map[string]any{
+		"forked_from": gist.ForkedID,
+	}); err != nil {
+		return err
+	}
+
+	metrics.GistForks.Inc()
+	return nil
+}
+
+// keepDisallowedForks stores a false AllowForks after a creation, GORM inserts the default of the column instead of
+// a zero value
+func (gist *Gist) keepDisallowedForks(allowForks bool) error {
+	if allowForks {
+		return nil
+	}
+
+	gist.AllowForks = false
+	return db.Model(&Gist{}).
+		Where("id = ?", gist.ID).
+		UpdateColumn("allow_forks", false).Error
+}
+
+func (gist *Gist) setSlug() error {
+	if gist.Slug != "" {
+		return nil
+	}
+
+	slug, err := gist.newSlug()
+	gist.Slug = slug
+	return err
+}
+
+func (gist *Gist) Update() error {
+	return db.Omit("forked_id").Save(&gist).Error
+}
+
+// UpdateMetadata saves the title, description and visibility of the dto without touching the repository, so no
+// commit is created. An empty title falls back to the one of untitled gists.
+func (gist *Gist) UpdateMetadata(dto *GistDTO) error {
+	gist.Title = dto.Title
+	if gist.Title == "" {
+		gist.Title = "gist:" + gist.Uuid
+	}
+	gist.Description = dto.Description
+	gist.Private = dto.Private
+	return gist.Update()
+}
+
+func (gist *Gist) UpdateNoTimestamps() error {
+	return db.Omit("forked_id", "updated_at").Save(&gist).Error
+}
+
+// Delete moves the gist to the trash of its owner, from where it can be restored until it is purged. The gist is
+// deleted for good right away if the trash is disabled.
+func (gist *Gist) Delete() error {
+	if config.C.GistTrashRetention == 0 {
+		return gist.Purge()
+	}
+
+	forks, err := gist.forkUuids()
+	if err != nil {
+		return err
+	}
+	if err = git.TrashRepository(gist.Uuid, forks); err != nil {
+		return err
+	}
+
+	return db.Delete(&gist).Error
+}
+
+// Restore moves the gist back from the trash
+func (gist *Gist) Restore() error {
+	if err := git.RestoreRepository(gist.Uuid); err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().Model(&Gist{}).
+			Where("id = ?", gist.ID).
+			UpdateColumn("deleted_at", nil).Error
+		if err != nil {
+			return err
+		}
+
+		gist.DeletedAt = gorm.DeletedAt{}
+		return tx.Model(&Gist{}).
+			Omit("updated_at").
+			Where("id = ?", gist.ForkedID).
+			UpdateColumn("nb_forks", gorm.Expr("nb_forks + 1")).Error
+	})
+}
+
+// Purge deletes the gist and its repository for good, whether it is in the trash or not. The rows go first, a
+// repository left behind by a failure has no gist pointing to it, while a gist without its repository would be broken.
+func (gist *Gist) Purge() error {
+	// read before the rows go, deleting the gist unlinks its forks
+	forks, err := gist.forkUuids()
+	if err != nil {
+		return err
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("gist_id = ?", gist.ID).Delete(&Watch{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("gist_id = ?", gist.ID).Delete(&Comment{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("gist_id = ?", gist.ID).Delete(&GistFile{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("gist_id = ?", gist.ID).Delete(&GistCollaborator{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("gist_id = ?", gist.ID).Delete(&RecentView{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(gist).Association("Topics").Clear(); err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&gist).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	if gist.DeletedAt.Valid {
+		return git.DeleteTrashedRepository(gist.Uuid)
+	}
+	return git.DeleteRepository(gist.Uuid, forks)
+}
+
+// IsTrashed reports whether the gist is in the trash of its owner
+func (gist *Gist) IsTrashed() bool {
+	return gist.DeletedAt.Valid
+}
+
+// PurgeDate returns the date after which the trashed gist is deleted for good
+func (gist *Gist) PurgeDate() time.Time {
+	return gist.DeletedAt.Time.AddDate(0, 0, config.C.GistTrashRetention)
+}
+
+// GetTrashedGistsFromUser returns a page of the gists in the trash of the user, the most recently deleted first, and
+// their total count
+func GetTrashedGistsFromUser(userId uint, page Page) ([]*Gist, int64, error) {
+	return paginate[Gist](db.Unscoped().Preload("User").
+		Where("user_id = ? AND deleted_at IS NOT NULL", userId), page, "deleted_at desc")
+}
+
+// GetTrashedGistFromUser returns a gist in the trash of the user
+func GetTrashedGistFromUser(userId uint, gistId uint) (*Gist, error) {
+	gist := new(Gist)
+	err := db.Unscoped().Preload("User").
+		Where("id = ? AND user_id = ? AND deleted_at IS NOT NULL", gistId, userId).
+		First(&gist).Error
+
+	return gist, err
 }
 
-func (gist *Gist) Update() error {
-	return db.Omit("forked_id").Save(&gist).Error
-}
+// GetExpiredGists returns the gists whose expiration date passed, trashed ones included
+func GetExpiredGists() ([]*Gist, error) {
+	var gists []*Gist
+	err := db.Unscoped().Preload("User").
+		Where("expires_at != 0 AND expires_at <= ?", time.Now().Unix()).
+		Find(&gists).Error
 
-func (gist *Gist) UpdateNoTimestamps() error {
-	return db.Omit("forked_id", "updated_at").Save(&gist).Error
+	return gists, err
 }
 
-func (gist *Gist) Delete() error {
-	err := gist.DeleteRepository()
-	if err != nil {
-		return err
+// hideExpiredGists leaves the expired gists out of the queries on the gists table until the cleanup job deletes them,
+// unscoped queries still see them
+func hideExpiredGists(tx *gorm.DB) {
+	if tx.Statement.Unscoped || tx.Statement.Schema == nil || tx.Statement.Schema.Table != "gists" {
+		return
 	}
 
-	return db.Delete(&gist).Error
+	expiresAt := clause.Column{Table: clause.CurrentTable, Name: "expires_at"}
+	tx.Statement.AddClause(clause.Where{Exprs: []clause.Expression{
+		clause.Expr{SQL: "(? = 0 OR ? > ?)", Vars: []any{expiresAt, expiresAt, time.Now().Unix()}},
+	}})
+}
+
+// GetExpiredTrashedGists returns the gists that have been in the trash for longer than the retention period
+func GetExpiredTrashedGists() ([]*Gist, error) {
+	var gists []*Gist
+	err := db.Unscoped().Preload("User").
+		Where("deleted_at IS NOT NULL AND deleted_at < ?", time.Now().AddDate(0, 0, -config.C.GistTrashRetention)).
+		Find(&gists).Error
+
+	return gists, err
 }
 
 func (gist *Gist) SetLastActiveNow() error {
@@ -281,13 +857,24 @@ func (gist *Gist) SetLastActiveNow() error {
 		Update("updated_at", time.Now().Unix()).Error
 }
 
+func (gist *Gist) SetLastGcNow() error {
+	return db.Model(&Gist{}).
+		Where("id = ?", gist.ID).
+		UpdateColumn("last_gc_at", time.Now().Unix()).Error
+}
+
 func (gist *Gist) AppendUserLike(user *User) error {
 	err := db.Model(&gist).Omit("updated_at").Update("nb_likes", gist.NbLikes+1).Error
 	if err != nil {
 		return err
 	}
 
-	return db.Model(&gist).Omit("updated_at").Association("Likes").Append(user)
+	if err = db.Model(&gist).Omit("updated_at").Association("Likes").Append(user); err != nil {
+		return err
+	}
+
+	metrics.GistLikes.Inc()
+	return nil
 }
 
 func (gist *Gist) RemoveUserLike(user *User) error {
@@ -311,43 +898,151 @@ func (gist *Gist) GetForkParent(user *User) (*Gist, error) {
 	return fork, err
 }
 
-func (gist *Gist) GetUsersLikes(offset int) ([]*User, error) {
-	var users []*User
-	err := db.Model(&gist).
-		Where("gist_id = ?", gist.ID).
-		Limit(31).
-		Offset(offset * 30).
-		Association("Likes").Find(&users)
-	return users, err
+// GetUsersLikes returns a page of the users who liked the gist and their total count
+func (gist *Gist) GetUsersLikes(page Page) ([]*User, int64, error) {
+	return paginate[User](db.Joins("join likes on likes.user_id = users.id").
+		Where("likes.gist_id = ?", gist.ID), page, "users.id asc")
 }
 
-func (gist *Gist) GetForks(currentUserId uint, offset int) ([]*Gist, error) {
-	var gists []*Gist
-	err := db.Model(&gist).Preload("User").
+func (gist *Gist) CountUsersLikes() (int64, error) {
+	association := db.Model(&gist).Association("Likes")
+	count := association.Count()
+	return count, association.Error
+}
+
+func (gist *Gist) forksStatement(currentUserId uint) *gorm.DB {
+	return db.Model(&Gist{}).
 		Where("forked_id = ?", gist.ID).
-		Where("(gists.private = 0) or (gists.private > 0 and gists.user_id = ?)", currentUserId).
-		Limit(11).
-		Offset(offset * 10).
-		Order("updated_at desc").
-		Find(&gists).Error
+		Where("(gists.private = 0) or (gists.private > 0 and gists.user_id = ?)", currentUserId)
+}
 
-	return gists, err
+// GetForks returns a page of the forks of the gist visible by the current user and their total count
+func (gist *Gist) GetForks(currentUserId uint, page Page) ([]*Gist, int64, error) {
+	defer metrics.ListingQueryDuration.ObserveSince(time.Now(), "forks")
+	return paginate[Gist](gist.forksStatement(currentUserId).Preload("User"), page, "gists.updated_at desc")
+}
+
+func (gist *Gist) CountForks(currentUserId uint) (int64, error) {
+	var count int64
+	err := gist.forksStatement(currentUserId).Count(&count).Error
+	return count, err
+}
+
+// GetForkNetwork returns every fork descending from the gist, level by level, that the current user can see.
+// Forks hidden from the current user are not walked through, and gists already seen are skipped to guard against cycles.
+func (gist *Gist) GetForkNetwork(currentUserId uint) ([]*Gist, error) {
+	var network []*Gist
+	seen := map[uint]bool{gist.ID: true}
+	parents := []uint{gist.ID}
+
+	for len(parents) > 0 {
+		var forks []*Gist
+		err := db.Model(&Gist{}).Preload("User").
+			Where("forked_id IN ?", parents).
+			Where("(gists.private = 0) or (gists.private > 0 and gists.user_id = ?)", currentUserId).
+			Order("created_at asc").
+			Find(&forks).Error
+		if err != nil {
+			return nil, err
+		}
+
+		parents = parents[:0]
+		for _, fork := range forks {
+			if seen[fork.ID] {
+				continue
+			}
+			seen[fork.ID] = true
+			network = append(network, fork)
+			parents = append(parents, fork.ID)
+		}
+	}
+
+	return network, nil
+}
+
+// CanRead reports whether the user can see the gist, private gists are visible to their writers only
+func (gist *Gist) CanRead(user *User) bool {
+	return gist.Private != PrivateVisibility || gist.IsWriter(user)
+}
+
+// VisibilityAllowed reports whether the gist can take the visibility. A fork of a private gist has to stay private
+// while its parent exists and is private.
+func (gist *Gist) VisibilityAllowed(visibility Visibility) (bool, error) {
+	if visibility == PrivateVisibility || gist.ForkedID == 0 {
+		return true, nil
+	}
+
+	parent := new(Gist)
+	err := db.Select("private").First(&parent, gist.ForkedID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return parent.Private != PrivateVisibility, nil
 }
 
+// CanWrite reports whether the user can edit the gist and push to its repository, that is its owner or one of
+// its collaborators while the gist is not locked. Collaborators are bound to this gist only and are not carried over
+// to its forks.
 func (gist *Gist) CanWrite(user *User) bool {
+	return !gist.Locked && gist.IsWriter(user)
+}
+
+// IsWriter reports whether the user is the owner or a collaborator of the gist, whether it is locked or not
+func (gist *Gist) IsWriter(user *User) bool {
+	if user == nil {
+		return false
+	}
+	if gist.CanManage(user) {
+		return true
+	}
+
+	isCollaborator, err := gist.IsCollaborator(user.ID)
+	return err == nil && isCollaborator
+}
+
+// CanManage reports whether the user owns the gist, only the owner can delete it, change its visibility
+// or manage its collaborators
+func (gist *Gist) CanManage(user *User) bool {
 	return !(user == nil) && (gist.UserID == user.ID)
 }
 
+// CanToggleLock reports whether the user can lock or unlock the gist, that is its owner, or an admin to unlock it
+func (gist *Gist) CanToggleLock(user *User) bool {
+	return gist.CanManage(user) || (user != nil && user.IsAdmin && gist.Locked)
+}
+
 func (gist *Gist) InitRepository() error {
-	return git.InitRepository(gist.User.Username, gist.Uuid)
+	return git.InitRepository(gist.Uuid)
 }
 
 func (gist *Gist) DeleteRepository() error {
-	return git.DeleteRepository(gist.User.Username, gist.Uuid)
+	forks, err := gist.forkUuids()
+	if err != nil {
+		return err
+	}
+	return git.DeleteRepository(gist.Uuid, forks)
+}
+
+// forkUuids returns the uuids of the forks of the gist outside of the trash, the only ones whose repository may
+// borrow objects from the one of the gist
+func (gist *Gist) forkUuids() ([]string, error) {
+	var uuids []string
+	err := db.Model(&Gist{}).Where("forked_id = ?", gist.ID).Pluck("uuid", &uuids).Error
+	return uuids, err
 }
 
+// Files returns the files of the gist at a revision. The revision is resolved to its commit first, so a full commit hash
+// is read the same way whatever the refs are, and a missing revision is a RevisionNotFoundError.
 func (gist *Gist) Files(revision string, truncate bool) ([]*git.File, error) {
-	filesCat, err := git.CatFileBatch(gist.User.Username, gist.Uuid, revision, truncate)
+	hash, err := gist.CommitHash(revision)
+	if err != nil {
+		return nil, err
+	}
+
+	filesCat, err := git.CatFileBatch(gist.Uuid, hash, truncate)
 	if err != nil {
 		// if the revision or the file do not exist
 		if exiterr, ok := err.(*exec.ExitError); ok && exiterr.ExitCode() == 128 {
@@ -369,17 +1064,26 @@ func (gist *Gist) Files(revision string, truncate bool) ([]*git.File, error) {
 	return files, err
 }
 
+// File returns a file of the gist at a revision, resolved to its commit like for Files. It is nil if the revision or
+// the file do not exist.
 func (gist *Gist) File(revision string, filename string, truncate bool) (*git.File, error) {
-	content, truncated, err := git.GetFileContent(gist.User.Username, gist.Uuid, revision, filename, truncate)
+	hash, err := gist.CommitHash(revision)
+	if _, ok := err.(*git.RevisionNotFoundError); ok {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	content, truncated, err := git.GetFileContent(gist.Uuid, hash, filename, truncate)
 
-	// if the revision or the file do not exist
+	// if the file does not exist
 	if exiterr, ok := err.(*exec.ExitError); ok && exiterr.ExitCode() == 128 {
 		return nil, nil
 	}
 
 	var size uint64
 
-	size, err = git.GetFileSize(gist.User.Username, gist.Uuid, revision, filename)
+	size, err = git.GetFileSize(gist.Uuid, hash, filename)
 	if err != nil {
 		return nil, err
 	}
@@ -393,102 +1097,367 @@ func (gist *Gist) File(revision string, filename string, truncate bool) (*git.Fi
 	}, err
 }
 
+// OpenFile starts streaming the content of a file at a revision of the gist, it is nil if the revision or the file do
+// not exist
+func (gist *Gist) OpenFile(revision string, filename string) (*git.FileReader, error) {
+	return git.OpenFile(gist.Uuid, revision, filename)
+}
+
 func (gist *Gist) FileNames(revision string) ([]string, error) {
-	return git.GetFilesOfRepository(gist.User.Username, gist.Uuid, revision)
+	return git.GetFilesOfRepository(gist.Uuid, revision)
+}
+
+// CommitHash returns the full commit hash a revision of the gist resolves to
+func (gist *Gist) CommitHash(revision string) (string, error) {
+	return git.GetRevisionHash(gist.Uuid, revision)
+}
+
+func (gist *Gist) CurrentCommitHash() (string, error) {
+	return gist.CommitHash("HEAD")
+}
+
+var commitHashRegex = regexp.MustCompile(`^[0-9a-f]{4,64}$`)
+
+// CommitPatch returns the patch of a single commit, the hash is checked before being handed to git
+func (gist *Gist) CommitPatch(hash string) ([]byte, error) {
+	if !commitHashRegex.MatchString(hash) {
+		return nil, &git.RevisionNotFoundError{}
+	}
+	return git.GetPatch(gist.Uuid, hash)
+}
+
+func (gist *Gist) Archive(revision string, format string) ([]byte, error) {
+	hash, err := gist.CommitHash(revision)
+	if err != nil {
+		return nil, err
+	}
+	return git.Archive(gist.Uuid, hash, format)
 }
 
 func (gist *Gist) Log(skip int) ([]*git.Commit, error) {
-	return git.GetLog(gist.User.Username, gist.Uuid, skip)
+	return git.GetLog(gist.Uuid, "HEAD", skip)
+}
+
+// BranchLog returns a page of the commits of a branch of the gist
+func (gist *Gist) BranchLog(branch string, skip int) ([]*git.Commit, error) {
+	return git.GetLog(gist.Uuid, "refs/heads/"+branch, skip)
+}
+
+func (gist *Gist) Branches() ([]string, error) {
+	return git.GetBranches(gist.Uuid)
+}
+
+// Tags returns the versions of the gist, the most recent first
+func (gist *Gist) Tags() ([]*git.Tag, error) {
+	return git.GetTags(gist.Uuid)
+}
+
+// DefaultBranch returns the branch shown by default, the one the commits made from the web interface go to
+func (gist *Gist) DefaultBranch() (string, error) {
+	return git.GetDefaultBranch(gist.Uuid)
+}
+
+// DiffWithFork returns the changes made in the latest revision of the fork compared to the latest one of the gist
+func (gist *Gist) DiffWithFork(fork *Gist) ([]*git.File, error) {
+	return git.DiffRepositories(gist.Uuid, fork.Uuid)
+}
+
+// DiffRevisions returns the changes from a commit of the gist to another one
+func (gist *Gist) DiffRevisions(hash string, otherHash string) ([]*git.File, error) {
+	return git.DiffRevisions(gist.Uuid, hash, otherHash)
+}
+
+// Blame returns the lines of a file at a commit of the gist grouped by the commit that last changed them
+func (gist *Gist) Blame(hash string, filename string) ([]*git.BlameHunk, error) {
+	return git.Blame(gist.Uuid, hash, filename)
 }
 
 func (gist *Gist) NbCommits() (string, error) {
-	return git.CountCommits(gist.User.Username, gist.Uuid)
+	return git.CountCommits(gist.Uuid)
 }
 
-func (gist *Gist) AddAndCommitFiles(files *[]FileDTO) error {
-	if err := git.CloneTmp(gist.User.Username, gist.Uuid, gist.Uuid, gist.User.Email, true); err != nil {
+func (gist *Gist) AddAndCommitFiles(files *[]FileDTO, author *User) error {
+	defer metrics.CommitFilesDuration.ObserveSince(time.Now())
+	if err := gist.commitFiles(*files, true, author); err != nil {
 		return err
 	}
 
-	for _, file := range *files {
-		if err := git.SetFileContent(gist.Uuid, file.Filename, file.Content); err != nil {
-			return err
-		}
+	// a new gist gets the languages of its files once it is saved
+	if gist.ID == 0 {
+		return nil
+	}
+	return gist.SetLanguages(filesFromDTOs(*files))
+}
+
+func (gist *Gist) AddAndCommitFile(file *FileDTO, author *User) error {
+	return gist.commitFiles([]FileDTO{*file}, false, author)
+}
+
+// commitIdentity returns the name and email the commits of the author are attributed to,
+// falling back to the configured default identity if there is no author or if the author has no email
+func commitIdentity(author *User) (string, string) {
+	if author == nil {
+		return config.C.GitDefaultAuthorName, config.C.GitDefaultAuthorEmail
 	}
 
-	if err := git.AddAll(gist.Uuid); err != nil {
+	email := author.Email
+	if email == "" {
+		email = config.C.GitDefaultAuthorEmail
+	}
+	return author.Username, email
+}
+
+// commitFiles clones the gist in a unique temporary directory, writes the files, then commits and pushes them.
+// If removeOthers is true, the files not present in the given list are removed from the gist.
+func (gist *Gist) commitFiles(files []FileDTO, removeOthers bool, author *User) error {
+	unlock := git.LockRepository(gist.Uuid)
+	defer unlock()
+
+	gistTmpId := git.NewTmpRepositoryId(gist.Uuid)
+	defer func() {
+		if err := git.RemoveTmpRepository(gistTmpId); err != nil {
+			log.Warn().Err(err).Msgf("Cannot remove temporary repository %s", gistTmpId)
+		}
+	}()
+
+	if err := gist.validateContent(files); err != nil {
 		return err
 	}
 
-	if err := git.CommitRepository(gist.Uuid, gist.User.Username, gist.User.Email); err != nil {
+	authorName, authorEmail := commitIdentity(author)
+
+	if err := git.CloneTmp(authorName, gist.Uuid, gistTmpId, authorEmail, removeOthers); err != nil {
 		return err
 	}
 
-	return git.Push(gist.Uuid)
-}
+	for _, file := range files {
+		if err := git.SetFileContent(gistTmpId, file.Filename, file.Content); err != nil {
+			return err
+		}
+	}
 
-func (gist *Gist) AddAndCommitFile(file *FileDTO) error {
-	if err := git.CloneTmp(gist.User.Username, gist.Uuid, gist.Uuid, gist.User.Email, false); err != nil {
+	if err := git.AddAll(gistTmpId); err != nil {
 		return err
 	}
 
-	if err := git.SetFileContent(gist.Uuid, file.Filename, file.Content); err != nil {
+	if err := git.CommitRepository(gistTmpId, authorName, authorEmail); err != nil {
 		return err
 	}
 
-	if err := git.AddAll(gist.Uuid); err != nil {
+	if err := git.Push(gistTmpId); err != nil {
 		return err
 	}
 
-	if err := git.CommitRepository(gist.Uuid, gist.User.Username, gist.User.Email); err != nil {
+	size, err := gist.RepoSize()
+	if err != nil {
 		return err
 	}
+	gist.Size = size
+	return nil
+}
+
+func (gist *Gist) RepoSize() (int64, error) {
+	return git.RepositorySize(gist.Uuid)
+}
+
+func (gist *Gist) HumanSize() string {
+	return humanize.IBytes(uint64(gist.Size))
+}
 
-	return git.Push(gist.Uuid)
+func (gist *Gist) ForkClone(uuid string) error {
+	if !gist.AllowForks {
+		return ErrForksDisabled
+	}
+	return git.ForkClone(gist.Uuid, uuid)
 }
 
-func (gist *Gist) ForkClone(username string, uuid string) error {
-	return git.ForkClone(gist.User.Username, gist.Uuid, username, uuid)
+// ForkCloneAt forks the repository of the gist as it was at the given revision
+func (gist *Gist) ForkCloneAt(uuid string, revision string) error {
+	if !gist.AllowForks {
+		return ErrForksDisabled
+	}
+	return git.ForkCloneAt(gist.Uuid, uuid, revision)
 }
 
 func (gist *Gist) UpdateServerInfo() error {
-	return git.UpdateServerInfo(gist.User.Username, gist.Uuid)
+	return git.UpdateServerInfo(gist.Uuid)
 }
 
 func (gist *Gist) RPC(service string) ([]byte, error) {
-	return git.RPC(gist.User.Username, gist.Uuid, service)
+	return git.RPC(gist.Uuid, service)
 }
 
 func (gist *Gist) UpdatePreviewAndCount(withTimestampUpdate bool) error {
-	filesStr, err := git.GetFilesOfRepository(gist.User.Username, gist.Uuid, "HEAD")
+	files, err := gist.Files("HEAD", true)
 	if err != nil {
 		return err
 	}
-	gist.NbFiles = len(filesStr)
+	gist.NbFiles = len(files)
+	gist.SetPreview(files)
+
+	if err = gist.SetLanguages(files); err != nil {
+		return err
+	}
+
+	if gist.Size, err = gist.RepoSize(); err != nil {
+		return err
+	}
 
-	if len(filesStr) == 0 {
+	if withTimestampUpdate {
+		return gist.Update()
+	}
+	return gist.UpdateNoTimestamps()
+}
+
+// SetPreview sets the preview of the gist from the first lines of its most meaningful file
+func (gist *Gist) SetPreview(files []*git.File) {
+	file := choosePreviewFile(files)
+	if file == nil {
 		gist.Preview = ""
 		gist.PreviewFilename = ""
+		return
+	}
+
+	lines := config.C.PreviewLines
+	if lines <= 0 {
+		lines = 10
+	}
+
+	split := strings.Split(file.Content, "\n")
+	if len(split) > lines {
+		gist.Preview = strings.Join(split[:lines], "\n")
 	} else {
-		file, err := gist.File("HEAD", filesStr[0], true)
-		if err != nil {
-			return err
+		gist.Preview = file.Content
+	}
+
+	gist.PreviewFilename = file.Filename
+}
+
+var previewLockfiles = []string{
+	"package-lock.json", "yarn.lock", "pnpm-lock.yaml", "composer.lock", "Gemfile.lock",
+	"Cargo.lock", "poetry.lock", "Pipfile.lock", "go.sum", "flake.lock",
+}
+
+// choosePreviewFile returns the first text file that is not a lockfile, or the first text file if there are only
+// lockfiles. Binary files and images are never chosen.
+func choosePreviewFile(files []*git.File) *git.File {
+	var fallback *git.File
+	for _, file := range files {
+		if file.IsBinary() || file.IsImage() {
+			continue
+		}
+		if !slices.Contains(previewLockfiles, file.Filename) && !strings.HasSuffix(file.Filename, ".lock") {
+			return file
+		}
+		if fallback == nil {
+			fallback = file
+		}
+	}
+	return fallback
+}
+
+var templatePlaceholderRegex = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.-]+)\s*\}\}`)
+
+// TemplatePlaceholders returns the distinct {{placeholder}} names found in the title, description and files of the gist
+func (gist *Gist) TemplatePlaceholders() ([]string, error) {
+	files, err := gist.Files("HEAD", false)
+	if err != nil {
+		return nil, err
+	}
+
+	contents := []string{gist.Title, gist.Description}
+	for _, file := range files {
+		contents = append(contents, file.Content)
+	}
+
+	var placeholders []string
+	for _, content := range contents {
+		for _, match := range templatePlaceholderRegex.FindAllStringSubmatch(content, -1) {
+			if !slices.Contains(placeholders, match[1]) {
+				placeholders = append(placeholders, match[1])
+			}
 		}
+	}
+	return placeholders, nil
+}
 
-		split := strings.Split(file.Content, "\n")
-		if len(split) > 10 {
-			gist.Preview = strings.Join(split[:10], "\n")
-		} else {
-			gist.Preview = file.Content
+// renderTemplate replaces the placeholders of the content by their value, the undeclared ones are left as-is and returned
+func renderTemplate(content string, vars map[string]string) (string, []string) {
+	var undeclared []string
+	rendered := templatePlaceholderRegex.ReplaceAllStringFunc(content, func(placeholder string) string {
+		name := templatePlaceholderRegex.FindStringSubmatch(placeholder)[1]
+		if value, ok := vars[name]; ok {
+			return value
 		}
+		undeclared = append(undeclared, name)
+		return placeholder
+	})
+	return rendered, undeclared
+}
+
+type UndeclaredPlaceholdersError struct {
+	Placeholders []string
+}
+
+func (e *UndeclaredPlaceholdersError) Error() string {
+	return "undeclared placeholders: " + strings.Join(e.Placeholders, ", ")
+}
 
-		gist.PreviewFilename = file.Filename
+// CreateFromTemplate creates a new gist for the user from a template gist, replacing the {{placeholder}} tokens of its
+// title, description and files by the given values. If strict is set, an undeclared placeholder is an error,
+// otherwise it is left as-is.
+func CreateFromTemplate(templateGist *Gist, vars map[string]string, user *User, strict bool) (*Gist, error) {
+	files, err := templateGist.Files("HEAD", false)
+	if err != nil {
+		return nil, err
 	}
 
-	if withTimestampUpdate {
-		return gist.Update()
+	var undeclared []string
+	render := func(content string) string {
+		rendered, missing := renderTemplate(content, vars)
+		for _, name := range missing {
+			if !slices.Contains(undeclared, name) {
+				undeclared = append(undeclared, name)
+			}
+		}
+		return rendered
 	}
-	return gist.UpdateNoTimestamps()
+
+	gist := &Gist{
+		Title:       render(templateGist.Title),
+		Description: render(templateGist.Description),
+		Private:     user.AllowedVisibility(templateGist.Private),
+		AllowForks:  true,
+		UserID:      user.ID,
+		User:        *user,
+		NbFiles:     len(files),
+	}
+
+	fileDTOs := make([]FileDTO, 0, len(files))
+	previewFiles := make([]*git.File, 0, len(files))
+	for _, file := range files {
+		content := render(file.Content)
+		fileDTOs = append(fileDTOs, FileDTO{Filename: file.Filename, Content: content})
+		previewFiles = append(previewFiles, &git.File{Filename: file.Filename, Content: content})
+	}
+
+	if strict && len(undeclared) > 0 {
+		return nil, &UndeclaredPlaceholdersError{Placeholders: undeclared}
+	}
+
+	uuidGist, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+	gist.Uuid = strings.Replace(uuidGist.String(), "-", "", -1)
+	gist.SetPreview(previewFiles)
+
+	if err = gist.CreateWithFiles(fileDTOs, user); err != nil {
+		return nil, err
+	}
+
+	gist.AddInIndex()
+	return gist, nil
 }
 
 func (gist *Gist) VisibilityStr() string {
@@ -508,6 +1477,9 @@ func (gist *Gist) Identifier() string {
 	if gist.URL != "" {
 		return gist.URL
 	}
+	if gist.Slug != "" {
+		return gist.Slug
+	}
 	return gist.Uuid
 }
 
@@ -519,17 +1491,7 @@ func (gist *Gist) GetLanguagesFromFiles() ([]string, error) {
 
 	languages := make([]string, 0, len(files))
 	for _, file := range files {
-		var lexer chroma.Lexer
-		if lexer = lexers.Get(file.Filename); lexer == nil {
-			lexer = lexers.Fallback
-		}
-
-		fileType := lexer.Config().Name
-		if lexer.Config().Name == "fallback" || lexer.Config().Name == "plaintext" {
-			fileType = "Text"
-		}
-
-		languages = append(languages, fileType)
+		languages = append(languages, DetectLanguage(file.Filename, file.Content))
 	}
 
 	return languages, nil
@@ -540,11 +1502,95 @@ func (gist *Gist) GetLanguagesFromFiles() ([]string, error) {
 type GistDTO struct {
 	Title       string    `validate:"max=250" form:"title"`
 	Description string    `validate:"max=1000" form:"description"`
-	URL         string    `validate:"max=32,alphanumdashorempty" form:"url"`
-	Files       []FileDTO `validate:"min=1,dive"`
+	URL         string    `validate:"max=32,alphanumdashorempty,notreservedgist" form:"url"`
+	Topics      string    `validate:"max=400,topics" form:"topics"` // separated by spaces or commas
+	Files       []FileDTO `validate:"min=1,maxfiles,uniquefilenames,dive"`
 	Name        []string  `form:"name"`
 	Content     []string  `form:"content"`
 	VisibilityDTO
+
+	// nil keeps the current setting, forks are allowed by default on a new gist
+	AllowForks *bool `form:"allow_forks"`
+
+	// formatting applied to the files before they are committed, none by default
+	LineEndings            string `validate:"omitempty,oneof=lf crlf" form:"line_endings"`
+	TrimTrailingWhitespace bool   `form:"trim_trailing_whitespace"`
+
+	// only read on creation, the gist never expires by default
+	Expiration string `validate:"omitempty,oneof=never 1h 1d 1w" form:"expiration"`
+}
+
+// GistBatchDTO lists the gists to fetch at once, up to 50 to keep the request cheap
+type GistBatchDTO struct {
+	Gists []GistRefDTO `json:"gists" validate:"min=1,max=50,dive"`
+	Files bool         `json:"files"`
+}
+
+// GistAPIDTO is the JSON body of the API creating and updating gists, the fields left out of an update keep their
+// current value. It is turned into a GistDTO to be validated.
+type GistAPIDTO struct {
+	Title       *string   `json:"title"`
+	Description *string   `json:"description"`
+	URL         *string   `json:"url"`
+	Visibility  *string   `json:"visibility"`
+	AllowForks  *bool     `json:"allow_forks"`
+	Expiration  *string   `json:"expiration"`
+	Topics      []string  `json:"topics"`
+	Files       []FileDTO `json:"files"`
+}
+
+// ToGistDTO fills a GistDTO with the fields of the request, and with the ones of the gist for those left out. The
+// gist is nil on creation.
+func (dto *GistAPIDTO) ToGistDTO(gist *Gist) (*GistDTO, error) {
+	gistDTO := &GistDTO{AllowForks: dto.AllowForks, Files: dto.Files}
+	if gist != nil {
+		gistDTO.Title = gist.Title
+		gistDTO.Description = gist.Description
+		gistDTO.URL = gist.URL
+		gistDTO.Private = gist.Private
+		gistDTO.Topics = gist.TopicList()
+	}
+
+	if dto.Title != nil {
+		gistDTO.Title = *dto.Title
+	}
+	if dto.Description != nil {
+		gistDTO.Description = *dto.Description
+	}
+	if dto.URL != nil {
+		gistDTO.URL = *dto.URL
+	}
+	if dto.Expiration != nil {
+		gistDTO.Expiration = *dto.Expiration
+	}
+	if dto.Topics != nil {
+		gistDTO.Topics = strings.Join(dto.Topics, ",")
+	}
+	if dto.Visibility != nil {
+		visibility, err := ParseVisibility(*dto.Visibility)
+		if err != nil {
+			return nil, err
+		}
+		gistDTO.Private = visibility
+	}
+
+	// the files are named like in the web form, where a file left unnamed is a gistfile
+	fileCounter := 0
+	for i := range gistDTO.Files {
+		if gistDTO.Files[i].Filename == "" {
+			fileCounter += 1
+			gistDTO.Files[i].Filename = "gistfile" + strconv.Itoa(fileCounter) + ".txt"
+		}
+		gistDTO.Files[i].Filename = norm.NFC.String(strings.Trim(gistDTO.Files[i].Filename, " "))
+	}
+
+	return gistDTO, nil
+}
+
+// GistRefDTO names a gist by its owner and its identifier, which can be its UUID, custom URL or slug
+type GistRefDTO struct {
+	User string `json:"user" validate:"required"`
+	Gist string `json:"gist" validate:"required"`
 }
 
 type VisibilityDTO struct {
@@ -552,23 +1598,81 @@ type VisibilityDTO struct {
 }
 
 type FileDTO struct {
-	Filename string `validate:"excludes=\x2f,excludes=\x5c,max=255"`
-	Content  string `validate:"required"`
+	Filename string `validate:"excludes=\x2f,excludes=\x5c,max=255,filename,allowedext" json:"filename"`
+	Content  string `validate:"required" json:"content"`
+}
+
+type GistSuggestionDTO struct {
+	ID       uint
+	Uuid     string
+	URL      string
+	Slug     string
+	Title    string
+	Username string
+}
+
+func (dto *GistSuggestionDTO) Identifier() string {
+	if dto.URL != "" {
+		return dto.URL
+	}
+	if dto.Slug != "" {
+		return dto.Slug
+	}
+	return dto.Uuid
+}
+
+// FormatFiles trims the trailing whitespace of the lines of the files and normalizes their line endings, as asked
+func (dto *GistDTO) FormatFiles() {
+	for i := range dto.Files {
+		dto.Files[i].Content = formatContent(dto.Files[i].Content, dto.LineEndings, dto.TrimTrailingWhitespace)
+	}
+}
+
+func formatContent(content string, lineEndings string, trimTrailingWhitespace bool) string {
+	if lineEndings == "" && !trimTrailingWhitespace {
+		return content
+	}
+
+	lines := strings.Split(content, "\n")
+	for i, line := range lines {
+		hasCR := strings.HasSuffix(line, "\r")
+		line = strings.TrimSuffix(line, "\r")
+		if trimTrailingWhitespace {
+			line = strings.TrimRight(line, " \t")
+		}
+
+		switch {
+		case lineEndings == "crlf" && i < len(lines)-1:
+			line += "\r"
+		case lineEndings == "" && hasCR:
+			line += "\r"
+		}
+		lines[i] = line
+	}
+	return strings.Join(lines, "\n")
 }
 
 func (dto *GistDTO) ToGist() *Gist {
-	return &Gist{
+	gist := &Gist{
 		Title:       dto.Title,
 		Description: dto.Description,
 		Private:     dto.Private,
 		URL:         dto.URL,
+		AllowForks:  dto.AllowForks == nil || *dto.AllowForks,
+	}
+	if expiration, ok := GistExpirations[dto.Expiration]; ok {
+		gist.ExpiresAt = time.Now().Add(expiration).Unix()
 	}
+	return gist
 }
 
 func (dto *GistDTO) ToExistingGist(gist *Gist) *Gist {
 	gist.Title = dto.Title
 	gist.Description = dto.Description
 	gist.URL = dto.URL
+	if dto.AllowForks != nil {
+		gist.AllowForks = *dto.AllowForks
+	}
 	return gist
 }
 
@@ -598,15 +1702,16 @@ func (gist *Gist) ToIndexedGist() (*index.Gist, error) {
 	}
 
 	indexedGist := &index.Gist{
-		GistID:     gist.ID,
-		Username:   gist.User.Username,
-		Title:      gist.Title,
-		Content:    wholeContent,
-		Filenames:  fileNames,
-		Extensions: exts,
-		Languages:  langs,
-		CreatedAt:  gist.CreatedAt,
-		UpdatedAt:  gist.UpdatedAt,
+		GistID:      gist.ID,
+		Username:    gist.User.Username,
+		Title:       gist.Title,
+		Description: gist.Description,
+		Content:     wholeContent,
+		Filenames:   fileNames,
+		Extensions:  exts,
+		Languages:   langs,
+		CreatedAt:   gist.CreatedAt,
+		UpdatedAt:   gist.UpdatedAt,
 	}
 
 	return indexedGist, nil
@@ -0,0 +1,121 @@
+package db
+
+import (
+	"github.com/alecthomas/chroma/v2"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/thomiceli/opengist/internal/git"
+	"gorm.io/gorm"
+)
+
+// GistFile is a file of a gist at HEAD along with the language detected when it was committed, so the gists can be
+// listed by language without reading their repository
+type GistFile struct {
+	ID       uint   `gorm:"primaryKey"`
+	GistID   uint   `gorm:"index"`
+	Gist     Gist   `validate:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+	Filename string `gorm:"size:255"`
+	Language string `gorm:"index;size:255"` // empty for the images and the binary files
+}
+
+// DetectLanguage returns the name of the language of a file, from its name first, from its content if the name tells
+// nothing. A file whose language is unknown is Text.
+func DetectLanguage(filename string, content string) string {
+	var lexer chroma.Lexer
+	if lexer = lexers.Get(filename); lexer == nil {
+		if lexer = lexers.Analyse(content); lexer == nil {
+			return "Text"
+		}
+	}
+
+	name := lexer.Config().Name
+	if name == "fallback" || name == "plaintext" {
+		return "Text"
+	}
+	return name
+}
+
+func fileLanguage(file *git.File) string {
+	if file.IsImage() || file.IsBinary() {
+		return ""
+	}
+	return DetectLanguage(file.Filename, file.Content)
+}
+
+func filesFromDTOs(dtos []FileDTO) []*git.File {
+	files := make([]*git.File, 0, len(dtos))
+	for _, dto := range dtos {
+		files = append(files, &git.File{Filename: dto.Filename, Content: dto.Content})
+	}
+	return files
+}
+
+// SetLanguages replaces the files of the gist, and their languages, by the files at HEAD
+func (gist *Gist) SetLanguages(files []*git.File) error {
+	return setGistFiles(db, gist.ID, files)
+}
+
+func setGistFiles(tx *gorm.DB, gistId uint, files []*git.File) error {
+	return tx.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("gist_id = ?", gistId).Delete(&GistFile{}).Error; err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			return nil
+		}
+
+		gistFiles := make([]*GistFile, 0, len(files))
+		for _, file := range files {
+			gistFiles = append(gistFiles, &GistFile{GistID: gistId, Filename: file.Filename, Language: fileLanguage(file)})
+		}
+		return tx.Omit("Gist").Create(&gistFiles).Error
+	})
+}
+
+// Languages returns the languages of the files of the gist, sorted by name
+func (gist *Gist) Languages() ([]string, error) {
+	var languages []string
+	err := db.Model(&GistFile{}).
+		Distinct("language").
+		Where("gist_id = ? AND language != ''", gist.ID).
+		Order("language").
+		Pluck("language", &languages).Error
+
+	return languages, err
+}
+
+// GetGistsLanguages returns the languages of the files of each gist, sorted by name, by gist ID
+func GetGistsLanguages(gistIds []uint) (map[uint][]string, error) {
+	languages := make(map[uint][]string)
+	if len(gistIds) == 0 {
+		return languages, nil
+	}
+
+	var rows []struct {
+		GistID   uint
+		Language string
+	}
+	err := db.Model(&GistFile{}).
+		Distinct("gist_id", "language").
+		Where("gist_id IN ? AND language != ''", gistIds).
+		Order("gist_id, language").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		languages[row.GistID] = append(languages[row.GistID], row.Language)
+	}
+	return languages, nil
+}
+
+// withLanguage keeps the gists having a file in the language in the statement, all of them if the language is empty
+func withLanguage(statement *gorm.DB, language string) *gorm.DB {
+	if language == "" {
+		return statement
+	}
+
+	return statement.Where("gists.id IN (?)", db.Model(&GistFile{}).
+		Select("gist_files.gist_id").
+		Where("lower(gist_files.language) = lower(?)", language))
+}
@@ -0,0 +1,65 @@
+package db
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thomiceli/opengist/internal/config"
+	"github.com/thomiceli/opengist/internal/git"
+)
+
+func TestDetectLanguage(t *testing.T) {
+	require.Equal(t, "Go", DetectLanguage("main.go", "package main"))
+	require.Equal(t, "Bash", DetectLanguage("script", "#!/usr/bin/env bash\necho hello"))
+	require.Equal(t, "Text", DetectLanguage("notes", "some notes"))
+	require.Equal(t, "Text", DetectLanguage("notes.txt", "package main"))
+}
+
+func TestGistLanguages(t *testing.T) {
+	require.NoError(t, config.InitConfig("", io.Discard))
+	require.NoError(t, Setup("file::memory:", true))
+	defer Close()
+
+	user := &User{Username: "thomas"}
+	require.NoError(t, db.Create(user).Error)
+
+	var gists []*Gist
+	for _, title := range []string{"gist1", "gist2"} {
+		gist := &Gist{Uuid: title, Title: title, UserID: user.ID, Private: PublicVisibility}
+		require.NoError(t, db.Omit("forked_id").Create(gist).Error)
+		gists = append(gists, gist)
+	}
+
+	require.NoError(t, gists[0].SetLanguages([]*git.File{
+		{Filename: "main.go", Content: "package main"},
+		{Filename: "util.go", Content: "package main"},
+		{Filename: "README.md", Content: "# gist"},
+		{Filename: "image.png", Content: "\x89PNG"},
+	}))
+	require.NoError(t, gists[1].SetLanguages([]*git.File{{Filename: "script.py", Content: "print('hello')"}}))
+
+	languages, err := gists[0].Languages()
+	require.NoError(t, err)
+	require.Equal(t, []string{"Go", "markdown"}, languages)
+
+	byGist, err := GetGistsLanguages([]uint{gists[0].ID, gists[1].ID})
+	require.NoError(t, err)
+	require.Equal(t, []string{"Python"}, byGist[gists[1].ID])
+
+	// the files of the previous commit are replaced
+	require.NoError(t, gists[0].SetLanguages([]*git.File{{Filename: "main.py", Content: "print('hello')"}}))
+	languages, err = gists[0].Languages()
+	require.NoError(t, err)
+	require.Equal(t, []string{"Python"}, languages)
+
+	require.NoError(t, gists[1].SetLanguages([]*git.File{{Filename: "main.go", Content: "package main"}}))
+	listed, total, err := GetAllGistsForCurrentUser(0, Page{Number: 1, Size: 10}, "created", "asc", "go", TimeRange{})
+	require.NoError(t, err)
+	require.EqualValues(t, 1, total)
+	require.Equal(t, gists[1].ID, listed[0].ID)
+
+	count, err := CountAllGistsFromUser(user.ID, 0, "", "python", TimeRange{})
+	require.NoError(t, err)
+	require.EqualValues(t, 1, count)
+}
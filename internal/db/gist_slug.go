@@ -0,0 +1,104 @@
+package db
+
+import (
+	"crypto/rand"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/thomiceli/opengist/internal/config"
+	"github.com/thomiceli/opengist/internal/utils"
+)
+
+const (
+	GistUrlFormatUuid  = "uuid"
+	GistUrlFormatShort = "short"
+	GistUrlFormatSlug  = "slug"
+)
+
+const base62Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+const shortIdLength = 8
+
+var titleSlugRegex = regexp.MustCompile("[^a-z0-9]+")
+
+func GetGistBySlug(user string, slug string) (*Gist, error) {
+	gist := new(Gist)
+	err := db.Preload("User").Preload("Forked.User").
+		Where("gists.slug = ? AND lower(users.username) = lower(?)", slug, user).
+		Joins("join users on gists.user_id = users.id").
+		First(&gist).Error
+
+	return gist, err
+}
+
+// newSlug returns the identifier used in the URL of a new gist according to the gist.url-format setting, it is
+// empty if the gist is identified by its UUID. Slugs derived from the title get a numbered suffix on collisions.
+func (gist *Gist) newSlug() (string, error) {
+	switch config.C.GistUrlFormat {
+	case GistUrlFormatSlug:
+		base := titleSlug(gist.Title)
+		// untitled gists are named after their UUID, which makes for a poor slug
+		if base == "" || gist.Title == "gist:"+gist.Uuid {
+			return gist.newShortId()
+		}
+
+		slug := base
+		for i := 2; ; i++ {
+			taken, err := gist.slugTaken(slug)
+			if err != nil {
+				return "", err
+			}
+			if !taken {
+				return slug, nil
+			}
+			slug = base + "-" + strconv.Itoa(i)
+		}
+	case GistUrlFormatShort:
+		return gist.newShortId()
+	default:
+		return "", nil
+	}
+}
+
+func (gist *Gist) newShortId() (string, error) {
+	for {
+		buf := make([]byte, shortIdLength)
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		for i, b := range buf {
+			buf[i] = base62Chars[int(b)%len(base62Chars)]
+		}
+
+		taken, err := gist.slugTaken(string(buf))
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			return string(buf), nil
+		}
+	}
+}
+
+// slugTaken reports whether the slug would be ambiguous with the URL of another gist of the same user
+func (gist *Gist) slugTaken(slug string) (bool, error) {
+	if utils.IsReservedGistPath(slug) {
+		return true, nil
+	}
+
+	var count int64
+	// gists in the trash keep their slug so they can be restored at the same URL
+	err := db.Unscoped().Model(&Gist{}).
+		Where("user_id = ? AND (uuid = ? OR url = ? OR slug = ?)", gist.UserID, slug, slug, slug).
+		Count(&count).Error
+	return count > 0, err
+}
+
+func titleSlug(title string) string {
+	slug := strings.Trim(titleSlugRegex.ReplaceAllString(strings.ToLower(title), "-"), "-")
+	if len(slug) > 32 {
+		slug = strings.TrimRight(slug[:32], "-")
+	}
+	return slug
+}
@@ -0,0 +1,135 @@
+package db
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thomiceli/opengist/internal/config"
+)
+
+func BenchmarkGetGistsAfterCursor(b *testing.B) {
+	if err := config.InitConfig("", io.Discard); err != nil {
+		b.Fatal(err)
+	}
+	if err := Setup("file::memory:", true); err != nil {
+		b.Fatal(err)
+	}
+	defer Close()
+
+	user := &User{Username: "thomas"}
+	if err := db.Create(user).Error; err != nil {
+		b.Fatal(err)
+	}
+
+	description := strings.Repeat("A long description. ", 1000)
+	for i := 0; i < 500; i++ {
+		if err := db.Omit("forked_id").Create(&Gist{
+			Uuid:        strconv.Itoa(i),
+			Title:       "gist" + strconv.Itoa(i),
+			Description: description,
+			Preview:     "hello",
+			UserID:      user.ID,
+			UpdatedAt:   int64(i),
+		}).Error; err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for _, lite := range []bool{false, true} {
+		name := "full"
+		if lite {
+			name = "lite"
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, _, err := GetGistsAfterCursor(nil, 100, lite, TimeRange{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestGetTrendingGists(t *testing.T) {
+	require.NoError(t, config.InitConfig("", io.Discard))
+	require.NoError(t, Setup("file::memory:", true))
+	defer Close()
+
+	var users []*User
+	for _, username := range []string{"thomas", "kaguya", "noriaki"} {
+		user := &User{Username: username}
+		require.NoError(t, db.Create(user).Error)
+		users = append(users, user)
+	}
+
+	var gists []*Gist
+	for i, visibility := range []Visibility{PublicVisibility, PublicVisibility, PublicVisibility, UnlistedVisibility} {
+		gist := &Gist{Uuid: strconv.Itoa(i), Title: "gist" + strconv.Itoa(i), UserID: users[0].ID, Private: visibility}
+		require.NoError(t, db.Omit("forked_id").Create(gist).Error)
+		gists = append(gists, gist)
+	}
+
+	now := time.Now()
+	old := now.AddDate(0, 0, -30).Unix()
+	likes := []Like{
+		// gist0 is the most liked of all time, but not lately
+		{UserID: users[0].ID, GistID: gists[0].ID, CreatedAt: old},
+		{UserID: users[1].ID, GistID: gists[0].ID, CreatedAt: old},
+		{UserID: users[2].ID, GistID: gists[0].ID, CreatedAt: now.Unix()},
+		{UserID: users[1].ID, GistID: gists[1].ID, CreatedAt: now.Unix()},
+		{UserID: users[2].ID, GistID: gists[1].ID, CreatedAt: now.Add(-time.Hour).Unix()},
+		{UserID: users[1].ID, GistID: gists[3].ID, CreatedAt: now.Unix()},
+		{UserID: users[2].ID, GistID: gists[3].ID, CreatedAt: now.Unix()},
+	}
+	require.NoError(t, db.Create(&likes).Error)
+
+	trending, err := GetTrendingGists(7, 0)
+	require.NoError(t, err)
+	require.Len(t, trending, 2, "unliked and unlisted gists should be left out")
+	require.Equal(t, gists[1].ID, trending[0].ID)
+	require.Equal(t, gists[0].ID, trending[1].ID)
+	require.Equal(t, "thomas", trending[0].User.Username)
+
+	trending, err = GetTrendingGists(60, 0)
+	require.NoError(t, err)
+	require.Equal(t, gists[0].ID, trending[0].ID)
+
+	trending, err = GetTrendingGists(7, 1)
+	require.NoError(t, err)
+	require.Empty(t, trending)
+}
+
+func TestDeleteTopics(t *testing.T) {
+	require.NoError(t, config.InitConfig("", io.Discard))
+	require.NoError(t, Setup("file::memory:", true))
+	defer Close()
+
+	user := &User{Username: "thomas"}
+	require.NoError(t, db.Create(user).Error)
+
+	var gists []*Gist
+	for _, title := range []string{"gist1", "gist2"} {
+		gist := &Gist{Uuid: title, Title: title, UserID: user.ID, Private: PublicVisibility}
+		require.NoError(t, db.Omit("forked_id").Create(gist).Error)
+		require.NoError(t, gist.SetTopics([]string{"go", "cli"}))
+		gists = append(gists, gist)
+	}
+
+	countTopics := func() int64 {
+		var count int64
+		require.NoError(t, db.Table("gist_topics").Count(&count).Error)
+		return count
+	}
+	require.Equal(t, int64(4), countTopics())
+
+	// the topics are taken off the gist purged, and off the gists of the user deleted
+	require.NoError(t, gists[0].Purge())
+	require.Equal(t, int64(2), countTopics())
+
+	require.NoError(t, user.Delete())
+	require.Equal(t, int64(0), countTopics())
+}
@@ -1,23 +1,35 @@
 package db
 
 import (
+	"errors"
 	"math/rand"
 	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+// ErrInvitationNotUsable is returned when signing up with an invitation that expired or has no use left
+var ErrInvitationNotUsable = errors.New("invitation is expired or has no use left")
+
 type Invitation struct {
-	ID        uint `gorm:"primaryKey"`
-	Code      string
-	ExpiresAt int64
-	NbUsed    uint
-	NbMax     uint
+	ID          uint `gorm:"primaryKey"`
+	Code        string
+	ExpiresAt   int64
+	NbUsed      uint
+	NbMax       uint
+	CreatedByID uint // admin who generated the code, 0 for older invitations
 }
 
 func GetAllInvitations() ([]*Invitation, error) {
 	var invitations []*Invitation
+	// the usable invitations first
 	err := db.
-		Order("(((expires_at >= strftime('%s', 'now')) AND ((nb_max <= 0) OR (nb_used < nb_max)))) desc").
-		Order("id asc").
+		Clauses(clause.OrderBy{Expression: clause.Expr{
+			SQL:                "CASE WHEN expires_at >= ? AND (nb_max <= 0 OR nb_used < nb_max) THEN 0 ELSE 1 END, id asc",
+			Vars:               []interface{}{time.Now().Unix()},
+			WithoutParentheses: true,
+		}}).
 		Find(&invitations).Error
 
 	return invitations, err
@@ -70,9 +82,23 @@ func (i *Invitation) IsUsable() bool {
 	return !i.IsExpired() && !i.IsMaxedOut()
 }
 
-func (i *Invitation) Use() error {
-	i.NbUsed++
-	return i.Update()
+// CreateWithInvitation creates the user and consumes a use of the invitation in a single transaction. The invitation is
+// checked again by the update itself, so concurrent signups cannot use a code beyond its limit.
+func (user *User) CreateWithInvitation(invitation *Invitation) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Invitation{}).
+			Where("id = ? AND expires_at >= ? AND (nb_max <= 0 OR nb_used < nb_max)", invitation.ID, time.Now().Unix()).
+			UpdateColumn("nb_used", gorm.Expr("nb_used + 1"))
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrInvitationNotUsable
+		}
+
+		user.InvitationID = invitation.ID
+		return tx.Create(&user).Error
+	})
 }
 
 func generateRandomCode() string {
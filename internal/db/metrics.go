@@ -0,0 +1,41 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/thomiceli/opengist/internal/metrics"
+	"gorm.io/gorm"
+)
+
+const queryStartKey = "opengist:query_start"
+
+// registerQueryMetrics times the database queries, by the operation of the statement
+func registerQueryMetrics(db *gorm.DB) error {
+	start := func(tx *gorm.DB) {
+		tx.InstanceSet(queryStartKey, time.Now())
+	}
+	observe := func(operation string) func(*gorm.DB) {
+		return func(tx *gorm.DB) {
+			if startedAt, ok := tx.InstanceGet(queryStartKey); ok {
+				metrics.DBQueryDuration.ObserveSince(startedAt.(time.Time), operation)
+			}
+		}
+	}
+
+	callbacks := db.Callback()
+	return errors.Join(
+		callbacks.Create().Before("gorm:create").Register("opengist:metrics_start", start),
+		callbacks.Create().After("gorm:create").Register("opengist:metrics_observe", observe("create")),
+		callbacks.Query().Before("gorm:query").Register("opengist:metrics_start", start),
+		callbacks.Query().After("gorm:query").Register("opengist:metrics_observe", observe("query")),
+		callbacks.Update().Before("gorm:update").Register("opengist:metrics_start", start),
+		callbacks.Update().After("gorm:update").Register("opengist:metrics_observe", observe("update")),
+		callbacks.Delete().Before("gorm:delete").Register("opengist:metrics_start", start),
+		callbacks.Delete().After("gorm:delete").Register("opengist:metrics_observe", observe("delete")),
+		callbacks.Row().Before("gorm:row").Register("opengist:metrics_start", start),
+		callbacks.Row().After("gorm:row").Register("opengist:metrics_observe", observe("row")),
+		callbacks.Raw().Before("gorm:raw").Register("opengist:metrics_start", start),
+		callbacks.Raw().After("gorm:raw").Register("opengist:metrics_observe", observe("raw")),
+	)
+}
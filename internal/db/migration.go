@@ -1,67 +1,232 @@
 package db
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
 	"github.com/rs/zerolog/log"
+	"github.com/thomiceli/opengist/internal/git"
 	"gorm.io/gorm"
 )
 
+// Migration is a versioned change of the database, applied once in the order of the list and recorded with its time.
+// Down reverts Up, it is nil when the change cannot be undone.
+type Migration struct {
+	ID   string
+	Up   func(tx *gorm.DB) error
+	Down func(tx *gorm.DB) error
+}
+
+// SchemaMigration records a migration applied to the database
+type SchemaMigration struct {
+	ID        string `gorm:"primaryKey;size:255"`
+	AppliedAt int64
+}
+
+// MigrationVersion is the version of the migrations applied by the releases which did not record them one by one, the
+// first migrations of the list have the versions 1, 2, 3...
 type MigrationVersion struct {
 	ID      uint `gorm:"primaryKey"`
 	Version uint
 }
 
-func ApplyMigrations(db *gorm.DB) error {
-	// Create migration table if it doesn't exist
-	if err := db.AutoMigrate(&MigrationVersion{}); err != nil {
-		log.Fatal().Err(err).Msg("Error creating migration version table")
+// MigrationStatus is a migration of the list along with the time it was applied, 0 if it is pending
+type MigrationStatus struct {
+	ID        string
+	AppliedAt int64
+}
+
+var (
+	ErrIrreversibleMigration = errors.New("migration cannot be reverted")
+	ErrUnknownMigration      = errors.New("unknown migration")
+)
+
+// migrations are applied in this order, a new one is appended with the next number. The tables of a new database are
+// created from the models at once, and the database of a release from before the migrations were recorded is brought
+// up to the models first, so a migration checks the schema through the migrator before changing it.
+var migrations = []*Migration{
+	{ID: "0001_ssh_keys_cascade", Up: v1_modifyConstraintToSSHKeys},
+	{ID: "0002_lowercase_emails", Up: v2_lowercaseEmails},
+	{ID: "0003_uuid_repository_paths", Up: v3_moveRepositoriesToUuidPaths, Down: v3_moveRepositoriesToLegacyPaths},
+	{ID: "0004_verify_existing_emails", Up: v4_verifyExistingEmails},
+	{ID: "0005_gist_files", Up: v5_createGistFiles, Down: v5_dropGistFiles},
+	// Add more migrations here as needed
+}
+
+func models() []interface{} {
+	return []interface{}{&User{}, &Gist{}, &SSHKey{}, &AdminSetting{}, &Invitation{}, &Token{}, &GistCollaborator{}, &RecentView{}, &AuditLog{}, &Watch{}, &RefreshToken{}, &Comment{}, &Topic{}, &TOTP{}, &WebAuthnCredential{}, &PasswordResetToken{}, &Webhook{}, &WebhookDelivery{}, &GistFile{}}
+}
+
+// Migrate applies the pending migrations. A database migrated by a newer release is refused, it has to be rolled back
+// with that release first.
+func Migrate() error {
+	if err := db.AutoMigrate(&SchemaMigration{}); err != nil {
 		return err
 	}
 
-	// Get the current migration version
-	var currentVersion MigrationVersion
-	db.First(&currentVersion)
+	applied, err := appliedMigrations()
+	if err != nil {
+		return err
+	}
 
-	// Define migrations
-	migrations := []struct {
-		Version uint
-		Func    func(*gorm.DB) error
-	}{
-		{1, v1_modifyConstraintToSSHKeys},
-		{2, v2_lowercaseEmails},
-		// Add more migrations here as needed
+	if len(applied) == 0 {
+		if err = initSchema(); err != nil {
+			return err
+		}
+		if applied, err = appliedMigrations(); err != nil {
+			return err
+		}
+	}
+
+	for id := range applied {
+		if migrationIndex(id) < 0 {
+			return fmt.Errorf("%w %s, the database was migrated by a newer version of Opengist", ErrUnknownMigration, id)
+		}
 	}
 
-	// Apply migrations
 	for _, m := range migrations {
-		if m.Version > currentVersion.Version {
-			tx := db.Begin()
-			if err := tx.Error; err != nil {
-				log.Fatal().Err(err).Msg("Error starting transaction")
+		if _, ok := applied[m.ID]; ok {
+			continue
+		}
+
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Up(tx); err != nil {
 				return err
 			}
+			return tx.Create(&SchemaMigration{ID: m.ID, AppliedAt: time.Now().Unix()}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("error applying migration %s: %w", m.ID, err)
+		}
+		log.Info().Msg(fmt.Sprintf("Migration %s applied successfully", m.ID))
+	}
+
+	return nil
+}
+
+// RollbackMigrations reverts the migrations applied after the one of the ID, the latest first, so the database can be
+// used by the release which shipped it. It returns the IDs of the migrations reverted.
+func RollbackMigrations(id string) ([]string, error) {
+	target := migrationIndex(id)
+	if target < 0 {
+		return nil, fmt.Errorf("%w %s", ErrUnknownMigration, id)
+	}
 
-			if err := m.Func(db); err != nil {
-				log.Fatal().Err(err).Msg(fmt.Sprintf("Error applying migration %d:", m.Version))
-				tx.Rollback()
+	applied, err := appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var reverted []string
+	for i := len(migrations) - 1; i > target; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.ID]; !ok {
+			continue
+		}
+		if m.Down == nil {
+			return reverted, fmt.Errorf("%w: %s", ErrIrreversibleMigration, m.ID)
+		}
+
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Down(tx); err != nil {
 				return err
-			} else {
-				if err = tx.Commit().Error; err != nil {
-					log.Fatal().Err(err).Msg(fmt.Sprintf("Error committing migration %d:", m.Version))
-					return err
-				}
-				currentVersion.Version = m.Version
-				db.Save(&currentVersion)
-				log.Info().Msg(fmt.Sprintf("Migration %d applied successfully", m.Version))
 			}
+			return tx.Delete(&SchemaMigration{ID: m.ID}).Error
+		})
+		if err != nil {
+			return reverted, fmt.Errorf("error reverting migration %s: %w", m.ID, err)
 		}
+		log.Info().Msg(fmt.Sprintf("Migration %s reverted successfully", m.ID))
+		reverted = append(reverted, m.ID)
 	}
 
-	return nil
+	return reverted, nil
+}
+
+// GetMigrationStatuses returns the migrations of the list in their order, with the time they were applied
+func GetMigrationStatuses() ([]MigrationStatus, error) {
+	if err := db.AutoMigrate(&SchemaMigration{}); err != nil {
+		return nil, err
+	}
+
+	applied, err := appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		statuses = append(statuses, MigrationStatus{ID: m.ID, AppliedAt: applied[m.ID]})
+	}
+	return statuses, nil
+}
+
+// appliedMigrations returns the time each recorded migration was applied, by ID
+func appliedMigrations() (map[string]int64, error) {
+	var records []SchemaMigration
+	if err := db.Find(&records).Error; err != nil {
+		return nil, err
+	}
+
+	applied := make(map[string]int64, len(records))
+	for _, record := range records {
+		applied[record.ID] = record.AppliedAt
+	}
+	return applied, nil
+}
+
+func migrationIndex(id string) int {
+	return slices.IndexFunc(migrations, func(m *Migration) bool {
+		return m.ID == id
+	})
+}
+
+// initSchema creates the tables of a new database and records all the migrations, which it does not need. The
+// database of an older release is brought up to the models instead, and only the migrations of the version it had
+// are recorded, the others are left to apply.
+func initSchema() error {
+	newDatabase := !db.Migrator().HasTable(&User{})
+
+	var legacyVersion MigrationVersion
+	if db.Migrator().HasTable(&MigrationVersion{}) {
+		if err := db.Limit(1).Find(&legacyVersion).Error; err != nil {
+			return err
+		}
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.AutoMigrate(models()...); err != nil {
+			return err
+		}
+
+		now := time.Now().Unix()
+		for i, m := range migrations {
+			if !newDatabase && uint(i+1) > legacyVersion.Version {
+				break
+			}
+			if err := tx.Create(&SchemaMigration{ID: m.ID, AppliedAt: now}).Error; err != nil {
+				return err
+			}
+		}
+
+		if tx.Migrator().HasTable(&MigrationVersion{}) {
+			return tx.Migrator().DropTable(&MigrationVersion{})
+		}
+		return nil
+	})
 }
 
-// Modify the constraint on the ssh_keys table to use ON DELETE CASCADE
+// Modify the constraint on the ssh_keys table to use ON DELETE CASCADE. Only the SQLite databases of older versions
+// lack it, the others are created with it.
 func v1_modifyConstraintToSSHKeys(db *gorm.DB) error {
+	if db.Dialector.Name() != "sqlite" {
+		return nil
+	}
+
 	createSQL := `
 	CREATE TABLE ssh_keys_temp (
 		id integer primary key,
@@ -101,3 +266,119 @@ func v2_lowercaseEmails(db *gorm.DB) error {
 	copySQL := `UPDATE users SET email = lower(email);`
 	return db.Exec(copySQL).Error
 }
+
+// Move the repositories from <username>/<uuid> to <uuid>, so they no longer depend on the gist owner username
+func v3_moveRepositoriesToUuidPaths(db *gorm.DB) error {
+	var rows []struct {
+		Username string
+		Uuid     string
+	}
+	err := db.Table("gists").
+		Select("users.username, gists.uuid").
+		Joins("join users on gists.user_id = users.id").
+		Scan(&rows).Error
+	if err != nil {
+		return err
+	}
+
+	var renames [][2]string
+	for _, row := range rows {
+		legacyPath := git.LegacyRepositoryPath(row.Username, row.Uuid)
+		if _, err := os.Stat(legacyPath); os.IsNotExist(err) {
+			continue
+		}
+		renames = append(renames, [2]string{legacyPath, git.RepositoryPath(row.Uuid)})
+	}
+	if err := renameRepositories(renames); err != nil {
+		return err
+	}
+
+	// remove the now empty user directories
+	for _, row := range rows {
+		_ = os.Remove(filepath.Dir(git.LegacyRepositoryPath(row.Username, row.Uuid)))
+	}
+
+	return nil
+}
+
+// Move the repositories back to <username>/<uuid>
+func v3_moveRepositoriesToLegacyPaths(db *gorm.DB) error {
+	var rows []struct {
+		Username string
+		Uuid     string
+	}
+	err := db.Table("gists").
+		Select("users.username, gists.uuid").
+		Joins("join users on gists.user_id = users.id").
+		Scan(&rows).Error
+	if err != nil {
+		return err
+	}
+
+	var renames [][2]string
+	for _, row := range rows {
+		repositoryPath := git.RepositoryPath(row.Uuid)
+		if _, err := os.Stat(repositoryPath); os.IsNotExist(err) {
+			continue
+		}
+		renames = append(renames, [2]string{repositoryPath, git.LegacyRepositoryPath(row.Username, row.Uuid)})
+	}
+	return renameRepositories(renames)
+}
+
+// renameRepositories moves each repository from its first path to its second one. The renames happen outside of the
+// transaction of the migration, so if one fails the ones already done are moved back, leaving the repositories as they
+// were along with the database.
+func renameRepositories(renames [][2]string) error {
+	for i, rename := range renames {
+		err := os.MkdirAll(filepath.Dir(rename[1]), 0755)
+		if err == nil {
+			err = os.Rename(rename[0], rename[1])
+		}
+		if err == nil {
+			continue
+		}
+
+		for j := i - 1; j >= 0; j-- {
+			if errUndo := os.Rename(renames[j][1], renames[j][0]); errUndo != nil {
+				log.Error().Err(errUndo).Msgf("Cannot move back repository %s to %s", renames[j][1], renames[j][0])
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// The emails set before the verification existed are trusted, so enabling it does not restrict the existing accounts
+func v4_verifyExistingEmails(db *gorm.DB) error {
+	return db.Model(&User{}).Where("email != ?", "").Update("email_verified", true).Error
+}
+
+// Create the table of the files of the gists, then detect the languages of the files of the existing gists. A gist
+// whose repository cannot be read is left without files, they are set on its next commit.
+func v5_createGistFiles(db *gorm.DB) error {
+	if err := db.AutoMigrate(&GistFile{}); err != nil {
+		return err
+	}
+
+	var gists []*Gist
+	if err := db.Select("id", "uuid").Find(&gists).Error; err != nil {
+		return err
+	}
+
+	for _, gist := range gists {
+		files, err := gist.Files("HEAD", true)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Cannot read the files of gist %d to detect their languages", gist.ID)
+			continue
+		}
+		if err = setGistFiles(db, gist.ID, files); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func v5_dropGistFiles(db *gorm.DB) error {
+	return db.Migrator().DropTable(&GistFile{})
+}
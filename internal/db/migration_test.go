@@ -0,0 +1,133 @@
+package db
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thomiceli/opengist/internal/config"
+	"github.com/thomiceli/opengist/internal/git"
+	"gorm.io/gorm"
+)
+
+func openTestDatabase(t *testing.T) {
+	require.NoError(t, config.InitConfig("", io.Discard))
+	require.NoError(t, Open(filepath.Join(t.TempDir(), "opengist.db"), false))
+	t.Cleanup(func() {
+		_ = Close()
+	})
+}
+
+func TestMigrate(t *testing.T) {
+	openTestDatabase(t)
+	require.NoError(t, Migrate())
+
+	statuses, err := GetMigrationStatuses()
+	require.NoError(t, err)
+	require.Len(t, statuses, len(migrations))
+	for _, status := range statuses {
+		require.NotZero(t, status.AppliedAt, status.ID)
+	}
+
+	type testTable struct {
+		ID uint
+	}
+	defaultMigrations := migrations
+	migrations = append(migrations[:len(migrations):len(migrations)], &Migration{
+		ID: "9999_test_table",
+		Up: func(tx *gorm.DB) error {
+			return tx.Migrator().CreateTable(&testTable{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&testTable{})
+		},
+	})
+	t.Cleanup(func() {
+		migrations = defaultMigrations
+	})
+
+	require.NoError(t, Migrate())
+	require.True(t, db.Migrator().HasTable(&testTable{}))
+
+	reverted, err := RollbackMigrations("0005_gist_files")
+	require.NoError(t, err)
+	require.Equal(t, []string{"9999_test_table"}, reverted)
+	require.False(t, db.Migrator().HasTable(&testTable{}))
+
+	statuses, err = GetMigrationStatuses()
+	require.NoError(t, err)
+	require.Zero(t, statuses[len(statuses)-1].AppliedAt)
+
+	require.NoError(t, Migrate())
+	require.True(t, db.Migrator().HasTable(&testTable{}))
+
+	reverted, err = RollbackMigrations("0003_uuid_repository_paths")
+	require.ErrorIs(t, err, ErrIrreversibleMigration)
+	require.Equal(t, []string{"9999_test_table", "0005_gist_files"}, reverted)
+	require.False(t, db.Migrator().HasTable(&GistFile{}))
+
+	_, err = RollbackMigrations("0000_unknown")
+	require.ErrorIs(t, err, ErrUnknownMigration)
+}
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	openTestDatabase(t)
+
+	// a database of a release which only recorded the version of its migrations, before the email verification
+	require.NoError(t, db.AutoMigrate(&User{}, &MigrationVersion{}))
+	require.NoError(t, db.Migrator().DropColumn(&User{}, "email_verified"))
+	require.NoError(t, db.Create(&MigrationVersion{Version: 3}).Error)
+	require.NoError(t, db.Exec("INSERT INTO users (username, email) VALUES ('thomas', 'thomas@mail.com'), ('kaguya', '')").Error)
+
+	require.NoError(t, Migrate())
+	require.False(t, db.Migrator().HasTable(&MigrationVersion{}))
+
+	statuses, err := GetMigrationStatuses()
+	require.NoError(t, err)
+	for _, status := range statuses {
+		require.NotZero(t, status.AppliedAt, status.ID)
+	}
+
+	user, err := GetUserByUsername("thomas")
+	require.NoError(t, err)
+	require.True(t, user.EmailVerified)
+	user, err = GetUserByUsername("kaguya")
+	require.NoError(t, err)
+	require.False(t, user.EmailVerified)
+}
+
+func TestMoveRepositoriesToUuidPaths(t *testing.T) {
+	openTestDatabase(t)
+	require.NoError(t, Migrate())
+	config.C.OpengistHome = t.TempDir()
+
+	user := &User{Username: "Thomas"}
+	require.NoError(t, db.Create(user).Error)
+	for _, uuid := range []string{"gist1", "gist2"} {
+		require.NoError(t, db.Omit("forked_id").Create(&Gist{Uuid: uuid, UserID: user.ID}).Error)
+		require.NoError(t, os.MkdirAll(filepath.Join(git.LegacyRepositoryPath("thomas", uuid), "objects"), 0755))
+	}
+
+	// the second repository cannot be moved, the first one is moved back
+	require.NoError(t, os.MkdirAll(filepath.Join(git.RepositoryPath("gist2"), "objects"), 0755))
+	require.Error(t, v3_moveRepositoriesToUuidPaths(db))
+	require.DirExists(t, git.LegacyRepositoryPath("thomas", "gist1"))
+	require.NoDirExists(t, git.RepositoryPath("gist1"))
+
+	require.NoError(t, os.RemoveAll(git.RepositoryPath("gist2")))
+	require.NoError(t, v3_moveRepositoriesToUuidPaths(db))
+	for _, uuid := range []string{"gist1", "gist2"} {
+		require.DirExists(t, git.RepositoryPath(uuid))
+	}
+	require.NoDirExists(t, filepath.Dir(git.LegacyRepositoryPath("thomas", "gist1")))
+}
+
+func TestMigrateNewerDatabase(t *testing.T) {
+	openTestDatabase(t)
+	require.NoError(t, Migrate())
+
+	require.NoError(t, db.Create(&SchemaMigration{ID: "9999_future"}).Error)
+	require.ErrorIs(t, Migrate(), ErrUnknownMigration)
+}
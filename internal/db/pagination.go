@@ -0,0 +1,37 @@
+package db
+
+import "gorm.io/gorm"
+
+// Page selects a page of a listing, pages are numbered from 1 and hold Size items
+type Page struct {
+	Number int
+	Size   int
+}
+
+func (page Page) offset() int {
+	return (page.Number - 1) * page.Size
+}
+
+// paginate counts the rows matched by the statement, then loads the rows of the page sorted by order. The order is only
+// given to the second query, counting doesn't need it.
+func paginate[T any](statement *gorm.DB, page Page, order string) ([]*T, int64, error) {
+	statement = statement.Session(&gorm.Session{})
+
+	var total int64
+	if err := statement.Model(new(T)).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	items := make([]*T, 0, page.Size)
+	if total <= int64(page.offset()) {
+		return items, total, nil
+	}
+
+	err := statement.
+		Limit(page.Size).
+		Offset(page.offset()).
+		Order(order).
+		Find(&items).Error
+
+	return items, total, err
+}
@@ -0,0 +1,85 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var ErrPasswordResetTokenNotUsable = errors.New("password reset token is unknown, expired or already used")
+
+// PasswordResetToken lets a user who lost their password choose a new one, its plain value is only sent by email and
+// the SHA-256 hash of it is stored
+type PasswordResetToken struct {
+	ID        uint   `gorm:"primaryKey"`
+	Hash      string `gorm:"uniqueIndex;size:255"`
+	CreatedAt int64
+	ExpiresAt int64
+	UserID    uint
+	User      User `validate:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+}
+
+// CreatePasswordResetToken generates a token valid for the given duration and returns its plain value, the previous
+// tokens of the user stop working
+func CreatePasswordResetToken(user *User, validity time.Duration) (string, error) {
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+	plainToken := hex.EncodeToString(randomBytes)
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", user.ID).Delete(&PasswordResetToken{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&PasswordResetToken{
+			Hash:      hashToken(plainToken),
+			ExpiresAt: time.Now().Add(validity).Unix(),
+			UserID:    user.ID,
+		}).Error
+	})
+	if err != nil {
+		return "", err
+	}
+	return plainToken, nil
+}
+
+// GetPasswordResetTokenByPlainToken returns the unexpired token, with its user, matching the plain value of a link
+func GetPasswordResetTokenByPlainToken(plainToken string) (*PasswordResetToken, error) {
+	resetToken := new(PasswordResetToken)
+	err := db.Preload("User").
+		Where("hash = ? AND expires_at > ?", hashToken(plainToken), time.Now().Unix()).
+		First(&resetToken).Error
+
+	return resetToken, err
+}
+
+// Use sets the new password hash of the user and deletes the token. The app sessions of the user are revoked, as the
+// old password may have been used to open them. A token can only be used once, even by concurrent requests,
+// otherwise ErrPasswordResetTokenNotUsable is returned.
+func (resetToken *PasswordResetToken) Use(passwordHash string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("id = ? AND expires_at > ?", resetToken.ID, time.Now().Unix()).Delete(&PasswordResetToken{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrPasswordResetTokenNotUsable
+		}
+
+		if err := tx.Model(&User{}).Where("id = ?", resetToken.UserID).Update("password", passwordHash).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", resetToken.UserID).Delete(&RefreshToken{}).Error
+	})
+}
+
+// -- DTO -- //
+
+type PasswordResetDTO struct {
+	Token    string `form:"token" validate:"required"`
+	Password string `form:"password" validate:"required"`
+}
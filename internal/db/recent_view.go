@@ -0,0 +1,70 @@
+package db
+
+import (
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+// maxRecentViews is the number of recently viewed gists kept per user, older views are pruned
+const maxRecentViews = 20
+
+// RecentView records the last time a user opened a gist
+type RecentView struct {
+	UserID   uint `gorm:"primaryKey"`
+	User     User `validate:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+	GistID   uint `gorm:"primaryKey"`
+	Gist     Gist `validate:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+	ViewedAt int64
+}
+
+// RecordView upserts the view of the gist by the user, then prunes the views beyond the last maxRecentViews
+func RecordView(userId uint, gistId uint) error {
+	err := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "gist_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"viewed_at"}),
+	}).Create(&RecentView{
+		UserID:   userId,
+		GistID:   gistId,
+		ViewedAt: time.Now().UnixNano(),
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	// the latest view dropped from the list, MySQL does not allow a limit in the subquery of a delete
+	var newestDropped []int64
+	err = db.Model(&RecentView{}).
+		Where("user_id = ?", userId).
+		Order("viewed_at desc").
+		Offset(maxRecentViews).
+		Limit(1).
+		Pluck("viewed_at", &newestDropped).Error
+	if err != nil || len(newestDropped) == 0 {
+		return err
+	}
+
+	return db.
+		Where("user_id = ? AND viewed_at <= ?", userId, newestDropped[0]).
+		Delete(&RecentView{}).Error
+}
+
+// GetRecentlyViewed returns the gists recently viewed by the user, most recent first. Gists that became private
+// since then are left out unless the user owns them or collaborates on them.
+func GetRecentlyViewed(userId uint, limit int) ([]*Gist, error) {
+	if limit > maxRecentViews {
+		limit = maxRecentViews
+	}
+
+	var gists []*Gist
+	err := db.Preload("User").
+		Joins("JOIN recent_views ON recent_views.gist_id = gists.id").
+		Where("recent_views.user_id = ?", userId).
+		Where("gists.private != ? OR gists.user_id = ? OR gists.id IN (?)", PrivateVisibility, userId,
+			db.Model(&GistCollaborator{}).Select("gist_id").Where("user_id = ?", userId)).
+		Order("recent_views.viewed_at desc").
+		Limit(limit).
+		Find(&gists).Error
+
+	return gists, err
+}
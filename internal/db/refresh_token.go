@@ -0,0 +1,130 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+var ErrRefreshTokenNotUsable = errors.New("refresh token is unknown, expired or already used")
+
+// RefreshToken is the session of an app logged in through the API, it is renewed on each refresh. Only the
+// SHA-256 hash of its current value is stored, along with a label naming the device so the user can revoke it.
+type RefreshToken struct {
+	ID         uint `gorm:"primaryKey"`
+	Label      string
+	Hash       string `gorm:"uniqueIndex;size:255"`
+	CreatedAt  int64
+	LastUsedAt int64
+	ExpiresAt  int64
+	UserID     uint
+	User       User `validate:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+}
+
+func newRefreshTokenValue() (string, error) {
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+	return "ogr_" + hex.EncodeToString(randomBytes), nil
+}
+
+func GetRefreshTokensByUserID(userId uint) ([]*RefreshToken, error) {
+	var refreshTokens []*RefreshToken
+	err := db.
+		Where("user_id = ? AND expires_at > ?", userId, time.Now().Unix()).
+		Order("created_at asc").
+		Find(&refreshTokens).Error
+
+	return refreshTokens, err
+}
+
+// GetRefreshTokenByID returns the refresh token with its user, the token of a user that does not exist is not found
+func GetRefreshTokenByID(refreshTokenId uint) (*RefreshToken, error) {
+	refreshToken := new(RefreshToken)
+	err := db.Joins("User").
+		Where("refresh_tokens.id = ?", refreshTokenId).
+		First(&refreshToken).Error
+
+	return refreshToken, err
+}
+
+// GetRefreshTokenByPlainToken returns the unexpired refresh token, with its user, matching the plain value sent by
+// a client. The token of a user that does not exist is not found.
+func GetRefreshTokenByPlainToken(plainToken string) (*RefreshToken, error) {
+	refreshToken := new(RefreshToken)
+	err := db.Joins("User").
+		Where("refresh_tokens.hash = ? AND refresh_tokens.expires_at > ?", hashToken(plainToken), time.Now().Unix()).
+		First(&refreshToken).Error
+
+	return refreshToken, err
+}
+
+// Create generates a new refresh token valid for the given duration, stores its hash and returns the plain value
+func (refreshToken *RefreshToken) Create(validity time.Duration) (string, error) {
+	plainToken, err := newRefreshTokenValue()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	refreshToken.Hash = hashToken(plainToken)
+	refreshToken.LastUsedAt = now.Unix()
+	refreshToken.ExpiresAt = now.Add(validity).Unix()
+
+	if err = db.Create(&refreshToken).Error; err != nil {
+		return "", err
+	}
+	return plainToken, nil
+}
+
+// Rotate replaces the refresh token value with a new one valid for the given duration and returns it. The update
+// is conditioned on the old value, so a refresh token can only be used once even by concurrent requests, otherwise
+// ErrRefreshTokenNotUsable is returned.
+func (refreshToken *RefreshToken) Rotate(validity time.Duration) (string, error) {
+	plainToken, err := newRefreshTokenValue()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	res := db.Model(&RefreshToken{}).
+		Where("id = ? AND hash = ? AND expires_at > ?", refreshToken.ID, refreshToken.Hash, now.Unix()).
+		Updates(map[string]interface{}{
+			"hash":         hashToken(plainToken),
+			"last_used_at": now.Unix(),
+			"expires_at":   now.Add(validity).Unix(),
+		})
+	if res.Error != nil {
+		return "", res.Error
+	}
+	if res.RowsAffected == 0 {
+		return "", ErrRefreshTokenNotUsable
+	}
+
+	return plainToken, nil
+}
+
+func (refreshToken *RefreshToken) Delete() error {
+	return db.Delete(&refreshToken).Error
+}
+
+// IsActive reports whether the session can still be refreshed, access tokens issued for a revoked or expired
+// session are refused
+func (refreshToken *RefreshToken) IsActive() bool {
+	return refreshToken.ExpiresAt > time.Now().Unix()
+}
+
+// -- DTO -- //
+
+type ApiLoginDTO struct {
+	Username string `json:"username" form:"username" validate:"required"`
+	Password string `json:"password" form:"password" validate:"required"`
+	Passcode string `json:"passcode" form:"passcode"` // TOTP passcode, for the users who enabled it
+	Label    string `json:"label" form:"label" validate:"max=100"`
+}
+
+type RefreshTokenDTO struct {
+	RefreshToken string `json:"refresh_token" form:"refresh_token" validate:"required"`
+}
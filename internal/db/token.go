@@ -0,0 +1,130 @@
+package db
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	ScopeGistRead   = "gist:read"
+	ScopeGistWrite  = "gist:write"
+	ScopeGistDelete = "gist:delete"
+	ScopeAdmin      = "admin"
+)
+
+var AllScopes = []string{ScopeGistRead, ScopeGistWrite, ScopeGistDelete, ScopeAdmin}
+
+// TokenExpirations are the validity periods in days a token can be created with, 0 never expires
+var TokenExpirations = []int{7, 30, 90, 365, 0}
+
+// Token is a personal access token, only its SHA-256 hash is stored
+type Token struct {
+	ID         uint `gorm:"primaryKey"`
+	Name       string
+	Hash       string `gorm:"uniqueIndex;size:255"`
+	Scopes     string // comma separated list of scopes
+	CreatedAt  int64
+	LastUsedAt int64
+	ExpiresAt  int64 // 0 if the token never expires
+	UserID     uint
+	User       User `validate:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+}
+
+func hashToken(plainToken string) string {
+	sum := sha256.Sum256([]byte(plainToken))
+	return hex.EncodeToString(sum[:])
+}
+
+func GetTokensByUserID(userId uint) ([]*Token, error) {
+	var tokens []*Token
+	err := db.
+		Where("user_id = ?", userId).
+		Order("created_at asc").
+		Find(&tokens).Error
+
+	return tokens, err
+}
+
+func GetTokenByID(tokenId uint) (*Token, error) {
+	token := new(Token)
+	err := db.
+		Where("id = ?", tokenId).
+		First(&token).Error
+
+	return token, err
+}
+
+// GetTokenByPlainToken returns the token, with its user, matching the plain value sent by a client
+func GetTokenByPlainToken(plainToken string) (*Token, error) {
+	token := new(Token)
+	err := db.Preload("User").
+		Where("hash = ?", hashToken(plainToken)).
+		First(&token).Error
+
+	return token, err
+}
+
+// Create generates a new random token value, stores its hash and returns the plain value,
+// which cannot be retrieved afterward
+func (token *Token) Create() (string, error) {
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+
+	plainToken := "og_" + hex.EncodeToString(randomBytes)
+	token.Hash = hashToken(plainToken)
+
+	if err := db.Create(&token).Error; err != nil {
+		return "", err
+	}
+	return plainToken, nil
+}
+
+func (token *Token) Delete() error {
+	return db.Delete(&token).Error
+}
+
+func (token *Token) SetLastUsedNow() error {
+	return db.Model(&Token{}).
+		Where("id = ?", token.ID).
+		Update("last_used_at", time.Now().Unix()).Error
+}
+
+func (token *Token) IsExpired() bool {
+	return token.ExpiresAt != 0 && token.ExpiresAt <= time.Now().Unix()
+}
+
+func (token *Token) ScopesList() []string {
+	if token.Scopes == "" {
+		return nil
+	}
+	return strings.Split(token.Scopes, ",")
+}
+
+func (token *Token) HasScope(scope string) bool {
+	return slices.Contains(token.ScopesList(), scope)
+}
+
+// -- DTO -- //
+
+type TokenDTO struct {
+	Name       string   `form:"name" validate:"required,max=50"`
+	Scopes     []string `form:"scopes" validate:"required,dive,oneof=gist:read gist:write gist:delete admin"`
+	Expiration int      `form:"expiration" validate:"oneof=0 7 30 90 365"` // in days
+}
+
+func (dto *TokenDTO) ToToken() *Token {
+	token := &Token{
+		Name:   dto.Name,
+		Scopes: strings.Join(dto.Scopes, ","),
+	}
+	if dto.Expiration != 0 {
+		token.ExpiresAt = time.Now().AddDate(0, 0, dto.Expiration).Unix()
+	}
+	return token
+}
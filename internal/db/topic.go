@@ -0,0 +1,73 @@
+package db
+
+import (
+	"strings"
+	"time"
+
+	"github.com/thomiceli/opengist/internal/metrics"
+	"gorm.io/gorm"
+)
+
+// Topic tags gists to organize them, its name is lowercase so a topic is not spelled several ways
+type Topic struct {
+	ID   uint   `gorm:"primaryKey"`
+	Name string `gorm:"uniqueIndex;size:255"`
+}
+
+// TopicNames returns the names of the topics of the gist, which must have been preloaded
+func (gist *Gist) TopicNames() []string {
+	names := make([]string, 0, len(gist.Topics))
+	for _, topic := range gist.Topics {
+		names = append(names, topic.Name)
+	}
+	return names
+}
+
+// TopicList returns the names of the topics of the gist separated by commas, as they are typed in the forms
+func (gist *Gist) TopicList() string {
+	return strings.Join(gist.TopicNames(), ",")
+}
+
+// SetTopics replaces the topics of the gist, the topics that do not exist yet are created
+func (gist *Gist) SetTopics(names []string) error {
+	topics := make([]Topic, 0, len(names))
+	for _, name := range names {
+		topic := Topic{Name: name}
+		if err := db.Where(Topic{Name: name}).FirstOrCreate(&topic).Error; err != nil {
+			return err
+		}
+		topics = append(topics, topic)
+	}
+
+	if err := db.Model(&gist).Omit("updated_at").Association("Topics").Replace(topics); err != nil {
+		return err
+	}
+	gist.Topics = topics
+	return nil
+}
+
+func orderTopics(tx *gorm.DB) *gorm.DB {
+	return tx.Order("topics.name")
+}
+
+// withTopic keeps the gists tagged with the topic in the statement, all of them if the topic is empty
+func withTopic(statement *gorm.DB, topic string) *gorm.DB {
+	if topic == "" {
+		return statement
+	}
+
+	return statement.Where("gists.id IN (?)", db.Table("gist_topics").
+		Select("gist_topics.gist_id").
+		Joins("join topics on topics.id = gist_topics.topic_id").
+		Where("topics.name = ?", topic))
+}
+
+func topicStatement(topic string) *gorm.DB {
+	return withTopic(db.Preload("User").Preload("Forked.User").Where("gists.private = 0"), topic)
+}
+
+// GetAllGistsWithTopic returns a page of the public gists tagged with the topic and their total count
+func GetAllGistsWithTopic(topic string, page Page, sort string, order string) ([]*Gist, int64, error) {
+	defer metrics.ListingQueryDuration.ObserveSince(time.Now(), "topic")
+	return paginate[Gist](topicStatement(topic), page, "gists."+sort+"_at "+order)
+}
@@ -0,0 +1,87 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"slices"
+	"strings"
+
+	"github.com/pquerna/otp/totp"
+)
+
+// recoveryCodesCount is the number of recovery codes given when the second factor is enabled
+const recoveryCodesCount = 8
+
+// TOTP is the time-based one-time password second factor of a user. The recovery codes let the user in when the
+// authenticator app is lost, only their SHA-256 hashes are stored and each of them can be used once.
+type TOTP struct {
+	ID            uint `gorm:"primaryKey"`
+	UserID        uint `gorm:"uniqueIndex"`
+	User          User `validate:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+	Secret        string
+	RecoveryCodes string // comma separated hashes of the unused recovery codes
+	CreatedAt     int64
+}
+
+func GetTOTPByUserID(userId uint) (*TOTP, error) {
+	t := new(TOTP)
+	err := db.
+		Where("user_id = ?", userId).
+		First(&t).Error
+
+	return t, err
+}
+
+// UserHasTOTP reports whether the user has to give a passcode on top of their password
+func UserHasTOTP(userId uint) (bool, error) {
+	var count int64
+	err := db.Model(&TOTP{}).
+		Where("user_id = ?", userId).
+		Count(&count).Error
+
+	return count > 0, err
+}
+
+// Create stores the second factor with new recovery codes and returns the plain codes, which cannot be retrieved
+// afterward
+func (t *TOTP) Create() ([]string, error) {
+	codes := make([]string, recoveryCodesCount)
+	hashes := make([]string, recoveryCodesCount)
+	for i := range codes {
+		randomBytes := make([]byte, 5)
+		if _, err := rand.Read(randomBytes); err != nil {
+			return nil, err
+		}
+		code := hex.EncodeToString(randomBytes)
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashToken(codes[i])
+	}
+	t.RecoveryCodes = strings.Join(hashes, ",")
+
+	if err := db.Create(&t).Error; err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func (t *TOTP) Delete() error {
+	return db.Delete(&t).Error
+}
+
+// Verify reports whether the passcode is the current code of the authenticator app, or one of the unused recovery
+// codes. A recovery code cannot be used again once it has been verified.
+func (t *TOTP) Verify(passcode string) (bool, error) {
+	passcode = strings.TrimSpace(passcode)
+	if totp.Validate(passcode, t.Secret) {
+		return true, nil
+	}
+
+	hashes := strings.Split(t.RecoveryCodes, ",")
+	i := slices.Index(hashes, hashToken(strings.ToLower(passcode)))
+	if passcode == "" || i < 0 {
+		return false, nil
+	}
+
+	t.RecoveryCodes = strings.Join(slices.Delete(hashes, i, i+1), ",")
+	return true, db.Model(&t).Update("recovery_codes", t.RecoveryCodes).Error
+}
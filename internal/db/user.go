@@ -1,14 +1,26 @@
 package db
 
 import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/thomiceli/opengist/internal/config"
+	"github.com/thomiceli/opengist/internal/utils"
 	"gorm.io/gorm"
 )
 
+var (
+	ErrUsernameExists   = errors.New("username already exists")
+	ErrUsernameReserved = errors.New("username is reserved")
+)
+
 type User struct {
 	ID        uint   `gorm:"primaryKey"`
-	Username  string `gorm:"uniqueIndex"`
+	Username  string `gorm:"uniqueIndex;size:255"`
 	Password  string
 	IsAdmin   bool
+	Suspended bool // suspended users cannot log in, nor use their access tokens and SSH keys
 	CreatedAt int64
 	Email     string
 	MD5Hash   string // for gravatar, if no Email is specified, the value is random
@@ -17,6 +29,14 @@ type User struct {
 	GitlabID  string
 	GiteaID   string
 	OIDCID    string `gorm:"column:oidc_id"`
+	LdapDN    string // DN of the directory entry of the user, set when the account comes from LDAP
+	Locale    string // language picked by the user, empty to follow the browser
+
+	EmailVerified bool // the user opened the verification link sent to Email, or got it from a trusted provider
+
+	DefaultVisibility string // visibility of the new gists picked by the user, empty to follow the instance default
+
+	InvitationID uint // invitation used to sign up, 0 if none
 
 	Gists   []Gist   `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;foreignKey:UserID"`
 	SSHKeys []SSHKey `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;foreignKey:UserID"`
@@ -39,50 +59,132 @@ func (user *User) BeforeDelete(tx *gorm.DB) error {
 		return err
 	}
 
-	// Decrement forks counter for all gists forked by this user
-	err = tx.Model(&Gist{}).
-		Omit("updated_at").
-		Where("id IN (?)", tx.
-			Select("forked_id").
-			Table("gists").
-			Where("user_id = ?", user.ID),
-		).
-		UpdateColumn("nb_forks", gorm.Expr("nb_forks - 1")).
-		Error
+	// Decrement forks counter for all gists forked by this user, the ids are fetched first because MySQL cannot
+	// update a table selected in the subquery
+	var forkedIds []uint
+	err = tx.Table("gists").
+		Where("user_id = ? AND deleted_at IS NULL AND forked_id IS NOT NULL", user.ID).
+		Pluck("forked_id", &forkedIds).Error
 	if err != nil {
 		return err
 	}
+	if len(forkedIds) > 0 {
+		err = tx.Model(&Gist{}).
+			Omit("updated_at").
+			Where("id IN ?", forkedIds).
+			UpdateColumn("nb_forks", gorm.Expr("nb_forks - 1")).
+			Error
+		if err != nil {
+			return err
+		}
+	}
+
+	// the gists of the user, whether they are in the trash or not, the rows bound to them are deleted along
+	userGists := tx.Unscoped().Model(&Gist{}).Select("id").Where("user_id = ?", user.ID)
 
 	err = tx.Where("user_id = ?", user.ID).Delete(&SSHKey{}).Error
 	if err != nil {
 		return err
 	}
 
-	// Delete all gists created by this user
-	return tx.Where("user_id = ?", user.ID).Delete(&Gist{}).Error
+	err = tx.Where("user_id = ?", user.ID).Delete(&Token{}).Error
+	if err != nil {
+		return err
+	}
+
+	// the sessions of the apps must not be refreshed once the user is gone
+	err = tx.Where("user_id = ?", user.ID).Delete(&RefreshToken{}).Error
+	if err != nil {
+		return err
+	}
+
+	err = tx.Where("user_id = ?", user.ID).Delete(&PasswordResetToken{}).Error
+	if err != nil {
+		return err
+	}
+
+	err = tx.Where("webhook_id IN (?)", tx.Model(&Webhook{}).Select("id").Where("user_id = ?", user.ID)).
+		Delete(&WebhookDelivery{}).Error
+	if err != nil {
+		return err
+	}
+
+	err = tx.Where("user_id = ?", user.ID).Delete(&Webhook{}).Error
+	if err != nil {
+		return err
+	}
+
+	// the collaborations of the user, and the collaborators of the gists of the user
+	err = tx.Where("user_id = ? OR gist_id IN (?)", user.ID, userGists).Delete(&GistCollaborator{}).Error
+	if err != nil {
+		return err
+	}
+
+	// the watches of the user, and the ones of the gists of the user
+	err = tx.Where("user_id = ? OR gist_id IN (?)", user.ID, userGists).Delete(&Watch{}).Error
+	if err != nil {
+		return err
+	}
+
+	// the comments of the user, and the ones under the gists of the user
+	err = tx.Where("user_id = ? OR gist_id IN (?)", user.ID, userGists).Delete(&Comment{}).Error
+	if err != nil {
+		return err
+	}
+
+	err = tx.Where("gist_id IN (?)", userGists).Delete(&GistFile{}).Error
+	if err != nil {
+		return err
+	}
+
+	// the views of the user, and the ones of the gists of the user
+	err = tx.Where("user_id = ? OR gist_id IN (?)", user.ID, userGists).Delete(&RecentView{}).Error
+	if err != nil {
+		return err
+	}
+
+	err = tx.Table("gist_topics").Where("gist_id IN (?)", userGists).Delete(nil).Error
+	if err != nil {
+		return err
+	}
+
+	err = tx.Where("user_id = ?", user.ID).Delete(&TOTP{}).Error
+	if err != nil {
+		return err
+	}
+
+	// the passkeys hold the ID of the user, they must not log in a new user given the same ID
+	err = tx.Where("user_id = ?", user.ID).Delete(&WebAuthnCredential{}).Error
+	if err != nil {
+		return err
+	}
+
+	// Delete all gists created by this user, for good since nobody can restore them anymore
+	return tx.Unscoped().Where("user_id = ?", user.ID).Delete(&Gist{}).Error
 }
 
 func UserExists(username string) (bool, error) {
 	var count int64
-	err := db.Model(&User{}).Where("username like ?", username).Count(&count).Error
+	err := db.Model(&User{}).Where("lower(username) = lower(?)", username).Count(&count).Error
 	return count > 0, err
 }
 
-func GetAllUsers(offset int) ([]*User, error) {
-	var users []*User
-	err := db.
-		Limit(11).
-		Offset(offset * 10).
-		Order("id asc").
-		Find(&users).Error
-
-	return users, err
+// GetAllUsers returns a page of the users whose username or email matches the query, all of them if it is empty, and
+// their total count
+func GetAllUsers(page Page, query string) ([]*User, int64, error) {
+	statement := db
+	if query != "" {
+		pattern := "%" + escapeLike(query) + "%"
+		statement = statement.Where("(lower(username) like lower(?) escape ? or lower(email) like lower(?) escape ?)",
+			pattern, likeEscape, pattern, likeEscape)
+	}
+	return paginate[User](statement, page, "id asc")
 }
 
 func GetUserByUsername(username string) (*User, error) {
 	user := new(User)
 	err := db.
-		Where("username like ?", username).
+		Where("lower(username) = lower(?)", username).
 		First(&user).Error
 	return user, err
 }
@@ -95,6 +197,15 @@ func GetUserById(userId uint) (*User, error) {
 	return user, err
 }
 
+// GetUserByVerifiedEmail returns the user who verified the email, the emails are stored in lowercase
+func GetUserByVerifiedEmail(email string) (*User, error) {
+	user := new(User)
+	err := db.
+		Where("email = ? AND email_verified = ?", strings.ToLower(strings.TrimSpace(email)), true).
+		First(&user).Error
+	return user, err
+}
+
 func GetUsersFromEmails(emailsSet map[string]struct{}) (map[string]*User, error) {
 	var users []*User
 
@@ -149,6 +260,8 @@ func GetUserByProvider(id string, provider string) (*User, error) {
 		err = db.Where("gitea_id = ?", id).First(&user).Error
 	case "openid-connect":
 		err = db.Where("oidc_id = ?", id).First(&user).Error
+	case "ldap":
+		err = db.Where("ldap_dn = ?", id).First(&user).Error
 	}
 
 	return user, err
@@ -166,10 +279,101 @@ func (user *User) Delete() error {
 	return db.Delete(&user).Error
 }
 
+// DeleteWithGists deletes the gists of the user one by one, along with their repositories, then the user itself.
+// A failing gist does not prevent the others from being deleted, but the user is kept so the deletion can be retried.
+func (user *User) DeleteWithGists() error {
+	var gists []*Gist
+	if err := db.Unscoped().Where("user_id = ?", user.ID).Find(&gists).Error; err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, gist := range gists {
+		if err := gist.Purge(); err != nil {
+			errs = append(errs, fmt.Errorf("cannot delete gist %d: %w", gist.ID, err))
+			continue
+		}
+		gist.RemoveFromIndex()
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	return user.Delete()
+}
+
 func (user *User) SetAdmin() error {
 	return db.Model(&user).Update("is_admin", true).Error
 }
 
+func (user *User) RevokeAdmin() error {
+	user.IsAdmin = false
+	return db.Model(&user).Update("is_admin", false).Error
+}
+
+// SetSuspended suspends the user, or lifts the suspension. The sessions of a suspended user are closed on their next
+// request.
+func (user *User) SetSuspended(suspended bool) error {
+	user.Suspended = suspended
+	return db.Model(&user).Update("suspended", suspended).Error
+}
+
+// VerifyEmail marks the email of the user as verified, unless it changed since the verification link was sent
+func (user *User) VerifyEmail(email string) (bool, error) {
+	if email == "" || email != user.Email {
+		return false, nil
+	}
+
+	user.EmailVerified = true
+	return true, db.Model(&user).Update("email_verified", true).Error
+}
+
+// CanPublish reports whether the user can make their gists public, the accounts without a verified email cannot when
+// email.restrict-public is set
+func (user *User) CanPublish() bool {
+	return user.EmailVerified || !config.C.EmailVerification || !config.C.EmailRestrictPublic
+}
+
+// AllowedVisibility returns the visibility, made unlisted if it is public and the user cannot publish
+func (user *User) AllowedVisibility(visibility Visibility) Visibility {
+	if visibility == PublicVisibility && !user.CanPublish() {
+		return UnlistedVisibility
+	}
+	return visibility
+}
+
+func (user *User) SetLocale(locale string) error {
+	user.Locale = locale
+	return db.Model(&user).Update("locale", locale).Error
+}
+
+// SetDefaultVisibility saves the visibility of the new gists of the user, an empty one follows the instance default
+func (user *User) SetDefaultVisibility(visibility string) error {
+	if visibility != "" {
+		v, err := ParseVisibility(visibility)
+		if err != nil {
+			return err
+		}
+		visibility = v.String()
+	}
+
+	user.DefaultVisibility = visibility
+	return db.Model(&user).Update("default_visibility", visibility).Error
+}
+
+// NewGistVisibility returns the visibility given to the new gists of the user, the one picked in their settings or
+// else the gist.default-visibility setting
+func (user *User) NewGistVisibility() Visibility {
+	if visibility, err := ParseVisibility(user.DefaultVisibility); err == nil {
+		return user.AllowedVisibility(visibility)
+	}
+	if visibility, err := ParseVisibility(config.C.GistDefaultVisibility); err == nil {
+		return user.AllowedVisibility(visibility)
+	}
+	return user.AllowedVisibility(PublicVisibility)
+}
+
 func (user *User) HasLiked(gist *Gist) (bool, error) {
 	association := db.Model(&gist).Where("user_id = ?", user.ID).Association("Likes")
 	if association.Error != nil {
@@ -182,6 +386,64 @@ func (user *User) HasLiked(gist *Gist) (bool, error) {
 	return true, nil
 }
 
+// GetLikedGistIDs returns the set of gists, among gistIds, liked by the user, using a single query
+func GetLikedGistIDs(userId uint, gistIds []uint) (map[uint]bool, error) {
+	liked := make(map[uint]bool)
+	if len(gistIds) == 0 {
+		return liked, nil
+	}
+
+	var ids []uint
+	err := db.Model(&Like{}).
+		Where("user_id = ? AND gist_id IN ?", userId, gistIds).
+		Pluck("gist_id", &ids).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		liked[id] = true
+	}
+	return liked, nil
+}
+
+// IsReservedUsername reports whether the username is used by a route or listed in the reserved-usernames setting,
+// a user named so would be shadowed or impersonate the instance
+func IsReservedUsername(username string) bool {
+	return utils.IsReservedKeyword(username) || config.C.UsernameReserved(username)
+}
+
+// Rename validates and changes the username of the user. Gist repositories are stored by UUID,
+// so there is nothing to move on the filesystem.
+func (user *User) Rename(newName string) error {
+	if err := utils.NewValidator().Var(newName, "required,max=24,alphanumdash"); err != nil {
+		return err
+	}
+	if IsReservedUsername(newName) {
+		return ErrUsernameReserved
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		err := tx.Model(&User{}).
+			Where("lower(username) = lower(?) AND id <> ?", newName, user.ID).
+			Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrUsernameExists
+		}
+
+		if err = tx.Model(user).Update("username", newName).Error; err != nil {
+			return err
+		}
+
+		user.Username = newName
+		return nil
+	})
+}
+
 func (user *User) DeleteProviderID(provider string) error {
 	providerIDFields := map[string]string{
 		"github":         "github_id",
@@ -205,11 +467,13 @@ func (user *User) DeleteProviderID(provider string) error {
 type UserDTO struct {
 	Username string `form:"username" validate:"required,max=24,alphanumdash,notreserved"`
 	Password string `form:"password" validate:"required"`
+	Email    string `form:"email" validate:"omitempty,email,max=254"`
 }
 
 func (dto *UserDTO) ToUser() *User {
 	return &User{
 		Username: dto.Username,
 		Password: dto.Password,
+		Email:    strings.ToLower(strings.TrimSpace(dto.Email)),
 	}
 }
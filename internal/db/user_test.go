@@ -0,0 +1,40 @@
+package db
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thomiceli/opengist/internal/config"
+)
+
+func TestGetLikedGistIDs(t *testing.T) {
+	require.NoError(t, config.InitConfig("", io.Discard))
+	require.NoError(t, Setup("file::memory:", true))
+	defer Close()
+
+	user := &User{Username: "thomas"}
+	require.NoError(t, db.Create(user).Error)
+	other := &User{Username: "kaguya"}
+	require.NoError(t, db.Create(other).Error)
+
+	var gists []*Gist
+	for _, title := range []string{"gist1", "gist2", "gist3"} {
+		gist := &Gist{Uuid: title, Title: title, UserID: user.ID, Private: PublicVisibility}
+		require.NoError(t, db.Omit("forked_id").Create(gist).Error)
+		gists = append(gists, gist)
+	}
+	require.NoError(t, gists[0].AppendUserLike(user))
+	require.NoError(t, gists[2].AppendUserLike(user))
+	require.NoError(t, gists[1].AppendUserLike(other))
+
+	liked, err := GetLikedGistIDs(user.ID, nil)
+	require.NoError(t, err)
+	require.Empty(t, liked)
+
+	// only the gists asked for are looked up, the likes of other users do not count
+	liked, err = GetLikedGistIDs(user.ID, []uint{gists[0].ID, gists[1].ID})
+	require.NoError(t, err)
+	require.Equal(t, map[uint]bool{gists[0].ID: true}, liked)
+	require.False(t, liked[gists[1].ID])
+}
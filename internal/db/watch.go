@@ -0,0 +1,54 @@
+package db
+
+import (
+	"time"
+)
+
+// Watch subscribes a user to the changes of a gist, whoever owns it
+type Watch struct {
+	UserID    uint `gorm:"primaryKey"`
+	User      User `validate:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+	GistID    uint `gorm:"primaryKey"`
+	Gist      Gist `validate:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+	CreatedAt int64
+}
+
+func (gist *Gist) GetWatchers() ([]*User, error) {
+	var users []*User
+	err := db.
+		Joins("JOIN watches ON watches.user_id = users.id").
+		Where("watches.gist_id = ?", gist.ID).
+		Order("watches.created_at asc").
+		Find(&users).Error
+
+	return users, err
+}
+
+func (gist *Gist) CountWatchers() (int64, error) {
+	var count int64
+	err := db.Model(&Watch{}).
+		Where("gist_id = ?", gist.ID).
+		Count(&count).Error
+	return count, err
+}
+
+func (gist *Gist) IsWatchedBy(userId uint) (bool, error) {
+	var count int64
+	err := db.Model(&Watch{}).
+		Where("gist_id = ? AND user_id = ?", gist.ID, userId).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// WatchGist subscribes the user to the gist, watching a gist twice is a no-op
+func (gist *Gist) WatchGist(user *User) error {
+	return db.Where(Watch{UserID: user.ID, GistID: gist.ID}).
+		Attrs(Watch{CreatedAt: time.Now().Unix()}).
+		FirstOrCreate(&Watch{}).Error
+}
+
+func (gist *Gist) UnwatchGist(user *User) error {
+	return db.
+		Where("gist_id = ? AND user_id = ?", gist.ID, user.ID).
+		Delete(&Watch{}).Error
+}
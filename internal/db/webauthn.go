@@ -0,0 +1,191 @@
+package db
+
+import (
+	"encoding/binary"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"gorm.io/gorm"
+)
+
+// WebAuthnCredential is a passkey or a hardware security key of a user. It logs the user in on its own, or acts as the
+// second factor of a password login.
+type WebAuthnCredential struct {
+	ID              uint `gorm:"primaryKey"`
+	Name            string
+	UserID          uint
+	User            User   `validate:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+	CredentialID    []byte `gorm:"uniqueIndex;size:1023"`
+	PublicKey       []byte
+	AttestationType string
+	Transports      string // comma separated
+	AAGUID          []byte
+	SignCount       uint32
+	CloneWarning    bool
+	BackupEligible  bool
+	BackupState     bool
+	CreatedAt       int64
+	LastUsedAt      int64
+}
+
+func GetWebAuthnCredentialsByUserID(userId uint) ([]*WebAuthnCredential, error) {
+	var credentials []*WebAuthnCredential
+	err := db.
+		Where("user_id = ?", userId).
+		Order("created_at asc").
+		Find(&credentials).Error
+
+	return credentials, err
+}
+
+func GetWebAuthnCredentialByID(credentialId uint) (*WebAuthnCredential, error) {
+	credential := new(WebAuthnCredential)
+	err := db.
+		Where("id = ?", credentialId).
+		First(&credential).Error
+
+	return credential, err
+}
+
+// UserHasWebAuthn reports whether the user registered at least one passkey
+func UserHasWebAuthn(userId uint) (bool, error) {
+	var count int64
+	err := db.Model(&WebAuthnCredential{}).
+		Where("user_id = ?", userId).
+		Count(&count).Error
+
+	return count > 0, err
+}
+
+// NewWebAuthnCredential converts the credential created by a registration ceremony into the model to store
+func NewWebAuthnCredential(name string, userId uint, credential *webauthn.Credential) *WebAuthnCredential {
+	transports := make([]string, len(credential.Transport))
+	for i, transport := range credential.Transport {
+		transports[i] = string(transport)
+	}
+
+	return &WebAuthnCredential{
+		Name:            name,
+		UserID:          userId,
+		CredentialID:    credential.ID,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		Transports:      strings.Join(transports, ","),
+		AAGUID:          credential.Authenticator.AAGUID,
+		SignCount:       credential.Authenticator.SignCount,
+		BackupEligible:  credential.Flags.BackupEligible,
+		BackupState:     credential.Flags.BackupState,
+	}
+}
+
+func (c *WebAuthnCredential) Create() error {
+	return db.Create(&c).Error
+}
+
+func (c *WebAuthnCredential) Delete() error {
+	return db.Delete(&c).Error
+}
+
+// UpdateAfterLogin saves the counter and the flags returned by the authenticator in a login ceremony
+func (c *WebAuthnCredential) UpdateAfterLogin(credential *webauthn.Credential) error {
+	return db.Model(&c).Updates(map[string]interface{}{
+		"sign_count":    credential.Authenticator.SignCount,
+		"clone_warning": credential.Authenticator.CloneWarning,
+		"backup_state":  credential.Flags.BackupState,
+		"last_used_at":  time.Now().Unix(),
+	}).Error
+}
+
+func (c *WebAuthnCredential) toCredential() webauthn.Credential {
+	var transports []protocol.AuthenticatorTransport
+	if c.Transports != "" {
+		for _, transport := range strings.Split(c.Transports, ",") {
+			transports = append(transports, protocol.AuthenticatorTransport(transport))
+		}
+	}
+
+	return webauthn.Credential{
+		ID:              c.CredentialID,
+		PublicKey:       c.PublicKey,
+		AttestationType: c.AttestationType,
+		Transport:       transports,
+		Flags: webauthn.CredentialFlags{
+			BackupEligible: c.BackupEligible,
+			BackupState:    c.BackupState,
+		},
+		Authenticator: webauthn.Authenticator{
+			AAGUID:       c.AAGUID,
+			SignCount:    c.SignCount,
+			CloneWarning: c.CloneWarning,
+		},
+	}
+}
+
+// WebAuthnUser is a user along with their passkeys, as seen by the WebAuthn ceremonies
+type WebAuthnUser struct {
+	User        *User
+	Credentials []*WebAuthnCredential
+}
+
+func GetWebAuthnUser(user *User) (*WebAuthnUser, error) {
+	credentials, err := GetWebAuthnCredentialsByUserID(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &WebAuthnUser{User: user, Credentials: credentials}, nil
+}
+
+// GetWebAuthnUserByHandle returns the user of a user handle given by an authenticator in a passwordless login
+func GetWebAuthnUserByHandle(handle []byte) (*WebAuthnUser, error) {
+	if len(handle) != 8 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	user, err := GetUserById(uint(binary.BigEndian.Uint64(handle)))
+	if err != nil {
+		return nil, err
+	}
+	return GetWebAuthnUser(user)
+}
+
+// Credential returns the passkey of the user with the given credential ID, or nil if there is none
+func (u *WebAuthnUser) Credential(credentialId []byte) *WebAuthnCredential {
+	for _, credential := range u.Credentials {
+		if string(credential.CredentialID) == string(credentialId) {
+			return credential
+		}
+	}
+	return nil
+}
+
+// WebAuthnID is the user handle stored by the authenticators, it is the ID of the user as 8 bytes
+func (u *WebAuthnUser) WebAuthnID() []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(u.User.ID))
+}
+
+func (u *WebAuthnUser) WebAuthnName() string {
+	return u.User.Username
+}
+
+func (u *WebAuthnUser) WebAuthnDisplayName() string {
+	return u.User.Username
+}
+
+func (u *WebAuthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (u *WebAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, len(u.Credentials))
+	for i, credential := range u.Credentials {
+		credentials[i] = credential.toCredential()
+	}
+	return credentials
+}
+
+// -- DTO -- //
+
+type WebAuthnCredentialDTO struct {
+	Name string `form:"name" validate:"required,max=50"`
+}
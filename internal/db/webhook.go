@@ -0,0 +1,188 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"slices"
+	"strings"
+	"time"
+)
+
+// webhookDeliveriesKept is the number of deliveries kept in the log of each webhook, the oldest are deleted
+const webhookDeliveriesKept = 50
+
+// Webhook sends the events of the gists of a user to a URL. A webhook without user is an instance webhook, set by an
+// admin, it gets the events of all the public gists.
+type Webhook struct {
+	ID        uint `gorm:"primaryKey"`
+	URL       string
+	Secret    string // key of the HMAC-SHA256 signature of the payloads
+	Events    string // comma separated names of the events sent
+	UserID    uint
+	User      User `validate:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+	CreatedAt int64
+}
+
+// WebhookDelivery is an event sent, or to send, to a webhook. A failed delivery is attempted again until it has no
+// attempt planned anymore.
+type WebhookDelivery struct {
+	ID            uint    `gorm:"primaryKey"`
+	WebhookID     uint    `gorm:"index"`
+	Webhook       Webhook `validate:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+	Event         string
+	Payload       string
+	Attempts      int
+	NextAttemptAt int64  `gorm:"index"` // 0 once delivered or given up
+	StatusCode    int    // of the last attempt, 0 if there was no response
+	Error         string // of the last attempt
+	Delivered     bool
+	CreatedAt     int64
+	UpdatedAt     int64
+}
+
+func GetWebhooksByUserID(userId uint) ([]*Webhook, error) {
+	var webhooks []*Webhook
+	err := db.
+		Where("user_id = ?", userId).
+		Order("id asc").
+		Find(&webhooks).Error
+
+	return webhooks, err
+}
+
+func GetInstanceWebhooks() ([]*Webhook, error) {
+	var webhooks []*Webhook
+	err := db.
+		Where("user_id IS NULL").
+		Order("id asc").
+		Find(&webhooks).Error
+
+	return webhooks, err
+}
+
+func GetWebhookByID(webhookId uint) (*Webhook, error) {
+	webhook := new(Webhook)
+	err := db.
+		Where("id = ?", webhookId).
+		First(&webhook).Error
+
+	return webhook, err
+}
+
+// GetWebhooksForEvent returns the webhooks of the user sending the event, along with the instance ones if asked
+func GetWebhooksForEvent(event string, userId uint, withInstance bool) ([]*Webhook, error) {
+	var webhooks []*Webhook
+	statement := db.Where("user_id = ?", userId)
+	if withInstance {
+		statement = statement.Or("user_id IS NULL")
+	}
+	if err := statement.Order("id asc").Find(&webhooks).Error; err != nil {
+		return nil, err
+	}
+
+	return slices.DeleteFunc(webhooks, func(webhook *Webhook) bool {
+		return !webhook.HasEvent(event)
+	}), nil
+}
+
+// Create saves the webhook with a new random secret, an instance webhook is saved without user
+func (webhook *Webhook) Create() error {
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return err
+	}
+	webhook.Secret = hex.EncodeToString(randomBytes)
+
+	// avoids foreign key constraint error because the default value in the struct is 0
+	if webhook.UserID == 0 {
+		return db.Omit("user_id").Create(&webhook).Error
+	}
+	return db.Create(&webhook).Error
+}
+
+func (webhook *Webhook) Delete() error {
+	return db.Delete(&webhook).Error
+}
+
+func (webhook *Webhook) IsInstance() bool {
+	return webhook.UserID == 0
+}
+
+func (webhook *Webhook) EventList() []string {
+	return strings.Split(webhook.Events, ",")
+}
+
+func (webhook *Webhook) HasEvent(event string) bool {
+	return slices.Contains(webhook.EventList(), event)
+}
+
+// QueueDelivery saves the payload of the event to be sent as soon as possible, the log of the webhook is trimmed to
+// its latest deliveries
+func (webhook *Webhook) QueueDelivery(event string, payload string) error {
+	delivery := &WebhookDelivery{
+		WebhookID:     webhook.ID,
+		Event:         event,
+		Payload:       payload,
+		NextAttemptAt: time.Now().Unix(),
+	}
+	if err := db.Create(&delivery).Error; err != nil {
+		return err
+	}
+
+	// the newest delivery dropped from the log, MySQL does not allow a limit in the subquery of a delete
+	var newestDropped []uint
+	err := db.Model(&WebhookDelivery{}).
+		Where("webhook_id = ?", webhook.ID).
+		Order("id desc").
+		Offset(webhookDeliveriesKept).
+		Limit(1).
+		Pluck("id", &newestDropped).Error
+	if err != nil || len(newestDropped) == 0 {
+		return err
+	}
+
+	return db.
+		Where("webhook_id = ? AND id <= ?", webhook.ID, newestDropped[0]).
+		Delete(&WebhookDelivery{}).Error
+}
+
+// GetWebhookDeliveries returns the log of the webhook, newest first
+func GetWebhookDeliveries(webhookId uint) ([]*WebhookDelivery, error) {
+	var deliveries []*WebhookDelivery
+	err := db.
+		Where("webhook_id = ?", webhookId).
+		Order("id desc").
+		Find(&deliveries).Error
+
+	return deliveries, err
+}
+
+// GetDueWebhookDeliveries returns the deliveries whose next attempt is due, oldest first, with their webhook
+func GetDueWebhookDeliveries(limit int) ([]*WebhookDelivery, error) {
+	var deliveries []*WebhookDelivery
+	err := db.Preload("Webhook").
+		Where("next_attempt_at > 0 AND next_attempt_at <= ?", time.Now().Unix()).
+		Order("id asc").
+		Limit(limit).
+		Find(&deliveries).Error
+
+	return deliveries, err
+}
+
+func (delivery *WebhookDelivery) Update() error {
+	return db.Omit("Webhook").Save(&delivery).Error
+}
+
+// -- DTO -- //
+
+type WebhookDTO struct {
+	URL    string   `form:"url" validate:"required,max=2048,http_url"`
+	Events []string `form:"events" validate:"required,min=1,dive,oneof=gist-created gist-updated gist-deleted gist-forked gist-liked"`
+}
+
+func (dto *WebhookDTO) ToWebhook() *Webhook {
+	return &Webhook{
+		URL:    dto.URL,
+		Events: strings.Join(dto.Events, ","),
+	}
+}
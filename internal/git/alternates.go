@@ -0,0 +1,114 @@
+package git
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// maxAlternatesDepth is the longest chain of alternates a fork can be at the end of, git ignores deeper ones
+const maxAlternatesDepth = 5
+
+func alternatesFile(repositoryPath string) string {
+	return filepath.Join(repositoryPath, "objects", "info", "alternates")
+}
+
+// readAlternates returns the absolute paths of the object directories the repository borrows objects from
+func readAlternates(repositoryPath string) ([]string, error) {
+	f, err := os.Open(alternatesFile(repositoryPath))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var alternates []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// relative paths are relative to the objects directory of the repository
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(repositoryPath, "objects", line)
+		}
+		alternates = append(alternates, filepath.Clean(line))
+	}
+	return alternates, scanner.Err()
+}
+
+// alternatesDepth returns the length of the longest chain of alternates starting from the repository
+func alternatesDepth(repositoryPath string, depth int) int {
+	if depth > maxAlternatesDepth {
+		return depth
+	}
+
+	alternates, err := readAlternates(repositoryPath)
+	if err != nil {
+		return maxAlternatesDepth
+	}
+
+	maxDepth := depth
+	for _, alternate := range alternates {
+		if d := alternatesDepth(filepath.Dir(alternate), depth+1); d > maxDepth {
+			maxDepth = d
+		}
+	}
+	return maxDepth
+}
+
+// shareObjects points the alternates of the fork to the source repository with a relative path, so the repositories
+// directory can be moved, and keeps the source from pruning the objects the fork may still need.
+func shareObjects(gistSrc string, gistDst string) error {
+	relative, err := filepath.Rel(filepath.Join(RepositoryPath(gistDst), "objects"), filepath.Join(RepositoryPath(gistSrc), "objects"))
+	if err != nil {
+		return err
+	}
+
+	if err = os.WriteFile(alternatesFile(RepositoryPath(gistDst)), []byte(relative+"\n"), 0644); err != nil {
+		return err
+	}
+
+	cmd := newCommand("config", "gc.pruneExpire", "never")
+	cmd.Dir = RepositoryPath(gistSrc)
+	return cmd.Run()
+}
+
+// borrowingRepositories returns the forks whose repository borrows objects from the one of the gist, forks made
+// without git.shared-fork-objects have their own copy of them
+func borrowingRepositories(gist string, forks []string) ([]string, error) {
+	objectsPath := filepath.Clean(filepath.Join(RepositoryPath(gist), "objects"))
+
+	var borrowers []string
+	for _, fork := range forks {
+		if fork == gist {
+			continue
+		}
+
+		alternates, err := readAlternates(RepositoryPath(fork))
+		if err != nil {
+			return nil, err
+		}
+		if slices.Contains(alternates, objectsPath) {
+			borrowers = append(borrowers, fork)
+		}
+	}
+	return borrowers, nil
+}
+
+// dissociate copies into the repository of the gist all the objects it borrows, then stops borrowing them
+func dissociate(gist string) error {
+	cmd := newCommand("repack", "-a", "-d")
+	cmd.Dir = RepositoryPath(gist)
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+
+	return os.Remove(alternatesFile(RepositoryPath(gist)))
+}
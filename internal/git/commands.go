@@ -4,28 +4,40 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 	"github.com/rs/zerolog/log"
 	"github.com/thomiceli/opengist/internal/config"
+	"github.com/thomiceli/opengist/internal/metrics"
 )
 
 var (
 	ReposDirectory = "repos"
+	TrashDirectory = "trash"
+
+	// repositoryLocks are shared by the repositories falling in the same stripe, so their number does not grow with
+	// the gists ever written to
+	repositoryLocks [256]sync.Mutex
 )
 
 const truncateLimit = 2 << 18
 const diffSize = 2 << 12
 const maxFilesPerDiffCommit = 10
+const maxFilesPerComparison = 100
 
 type RevisionNotFoundError struct{}
 
@@ -33,7 +45,150 @@ func (m *RevisionNotFoundError) Error() string {
 	return "revision not found"
 }
 
-func RepositoryPath(user string, gist string) string {
+// TimeoutError is returned when a git command is killed for running longer than the git timeout
+type TimeoutError struct {
+	Args    []string
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("git %s timed out after %s", strings.Join(e.Args, " "), e.Timeout)
+}
+
+// waitDelay bounds the wait for the pipes of a killed command, as git may leave children holding them
+const waitDelay = 5 * time.Second
+
+// maxLoggedStderr bounds the error output of a git command kept for the logs
+const maxLoggedStderr = 4096
+
+// gitCommand is a git command killed once the git timeout is over. Each run is logged along with its error output,
+// at the error level when it fails unexpectedly.
+type gitCommand struct {
+	*exec.Cmd
+	args    []string
+	ctx     context.Context
+	cancel  context.CancelFunc
+	timeout time.Duration
+	start   time.Time
+	stderr  limitedBuffer
+
+	// notFoundExitCodes are the exit codes meaning a revision or a file does not exist, which is expected
+	notFoundExitCodes []int
+}
+
+func newCommand(args ...string) *gitCommand {
+	timeout := time.Duration(config.C.GitTimeout) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+
+	// paths are printed as is rather than quoted and escaped when they are not ASCII, so unicode filenames can be parsed
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-c", "core.quotePath=false"}, args...)...)
+	cmd.WaitDelay = waitDelay
+
+	c := &gitCommand{Cmd: cmd, args: args, ctx: ctx, cancel: cancel, timeout: timeout, start: time.Now(),
+		notFoundExitCodes: []int{128}}
+	c.stderr.limit = maxLoggedStderr
+	return c
+}
+
+// subcommand returns the git subcommand being run, skipping the global options
+func (c *gitCommand) subcommand() string {
+	for _, arg := range c.args {
+		if !strings.HasPrefix(arg, "-") {
+			return arg
+		}
+	}
+	return ""
+}
+
+// captureStderr keeps the error output of the command for the logs, unless the caller reads it
+func (c *gitCommand) captureStderr() {
+	if c.Stderr == nil {
+		c.Stderr = &c.stderr
+	}
+}
+
+func (c *gitCommand) Run() error {
+	c.captureStderr()
+	return c.done(c.Cmd.Run())
+}
+
+func (c *gitCommand) Output() ([]byte, error) {
+	c.captureStderr()
+	out, err := c.Cmd.Output()
+	return out, c.done(err)
+}
+
+func (c *gitCommand) Start() error {
+	c.captureStderr()
+	if err := c.Cmd.Start(); err != nil {
+		return c.done(err)
+	}
+	return nil
+}
+
+func (c *gitCommand) Wait() error {
+	return c.done(c.Cmd.Wait())
+}
+
+// done releases the timeout of the command, records its duration, logs it and turns the error of a killed command
+// into a TimeoutError
+func (c *gitCommand) done(err error) error {
+	c.cancel()
+	metrics.GitCommandDuration.ObserveSince(c.start, c.subcommand())
+	if err != nil && errors.Is(c.ctx.Err(), context.DeadlineExceeded) {
+		err = &TimeoutError{Args: c.args, Timeout: c.timeout}
+	}
+	c.log(err)
+	return err
+}
+
+func (c *gitCommand) log(err error) {
+	exitCode := 0
+	event := log.Debug()
+	if err != nil {
+		exitCode = -1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			exitCode = exitErr.ExitCode()
+		}
+		if !slices.Contains(c.notFoundExitCodes, exitCode) {
+			event = log.Error().Err(err)
+		}
+	}
+
+	event.Str("command", c.subcommand()).
+		Strs("args", c.args).
+		Str("dir", c.Dir).
+		Int("exit_code", exitCode).
+		Str("stderr", strings.TrimSpace(c.stderr.String())).
+		Dur("duration", time.Since(c.start)).
+		Msg("Git command")
+}
+
+// limitedBuffer keeps the first bytes written to it up to its limit and discards the rest
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); room > 0 {
+		if len(p) > room {
+			b.Buffer.Write(p[:room])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// RepositoryPath returns the path of a gist repository, keyed by the gist UUID only so it does not depend on its owner
+func RepositoryPath(gist string) string {
+	return filepath.Join(config.GetHomeDir(), ReposDirectory, gist)
+}
+
+// LegacyRepositoryPath returns the path where repositories were stored before being keyed by the gist UUID only
+func LegacyRepositoryPath(user string, gist string) string {
 	return filepath.Join(config.GetHomeDir(), ReposDirectory, strings.ToLower(user), gist)
 }
 
@@ -63,8 +218,52 @@ func TmpRepositoriesPath() string {
 	return filepath.Join(config.GetHomeDir(), "tmp", "repos")
 }
 
-func InitRepository(user string, gist string) error {
-	repositoryPath := RepositoryPath(user, gist)
+// NewTmpRepositoryId returns a unique temporary repository name for a gist,
+// so concurrent operations on the same gist never share a working directory
+func NewTmpRepositoryId(gist string) string {
+	return gist + "_" + strings.Replace(uuid.NewString(), "-", "", -1)
+}
+
+func RemoveTmpRepository(gistTmpId string) error {
+	return os.RemoveAll(TmpRepositoryPath(gistTmpId))
+}
+
+// LockRepository serializes write operations (clone, commit, push) made by Opengist on a gist repository.
+// The returned function releases the lock. Several repositories may share a lock, so no other repository must be
+// locked while holding it, LockRepositories locks several at once.
+func LockRepository(gist string) func() {
+	return LockRepositories(gist)
+}
+
+// LockRepositories locks the repositories of several gists together. The stripes are taken once each and in
+// ascending order, so repositories sharing a stripe do not deadlock, nor do two callers locking overlapping sets.
+func LockRepositories(gists ...string) func() {
+	var stripes []uint32
+	for _, gist := range gists {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(gist))
+		if stripe := h.Sum32() % uint32(len(repositoryLocks)); !slices.Contains(stripes, stripe) {
+			stripes = append(stripes, stripe)
+		}
+	}
+	slices.Sort(stripes)
+
+	for _, stripe := range stripes {
+		repositoryLocks[stripe].Lock()
+	}
+	return func() {
+		for i := len(stripes) - 1; i >= 0; i-- {
+			repositoryLocks[stripes[i]].Unlock()
+		}
+	}
+}
+
+func InitRepository(gist string) error {
+	repositoryPath := RepositoryPath(gist)
+
+	// only a repository created by this call is removed when it cannot be set up, an existing one keeps its history
+	_, err := os.Stat(repositoryPath)
+	created := errors.Is(err, os.ErrNotExist)
 
 	var args []string
 	args = append(args, "init")
@@ -73,20 +272,96 @@ func InitRepository(user string, gist string) error {
 	}
 	args = append(args, "--bare", repositoryPath)
 
-	cmd := exec.Command("git", args...)
+	cmd := newCommand(args...)
 
 	if err := cmd.Run(); err != nil {
 		return err
 	}
 
-	return CreateDotGitFiles(user, gist)
+	if err := CreateDotGitFiles(gist); err != nil {
+		if created {
+			_ = os.RemoveAll(repositoryPath)
+		}
+		return err
+	}
+	return nil
 }
 
-func CountCommits(user string, gist string) (string, error) {
-	repositoryPath := RepositoryPath(user, gist)
+// GetRevisionHash resolves a revision of the repository to its full commit hash
+func GetRevisionHash(gist string, revision string) (string, error) {
+	repositoryPath := RepositoryPath(gist)
 
-	cmd := exec.Command(
-		"git",
+	cmd := newCommand(
+		"rev-parse",
+		"--verify",
+		"--quiet",
+		revision+"^{commit}",
+	)
+	cmd.Dir = repositoryPath
+	// --verify --quiet exits with 1 when the revision does not exist
+	cmd.notFoundExitCodes = append(cmd.notFoundExitCodes, 1)
+
+	stdout, err := cmd.Output()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return "", &RevisionNotFoundError{}
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(stdout)), nil
+}
+
+// GetPatch returns a single commit formatted as a patch, ready to be applied with git apply or git am
+func GetPatch(gist string, hash string) ([]byte, error) {
+	repositoryPath := RepositoryPath(gist)
+
+	cmd := newCommand(
+		"format-patch",
+		"-1",
+		"--stdout",
+		hash+"^{commit}",
+	)
+	cmd.Dir = repositoryPath
+
+	stdout, err := cmd.Output()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return nil, &RevisionNotFoundError{}
+		}
+		return nil, err
+	}
+	return stdout, nil
+}
+
+// ArchiveFormats are the formats an archive can be created in, as named by git archive
+var ArchiveFormats = []string{"zip", "tar.gz"}
+
+// Archive returns an archive of the files at the given commit, in one of the ArchiveFormats. It runs through git
+// archive so the export-ignore attributes of the .gitattributes file of that commit are honored.
+func Archive(gist string, hash string, format string) ([]byte, error) {
+	repositoryPath := RepositoryPath(gist)
+
+	cmd := newCommand(
+		"archive",
+		"--format="+format,
+		hash+"^{commit}",
+	)
+	cmd.Dir = repositoryPath
+
+	stdout, err := cmd.Output()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return nil, &RevisionNotFoundError{}
+		}
+		return nil, err
+	}
+	return stdout, nil
+}
+
+func CountCommits(gist string) (string, error) {
+	repositoryPath := RepositoryPath(gist)
+
+	cmd := newCommand(
 		"rev-list",
 		"--all",
 		"--count",
@@ -97,11 +372,10 @@ func CountCommits(user string, gist string) (string, error) {
 	return strings.TrimSuffix(string(stdout), "\n"), err
 }
 
-func GetFilesOfRepository(user string, gist string, revision string) ([]string, error) {
-	repositoryPath := RepositoryPath(user, gist)
+func GetFilesOfRepository(gist string, revision string) ([]string, error) {
+	repositoryPath := RepositoryPath(gist)
 
-	cmd := exec.Command(
-		"git",
+	cmd := newCommand(
 		"ls-tree",
 		"--name-only",
 		"--",
@@ -124,10 +398,10 @@ type catFileBatch struct {
 	Truncated           bool
 }
 
-func CatFileBatch(user string, gist string, revision string, truncate bool) ([]*catFileBatch, error) {
-	repositoryPath := RepositoryPath(user, gist)
+func CatFileBatch(gist string, revision string, truncate bool) ([]*catFileBatch, error) {
+	repositoryPath := RepositoryPath(gist)
 
-	lsTreeCmd := exec.Command("git", "ls-tree", "-l", revision)
+	lsTreeCmd := newCommand("ls-tree", "-l", revision)
 	lsTreeCmd.Dir = repositoryPath
 	lsTreeOutput, err := lsTreeCmd.Output()
 	if err != nil {
@@ -157,7 +431,7 @@ func CatFileBatch(user string, gist string, revision string, truncate bool) ([]*
 		})
 	}
 
-	catFileCmd := exec.Command("git", "cat-file", "--batch")
+	catFileCmd := newCommand("cat-file", "--batch")
 	catFileCmd.Dir = repositoryPath
 	stdin, err := catFileCmd.StdinPipe()
 	if err != nil {
@@ -232,21 +506,15 @@ func CatFileBatch(user string, gist string, revision string, truncate bool) ([]*
 	return fileMap, nil
 }
 
-func GetFileContent(user string, gist string, revision string, filename string, truncate bool) (string, bool, error) {
-	repositoryPath := RepositoryPath(user, gist)
+func GetFileContent(gist string, revision string, filename string, truncate bool) (string, bool, error) {
+	repositoryPath := RepositoryPath(gist)
 
 	var maxBytes int64 = -1
 	if truncate {
 		maxBytes = truncateLimit
 	}
 
-	// Set up a context with a timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
-	defer cancel()
-
-	cmd := exec.CommandContext(
-		ctx,
-		"git",
+	cmd := newCommand(
 		"--no-pager",
 		"show",
 		revision+":"+filename,
@@ -266,11 +534,62 @@ func GetFileContent(user string, gist string, revision string, filename string,
 	return content, truncated, nil
 }
 
-func GetFileSize(user string, gist string, revision string, filename string) (uint64, error) {
-	repositoryPath := RepositoryPath(user, gist)
+// FileReader streams the content of a file out of git, it must be closed once read
+type FileReader struct {
+	io.Reader
+	Size uint64
+
+	cmd    *gitCommand
+	stdout io.Reader
+}
+
+// Close discards what is left of the content so git can exit, and waits for it
+func (r *FileReader) Close() error {
+	_, _ = io.Copy(io.Discard, r.stdout)
+	return r.cmd.Wait()
+}
+
+// OpenFile starts streaming the content of a file at a revision of the repository, with a single git process so the
+// size and the content always match. It returns nil if the revision or the file do not exist.
+func OpenFile(gist string, revision string, filename string) (*FileReader, error) {
+	cmd := newCommand("cat-file", "--batch")
+	cmd.Dir = RepositoryPath(gist)
+	cmd.Stdin = strings.NewReader(revision + ":" + filename + "\n")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(stdout)
+	file := &FileReader{cmd: cmd, stdout: reader}
+
+	// "<hash> blob <size>", or "<object> missing" when the revision or the file do not exist
+	header, err := reader.ReadString('\n')
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	parts := strings.Fields(header)
+	if len(parts) != 3 || parts[1] != "blob" {
+		return nil, file.Close()
+	}
+
+	if file.Size, err = strconv.ParseUint(parts[2], 10, 64); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	file.Reader = io.LimitReader(reader, int64(file.Size))
+
+	return file, nil
+}
+
+func GetFileSize(gist string, revision string, filename string) (uint64, error) {
+	repositoryPath := RepositoryPath(gist)
 
-	cmd := exec.Command(
-		"git",
+	cmd := newCommand(
 		"cat-file",
 		"-s",
 		revision+":"+filename,
@@ -285,11 +604,96 @@ func GetFileSize(user string, gist string, revision string, filename string) (ui
 	return strconv.ParseUint(strings.TrimSuffix(string(stdout), "\n"), 10, 64)
 }
 
-func GetLog(user string, gist string, skip int) ([]*Commit, error) {
-	repositoryPath := RepositoryPath(user, gist)
+// Blame returns the lines of a file at a commit grouped by the commit that last changed them, in the order of the file
+func Blame(gist string, hash string, filename string) ([]*BlameHunk, error) {
+	cmd := newCommand(
+		"blame",
+		"--porcelain",
+		hash,
+		"--",
+		filename,
+	)
+	cmd.Dir = RepositoryPath(gist)
+	stdout, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	return parseBlame(bytes.NewReader(stdout))
+}
+
+// GetBranches returns the names of the branches of the repository, sorted by name
+func GetBranches(gist string) ([]string, error) {
+	cmd := newCommand(
+		"for-each-ref",
+		"--format=%(refname:lstrip=2)",
+		"refs/heads/",
+	)
+	cmd.Dir = RepositoryPath(gist)
+	stdout, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.Fields(string(stdout)), nil
+}
+
+// GetDefaultBranch returns the name of the branch HEAD points to, the branch does not exist until it has a commit
+func GetDefaultBranch(gist string) (string, error) {
+	cmd := newCommand(
+		"symbolic-ref",
+		"HEAD",
+	)
+	cmd.Dir = RepositoryPath(gist)
+	stdout, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimPrefix(strings.TrimSpace(string(stdout)), "refs/heads/"), nil
+}
+
+// GetTags returns the tags of the repository pointing to a commit, the most recent first
+func GetTags(gist string) ([]*Tag, error) {
+	cmd := newCommand(
+		"for-each-ref",
+		"--sort=-creatordate",
+		"--format=%(refname:lstrip=2)%00%(objecttype)%00%(objectname)%00%(*objecttype)%00%(*objectname)%00%(creatordate:unix)%00%(contents:subject)",
+		"refs/tags/",
+	)
+	cmd.Dir = RepositoryPath(gist)
+	stdout, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var tags []*Tag
+	for _, line := range strings.Split(strings.TrimSuffix(string(stdout), "\n"), "\n") {
+		fields := strings.Split(line, "\x00")
+		if len(fields) != 7 {
+			continue
+		}
 
-	cmd := exec.Command(
-		"git",
+		// an annotated tag is an object of its own, pointing to the commit
+		objectType, hash := fields[1], fields[2]
+		if objectType == "tag" {
+			objectType, hash = fields[3], fields[4]
+		}
+		if objectType != "commit" {
+			continue
+		}
+
+		tags = append(tags, &Tag{Name: fields[0], Hash: hash, Timestamp: fields[5], Message: fields[6]})
+	}
+	return tags, nil
+}
+
+// GetLog returns a page of the commits reachable from the revision, with one more commit to tell if there is a next
+// page
+func GetLog(gist string, revision string, skip int) ([]*Commit, error) {
+	repositoryPath := RepositoryPath(gist)
+
+	cmd := newCommand(
 		"--no-pager",
 		"log",
 		"-n",
@@ -300,7 +704,7 @@ func GetLog(user string, gist string, skip int) ([]*Commit, error) {
 		strconv.Itoa(skip),
 		"--format=format:c %H%na %aN%nm %ae%nt %at",
 		"--shortstat",
-		"HEAD",
+		revision,
 	)
 	cmd.Dir = repositoryPath
 	stdout, _ := cmd.StdoutPipe()
@@ -308,7 +712,7 @@ func GetLog(user string, gist string, skip int) ([]*Commit, error) {
 	if err != nil {
 		return nil, err
 	}
-	defer func(cmd *exec.Cmd) {
+	defer func(cmd *gitCommand) {
 		waitErr := cmd.Wait()
 		if waitErr != nil {
 			err = waitErr
@@ -319,7 +723,7 @@ func GetLog(user string, gist string, skip int) ([]*Commit, error) {
 }
 
 func CloneTmp(user string, gist string, gistTmpId string, email string, remove bool) error {
-	repositoryPath := RepositoryPath(user, gist)
+	repositoryPath := RepositoryPath(gist)
 
 	tmpPath := TmpRepositoriesPath()
 
@@ -330,7 +734,7 @@ func CloneTmp(user string, gist string, gistTmpId string, email string, remove b
 		return err
 	}
 
-	cmd := exec.Command("git", "clone", repositoryPath, gistTmpId)
+	cmd := newCommand("clone", repositoryPath, gistTmpId)
 	cmd.Dir = tmpPath
 	if err = cmd.Run(); err != nil {
 		return err
@@ -343,32 +747,163 @@ func CloneTmp(user string, gist string, gistTmpId string, email string, remove b
 			return err
 		}
 	}
-	cmd = exec.Command("git", "config", "--local", "user.name", user)
+	cmd = newCommand("config", "--local", "user.name", user)
 	cmd.Dir = tmpRepositoryPath
 	if err = cmd.Run(); err != nil {
 		return err
 	}
 
-	cmd = exec.Command("git", "config", "--local", "user.email", email)
+	cmd = newCommand("config", "--local", "user.email", email)
 	cmd.Dir = tmpRepositoryPath
 	return cmd.Run()
 }
 
-func ForkClone(userSrc string, gistSrc string, userDst string, gistDst string) error {
-	repositoryPathSrc := RepositoryPath(userSrc, gistSrc)
-	repositoryPathDst := RepositoryPath(userDst, gistDst)
+// ForkClone clones the repository of a gist into the one of its fork. With git.shared-fork-objects, the fork borrows
+// the objects of the source through git alternates instead of copying them.
+func ForkClone(gistSrc string, gistDst string) error {
+	repositoryPathSrc := RepositoryPath(gistSrc)
+	repositoryPathDst := RepositoryPath(gistDst)
 
-	cmd := exec.Command("git", "clone", "--bare", repositoryPathSrc, repositoryPathDst)
+	// git does not follow chained alternates past a few levels, forks of deep forks get their own objects
+	shared := config.C.GitSharedForkObjects && alternatesDepth(repositoryPathSrc, 0) < maxAlternatesDepth
+
+	args := []string{"clone", "--bare"}
+	if shared {
+		args = append(args, "--shared")
+	}
+	cmd := newCommand(append(args, repositoryPathSrc, repositoryPathDst)...)
 	if err := cmd.Run(); err != nil {
 		return err
 	}
 
-	return CreateDotGitFiles(userDst, gistDst)
+	if shared {
+		if err := shareObjects(gistSrc, gistDst); err != nil {
+			return err
+		}
+	}
+
+	return CreateDotGitFiles(gistDst)
 }
 
+// ForkCloneAt forks a gist as it was at the given revision, the history of the fork stops at that commit.
+// A RevisionNotFoundError is returned before anything is cloned if the revision does not exist.
+func ForkCloneAt(gistSrc string, gistDst string, revision string) error {
+	hash, err := GetRevisionHash(gistSrc, revision)
+	if err != nil {
+		return err
+	}
+
+	if err = ForkClone(gistSrc, gistDst); err != nil {
+		return err
+	}
+
+	cmd := newCommand("symbolic-ref", "HEAD")
+	cmd.Dir = RepositoryPath(gistDst)
+	stdout, err := cmd.Output()
+	if err != nil {
+		return err
+	}
+	head := strings.TrimSpace(string(stdout))
+
+	cmd = newCommand("for-each-ref", "--format=%(refname)")
+	cmd.Dir = RepositoryPath(gistDst)
+	if stdout, err = cmd.Output(); err != nil {
+		return err
+	}
+
+	// the other branches and the tags would still lead to the commits made after the revision
+	updates := "update " + head + " " + hash + "\n"
+	for _, ref := range strings.Fields(string(stdout)) {
+		if ref != head {
+			updates += "delete " + ref + "\n"
+		}
+	}
+
+	cmd = newCommand("update-ref", "--stdin")
+	cmd.Dir = RepositoryPath(gistDst)
+	cmd.Stdin = strings.NewReader(updates)
+	return cmd.Run()
+}
+
+// DiffRepositories returns the changes between the latest revision of a gist and the one of another gist, usually
+// one of its forks. The diff runs in a temporary repository borrowing the objects of both through git alternates,
+// so nothing is fetched nor copied however far the two repositories diverged.
+func DiffRepositories(gist string, other string) ([]*File, error) {
+	hash, err := GetRevisionHash(gist, "HEAD")
+	if err != nil {
+		return nil, err
+	}
+	otherHash, err := GetRevisionHash(other, "HEAD")
+	if err != nil {
+		return nil, err
+	}
+
+	var alternates string
+	for _, g := range []string{gist, other} {
+		objectsPath, err := filepath.Abs(filepath.Join(RepositoryPath(g), "objects"))
+		if err != nil {
+			return nil, err
+		}
+		alternates += objectsPath + "\n"
+	}
+
+	tmpId := NewTmpRepositoryId(gist)
+	defer RemoveTmpRepository(tmpId)
+
+	if err = newCommand("init", "--bare", TmpRepositoryPath(tmpId)).Run(); err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(alternatesFile(TmpRepositoryPath(tmpId)), []byte(alternates), 0644); err != nil {
+		return nil, err
+	}
+
+	return diff(TmpRepositoryPath(tmpId), hash, otherHash)
+}
+
+// DiffRevisions returns the changes between two commits of a gist, the renames are detected
+func DiffRevisions(gist string, hash string, otherHash string) ([]*File, error) {
+	return diff(RepositoryPath(gist), hash, otherHash)
+}
+
+func diff(repositoryPath string, hash string, otherHash string) ([]*File, error) {
+	cmd := newCommand(
+		"--no-pager",
+		"diff",
+		"--no-color",
+		"-p",
+		"-M",
+		hash,
+		otherHash,
+	)
+	cmd.Dir = repositoryPath
+	stdout, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	// the output is the one of a commit of git log -p without its header
+	commits, err := parseLog(io.MultiReader(strings.NewReader("c "+otherHash+"\n"), bytes.NewReader(stdout)), maxFilesPerComparison, diffSize)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*File
+	for _, commit := range commits {
+		for i := range commit.Files {
+			files = append(files, &commit.Files[i])
+		}
+	}
+	return files, nil
+}
+
+// SetFileContent writes a file at the root of the temporary repository, a name that would lead elsewhere is refused
 func SetFileContent(gistTmpId string, filename string, content string) error {
 	repositoryPath := TmpRepositoryPath(gistTmpId)
 
+	if filename == "" || filename == "." || filename == ".." || filepath.Base(filename) != filename {
+		return fmt.Errorf("invalid filename %q", filename)
+	}
+
 	return os.WriteFile(filepath.Join(repositoryPath, filename), []byte(content), 0644)
 }
 
@@ -376,21 +911,21 @@ func AddAll(gistTmpId string) error {
 	tmpPath := TmpRepositoryPath(gistTmpId)
 
 	// in case of a change where only a file name has its case changed
-	cmd := exec.Command("git", "rm", "-r", "--cached", "--ignore-unmatch", ".")
+	cmd := newCommand("rm", "-r", "--cached", "--ignore-unmatch", ".")
 	cmd.Dir = tmpPath
 	err := cmd.Run()
 	if err != nil {
 		return err
 	}
 
-	cmd = exec.Command("git", "add", "-A")
+	cmd = newCommand("add", "-A")
 	cmd.Dir = tmpPath
 
 	return cmd.Run()
 }
 
 func CommitRepository(gistTmpId string, authorName string, authorEmail string) error {
-	cmd := exec.Command("git",
+	cmd := newCommand(
 		"commit",
 		"--allow-empty",
 		"-m",
@@ -406,8 +941,7 @@ func CommitRepository(gistTmpId string, authorName string, authorEmail string) e
 
 func Push(gistTmpId string) error {
 	tmpRepositoryPath := TmpRepositoryPath(gistTmpId)
-	cmd := exec.Command(
-		"git",
+	cmd := newCommand(
 		"push",
 	)
 	cmd.Dir = tmpRepositoryPath
@@ -419,72 +953,140 @@ func Push(gistTmpId string) error {
 	return os.RemoveAll(tmpRepositoryPath)
 }
 
-func DeleteRepository(user string, gist string) error {
-	return os.RemoveAll(RepositoryPath(user, gist))
+// DeleteRepository removes the repository of a gist. Among the forks given, the ones borrowing its objects through git
+// alternates first get their own copy of them, so they are not left with dangling references.
+func DeleteRepository(gist string, forks []string) error {
+	borrowers, err := borrowingRepositories(gist, forks)
+	if err != nil {
+		return err
+	}
+	defer LockRepositories(append([]string{gist}, borrowers...)...)()
+
+	for _, borrower := range borrowers {
+		if err = dissociate(borrower); err != nil {
+			return err
+		}
+	}
+
+	return os.RemoveAll(RepositoryPath(gist))
+}
+
+// TrashedRepositoryPath returns the path where the repository of a deleted gist is kept until it is purged
+func TrashedRepositoryPath(gist string) string {
+	return filepath.Join(config.GetHomeDir(), TrashDirectory, gist)
+}
+
+// TrashRepository moves the repository of a gist out of the repositories directory. Neither the repository nor the
+// forks given borrowing its objects are left sharing objects through git alternates, so either side can be purged alone.
+func TrashRepository(gist string, forks []string) error {
+	borrowers, err := borrowingRepositories(gist, forks)
+	if err != nil {
+		return err
+	}
+	defer LockRepositories(append([]string{gist}, borrowers...)...)()
+
+	for _, borrower := range borrowers {
+		if err = dissociate(borrower); err != nil {
+			return err
+		}
+	}
+
+	// the alternates are relative to the repositories directory, they would not resolve from the trash
+	alternates, err := readAlternates(RepositoryPath(gist))
+	if err != nil {
+		return err
+	}
+	if len(alternates) > 0 {
+		if err = dissociate(gist); err != nil {
+			return err
+		}
+	}
+
+	if err = os.MkdirAll(filepath.Join(config.GetHomeDir(), TrashDirectory), 0755); err != nil {
+		return err
+	}
+
+	err = os.Rename(RepositoryPath(gist), TrashedRepositoryPath(gist))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// RestoreRepository moves back the repository of a gist from the trash
+func RestoreRepository(gist string) error {
+	defer LockRepository(gist)()
+
+	return os.Rename(TrashedRepositoryPath(gist), RepositoryPath(gist))
 }
 
-func UpdateServerInfo(user string, gist string) error {
-	repositoryPath := RepositoryPath(user, gist)
+// DeleteTrashedRepository removes the repository of a gist from the trash
+func DeleteTrashedRepository(gist string) error {
+	return os.RemoveAll(TrashedRepositoryPath(gist))
+}
 
-	cmd := exec.Command("git", "update-server-info")
+func UpdateServerInfo(gist string) error {
+	repositoryPath := RepositoryPath(gist)
+
+	cmd := newCommand("update-server-info")
 	cmd.Dir = repositoryPath
 	return cmd.Run()
 }
 
-func RPC(user string, gist string, service string) ([]byte, error) {
-	repositoryPath := RepositoryPath(user, gist)
+func RPC(gist string, service string) ([]byte, error) {
+	repositoryPath := RepositoryPath(gist)
 
-	cmd := exec.Command("git", service, "--stateless-rpc", "--advertise-refs", ".")
+	cmd := newCommand(service, "--stateless-rpc", "--advertise-refs", ".")
 	cmd.Dir = repositoryPath
 	stdout, err := cmd.Output()
 	return stdout, err
 }
 
-func GcRepos() error {
-	subdirs, err := os.ReadDir(filepath.Join(config.GetHomeDir(), ReposDirectory))
+// GC garbage collects the repository, only if needed unless aggressive is set
+func GC(gist string, aggressive bool) error {
+	args := []string{"gc", "--auto"}
+	if aggressive {
+		args = []string{"gc", "--aggressive"}
+	}
+
+	cmd := newCommand(args...)
+	cmd.Dir = RepositoryPath(gist)
+	return cmd.Run()
+}
+
+// RepositorySize returns the total size in bytes of the files of the gist at HEAD, 0 if the repository is empty
+func RepositorySize(gist string) (int64, error) {
+	noCommits, err := HasNoCommits(gist)
+	if err != nil || noCommits {
+		return 0, err
+	}
+
+	cmd := newCommand("ls-tree", "-r", "-l", "HEAD")
+	cmd.Dir = RepositoryPath(gist)
+	stdout, err := cmd.Output()
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	for _, subdir := range subdirs {
-		if !subdir.IsDir() {
+	var size int64
+	for _, line := range strings.Split(string(stdout), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[1] != "blob" {
 			continue
 		}
-
-		subRoot := filepath.Join(config.GetHomeDir(), ReposDirectory, subdir.Name())
-
-		gitRepos, err := os.ReadDir(subRoot)
+		blobSize, err := strconv.ParseInt(fields[3], 10, 64)
 		if err != nil {
-			log.Warn().Err(err).Msg("Cannot read directory")
 			continue
 		}
-
-		for _, repo := range gitRepos {
-			if !repo.IsDir() {
-				continue
-			}
-
-			repoPath := filepath.Join(subRoot, repo.Name())
-
-			log.Info().Msg("Running git gc for repository " + repoPath)
-
-			cmd := exec.Command("git", "gc")
-			cmd.Dir = repoPath
-			err = cmd.Run()
-			if err != nil {
-				log.Warn().Err(err).Msg("Cannot run git gc for repository " + repoPath)
-				continue
-			}
-		}
+		size += blobSize
 	}
-
-	return err
+	return size, nil
 }
 
-func HasNoCommits(user string, gist string) (bool, error) {
-	repositoryPath := RepositoryPath(user, gist)
+func HasNoCommits(gist string) (bool, error) {
+	repositoryPath := RepositoryPath(gist)
 
-	cmd := exec.Command("git", "rev-parse", "--all")
+	cmd := newCommand("rev-parse", "--all")
 	cmd.Dir = repositoryPath
 
 	var out bytes.Buffer
@@ -502,7 +1104,7 @@ func HasNoCommits(user string, gist string) (bool, error) {
 }
 
 func GetGitVersion() (string, error) {
-	cmd := exec.Command("git", "--version")
+	cmd := newCommand("--version")
 	stdout, err := cmd.Output()
 	if err != nil {
 		return "", err
@@ -516,8 +1118,8 @@ func GetGitVersion() (string, error) {
 	return versionFields[2], nil
 }
 
-func CreateDotGitFiles(user string, gist string) error {
-	repositoryPath := RepositoryPath(user, gist)
+func CreateDotGitFiles(gist string) error {
+	repositoryPath := RepositoryPath(gist)
 
 	f1, err := os.OpenFile(filepath.Join(repositoryPath, "git-daemon-export-ok"), os.O_RDONLY|os.O_CREATE, 0644)
 	if err != nil {
@@ -1,13 +1,24 @@
 package git
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/require"
 	"github.com/thomiceli/opengist/internal/config"
+	"hash/fnv"
+	"io"
 	"os"
 	"os/exec"
 	"path"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestInitDeleteRepository(t *testing.T) {
@@ -15,43 +26,77 @@ func TestInitDeleteRepository(t *testing.T) {
 	defer TeardownTest(t)
 
 	cmd := exec.Command("git", "rev-parse", "--is-bare-repository")
-	cmd.Dir = RepositoryPath("thomas", "gist1")
+	cmd.Dir = RepositoryPath("gist1")
 	out, err := cmd.Output()
 	require.NoError(t, err, "Could not run git command")
 	require.Equal(t, "true", strings.TrimSpace(string(out)), "Repository is not bare")
 
-	_, err = os.Stat(path.Join(RepositoryPath("thomas", "gist1"), "git-daemon-export-ok"))
+	_, err = os.Stat(path.Join(RepositoryPath("gist1"), "git-daemon-export-ok"))
 	require.NoError(t, err, "git-daemon-export-ok file not found")
 
-	err = DeleteRepository("thomas", "gist1")
+	err = DeleteRepository("gist1", nil)
 	require.NoError(t, err, "Could not delete repository")
-	require.NoDirExists(t, RepositoryPath("thomas", "gist1"), "Repository should not exist")
+	require.NoDirExists(t, RepositoryPath("gist1"), "Repository should not exist")
+}
+
+func TestInitExistingRepository(t *testing.T) {
+	SetupTest(t)
+	defer TeardownTest(t)
+
+	CommitToBare(t, "thomas", "gist1", map[string]string{"my_file.txt": "I love Opengist\n"})
+
+	// a failing setup of an existing repository leaves it and its history alone
+	exportOk := path.Join(RepositoryPath("gist1"), "git-daemon-export-ok")
+	require.NoError(t, os.Remove(exportOk))
+	require.NoError(t, os.Mkdir(exportOk, 0755))
+	require.Error(t, InitRepository("gist1"))
+
+	nbCommits, err := CountCommits("gist1")
+	require.NoError(t, err, "The repository should still exist")
+	require.Equal(t, "1", nbCommits)
 }
 
 func TestCommits(t *testing.T) {
 	SetupTest(t)
 	defer TeardownTest(t)
 
-	hasNoCommits, err := HasNoCommits("thomas", "gist1")
+	hasNoCommits, err := HasNoCommits("gist1")
 	require.NoError(t, err, "Could not check if repository has no commits")
 	require.True(t, hasNoCommits, "Repository should have no commits")
 
 	CommitToBare(t, "thomas", "gist1", nil)
 
-	hasNoCommits, err = HasNoCommits("thomas", "gist1")
+	hasNoCommits, err = HasNoCommits("gist1")
 	require.NoError(t, err, "Could not check if repository has no commits")
 	require.False(t, hasNoCommits, "Repository should have commits")
 
-	nbCommits, err := CountCommits("thomas", "gist1")
+	nbCommits, err := CountCommits("gist1")
 	require.NoError(t, err, "Could not count commits")
 	require.Equal(t, "1", nbCommits, "Repository should have 1 commit")
 
 	CommitToBare(t, "thomas", "gist1", nil)
-	nbCommits, err = CountCommits("thomas", "gist1")
+	nbCommits, err = CountCommits("gist1")
 	require.NoError(t, err, "Could not count commits")
 	require.Equal(t, "2", nbCommits, "Repository should have 2 commits")
 }
 
+func TestGetRevisionHash(t *testing.T) {
+	SetupTest(t)
+	defer TeardownTest(t)
+
+	_, err := GetRevisionHash("gist1", "HEAD")
+	require.ErrorAs(t, err, new(*RevisionNotFoundError), "Empty repository should not have a HEAD commit")
+
+	CommitToBare(t, "thomas", "gist1", nil)
+
+	hash, err := GetRevisionHash("gist1", "HEAD")
+	require.NoError(t, err, "Could not get revision hash")
+	require.Equal(t, LastHashOfCommit(t, "gist1"), hash, "Revision hash is not correct")
+
+	_, err = GetRevisionHash("gist1", "notarevision")
+	require.ErrorAs(t, err, new(*RevisionNotFoundError), "Unknown revision should not be found")
+}
+
 func TestContent(t *testing.T) {
 	SetupTest(t)
 	defer TeardownTest(t)
@@ -63,16 +108,16 @@ hate Opengist`,
 		"rip.txt": "byebye",
 	})
 
-	files, err := GetFilesOfRepository("thomas", "gist1", "HEAD")
+	files, err := GetFilesOfRepository("gist1", "HEAD")
 	require.NoError(t, err, "Could not get files of repository")
 	require.Subset(t, []string{"my_file.txt", "my_other_file.txt", "rip.txt"}, files, "Files are not correct")
 
-	content, truncated, err := GetFileContent("thomas", "gist1", "HEAD", "my_file.txt", false)
+	content, truncated, err := GetFileContent("gist1", "HEAD", "my_file.txt", false)
 	require.NoError(t, err, "Could not get content")
 	require.False(t, truncated, "Content should not be truncated")
 	require.Equal(t, "I love Opengist\n", content, "Content is not correct")
 
-	content, truncated, err = GetFileContent("thomas", "gist1", "HEAD", "my_other_file.txt", false)
+	content, truncated, err = GetFileContent("gist1", "HEAD", "my_other_file.txt", false)
 	require.NoError(t, err, "Could not get content")
 	require.False(t, truncated, "Content should not be truncated")
 	require.Equal(t, "I really\nhate Opengist", content, "Content is not correct")
@@ -84,16 +129,16 @@ like Opengist actually`,
 		"new_file.txt": "Wait now there is a new file",
 	})
 
-	files, err = GetFilesOfRepository("thomas", "gist1", "HEAD")
+	files, err = GetFilesOfRepository("gist1", "HEAD")
 	require.NoError(t, err, "Could not get files of repository")
 	require.Subset(t, []string{"my_renamed_file.txt", "my_other_file.txt", "new_file.txt"}, files, "Files are not correct")
 
-	content, truncated, err = GetFileContent("thomas", "gist1", "HEAD", "my_other_file.txt", false)
+	content, truncated, err = GetFileContent("gist1", "HEAD", "my_other_file.txt", false)
 	require.NoError(t, err, "Could not get content")
 	require.False(t, truncated, "Content should not be truncated")
 	require.Equal(t, "I really\nlike Opengist actually", content, "Content is not correct")
 
-	commits, err := GetLog("thomas", "gist1", 0)
+	commits, err := GetLog("gist1", "HEAD", 0)
 	require.NoError(t, err, "Could not get log")
 	require.Equal(t, 2, len(commits), "Commits count are not correct")
 	require.Regexp(t, "[a-f0-9]{40}", commits[0].Hash, "Commit ID is not correct")
@@ -150,7 +195,7 @@ like Opengist actually`,
 		IsDeleted: false,
 	}, "File new_file.txt is not correct")
 
-	commitsSkip1, err := GetLog("thomas", "gist1", 1)
+	commitsSkip1, err := GetLog("gist1", "HEAD", 1)
 	require.NoError(t, err, "Could not get log")
 	require.Equal(t, commitsSkip1[0], commits[1], "Commits skips are not correct")
 }
@@ -159,8 +204,15 @@ func TestGitGc(t *testing.T) {
 	SetupTest(t)
 	defer TeardownTest(t)
 
-	err := GcRepos()
+	CommitToBare(t, "thomas", "gist1", map[string]string{
+		"my_file.txt": "I love Opengist\n",
+	})
+
+	err := GC("gist1", false)
 	require.NoError(t, err, "Could not run git gc")
+
+	err = GC("gist1", true)
+	require.NoError(t, err, "Could not run aggressive git gc")
 }
 
 func TestFork(t *testing.T) {
@@ -171,18 +223,453 @@ func TestFork(t *testing.T) {
 		"my_file.txt": "I love Opengist\n",
 	})
 
-	err := ForkClone("thomas", "gist1", "thomas", "gist2")
+	err := ForkClone("gist1", "gist2")
 	require.NoError(t, err, "Could not fork repository")
 
-	files1, err := GetFilesOfRepository("thomas", "gist1", "HEAD")
+	files1, err := GetFilesOfRepository("gist1", "HEAD")
 	require.NoError(t, err, "Could not get files of repository")
-	files2, err := GetFilesOfRepository("thomas", "gist2", "HEAD")
+	files2, err := GetFilesOfRepository("gist2", "HEAD")
 	require.NoError(t, err, "Could not get files of repository")
 
 	require.Equal(t, files1, files2, "Files are not the same")
 
 }
 
+func TestForkAt(t *testing.T) {
+	SetupTest(t)
+	defer TeardownTest(t)
+
+	CommitToBare(t, "thomas", "gist1", map[string]string{
+		"my_file.txt": "I love Opengist\n",
+	})
+	oldHash := LastHashOfCommit(t, "gist1")
+
+	CommitToBare(t, "thomas", "gist1", map[string]string{
+		"my_file.txt": "I broke Opengist\n",
+		"other.txt":   "hello\n",
+	})
+	newHash := LastHashOfCommit(t, "gist1")
+
+	for _, args := range [][]string{{"branch", "feature/new", newHash}, {"tag", "v2", newHash}} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = RepositoryPath("gist1")
+		require.NoError(t, cmd.Run(), "Could not create ref")
+	}
+
+	err := ForkCloneAt("gist1", "gist2", "notarevision")
+	require.IsType(t, &RevisionNotFoundError{}, err)
+	require.NoDirExists(t, RepositoryPath("gist2"), "Nothing should be cloned for an unknown revision")
+
+	err = ForkCloneAt("gist1", "gist2", oldHash)
+	require.NoError(t, err, "Could not fork repository")
+	require.Equal(t, oldHash, LastHashOfCommit(t, "gist2"))
+
+	files1, err := GetFilesOfRepository("gist1", oldHash)
+	require.NoError(t, err, "Could not get files of repository")
+	files2, err := GetFilesOfRepository("gist2", "HEAD")
+	require.NoError(t, err, "Could not get files of repository")
+	require.Equal(t, files1, files2, "Files are not the same")
+
+	content, _, err := GetFileContent("gist2", "HEAD", "my_file.txt", false)
+	require.NoError(t, err)
+	require.Equal(t, "I love Opengist\n", content)
+
+	// no ref of the fork leads past the revision
+	defaultBranch, err := GetDefaultBranch("gist2")
+	require.NoError(t, err)
+	branches, err := GetBranches("gist2")
+	require.NoError(t, err)
+	require.Equal(t, []string{defaultBranch}, branches)
+
+	tags, err := GetTags("gist2")
+	require.NoError(t, err)
+	require.Empty(t, tags)
+
+	_, err = GetRevisionHash("gist2", "feature/new")
+	require.IsType(t, &RevisionNotFoundError{}, err)
+}
+
+func TestDiffRepositories(t *testing.T) {
+	SetupTest(t)
+	defer TeardownTest(t)
+
+	CommitToBare(t, "thomas", "gist1", map[string]string{
+		"kept.txt":    "same\n",
+		"changed.txt": "line 1\nline 2\n",
+		"removed.txt": "bye\n",
+	})
+
+	err := ForkClone("gist1", "gist2")
+	require.NoError(t, err, "Could not fork repository")
+
+	files, err := DiffRepositories("gist1", "gist2")
+	require.NoError(t, err, "Could not diff the repositories")
+	require.Empty(t, files, "A fresh fork should not differ from its gist")
+
+	CommitToBare(t, "thomas", "gist2", map[string]string{
+		"kept.txt":    "same\n",
+		"changed.txt": "line 1\nline 2 edited\n",
+		"added.txt":   "hello\n",
+	})
+
+	files, err = DiffRepositories("gist1", "gist2")
+	require.NoError(t, err, "Could not diff the repositories")
+	require.Len(t, files, 3)
+
+	byName := map[string]*File{}
+	for _, file := range files {
+		byName[file.Filename] = file
+	}
+	require.True(t, byName["added.txt"].IsCreated)
+	require.Equal(t, "@@ -0,0 +1 @@\n+hello\n", byName["added.txt"].Content)
+	require.True(t, byName["removed.txt"].IsDeleted)
+	require.Contains(t, byName["changed.txt"].Content, "-line 2\n+line 2 edited\n")
+
+	_, err = DiffRepositories("gist1", "notagist")
+	require.Error(t, err)
+
+	entries, err := os.ReadDir(TmpRepositoriesPath())
+	require.NoError(t, err)
+	require.Empty(t, entries, "The temporary repository should be removed")
+}
+
+func TestDiffRevisions(t *testing.T) {
+	SetupTest(t)
+	defer TeardownTest(t)
+
+	CommitToBare(t, "thomas", "gist1", map[string]string{
+		"file.txt": "line 1\nline 2\nline 3\nline 4\n",
+	})
+	first := LastHashOfCommit(t, "gist1")
+
+	CommitToBare(t, "thomas", "gist1", map[string]string{
+		"file.txt": "line 1\nline 2 edited\nline 3\n",
+	})
+	CommitToBare(t, "thomas", "gist1", map[string]string{
+		"file.txt":  "line 1\nline 2 edited\nline 3\n",
+		"other.txt": "hello\n",
+	})
+	last := LastHashOfCommit(t, "gist1")
+
+	files, err := DiffRevisions("gist1", first, last)
+	require.NoError(t, err, "Could not diff the revisions")
+	require.Len(t, files, 2)
+
+	byName := map[string]*File{}
+	for _, file := range files {
+		byName[file.Filename] = file
+	}
+	require.True(t, byName["other.txt"].IsCreated)
+
+	require.Equal(t, []DiffLine{
+		{Type: DiffHunk, Content: "@@ -1,4 +1,3 @@"},
+		{Type: DiffContext, OldLine: 1, NewLine: 1, Content: "line 1"},
+		{Type: DiffDeleted, OldLine: 2, Content: "line 2"},
+		{Type: DiffAdded, NewLine: 2, Content: "line 2 edited"},
+		{Type: DiffContext, OldLine: 3, NewLine: 3, Content: "line 3"},
+		{Type: DiffDeleted, OldLine: 4, Content: "line 4"},
+	}, byName["file.txt"].DiffLines())
+
+	rows := byName["file.txt"].SplitDiff()
+	require.Len(t, rows, 5)
+	require.Equal(t, DiffHunk, rows[0].Left.Type)
+	require.Equal(t, rows[0].Left, rows[0].Right)
+	require.Equal(t, "line 2", rows[2].Left.Content)
+	require.Equal(t, "line 2 edited", rows[2].Right.Content)
+	require.Equal(t, "line 4", rows[4].Left.Content)
+	require.Nil(t, rows[4].Right)
+
+	files, err = DiffRevisions("gist1", last, first)
+	require.NoError(t, err, "Could not diff the revisions")
+	require.Len(t, files, 2)
+
+	files, err = DiffRevisions("gist1", last, last)
+	require.NoError(t, err, "Could not diff the revisions")
+	require.Empty(t, files)
+}
+
+func TestBranches(t *testing.T) {
+	SetupTest(t)
+	defer TeardownTest(t)
+
+	CommitToBare(t, "thomas", "gist1", map[string]string{
+		"file.txt": "first",
+	})
+	first := LastHashOfCommit(t, "gist1")
+	CommitToBare(t, "thomas", "gist1", map[string]string{
+		"file.txt": "second",
+	})
+
+	cmd := exec.Command("git", "branch", "feature/old", first)
+	cmd.Dir = RepositoryPath("gist1")
+	require.NoError(t, cmd.Run(), "Could not create branch")
+
+	defaultBranch, err := GetDefaultBranch("gist1")
+	require.NoError(t, err, "Could not get the default branch")
+
+	branches, err := GetBranches("gist1")
+	require.NoError(t, err, "Could not get the branches")
+	require.ElementsMatch(t, []string{defaultBranch, "feature/old"}, branches)
+
+	commits, err := GetLog("gist1", "refs/heads/feature/old", 0)
+	require.NoError(t, err, "Could not get the log of the branch")
+	require.Len(t, commits, 1)
+	require.Equal(t, first, commits[0].Hash)
+
+	commits, err = GetLog("gist1", "HEAD", 0)
+	require.NoError(t, err, "Could not get the log of the default branch")
+	require.Len(t, commits, 2)
+}
+
+func TestTags(t *testing.T) {
+	SetupTest(t)
+	defer TeardownTest(t)
+
+	tags, err := GetTags("gist1")
+	require.NoError(t, err, "Could not get the tags of an empty repository")
+	require.Empty(t, tags)
+
+	CommitToBare(t, "thomas", "gist1", map[string]string{
+		"file.txt": "first",
+	})
+	first := LastHashOfCommit(t, "gist1")
+	CommitToBare(t, "thomas", "gist1", map[string]string{
+		"file.txt": "second",
+	})
+	last := LastHashOfCommit(t, "gist1")
+
+	for _, args := range [][]string{
+		{"tag", "v1", first},
+		{"-c", "user.name=thomas", "-c", "user.email=thomas@mail.com", "tag", "-a", "release/v2", "-m", "Second version", last},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = RepositoryPath("gist1")
+		require.NoError(t, cmd.Run(), "Could not create tag")
+	}
+
+	tags, err = GetTags("gist1")
+	require.NoError(t, err, "Could not get the tags")
+	require.Len(t, tags, 2)
+
+	byName := map[string]*Tag{}
+	for _, tag := range tags {
+		byName[tag.Name] = tag
+	}
+	require.Equal(t, first, byName["v1"].Hash)
+	require.Equal(t, "v1", byName["v1"].Revision())
+	require.NotEmpty(t, byName["v1"].Timestamp)
+
+	// an annotated tag is resolved to its commit
+	require.Equal(t, last, byName["release/v2"].Hash)
+	require.Equal(t, "Second version", byName["release/v2"].Message)
+	require.Equal(t, last, byName["release/v2"].Revision())
+
+	content, _, err := GetFileContent("gist1", "v1", "file.txt", false)
+	require.NoError(t, err, "Could not get the content of the file at the tag")
+	require.Equal(t, "first", content)
+}
+
+func TestBlame(t *testing.T) {
+	SetupTest(t)
+	defer TeardownTest(t)
+
+	CommitToBare(t, "thomas", "gist1", map[string]string{
+		"file.txt": "line 1\nline 2\nline 3\n",
+	})
+	first := LastHashOfCommit(t, "gist1")
+
+	CommitToBare(t, "alice", "gist1", map[string]string{
+		"file.txt": "line 1\nline 2 edited\nline 3\n",
+	})
+	last := LastHashOfCommit(t, "gist1")
+
+	hunks, err := Blame("gist1", last, "file.txt")
+	require.NoError(t, err, "Could not blame the file")
+	require.Len(t, hunks, 3)
+
+	require.Equal(t, first, hunks[0].Commit.Hash)
+	require.Equal(t, "thomas", hunks[0].Commit.AuthorName)
+	require.Equal(t, "thomas@mail.com", hunks[0].Commit.AuthorEmail)
+	require.Equal(t, []BlameLine{{Number: 1, Content: "line 1"}}, hunks[0].Lines)
+
+	require.Equal(t, last, hunks[1].Commit.Hash)
+	require.Equal(t, "alice", hunks[1].Commit.AuthorName)
+	require.NotEmpty(t, hunks[1].Commit.Timestamp)
+	require.Equal(t, []BlameLine{{Number: 2, Content: "line 2 edited"}}, hunks[1].Lines)
+
+	// the commit details are given once, the same commit is shared by its hunks
+	require.Same(t, hunks[0].Commit, hunks[2].Commit)
+	require.Equal(t, []BlameLine{{Number: 3, Content: "line 3"}}, hunks[2].Lines)
+
+	hunks, err = Blame("gist1", first, "file.txt")
+	require.NoError(t, err, "Could not blame the file")
+	require.Len(t, hunks, 1)
+	require.Len(t, hunks[0].Lines, 3)
+
+	_, err = Blame("gist1", last, "missing.txt")
+	require.Error(t, err, "A missing file should not be blamed")
+}
+
+func TestForkSharedObjects(t *testing.T) {
+	SetupTest(t)
+	defer TeardownTest(t)
+
+	config.C.GitSharedForkObjects = true
+	defer func() { config.C.GitSharedForkObjects = false }()
+
+	var content strings.Builder
+	for i := 0; i < 20000; i++ {
+		content.WriteString("line number " + strconv.Itoa(i) + " of a large gist\n")
+	}
+	CommitToBare(t, "thomas", "gist1", map[string]string{
+		"large.txt": content.String(),
+	})
+
+	err := ForkClone("gist1", "gist2")
+	require.NoError(t, err, "Could not fork repository")
+	err = ForkClone("gist2", "gist3")
+	require.NoError(t, err, "Could not fork the fork")
+
+	require.FileExists(t, alternatesFile(RepositoryPath("gist2")), "Fork should borrow objects")
+	require.Equal(t, 0, localObjectsCount(t, "gist2"), "Fork should not hold its own objects")
+	require.Equal(t, 0, localObjectsCount(t, "gist3"), "Fork of a fork should not hold its own objects")
+
+	files1, err := GetFilesOfRepository("gist1", "HEAD")
+	require.NoError(t, err)
+	files3, err := GetFilesOfRepository("gist3", "HEAD")
+	require.NoError(t, err)
+	require.Equal(t, files1, files3, "Files are not the same")
+
+	err = DeleteRepository("gist1", []string{"gist2"})
+	require.NoError(t, err, "Could not delete the source repository")
+
+	require.NoFileExists(t, alternatesFile(RepositoryPath("gist2")), "Fork should not borrow from a deleted repository")
+	require.Greater(t, localObjectsCount(t, "gist2"), 0, "Fork should hold its own objects")
+
+	for _, gist := range []string{"gist2", "gist3"} {
+		cmd := exec.Command("git", "fsck", "--full")
+		cmd.Dir = RepositoryPath(gist)
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, "Repository %s is broken: %s", gist, out)
+
+		content, _, err := GetFileContent(gist, "HEAD", "large.txt", false)
+		require.NoError(t, err)
+		require.Contains(t, content, "line number 19999 of a large gist")
+	}
+}
+
+func TestTrashRepository(t *testing.T) {
+	SetupTest(t)
+	defer TeardownTest(t)
+
+	config.C.GitSharedForkObjects = true
+	defer func() { config.C.GitSharedForkObjects = false }()
+
+	CommitToBare(t, "thomas", "gist1", map[string]string{
+		"file.txt": "shared content",
+	})
+
+	err := ForkClone("gist1", "gist2")
+	require.NoError(t, err, "Could not fork repository")
+	err = ForkClone("gist2", "gist3")
+	require.NoError(t, err, "Could not fork the fork")
+
+	err = TrashRepository("gist2", []string{"gist3"})
+	require.NoError(t, err, "Could not trash repository")
+	require.NoDirExists(t, RepositoryPath("gist2"), "Repository should have been moved")
+	require.DirExists(t, TrashedRepositoryPath("gist2"), "Repository should be in the trash")
+	require.NoFileExists(t, alternatesFile(TrashedRepositoryPath("gist2")), "Trashed repository should not borrow objects")
+	require.NoFileExists(t, alternatesFile(RepositoryPath("gist3")), "Fork should not borrow from a trashed repository")
+
+	err = DeleteRepository("gist1", []string{"gist2"})
+	require.NoError(t, err, "Could not delete the source repository")
+
+	err = RestoreRepository("gist2")
+	require.NoError(t, err, "Could not restore repository")
+	require.NoDirExists(t, TrashedRepositoryPath("gist2"), "Repository should not be in the trash anymore")
+
+	for _, gist := range []string{"gist2", "gist3"} {
+		content, _, err := GetFileContent(gist, "HEAD", "file.txt", false)
+		require.NoError(t, err)
+		require.Equal(t, "shared content", content)
+	}
+
+	err = TrashRepository("gist3", nil)
+	require.NoError(t, err, "Could not trash repository")
+	err = DeleteTrashedRepository("gist3")
+	require.NoError(t, err, "Could not delete trashed repository")
+	require.NoDirExists(t, TrashedRepositoryPath("gist3"), "Repository should have been deleted")
+}
+
+func TestLockRepositories(t *testing.T) {
+	stripe := func(gist string) uint32 {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(gist))
+		return h.Sum32() % uint32(len(repositoryLocks))
+	}
+
+	// a gist falling in the same stripe as gist1
+	other := ""
+	for i := 0; other == ""; i++ {
+		if gist := "gist" + strconv.Itoa(i+2); stripe(gist) == stripe("gist1") {
+			other = gist
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		LockRepositories("gist1", other, "gist1")()
+		LockRepositories(other, "gist1")()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Locking repositories sharing a stripe deadlocked")
+	}
+
+	unlock := LockRepository("gist1")
+	unlock()
+}
+
+// localObjectsCount returns the number of objects stored in the repository itself, not borrowed through alternates
+func localObjectsCount(t *testing.T, gist string) int {
+	cmd := exec.Command("git", "count-objects", "-v")
+	cmd.Dir = RepositoryPath(gist)
+	out, err := cmd.Output()
+	require.NoError(t, err, "Could not count objects")
+
+	total := 0
+	for _, line := range strings.Split(string(out), "\n") {
+		key, value, _ := strings.Cut(line, ": ")
+		if key == "count" || key == "in-pack" {
+			n, err := strconv.Atoi(value)
+			require.NoError(t, err)
+			total += n
+		}
+	}
+	return total
+}
+
+func TestRepositorySize(t *testing.T) {
+	SetupTest(t)
+	defer TeardownTest(t)
+
+	size, err := RepositorySize("gist1")
+	require.NoError(t, err, "Could not get the size of an empty repository")
+	require.Equal(t, int64(0), size)
+
+	CommitToBare(t, "thomas", "gist1", map[string]string{
+		"my_file.txt":     "I love Opengist\n",
+		"dir/another.txt": "12345",
+	})
+
+	size, err = RepositorySize("gist1")
+	require.NoError(t, err, "Could not get the size of the repository")
+	require.Equal(t, int64(len("I love Opengist\n")+5), size)
+}
+
 func TestTruncate(t *testing.T) {
 	SetupTest(t)
 	defer TeardownTest(t)
@@ -191,7 +678,7 @@ func TestTruncate(t *testing.T) {
 		"my_file.txt": "A",
 	})
 
-	content, truncated, err := GetFileContent("thomas", "gist1", "HEAD", "my_file.txt", true)
+	content, truncated, err := GetFileContent("gist1", "HEAD", "my_file.txt", true)
 	require.NoError(t, err, "Could not get content")
 	require.False(t, truncated, "Content should not be truncated")
 	require.Equal(t, 1, len(content), "Content size is not correct")
@@ -205,7 +692,7 @@ func TestTruncate(t *testing.T) {
 		"my_file.txt": str,
 	})
 
-	content, truncated, err = GetFileContent("thomas", "gist1", "HEAD", "my_file.txt", true)
+	content, truncated, err = GetFileContent("gist1", "HEAD", "my_file.txt", true)
 	require.NoError(t, err, "Could not get content")
 	require.True(t, truncated, "Content should be truncated")
 	require.Equal(t, truncateLimit, len(content), "Content size should be at truncate limit")
@@ -214,29 +701,223 @@ func TestTruncate(t *testing.T) {
 		"my_file.txt": "AA\n" + str,
 	})
 
-	content, truncated, err = GetFileContent("thomas", "gist1", "HEAD", "my_file.txt", true)
+	content, truncated, err = GetFileContent("gist1", "HEAD", "my_file.txt", true)
 	require.NoError(t, err, "Could not get content")
 	require.True(t, truncated, "Content should be truncated")
 	require.Equal(t, 2, len(content), "Content size is not correct")
 }
 
+func TestOpenFile(t *testing.T) {
+	SetupTest(t)
+	defer TeardownTest(t)
+
+	large := strings.Repeat("A", truncateLimit+10)
+	CommitToBare(t, "thomas", "gist1", map[string]string{
+		"my_file.txt": "I love Opengist\n",
+		"large.txt":   large,
+	})
+
+	file, err := OpenFile("gist1", "HEAD", "my_file.txt")
+	require.NoError(t, err)
+	require.NotNil(t, file)
+	require.Equal(t, uint64(16), file.Size)
+	content, err := io.ReadAll(file)
+	require.NoError(t, err)
+	require.Equal(t, "I love Opengist\n", string(content))
+	require.NoError(t, file.Close())
+
+	file, err = OpenFile("gist1", "HEAD", "large.txt")
+	require.NoError(t, err)
+	head := make([]byte, 10)
+	_, err = io.ReadFull(file, head)
+	require.NoError(t, err)
+	require.NoError(t, file.Close(), "Closing a file read partly should let git exit")
+
+	file, err = OpenFile("gist1", "HEAD", "missing.txt")
+	require.NoError(t, err)
+	require.Nil(t, file)
+
+	file, err = OpenFile("gist1", "0000000", "my_file.txt")
+	require.NoError(t, err)
+	require.Nil(t, file)
+}
+
 func TestGitInitBranchNames(t *testing.T) {
 	SetupTest(t)
 	defer TeardownTest(t)
 
 	cmd := exec.Command("git", "symbolic-ref", "HEAD")
-	cmd.Dir = RepositoryPath("thomas", "gist1")
+	cmd.Dir = RepositoryPath("gist1")
 	out, err := cmd.Output()
 	require.NoError(t, err, "Could not run git command")
 	require.Equal(t, "refs/heads/master", strings.TrimSpace(string(out)), "Repository should have master branch as default")
 
 	config.C.GitDefaultBranch = "main"
 
-	err = InitRepository("thomas", "gist2")
+	err = InitRepository("gist2")
 	require.NoError(t, err)
 	cmd = exec.Command("git", "symbolic-ref", "HEAD")
-	cmd.Dir = RepositoryPath("thomas", "gist2")
+	cmd.Dir = RepositoryPath("gist2")
 	out, err = cmd.Output()
 	require.NoError(t, err, "Could not run git command")
 	require.Equal(t, "refs/heads/main", strings.TrimSpace(string(out)), "Repository should have main branch as default")
 }
+
+func TestGetPatch(t *testing.T) {
+	SetupTest(t)
+	defer TeardownTest(t)
+
+	CommitToBare(t, "thomas", "gist1", map[string]string{
+		"my_file.txt": "I love Opengist\n",
+	})
+	hash := LastHashOfCommit(t, "gist1")
+
+	patch, err := GetPatch("gist1", hash)
+	require.NoError(t, err, "Could not get patch")
+	require.Contains(t, string(patch), "From "+hash)
+	require.Contains(t, string(patch), "+I love Opengist")
+
+	_, err = GetPatch("gist1", "0000000")
+	require.ErrorAs(t, err, new(*RevisionNotFoundError), "Unknown commit should not be found")
+}
+
+func TestArchive(t *testing.T) {
+	SetupTest(t)
+	defer TeardownTest(t)
+
+	archiveFiles := func(hash string) []string {
+		archive, err := Archive("gist1", hash, "zip")
+		require.NoError(t, err, "Could not create archive")
+		reader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+		require.NoError(t, err, "Archive is not a valid zip")
+
+		var names []string
+		for _, f := range reader.File {
+			names = append(names, f.Name)
+		}
+		return names
+	}
+
+	CommitToBare(t, "thomas", "gist1", map[string]string{
+		"my_file.txt":    "I love Opengist\n",
+		"secret.env":     "TOKEN=123\n",
+		".gitattributes": "*.env export-ignore\n",
+	})
+	require.ElementsMatch(t, []string{"my_file.txt", ".gitattributes"}, archiveFiles(LastHashOfCommit(t, "gist1")),
+		"Files marked export-ignore should not be archived")
+
+	CommitToBare(t, "thomas", "gist1", map[string]string{
+		"my_file.txt":    "I love Opengist\n",
+		"secret.env":     "TOKEN=123\n",
+		".gitattributes": "*.env export-ignore\n.gitattributes export-ignore\n",
+	})
+	require.ElementsMatch(t, []string{"my_file.txt"}, archiveFiles(LastHashOfCommit(t, "gist1")),
+		".gitattributes should be excluded when marked export-ignore")
+
+	archive, err := Archive("gist1", LastHashOfCommit(t, "gist1"), "tar.gz")
+	require.NoError(t, err, "Could not create archive")
+	gzipReader, err := gzip.NewReader(bytes.NewReader(archive))
+	require.NoError(t, err, "Archive is not gzipped")
+	tarReader := tar.NewReader(gzipReader)
+	var names []string
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err, "Archive is not a valid tar")
+		if header.Typeflag == tar.TypeReg {
+			names = append(names, header.Name)
+		}
+	}
+	require.ElementsMatch(t, []string{"my_file.txt"}, names, "The tar.gz archive should hold the same files")
+
+	_, err = Archive("gist1", "0000000", "zip")
+	require.ErrorAs(t, err, new(*RevisionNotFoundError), "Unknown commit should not be found")
+}
+
+func TestGitTimeout(t *testing.T) {
+	SetupTest(t)
+	defer TeardownTest(t)
+
+	// a fake git never answering, found before the real one in the PATH
+	fakeGitDir := t.TempDir()
+	err := os.WriteFile(path.Join(fakeGitDir, "git"), []byte("#!/bin/sh\nexec sleep 30\n"), 0755)
+	require.NoError(t, err, "Could not create fake git")
+	t.Setenv("PATH", fakeGitDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	config.C.GitTimeout = 1
+
+	start := time.Now()
+	_, err = GetRevisionHash("gist1", "HEAD")
+	require.ErrorAs(t, err, new(*TimeoutError), "Slow git command should time out")
+	require.Less(t, time.Since(start), 10*time.Second, "Slow git command should be killed")
+
+	_, _, err = GetFileContent("gist1", "HEAD", "my_file.txt", false)
+	require.ErrorAs(t, err, new(*TimeoutError), "Slow git command should time out")
+}
+
+func TestCommandLogs(t *testing.T) {
+	SetupTest(t)
+	defer TeardownTest(t)
+
+	var logs bytes.Buffer
+	defaultLogger := log.Logger
+	log.Logger = zerolog.New(&logs).Level(zerolog.DebugLevel)
+	defer func() { log.Logger = defaultLogger }()
+
+	lastLog := func() map[string]interface{} {
+		lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+		entry := make(map[string]interface{})
+		require.NoError(t, json.Unmarshal([]byte(lines[len(lines)-1]), &entry), "Could not parse log")
+		logs.Reset()
+		return entry
+	}
+
+	// a revision not found is expected, it is logged at the debug level
+	_, err := GetRevisionHash("gist1", "unknown")
+	require.ErrorAs(t, err, new(*RevisionNotFoundError))
+	entry := lastLog()
+	require.Equal(t, "debug", entry["level"])
+	require.Equal(t, "rev-parse", entry["command"])
+	require.Equal(t, float64(1), entry["exit_code"])
+
+	_, _, err = GetFileContent("gist1", "HEAD", "my_file.txt", false)
+	require.Error(t, err)
+	entry = lastLog()
+	require.Equal(t, "debug", entry["level"])
+	require.Equal(t, float64(128), entry["exit_code"])
+	require.NotEmpty(t, entry["stderr"])
+
+	// other failures are errors, logged along with the error output of git
+	cmd := newCommand("not-a-command")
+	require.Error(t, cmd.Run())
+	entry = lastLog()
+	require.Equal(t, "error", entry["level"])
+	require.Equal(t, []interface{}{"not-a-command"}, entry["args"])
+	require.Equal(t, float64(1), entry["exit_code"])
+	require.Contains(t, entry["stderr"], "not-a-command")
+
+	CommitToBare(t, "thomas", "gist1", nil)
+	logs.Reset()
+	_, err = CountCommits("gist1")
+	require.NoError(t, err)
+	entry = lastLog()
+	require.Equal(t, "debug", entry["level"])
+	require.Equal(t, "rev-list", entry["command"])
+	require.Equal(t, float64(0), entry["exit_code"])
+}
+
+func TestFileKinds(t *testing.T) {
+	image := &File{Filename: "diagram.PNG", Content: "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"}
+	require.True(t, image.IsImage())
+	require.True(t, image.IsBinary())
+
+	binary := &File{Filename: "program.bin", Content: "ELF\x00\x01"}
+	require.False(t, binary.IsImage())
+	require.True(t, binary.IsBinary())
+
+	text := &File{Filename: "notes.txt", Content: "just text"}
+	require.False(t, text.IsImage())
+	require.False(t, text.IsBinary())
+}
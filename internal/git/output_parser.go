@@ -6,6 +6,10 @@ import (
 	"encoding/csv"
 	"fmt"
 	"io"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 )
 
@@ -20,12 +24,51 @@ type File struct {
 	IsDeleted   bool   `json:"-"`
 }
 
+var imageExtensions = []string{".png", ".jpg", ".jpeg", ".gif", ".webp", ".avif"}
+
+// IsImage reports whether the file is an image that browsers can display, based on its extension
+func (f *File) IsImage() bool {
+	return slices.Contains(imageExtensions, strings.ToLower(filepath.Ext(f.Filename)))
+}
+
+// IsBinary uses the same heuristic as Git, a file with a NUL byte in its first 8000 bytes is considered binary
+func (f *File) IsBinary() bool {
+	content := f.Content
+	if len(content) > 8000 {
+		content = content[:8000]
+	}
+	return strings.IndexByte(content, 0) != -1
+}
+
 type CsvFile struct {
 	File
 	Header []string
 	Rows   [][]string
 }
 
+// The types of the lines of a diff
+const (
+	DiffHunk    = "hunk"
+	DiffContext = "context"
+	DiffAdded   = "added"
+	DiffDeleted = "deleted"
+)
+
+// DiffLine is a line of the diff of a file, with its numbers in the old and the new file, 0 for the file it is not in
+type DiffLine struct {
+	Type    string `json:"type"`
+	OldLine int    `json:"old_line,omitempty"`
+	NewLine int    `json:"new_line,omitempty"`
+	Content string `json:"content"`
+}
+
+// DiffRow is a row of the split view of a diff, the line of the old file on the left and the one of the new file on
+// the right. A hunk header or a context line is on both sides, a side is nil when the other one has no counterpart.
+type DiffRow struct {
+	Left  *DiffLine `json:"left"`
+	Right *DiffLine `json:"right"`
+}
+
 type Commit struct {
 	Hash        string
 	AuthorName  string
@@ -35,6 +78,42 @@ type Commit struct {
 	Files       []File
 }
 
+// Tag is a tag of the repository pointing to a commit, a version of the gist
+type Tag struct {
+	Name      string
+	Hash      string // of the commit tagged
+	Timestamp string
+	Message   string // subject of an annotated tag, or of the commit tagged by a lightweight one
+}
+
+// Revision returns how the tag is named in URLs, its commit if the name holds a slash a route parameter cannot match
+func (t *Tag) Revision() string {
+	if strings.Contains(t.Name, "/") {
+		return t.Hash
+	}
+	return t.Name
+}
+
+// BlameCommit is a commit that last changed some lines of a blamed file
+type BlameCommit struct {
+	Hash        string
+	AuthorName  string
+	AuthorEmail string
+	Timestamp   string
+	Summary     string
+}
+
+type BlameLine struct {
+	Number  int
+	Content string
+}
+
+// BlameHunk is a run of consecutive lines of a blamed file last changed by the same commit
+type BlameHunk struct {
+	Commit *BlameCommit
+	Lines  []BlameLine
+}
+
 func truncateCommandOutput(out io.Reader, maxBytes int64) (string, bool, error) {
 	var buf []byte
 	var err error
@@ -368,3 +447,151 @@ func ParseCsv(file *File) (*CsvFile, error) {
 		Rows:   records[1:],
 	}, nil
 }
+
+var hunkHeaderRegex = regexp.MustCompile(`^@@ -(\d+)(?:,\d+)? \+(\d+)(?:,\d+)? @@`)
+
+// DiffLines parses the diff of the file into its lines, the content is the one of git diff from the first hunk header
+func (f *File) DiffLines() []DiffLine {
+	var lines []DiffLine
+	var oldLine, newLine int
+
+	for _, line := range strings.Split(f.Content, "\n") {
+		if line == "" {
+			continue
+		}
+
+		switch line[0] {
+		case '@':
+			if matches := hunkHeaderRegex.FindStringSubmatch(line); matches != nil {
+				oldLine, _ = strconv.Atoi(matches[1])
+				newLine, _ = strconv.Atoi(matches[2])
+			}
+			lines = append(lines, DiffLine{Type: DiffHunk, Content: line})
+		case '+':
+			lines = append(lines, DiffLine{Type: DiffAdded, NewLine: newLine, Content: line[1:]})
+			newLine++
+		case '-':
+			lines = append(lines, DiffLine{Type: DiffDeleted, OldLine: oldLine, Content: line[1:]})
+			oldLine++
+		case ' ':
+			lines = append(lines, DiffLine{Type: DiffContext, OldLine: oldLine, NewLine: newLine, Content: line[1:]})
+			oldLine++
+			newLine++
+		}
+		// the "\ No newline at end of file" markers are left out
+	}
+
+	return lines
+}
+
+// SplitDiff lays out the lines of the diff of the file side by side, the lines deleted facing the ones added in their
+// place
+func (f *File) SplitDiff() []DiffRow {
+	lines := f.DiffLines()
+	var rows []DiffRow
+	var deleted, added []*DiffLine
+
+	flush := func() {
+		for i := 0; i < max(len(deleted), len(added)); i++ {
+			var row DiffRow
+			if i < len(deleted) {
+				row.Left = deleted[i]
+			}
+			if i < len(added) {
+				row.Right = added[i]
+			}
+			rows = append(rows, row)
+		}
+		deleted, added = nil, nil
+	}
+
+	for i := range lines {
+		line := &lines[i]
+		switch line.Type {
+		case DiffDeleted:
+			// a deletion after additions starts another change
+			if len(added) > 0 {
+				flush()
+			}
+			deleted = append(deleted, line)
+		case DiffAdded:
+			added = append(added, line)
+		default:
+			flush()
+			rows = append(rows, DiffRow{Left: line, Right: line})
+		}
+	}
+	flush()
+
+	return rows
+}
+
+// parseBlame reads the output of git blame --porcelain, where the details of a commit are only given the first time
+// one of its lines is, and each line starts with a header holding its commit hash and its numbers
+func parseBlame(out io.Reader) ([]*BlameHunk, error) {
+	var hunks []*BlameHunk
+	commits := map[string]*BlameCommit{}
+	var commit *BlameCommit
+	number := 0
+
+	input := bufio.NewReader(out)
+	for {
+		line, err := input.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+
+		if strings.HasPrefix(line, "\t") {
+			if commit != nil {
+				// the lines of a commit are grouped only if they follow each other in the file
+				if len(hunks) == 0 || hunks[len(hunks)-1].Commit != commit {
+					hunks = append(hunks, &BlameHunk{Commit: commit})
+				}
+				hunk := hunks[len(hunks)-1]
+				hunk.Lines = append(hunk.Lines, BlameLine{Number: number, Content: line[1:]})
+			}
+		} else if key, value, _ := strings.Cut(line, " "); isCommitHash(key) {
+			// "<hash> <line in the original file> <line in the final file> [<lines in the group>]"
+			fields := strings.Fields(value)
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("invalid blame header: %q", line)
+			}
+			if number, err = strconv.Atoi(fields[1]); err != nil {
+				return nil, fmt.Errorf("invalid blame header: %q", line)
+			}
+			if commit = commits[key]; commit == nil {
+				commit = &BlameCommit{Hash: key}
+				commits[key] = commit
+			}
+		} else if commit != nil {
+			switch key {
+			case "author":
+				commit.AuthorName = value
+			case "author-mail":
+				commit.AuthorEmail = strings.TrimSuffix(strings.TrimPrefix(value, "<"), ">")
+			case "author-time":
+				commit.Timestamp = value
+			case "summary":
+				commit.Summary = value
+			}
+		}
+
+		if err == io.EOF {
+			return hunks, nil
+		}
+	}
+}
+
+// isCommitHash reports whether the string is a full SHA-1 or SHA-256 commit hash
+func isCommitHash(s string) bool {
+	if len(s) != 40 && len(s) != 64 {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -20,18 +20,22 @@ func SetupTest(t *testing.T) {
 
 	err = os.MkdirAll(path.Join(config.GetHomeDir(), "tests"), 0755)
 	ReposDirectory = path.Join("tests")
+	TrashDirectory = path.Join("tests-trash")
 	require.NoError(t, err)
 
 	err = os.MkdirAll(filepath.Join(config.GetHomeDir(), "tmp", "repos"), 0755)
 	require.NoError(t, err)
 
-	err = InitRepository("thomas", "gist1")
+	err = InitRepository("gist1")
 	require.NoError(t, err)
 }
 
 func TeardownTest(t *testing.T) {
 	err := os.RemoveAll(path.Join(config.GetHomeDir(), "tests"))
 	require.NoError(t, err, "Could not remove repos directory")
+
+	err = os.RemoveAll(path.Join(config.GetHomeDir(), "tests-trash"))
+	require.NoError(t, err, "Could not remove trash directory")
 }
 
 func CommitToBare(t *testing.T, user string, gist string, files map[string]string) {
@@ -62,9 +66,9 @@ func CommitToBare(t *testing.T, user string, gist string, files map[string]strin
 	}
 }
 
-func LastHashOfCommit(t *testing.T, user string, gist string) string {
+func LastHashOfCommit(t *testing.T, gist string) string {
 	cmd := exec.Command("git", "rev-parse", "HEAD")
-	cmd.Dir = RepositoryPath(user, gist)
+	cmd.Dir = RepositoryPath(gist)
 	out, err := cmd.Output()
 	require.NoError(t, err, "Could not run git command")
 	return strings.TrimSpace(string(out))
@@ -6,6 +6,7 @@ import (
 	"github.com/thomiceli/opengist/internal/db"
 	"github.com/thomiceli/opengist/internal/git"
 	"github.com/thomiceli/opengist/internal/utils"
+	"github.com/thomiceli/opengist/internal/webhook"
 	"io"
 	"os"
 	"os/exec"
@@ -16,6 +17,7 @@ import (
 func PostReceive(in io.Reader, out, er io.Writer) error {
 	var outputSb strings.Builder
 	newGist := false
+	createdBranches := 0
 	opts := pushOptions()
 	gistUrl := os.Getenv("OPENGIST_REPOSITORY_URL_INTERNAL")
 	validator := utils.NewValidator()
@@ -28,14 +30,17 @@ func PostReceive(in io.Reader, out, er io.Writer) error {
 			_, _ = fmt.Fprintln(er, "Invalid input")
 			return fmt.Errorf("invalid input")
 		}
-		oldrev, _, refname := parts[0], parts[1], parts[2]
+		oldrev, newrev, refname := parts[0], parts[1], parts[2]
+		if !strings.HasPrefix(refname, "refs/heads/") || newrev == BaseHash {
+			continue
+		}
 
 		if err := verifyHEAD(); err != nil {
 			setSymbolicRef(refname)
 		}
 
 		if oldrev == BaseHash {
-			newGist = true
+			createdBranches++
 		}
 	}
 
@@ -45,12 +50,23 @@ func PostReceive(in io.Reader, out, er io.Writer) error {
 		return fmt.Errorf("failed to get gist: %w", err)
 	}
 
+	// the gist is new if all its branches were created by this push, not if a branch is added to it
+	if createdBranches > 0 {
+		branches, err := git.GetBranches(gist.Uuid)
+		if err != nil {
+			_, _ = fmt.Fprintln(er, "Failed to get branches")
+			return fmt.Errorf("failed to get branches: %w", err)
+		}
+		newGist = len(branches) == createdBranches
+	}
+
 	if slices.Contains([]string{"public", "unlisted", "private"}, opts["visibility"]) {
-		gist.Private, _ = db.ParseVisibility(opts["visibility"])
-		outputSb.WriteString(fmt.Sprintf("Gist visibility set to %s\n\n", opts["visibility"]))
+		visibility, _ := db.ParseVisibility(opts["visibility"])
+		gist.Private = gist.User.AllowedVisibility(visibility)
+		outputSb.WriteString(fmt.Sprintf("Gist visibility set to %s\n\n", gist.Private.String()))
 	}
 
-	if opts["url"] != "" && validator.Var(opts["url"], "max=32,alphanumdashorempty") == nil {
+	if opts["url"] != "" && validator.Var(opts["url"], "max=32,alphanumdashorempty,notreservedgist") == nil {
 		gist.URL = opts["url"]
 		lastIndex := strings.LastIndex(gistUrl, "/")
 		gistUrl = gistUrl[:lastIndex+1] + gist.URL
@@ -65,11 +81,11 @@ func PostReceive(in io.Reader, out, er io.Writer) error {
 		outputSb.WriteString(fmt.Sprintf("Gist title set to \"%s\"\n\n", opts["title"]))
 	}
 
-	if hasNoCommits, err := git.HasNoCommits(gist.User.Username, gist.Uuid); err != nil {
+	if hasNoCommits, err := git.HasNoCommits(gist.Uuid); err != nil {
 		_, _ = fmt.Fprintln(er, "Failed to check if gist has no commits")
 		return fmt.Errorf("failed to check if gist has no commits: %w", err)
 	} else if hasNoCommits {
-		if err = gist.Delete(); err != nil {
+		if err = gist.Purge(); err != nil {
 			_, _ = fmt.Fprintln(er, "Failed to delete gist")
 			return fmt.Errorf("failed to delete gist: %w", err)
 		}
@@ -84,6 +100,13 @@ func PostReceive(in io.Reader, out, er io.Writer) error {
 
 	gist.AddInIndex()
 
+	// the pusher is not known here, the deliveries are sent by the server
+	if newGist {
+		webhook.Trigger(webhook.GistCreated, gist, nil)
+	} else {
+		webhook.Trigger(webhook.GistUpdated, gist, nil)
+	}
+
 	if newGist {
 		outputSb.WriteString(fmt.Sprintf("Your new gist has been created here: %s\n", gistUrl))
 		outputSb.WriteString("If you want to keep working with your gist, you could set the Git remote URL via:\n")
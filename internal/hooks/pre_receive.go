@@ -23,7 +23,17 @@ func PreReceive(in io.Reader, out, er io.Writer) error {
 			return fmt.Errorf("invalid input")
 		}
 
-		oldRev, newRev := parts[0], parts[1]
+		oldRev, newRev, refName := parts[0], parts[1], parts[2]
+
+		// a deleted branch brings no files, but the default one is what the gist shows
+		if newRev == BaseHash {
+			if refName == headRef() {
+				_, _ = fmt.Fprintln(out, "\nDeleting the default branch is not allowed")
+				_, _ = fmt.Fprintln(out)
+				return fmt.Errorf("deleting the default branch is not allowed: %s", refName)
+			}
+			continue
+		}
 
 		var changedFiles string
 		if oldRev == BaseHash {
@@ -64,6 +74,12 @@ func PreReceive(in io.Reader, out, er io.Writer) error {
 	return nil
 }
 
+// headRef returns the branch HEAD points to, the default branch of the gist
+func headRef() string {
+	out, _ := exec.Command("git", "symbolic-ref", "HEAD").Output()
+	return strings.TrimSpace(string(out))
+}
+
 func getChangedFiles(rev string) (string, error) {
 	cmd := exec.Command("git", "log", "--name-only", "--format=/%H", "--diff-filter=AM", rev)
 
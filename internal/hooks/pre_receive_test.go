@@ -13,14 +13,14 @@ func TestPreReceiveHook(t *testing.T) {
 	git.SetupTest(t)
 	defer git.TeardownTest(t)
 	var lastCommitHash string
-	err := os.Chdir(git.RepositoryPath("thomas", "gist1"))
+	err := os.Chdir(git.RepositoryPath("gist1"))
 	require.NoError(t, err, "Could not change directory")
 
 	git.CommitToBare(t, "thomas", "gist1", map[string]string{
 		"my_file.txt":  "some allowed file",
 		"my_file2.txt": "some allowed file\nagain",
 	})
-	lastCommitHash = git.LastHashOfCommit(t, "thomas", "gist1")
+	lastCommitHash = git.LastHashOfCommit(t, "gist1")
 	err = PreReceive(bytes.NewBufferString(fmt.Sprintf("%s %s %s", BaseHash, lastCommitHash, "refs/heads/master")), os.Stdout, os.Stderr)
 	require.NoError(t, err, "Should not have an error on pre-receive hook for commit+push 1")
 
@@ -28,7 +28,7 @@ func TestPreReceiveHook(t *testing.T) {
 		"my_file.txt":     "some allowed file",
 		"dir/my_file.txt": "some disallowed file suddenly",
 	})
-	lastCommitHash = git.LastHashOfCommit(t, "thomas", "gist1")
+	lastCommitHash = git.LastHashOfCommit(t, "gist1")
 	err = PreReceive(bytes.NewBufferString(fmt.Sprintf("%s %s %s", BaseHash, lastCommitHash, "refs/heads/master")), os.Stdout, os.Stderr)
 	require.Error(t, err, "Should have an error on pre-receive hook for commit+push 2")
 	require.Equal(t, "pushing files in directories is not allowed: [dir/my_file.txt]", err.Error(), "Error message is not correct")
@@ -37,7 +37,7 @@ func TestPreReceiveHook(t *testing.T) {
 		"my_file.txt":           "some allowed file",
 		"dir/ok/afileagain.txt": "some disallowed file\nagain",
 	})
-	lastCommitHash = git.LastHashOfCommit(t, "thomas", "gist1")
+	lastCommitHash = git.LastHashOfCommit(t, "gist1")
 	err = PreReceive(bytes.NewBufferString(fmt.Sprintf("%s %s %s", BaseHash, lastCommitHash, "refs/heads/master")), os.Stdout, os.Stderr)
 	require.Error(t, err, "Should have an error on pre-receive hook for commit+push 3")
 	require.Equal(t, "pushing files in directories is not allowed: [dir/ok/afileagain.txt dir/my_file.txt]", err.Error(), "Error message is not correct")
@@ -45,10 +45,35 @@ func TestPreReceiveHook(t *testing.T) {
 	git.CommitToBare(t, "thomas", "gist1", map[string]string{
 		"allowedfile.txt": "some allowed file only",
 	})
-	lastCommitHash = git.LastHashOfCommit(t, "thomas", "gist1")
+	lastCommitHash = git.LastHashOfCommit(t, "gist1")
 	err = PreReceive(bytes.NewBufferString(fmt.Sprintf("%s %s %s", BaseHash, lastCommitHash, "refs/heads/master")), os.Stdout, os.Stderr)
 	require.Error(t, err, "Should have an error on pre-receive hook for commit+push 4")
 	require.Equal(t, "pushing files in directories is not allowed: [dir/ok/afileagain.txt dir/my_file.txt]", err.Error(), "Error message is not correct")
 
 	_ = os.Chdir(os.TempDir()) // Leave the current dir to avoid errors on teardown
 }
+
+func TestPreReceiveHookDeleteBranch(t *testing.T) {
+	git.SetupTest(t)
+	defer git.TeardownTest(t)
+	err := os.Chdir(git.RepositoryPath("gist1"))
+	require.NoError(t, err, "Could not change directory")
+
+	git.CommitToBare(t, "thomas", "gist1", map[string]string{
+		"my_file.txt": "some allowed file",
+	})
+	lastCommitHash := git.LastHashOfCommit(t, "gist1")
+	defaultBranch, err := git.GetDefaultBranch("gist1")
+	require.NoError(t, err, "Could not get the default branch")
+
+	err = PreReceive(bytes.NewBufferString(fmt.Sprintf("%s %s %s", BaseHash, lastCommitHash, "refs/heads/other")), os.Stdout, os.Stderr)
+	require.NoError(t, err, "Should not have an error on pre-receive hook for a new branch")
+
+	err = PreReceive(bytes.NewBufferString(fmt.Sprintf("%s %s %s", lastCommitHash, BaseHash, "refs/heads/other")), os.Stdout, os.Stderr)
+	require.NoError(t, err, "Should not have an error on pre-receive hook for a deleted branch")
+
+	err = PreReceive(bytes.NewBufferString(fmt.Sprintf("%s %s %s", lastCommitHash, BaseHash, "refs/heads/"+defaultBranch)), os.Stdout, os.Stderr)
+	require.Error(t, err, "Should have an error on pre-receive hook for the deleted default branch")
+
+	_ = os.Chdir(os.TempDir()) // Leave the current dir to avoid errors on teardown
+}
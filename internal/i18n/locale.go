@@ -16,6 +16,9 @@ import (
 
 var Locales = NewLocaleStore()
 
+// fallbackLocale holds every message, it is used for the keys missing from the other locales
+const fallbackLocale = "en-US"
+
 type LocaleStore struct {
 	Locales map[string]*Locale
 }
@@ -108,14 +111,17 @@ func (store *LocaleStore) MatchTag(langs []language.Tag) string {
 		}
 	}
 
-	return "en-US"
+	return fallbackLocale
 }
 
 func (l *Locale) String(key string, args ...any) string {
 	message := l.Messages[key]
 
 	if message == "" {
-		return Locales.Locales["en-US"].String(key, args...)
+		if l.Code == fallbackLocale {
+			return key
+		}
+		return Locales.Locales[fallbackLocale].String(key, args...)
 	}
 
 	if len(args) == 0 {
@@ -129,7 +135,10 @@ func (l *Locale) Tr(key string, args ...any) template.HTML {
 	message := l.Messages[key]
 
 	if message == "" {
-		return Locales.Locales["en-US"].Tr(key, args...)
+		if l.Code == fallbackLocale {
+			return template.HTML(key)
+		}
+		return Locales.Locales[fallbackLocale].Tr(key, args...)
 	}
 
 	if len(args) == 0 {
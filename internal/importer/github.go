@@ -0,0 +1,192 @@
+package importer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"github.com/thomiceli/opengist/internal/config"
+	"github.com/thomiceli/opengist/internal/db"
+	"github.com/thomiceli/opengist/internal/git"
+)
+
+// GithubAPIURL is the root of the GitHub REST API the gists are fetched from
+var GithubAPIURL = "https://api.github.com"
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+var ErrGithubUserRequired = errors.New("a GitHub username or token is required")
+
+type GithubImportDTO struct {
+	Username string `form:"github_username" validate:"max=39"`
+	Token    string `form:"github_token"`
+}
+
+type GithubGist struct {
+	ID          string                     `json:"id"`
+	Description string                     `json:"description"`
+	Public      bool                       `json:"public"`
+	CreatedAt   time.Time                  `json:"created_at"`
+	Files       map[string]*GithubGistFile `json:"files"`
+}
+
+type GithubGistFile struct {
+	Filename string `json:"filename"`
+	RawURL   string `json:"raw_url"`
+}
+
+// GithubImport is the outcome of an import, the gists that could not be imported are keyed by their GitHub ID
+type GithubImport struct {
+	Imported []*db.Gist
+	Failed   map[string]error
+}
+
+// ImportGithubGists creates a gist for each gist of the GitHub user, with the files of its latest revision. With a
+// token, the gists of the token owner are imported, secret ones included. Public gists stay public, secret ones are
+// unlisted as anyone with their link can see them on GitHub.
+func ImportGithubGists(user *db.User, dto *GithubImportDTO) (*GithubImport, error) {
+	gists, err := fetchGithubGists(dto.Username, dto.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &GithubImport{Failed: make(map[string]error)}
+	for _, githubGist := range gists {
+		gist, err := importGithubGist(user, githubGist, dto.Token)
+		if err != nil {
+			log.Warn().Err(err).Str("github_gist", githubGist.ID).Msg("Cannot import GitHub gist")
+			result.Failed[githubGist.ID] = err
+			continue
+		}
+		result.Imported = append(result.Imported, gist)
+	}
+
+	return result, nil
+}
+
+func fetchGithubGists(username string, token string) ([]*GithubGist, error) {
+	endpoint := "/gists"
+	if token == "" {
+		if username == "" {
+			return nil, ErrGithubUserRequired
+		}
+		endpoint = "/users/" + url.PathEscape(username) + "/gists"
+	}
+
+	var gists []*GithubGist
+	for page := 1; ; page++ {
+		body, err := githubGet(GithubAPIURL+endpoint+fmt.Sprintf("?per_page=100&page=%d", page), token)
+		if err != nil {
+			return nil, err
+		}
+
+		var pageGists []*GithubGist
+		err = json.Unmarshal(body, &pageGists)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse the gists from GitHub: %w", err)
+		}
+
+		gists = append(gists, pageGists...)
+		if len(pageGists) < 100 {
+			return gists, nil
+		}
+	}
+}
+
+func importGithubGist(user *db.User, githubGist *GithubGist, token string) (*db.Gist, error) {
+	if len(githubGist.Files) == 0 {
+		return nil, errors.New("gist has no files")
+	}
+	if len(githubGist.Files) > config.C.GistMaxFiles {
+		return nil, fmt.Errorf("gist has more than %d files", config.C.GistMaxFiles)
+	}
+
+	filenames := make([]string, 0, len(githubGist.Files))
+	for filename := range githubGist.Files {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	files := make([]db.FileDTO, 0, len(filenames))
+	previewFiles := make([]*git.File, 0, len(filenames))
+	for _, filename := range filenames {
+		if !config.C.FileExtensionAllowed(filename) {
+			return nil, fmt.Errorf("file extension of %s is not allowed", filename)
+		}
+
+		content, err := githubGet(githubGist.Files[filename].RawURL, token)
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, db.FileDTO{Filename: filename, Content: string(content)})
+		previewFiles = append(previewFiles, &git.File{Filename: filename, Content: string(content)})
+	}
+
+	uuidGist, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+
+	gist := &db.Gist{
+		Uuid:        strings.Replace(uuidGist.String(), "-", "", -1),
+		Title:       truncate(filenames[0], 250),
+		Description: truncate(githubGist.Description, 1000),
+		Private:     db.UnlistedVisibility,
+		AllowForks:  true,
+		UserID:      user.ID,
+		User:        *user,
+		NbFiles:     len(files),
+		CreatedAt:   githubGist.CreatedAt.Unix(),
+	}
+	if githubGist.Public {
+		gist.Private = user.AllowedVisibility(db.PublicVisibility)
+	}
+	gist.SetPreview(previewFiles)
+
+	if err = gist.CreateWithFiles(files, user); err != nil {
+		return nil, err
+	}
+	gist.AddInIndex()
+
+	return gist, nil
+}
+
+func githubGet(endpoint string, token string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GitHub answered %s to %s", res.Status, req.URL.Path)
+	}
+
+	return io.ReadAll(res.Body)
+}
+
+func truncate(s string, length int) string {
+	if utf8.RuneCountInString(s) <= length {
+		return s
+	}
+	return string([]rune(s)[:length])
+}
@@ -137,9 +137,14 @@ func SearchGists(queryStr string, queryMetadata SearchGistMetadata, gistsIds []u
 	var err error
 	var indexerQuery query.Query
 	if queryStr != "" {
-		contentQuery := bleve.NewMatchPhraseQuery(queryStr)
-		contentQuery.FieldVal = "Content"
-		indexerQuery = contentQuery
+		// the text is looked for in the title and the description of the gists as well as in their files
+		textQueries := make([]query.Query, 0, 3)
+		for _, field := range []string{"Content", "Title", "Description"} {
+			q := bleve.NewMatchPhraseQuery(queryStr)
+			q.FieldVal = field
+			textQueries = append(textQueries, q)
+		}
+		indexerQuery = bleve.NewDisjunctionQuery(textQueries...)
 	} else {
 		contentQuery := bleve.NewMatchAllQuery()
 		indexerQuery = contentQuery
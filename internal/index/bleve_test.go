@@ -0,0 +1,40 @@
+package index
+
+import (
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thomiceli/opengist/internal/config"
+)
+
+func TestSearchGists(t *testing.T) {
+	require.NoError(t, config.InitConfig("", io.Discard))
+	config.C.IndexEnabled = true
+
+	bleveIndex, err := open(filepath.Join(t.TempDir(), "opengist.index"))
+	require.NoError(t, err)
+	atomicIndexer.Store(&Indexer{Index: bleveIndex})
+	defer Close()
+
+	gists := []*Gist{
+		{GistID: 1, Username: "thomas", Title: "gist1", Content: "a needle in the content"},
+		{GistID: 2, Username: "thomas", Title: "the needle", Content: "nothing"},
+		{GistID: 3, Username: "thomas", Title: "gist3", Description: "a needle described", Content: "nothing"},
+		{GistID: 4, Username: "thomas", Title: "gist4", Content: "nothing"},
+		{GistID: 5, Username: "kaguya", Title: "needle", Content: "nothing"},
+	}
+	for _, gist := range gists {
+		require.NoError(t, AddInIndex(gist))
+	}
+
+	ids, total, _, err := SearchGists("needle", SearchGistMetadata{}, []uint{1, 2, 3, 4}, 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), total)
+	require.ElementsMatch(t, []uint{1, 2, 3}, ids, "The text should be found in the content, the title and the description")
+
+	ids, _, _, err = SearchGists("needle", SearchGistMetadata{Username: "kaguya"}, []uint{1, 2, 3, 4, 5}, 1)
+	require.NoError(t, err)
+	require.Equal(t, []uint{5}, ids)
+}
@@ -0,0 +1,133 @@
+// Package mailer sends the emails of the instance through an SMTP server
+package mailer
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"time"
+
+	"github.com/thomiceli/opengist/internal/config"
+)
+
+var ErrNoMailer = errors.New("no SMTP server is configured")
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers the messages
+type Mailer interface {
+	Send(msg *Message) error
+}
+
+var mailer Mailer
+
+// Setup sends the emails through the SMTP server of the config, none are sent if it has no host
+func Setup() {
+	if config.C.SmtpHost == "" {
+		mailer = nil
+		return
+	}
+	mailer = &smtpMailer{}
+}
+
+// SetMailer replaces the way the messages are delivered, nil disables the emails
+func SetMailer(m Mailer) {
+	mailer = m
+}
+
+// Enabled reports whether the emails can be sent
+func Enabled() bool {
+	return mailer != nil
+}
+
+func Send(msg *Message) error {
+	if mailer == nil {
+		return ErrNoMailer
+	}
+	return mailer.Send(msg)
+}
+
+type smtpMailer struct{}
+
+// Send delivers the message with STARTTLS when the server offers it, or over TLS from the start on port 465
+func (m *smtpMailer) Send(msg *Message) error {
+	host := config.C.SmtpHost
+	addr := net.JoinHostPort(host, config.C.SmtpPort)
+
+	var auth smtp.Auth
+	if config.C.SmtpUsername != "" {
+		auth = smtp.PlainAuth("", config.C.SmtpUsername, config.C.SmtpPassword, host)
+	}
+
+	data, err := msg.bytes(config.C.SmtpFrom)
+	if err != nil {
+		return err
+	}
+
+	if config.C.SmtpPort != "465" {
+		return smtp.SendMail(addr, auth, config.C.SmtpFrom, []string{msg.To}, data)
+	}
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", addr, &tls.Config{ServerName: host})
+	if err != nil {
+		return err
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if auth != nil {
+		if err = client.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err = client.Mail(config.C.SmtpFrom); err != nil {
+		return err
+	}
+	if err = client.Rcpt(msg.To); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(data); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// bytes formats the message with its headers, the body is encoded in quoted-printable
+func (msg *Message) bytes(from string) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	buf.WriteString("From: " + from + "\r\n")
+	buf.WriteString("To: " + msg.To + "\r\n")
+	buf.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", msg.Subject) + "\r\n")
+	buf.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	w := quotedprintable.NewWriter(buf)
+	if _, err := w.Write([]byte(msg.Body)); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
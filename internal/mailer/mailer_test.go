@@ -0,0 +1,79 @@
+package mailer
+
+import (
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thomiceli/opengist/internal/config"
+)
+
+// serveSMTP answers a single SMTP session on the listener and sends back the data of the message it received
+func serveSMTP(listener net.Listener) <-chan string {
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			received <- ""
+			return
+		}
+		defer conn.Close()
+
+		tp := textproto.NewConn(conn)
+		_ = tp.PrintfLine("220 localhost ESMTP")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				received <- ""
+				return
+			}
+			switch {
+			case strings.HasPrefix(line, "DATA"):
+				_ = tp.PrintfLine("354 go ahead")
+				data, _ := io.ReadAll(tp.DotReader()) // the lines end with \n once read
+				received <- string(data)
+				_ = tp.PrintfLine("250 ok")
+			case strings.HasPrefix(line, "QUIT"):
+				_ = tp.PrintfLine("221 bye")
+				return
+			default:
+				_ = tp.PrintfLine("250 ok")
+			}
+		}
+	}()
+	return received
+}
+
+func TestSend(t *testing.T) {
+	require.NoError(t, config.InitConfig("", io.Discard))
+
+	Setup()
+	require.False(t, Enabled())
+	require.ErrorIs(t, Send(&Message{To: "thomas@example.com"}), ErrNoMailer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	received := serveSMTP(listener)
+
+	config.C.SmtpHost, config.C.SmtpPort, err = net.SplitHostPort(listener.Addr().String())
+	require.NoError(t, err)
+	config.C.SmtpFrom = "opengist@example.com"
+
+	Setup()
+	defer SetMailer(nil)
+	require.True(t, Enabled())
+
+	err = Send(&Message{To: "thomas@example.com", Subject: "Vérification", Body: "Open this link: https://example.com/verify-email?token=abc"})
+	require.NoError(t, err)
+
+	data := <-received
+	require.Contains(t, data, "From: opengist@example.com\n")
+	require.Contains(t, data, "To: thomas@example.com\n")
+	require.Contains(t, data, "Subject: =?utf-8?q?V=C3=A9rification?=\n")
+	require.Contains(t, data, "Content-Transfer-Encoding: quoted-printable\n")
+	require.Contains(t, data, "https://example.com/verify-email?token=3Dabc")
+}
@@ -0,0 +1,248 @@
+// Package metrics holds the counters and histograms of the instance, exposed in the Prometheus text format
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the duration histograms
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var (
+	GistsCreated = NewCounterVec("opengist_gists_created_total", "Number of gists created.")
+	GistLikes    = NewCounterVec("opengist_gist_likes_total", "Number of likes given to gists.")
+	GistForks    = NewCounterVec("opengist_gist_forks_total", "Number of gists forked.")
+
+	GitCommandDuration = NewHistogramVec("opengist_git_command_duration_seconds",
+		"Duration of the git commands run by Opengist.", DefaultBuckets, "command")
+	CommitFilesDuration = NewHistogramVec("opengist_commit_files_duration_seconds",
+		"Duration of committing the files of a gist from the web interface.", DefaultBuckets)
+	ListingQueryDuration = NewHistogramVec("opengist_listing_query_duration_seconds",
+		"Duration of the database queries listing gists.", DefaultBuckets, "query")
+	DBQueryDuration = NewHistogramVec("opengist_db_query_duration_seconds",
+		"Duration of the database queries by operation.", DefaultBuckets, "operation")
+	GitRpcDuration = NewHistogramVec("opengist_git_rpc_duration_seconds",
+		"Duration of the git fetches and pushes by protocol.", DefaultBuckets, "protocol", "service")
+
+	HttpRequests = NewCounterVec("opengist_http_requests_total",
+		"Number of HTTP requests by route and status.", "method", "route", "status")
+	HttpRequestDuration = NewHistogramVec("opengist_http_request_duration_seconds",
+		"Duration of the HTTP requests by route.", DefaultBuckets, "method", "route")
+
+	LoginFailures = NewCounterVec("opengist_login_failures_total",
+		"Number of failed authentications by method.", "method")
+	RateLimited = NewCounterVec("opengist_rate_limited_requests_total",
+		"Number of requests refused by the rate limits.", "limit")
+)
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []metric
+)
+
+func register(m metric) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, m)
+}
+
+// Write writes all the metrics to w in the Prometheus text exposition format
+func Write(w io.Writer) error {
+	registryMu.Lock()
+	metrics := append([]metric(nil), registry...)
+	registryMu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// -- Counter -- //
+
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labelValues []string
+	value       float64
+}
+
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: make(map[string]*counterValue)}
+	register(c)
+	return c
+}
+
+// Inc increments the counter of the given label values, which must match the labels of the counter in number
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := strings.Join(labelValues, "\xff")
+	v, ok := c.values[key]
+	if !ok {
+		v = &counterValue{labelValues: labelValues}
+		c.values[key] = v
+	}
+	v.value++
+}
+
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if v, ok := c.values[strings.Join(labelValues, "\xff")]; ok {
+		return v.value
+	}
+	return 0
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writeHeader(w, c.name, c.help, "counter")
+	for _, key := range sortedKeys(c.values) {
+		v := c.values[key]
+		writeSample(w, c.name, c.labels, v.labelValues, "", v.value)
+	}
+}
+
+// -- Histogram -- //
+
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labelValues []string
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogramValue)}
+	register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := strings.Join(labelValues, "\xff")
+	v, ok := h.values[key]
+	if !ok {
+		v = &histogramValue{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = v
+	}
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			v.counts[i]++
+		}
+	}
+	v.sum += value
+	v.count++
+}
+
+// ObserveSince observes the time elapsed since start, in seconds. It is meant to be deferred:
+//
+//	defer metrics.ListingQueryDuration.ObserveSince(time.Now(), "all")
+func (h *HistogramVec) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *HistogramVec) Count(labelValues ...string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if v, ok := h.values[strings.Join(labelValues, "\xff")]; ok {
+		return v.count
+	}
+	return 0
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+	for _, key := range sortedKeys(h.values) {
+		v := h.values[key]
+		for i, bound := range h.buckets {
+			writeSample(w, h.name+"_bucket", h.labels, v.labelValues, formatFloat(bound), float64(v.counts[i]))
+		}
+		writeSample(w, h.name+"_bucket", h.labels, v.labelValues, "+Inf", float64(v.count))
+		writeSample(w, h.name+"_sum", h.labels, v.labelValues, "", v.sum)
+		writeSample(w, h.name+"_count", h.labels, v.labelValues, "", float64(v.count))
+	}
+}
+
+// -- Exposition format -- //
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeHeader(w *bufio.Writer, name string, help string, kind string) {
+	_, _ = w.WriteString("# HELP " + name + " " + help + "\n")
+	_, _ = w.WriteString("# TYPE " + name + " " + kind + "\n")
+}
+
+// writeSample writes a line of a metric, le is the upper bound label of a histogram bucket or empty
+func writeSample(w *bufio.Writer, name string, labels []string, labelValues []string, le string, value float64) {
+	pairs := make([]string, 0, len(labels)+1)
+	for i, label := range labels {
+		labelValue := ""
+		if i < len(labelValues) {
+			labelValue = labelValues[i]
+		}
+		pairs = append(pairs, label+`="`+labelValueReplacer.Replace(labelValue)+`"`)
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+
+	_, _ = w.WriteString(name)
+	if len(pairs) > 0 {
+		_, _ = w.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	_, _ = w.WriteString(" " + formatFloat(value) + "\n")
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,38 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrite(t *testing.T) {
+	counter := NewCounterVec("test_requests_total", "Number of test requests.", "route")
+	counter.Inc("/a")
+	counter.Inc("/a")
+	counter.Inc(`/"b"`)
+
+	histogram := NewHistogramVec("test_duration_seconds", "Duration of tests.", []float64{0.1, 1}, "kind")
+	histogram.Observe(0.05, "fast")
+	histogram.Observe(0.5, "fast")
+	histogram.Observe(5, "fast")
+
+	require.Equal(t, float64(2), counter.Value("/a"))
+	require.Equal(t, uint64(3), histogram.Count("fast"))
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, Write(buf))
+	out := buf.String()
+
+	require.Contains(t, out, "# HELP test_requests_total Number of test requests.\n# TYPE test_requests_total counter\n")
+	require.Contains(t, out, "test_requests_total{route=\"/a\"} 2\n")
+	require.Contains(t, out, "test_requests_total{route=\"/\\\"b\\\"\"} 1\n")
+
+	require.Contains(t, out, "# TYPE test_duration_seconds histogram\n")
+	require.Contains(t, out, "test_duration_seconds_bucket{kind=\"fast\",le=\"0.1\"} 1\n")
+	require.Contains(t, out, "test_duration_seconds_bucket{kind=\"fast\",le=\"1\"} 2\n")
+	require.Contains(t, out, "test_duration_seconds_bucket{kind=\"fast\",le=\"+Inf\"} 3\n")
+	require.Contains(t, out, "test_duration_seconds_sum{kind=\"fast\"} 5.55\n")
+	require.Contains(t, out, "test_duration_seconds_count{kind=\"fast\"} 3\n")
+}
@@ -0,0 +1,135 @@
+// Package ratelimit counts the requests made by a client in fixed windows of time, in memory or in Redis when several
+// instances of Opengist share the same limits
+package ratelimit
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Window is the duration the limits are counted over
+const Window = time.Minute
+
+// Limiter counts the requests of a key in the current window
+type Limiter interface {
+	// Allow counts a request of the key, it reports whether the key is still under the limit and, if not, how long to
+	// wait before the next window
+	Allow(ctx context.Context, key string, limit int) (bool, time.Duration, error)
+}
+
+var limiter Limiter
+
+// Setup creates the limiter, it stores the counts in Redis if an URL is given and in memory otherwise
+func Setup(redisUrl string) error {
+	if redisUrl == "" {
+		limiter = NewMemoryLimiter()
+		return nil
+	}
+
+	options, err := redis.ParseURL(redisUrl)
+	if err != nil {
+		return err
+	}
+	client := redis.NewClient(options)
+	if err = client.Ping(context.Background()).Err(); err != nil {
+		return err
+	}
+
+	limiter = NewRedisLimiter(client)
+	return nil
+}
+
+// Allow counts a request of the key with the limiter created by Setup, every request is allowed if there is none
+func Allow(ctx context.Context, key string, limit int) (bool, time.Duration, error) {
+	if limiter == nil || limit <= 0 {
+		return true, 0, nil
+	}
+	return limiter.Allow(ctx, key, limit)
+}
+
+// windowStart returns the start of the window the time is in, and the time left until the next one
+func windowStart(now time.Time) (time.Time, time.Duration) {
+	start := now.Truncate(Window)
+	return start, start.Add(Window).Sub(now)
+}
+
+// -- Memory -- //
+
+type memoryCount struct {
+	start time.Time
+	count int
+}
+
+// MemoryLimiter keeps the counts in the memory of the process, the limits apply to each instance on its own
+type MemoryLimiter struct {
+	mu        sync.Mutex
+	counts    map[string]*memoryCount
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{counts: make(map[string]*memoryCount), now: time.Now}
+}
+
+func (l *MemoryLimiter) Allow(_ context.Context, key string, limit int) (bool, time.Duration, error) {
+	start, retryAfter := windowStart(l.now())
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// the counts of the previous windows are dropped once per window, so the map does not grow with every client seen
+	if start.After(l.lastSweep) {
+		for k, c := range l.counts {
+			if c.start.Before(start) {
+				delete(l.counts, k)
+			}
+		}
+		l.lastSweep = start
+	}
+
+	c, ok := l.counts[key]
+	if !ok {
+		c = &memoryCount{start: start}
+		l.counts[key] = c
+	}
+	c.count++
+
+	if c.count > limit {
+		return false, retryAfter, nil
+	}
+	return true, 0, nil
+}
+
+// -- Redis -- //
+
+// RedisLimiter keeps the counts in Redis, each window of a key is a counter expiring with the window
+type RedisLimiter struct {
+	client *redis.Client
+	now    func() time.Time
+}
+
+func NewRedisLimiter(client *redis.Client) *RedisLimiter {
+	return &RedisLimiter{client: client, now: time.Now}
+}
+
+func (l *RedisLimiter) Allow(ctx context.Context, key string, limit int) (bool, time.Duration, error) {
+	start, retryAfter := windowStart(l.now())
+	redisKey := "opengist:ratelimit:" + key + ":" + strconv.FormatInt(start.Unix(), 10)
+
+	pipe := l.client.TxPipeline()
+	incr := pipe.Incr(ctx, redisKey)
+	pipe.Expire(ctx, redisKey, Window)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, 0, err
+	}
+
+	if incr.Val() > int64(limit) {
+		return false, retryAfter, nil
+	}
+	return true, 0, nil
+}
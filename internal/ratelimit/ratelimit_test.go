@@ -0,0 +1,50 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryLimiter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 15, 0, time.UTC)
+	l := NewMemoryLimiter()
+	l.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		allowed, _, err := l.Allow(ctx, "ip:1.2.3.4", 3)
+		require.NoError(t, err)
+		require.True(t, allowed)
+	}
+
+	allowed, retryAfter, err := l.Allow(ctx, "ip:1.2.3.4", 3)
+	require.NoError(t, err)
+	require.False(t, allowed)
+	require.Equal(t, 45*time.Second, retryAfter)
+
+	// the other keys have their own count
+	allowed, _, err = l.Allow(ctx, "user:1", 3)
+	require.NoError(t, err)
+	require.True(t, allowed)
+
+	// the count starts over in the next window, and the previous counts are dropped
+	now = now.Add(time.Minute)
+	allowed, _, err = l.Allow(ctx, "ip:1.2.3.4", 3)
+	require.NoError(t, err)
+	require.True(t, allowed)
+	require.Len(t, l.counts, 1)
+}
+
+func TestAllowWithoutLimit(t *testing.T) {
+	limiter = NewMemoryLimiter()
+	defer func() { limiter = nil }()
+
+	for i := 0; i < 10; i++ {
+		allowed, _, err := Allow(context.Background(), "ip:1.2.3.4", 0)
+		require.NoError(t, err)
+		require.True(t, allowed)
+	}
+}
@@ -16,15 +16,27 @@ import (
 
 type RenderedFile struct {
 	*git.File
-	Type  string   `json:"type"`
-	Lines []string `json:"-"`
-	HTML  string   `json:"-"`
+	Type      string     `json:"type"`
+	Lines     []string   `json:"-"`
+	HTML      string     `json:"-"`
+	Rendered  bool       `json:"-"` // HTML holds the file rendered by its Renderer, Lines its source
+	Selection *LineRange `json:"-"`
+}
+
+func (r RenderedFile) LineAnchor(line int) string {
+	return LineAnchor(r.Filename, line)
+}
+
+// IsSelected reports whether the line is within the lines emphasized on the gist page
+func (r RenderedFile) IsSelected(line int) bool {
+	return r.Selection.Contains(line)
 }
 
 type RenderedGist struct {
 	*db.Gist
-	Lines []string
-	HTML  string
+	Lines    []string
+	HTML     string
+	Rendered bool
 }
 
 func HighlightFile(file *git.File) (RenderedFile, error) {
@@ -32,12 +44,18 @@ func HighlightFile(file *git.File) (RenderedFile, error) {
 		File: file,
 	}
 
-	style := newStyle()
-	lexer := newLexer(file.Filename)
-	if lexer.Config().Name == "markdown" {
-		return MarkdownFile(file)
+	// images are displayed from the raw endpoint and other binaries are not displayed at all
+	if file.IsImage() {
+		rendered.Type = "Image"
+		return rendered, nil
+	}
+	if file.IsBinary() {
+		rendered.Type = "Binary"
+		return rendered, nil
 	}
 
+	style := newStyle()
+	lexer := newLexer(file.Filename)
 	formatter := html.New(html.WithClasses(true), html.PreventSurroundingPre(true))
 
 	iterator, err := lexer.Tokenise(nil, file.Content+"\n")
@@ -65,6 +83,13 @@ func HighlightFile(file *git.File) (RenderedFile, error) {
 	rendered.Lines = lines
 	rendered.Type = parseFileTypeName(*lexer.Config())
 
+	// the source is highlighted anyway, it can be shown instead of the rendered file
+	if renderer := rendererFor(lexer); renderer != nil {
+		rendered.Type = renderer.Type()
+		rendered.Rendered = true
+		rendered.HTML, err = renderer.Render(file.Content)
+	}
+
 	return rendered, err
 }
 
@@ -107,8 +132,11 @@ func HighlightGistPreview(gist *db.Gist) (RenderedGist, error) {
 
 	style := newStyle()
 	lexer := newLexer(gist.PreviewFilename)
-	if lexer.Config().Name == "markdown" {
-		return MarkdownGistPreview(gist)
+	if renderer := rendererFor(lexer); renderer != nil {
+		var err error
+		rendered.HTML, err = renderer.Render(gist.Preview)
+		rendered.Rendered = true
+		return rendered, err
 	}
 
 	formatter := html.New(html.WithClasses(true), html.PreventSurroundingPre(true))
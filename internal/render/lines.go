@@ -0,0 +1,64 @@
+package render
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var slugRegex = regexp.MustCompile("[^a-z0-9]+")
+
+// Slug returns the lowercase dashed form of a filename used in the anchors of the gist page
+func Slug(s string) string {
+	return strings.Trim(slugRegex.ReplaceAllString(strings.ToLower(s), "-"), "-")
+}
+
+// LineAnchor returns the anchor id of a line of a file, e.g. file-main-go-L10. A range of lines is linked
+// with #file-main-go-L10-L20.
+func LineAnchor(filename string, line int) string {
+	return "file-" + Slug(filename) + "-L" + strconv.Itoa(line)
+}
+
+// LineRange is an inclusive range of lines, starting at 1
+type LineRange struct {
+	From int
+	To   int
+}
+
+var errInvalidLineRange = errors.New("invalid line range")
+
+// ParseLineRange parses a single line ("10") or a range of lines ("10-20")
+func ParseLineRange(s string) (*LineRange, error) {
+	fromStr, toStr, isRange := strings.Cut(s, "-")
+	if !isRange {
+		toStr = fromStr
+	}
+
+	from, err := strconv.Atoi(fromStr)
+	if err != nil {
+		return nil, errInvalidLineRange
+	}
+	to, err := strconv.Atoi(toStr)
+	if err != nil {
+		return nil, errInvalidLineRange
+	}
+	if from < 1 || to < from {
+		return nil, errInvalidLineRange
+	}
+
+	return &LineRange{From: from, To: to}, nil
+}
+
+func (r *LineRange) Contains(line int) bool {
+	return r != nil && line >= r.From && line <= r.To
+}
+
+// Slice returns the lines of the content within the range, the range is capped to the end of the content
+func (r *LineRange) Slice(content string) string {
+	lines := strings.Split(content, "\n")
+	if r.From > len(lines) {
+		return ""
+	}
+	return strings.Join(lines[r.From-1:min(r.To, len(lines))], "\n")
+}
@@ -7,7 +7,6 @@ import (
 	"github.com/alecthomas/chroma/v2/formatters/html"
 	"github.com/rs/zerolog/log"
 	"github.com/thomiceli/opengist/internal/db"
-	"github.com/thomiceli/opengist/internal/git"
 	"github.com/yuin/goldmark"
 	emoji "github.com/yuin/goldmark-emoji"
 	highlighting "github.com/yuin/goldmark-highlighting/v2"
@@ -21,26 +20,20 @@ import (
 	"strconv"
 )
 
-func MarkdownGistPreview(gist *db.Gist) (RenderedGist, error) {
-	var buf bytes.Buffer
-	err := newMarkdown().Convert([]byte(gist.Preview), &buf)
-
-	return RenderedGist{
-		Gist: gist,
-		HTML: buf.String(),
-	}, err
+func init() {
+	RegisterRenderer("markdown", markdownRenderer{})
 }
 
-func MarkdownFile(file *git.File) (RenderedFile, error) {
-	var buf bytes.Buffer
-	err := newMarkdown().Convert([]byte(file.Content), &buf)
+type markdownRenderer struct{}
 
-	return RenderedFile{
-		File: file,
-		HTML: buf.String(),
-		Type: "Markdown",
-	}, err
+func (markdownRenderer) Type() string {
+	return "Markdown"
 }
+
+func (markdownRenderer) Render(content string) (string, error) {
+	return MarkdownString(content)
+}
+
 func MarkdownString(content string) (string, error) {
 	var buf bytes.Buffer
 	err := newMarkdown().Convert([]byte(content), &buf)
@@ -48,6 +41,8 @@ func MarkdownString(content string) (string, error) {
 	return buf.String(), err
 }
 
+// newMarkdown returns the Markdown converter of the gists and comments. It leaves out raw HTML and empties the links
+// with dangerous URLs (javascript: and the like) as goldmark's html.WithUnsafe is not set, so its output is safe to include.
 func newMarkdown() goldmark.Markdown {
 	return goldmark.New(
 		goldmark.WithExtensions(
@@ -117,3 +112,21 @@ func Checkbox(content string, checkboxNb int) (string, error) {
 
 	return buf.String(), nil
 }
+
+type RenderedComment struct {
+	*db.Comment
+	HTML string
+}
+
+// MarkdownComments renders the body of the comments, a comment that fails to render is shown empty
+func MarkdownComments(comments []*db.Comment) []RenderedComment {
+	renderedComments := make([]RenderedComment, 0, len(comments))
+	for _, comment := range comments {
+		html, err := MarkdownString(comment.Body)
+		if err != nil {
+			log.Error().Err(err).Msgf("Error rendering comment %d", comment.ID)
+		}
+		renderedComments = append(renderedComments, RenderedComment{Comment: comment, HTML: html})
+	}
+	return renderedComments
+}
@@ -0,0 +1,25 @@
+package render
+
+import "github.com/alecthomas/chroma/v2"
+
+// Renderer renders the files of a format to HTML, shown on the gist page in place of their highlighted source which
+// stays one click away
+type Renderer interface {
+	// Type is the name of the format, shown next to the name of the files
+	Type() string
+	// Render returns the HTML of the content, it is included in the page as is so it must be sanitized
+	Render(content string) (string, error)
+}
+
+// renderers are the registered renderers, by the name of the Chroma lexer of the files they render
+var renderers = map[string]Renderer{}
+
+// RegisterRenderer renders the files recognized by the Chroma lexer named lexerName with the renderer, in place of
+// the renderer registered before for them if any. It is meant to be called from init functions.
+func RegisterRenderer(lexerName string, renderer Renderer) {
+	renderers[lexerName] = renderer
+}
+
+func rendererFor(lexer chroma.Lexer) Renderer {
+	return renderers[lexer.Config().Name]
+}
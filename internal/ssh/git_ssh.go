@@ -5,11 +5,13 @@ import (
 	"io"
 	"os/exec"
 	"strings"
+	"time"
 
 	"github.com/rs/zerolog/log"
 	"github.com/thomiceli/opengist/internal/auth"
 	"github.com/thomiceli/opengist/internal/db"
 	"github.com/thomiceli/opengist/internal/git"
+	"github.com/thomiceli/opengist/internal/metrics"
 	"golang.org/x/crypto/ssh"
 	"gorm.io/gorm"
 )
@@ -59,21 +61,32 @@ func runGitCommand(ch ssh.Channel, gitCmd string, key string, ip string) error {
 			userToCheckPermissions, _ = db.GetUserFromSSHKey(key)
 		} else {
 			userToCheckPermissions = &gist.User
+			if keyUser, err := db.GetUserFromSSHKey(key); err == nil && gist.IsWriter(keyUser) {
+				userToCheckPermissions = keyUser
+			}
 		}
 
 		pubKey, err := db.SSHKeyExistsForUser(key, userToCheckPermissions.ID)
 		if err != nil {
 			if errors.Is(err, gorm.ErrRecordNotFound) {
 				log.Warn().Msg("Invalid SSH authentication attempt from " + ip)
+				metrics.LoginFailures.Inc("ssh")
 				return errors.New("gist not found")
 			}
 			errorSsh("Failed to get user by SSH key id", err)
 			return errors.New("internal server error")
 		}
+		if userToCheckPermissions.Suspended {
+			return errors.New("this account is suspended")
+		}
 		_ = db.SSHKeyLastUsedNow(pubKey.Content)
 	}
 
-	repositoryPath := git.RepositoryPath(gist.User.Username, gist.Uuid)
+	if verb == "receive-pack" && gist.Locked {
+		return errors.New("gist is locked, it cannot be pushed to")
+	}
+
+	repositoryPath := git.RepositoryPath(gist.Uuid)
 
 	cmd := exec.Command("git", verb, repositoryPath)
 	cmd.Dir = repositoryPath
@@ -82,6 +95,7 @@ func runGitCommand(ch ssh.Channel, gitCmd string, key string, ip string) error {
 	stdout, _ := cmd.StdoutPipe()
 	stderr, _ := cmd.StderrPipe()
 
+	defer metrics.GitRpcDuration.ObserveSince(time.Now(), "ssh", verb)
 	if err = cmd.Start(); err != nil {
 		errorSsh("Failed to start git command", err)
 		return errors.New("internal server error")
@@ -5,6 +5,7 @@ import (
 	"github.com/rs/zerolog/log"
 	"github.com/thomiceli/opengist/internal/config"
 	"github.com/thomiceli/opengist/internal/db"
+	"github.com/thomiceli/opengist/internal/metrics"
 	"golang.org/x/crypto/ssh"
 	"gorm.io/gorm"
 	"io"
@@ -31,6 +32,7 @@ func Start() {
 				}
 
 				log.Warn().Msg("Invalid SSH authentication attempt from " + conn.RemoteAddr().String())
+				metrics.LoginFailures.Inc("ssh")
 				return nil, errors.New("unknown public key")
 			}
 			return &ssh.Permissions{Extensions: map[string]string{"key": strKey}}, nil
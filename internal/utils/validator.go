@@ -3,8 +3,11 @@ package utils
 import (
 	"github.com/go-playground/validator/v10"
 	"github.com/thomiceli/opengist/internal/i18n"
+	"reflect"
 	"regexp"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 type OpengistValidator struct {
@@ -14,8 +17,12 @@ type OpengistValidator struct {
 func NewValidator() *OpengistValidator {
 	v := validator.New()
 	_ = v.RegisterValidation("notreserved", validateReservedKeywords)
+	_ = v.RegisterValidation("notreservedgist", validateNotReservedGistPath)
 	_ = v.RegisterValidation("alphanumdash", validateAlphaNumDash)
 	_ = v.RegisterValidation("alphanumdashorempty", validateAlphaNumDashOrEmpty)
+	_ = v.RegisterValidation("uniquefilenames", validateUniqueFilenames)
+	_ = v.RegisterValidation("filename", validateFilename)
+	_ = v.RegisterValidation("topics", validateTopics)
 	return &OpengistValidator{v}
 }
 
@@ -23,47 +30,109 @@ func (cv *OpengistValidator) Validate(i interface{}) error {
 	return cv.v.Struct(i)
 }
 
+// ValidatePartial validates only the given fields of the struct, nested fields are written as "Parent.Field"
+func (cv *OpengistValidator) ValidatePartial(i interface{}, fields ...string) error {
+	return cv.v.StructPartial(i, fields...)
+}
+
 func (cv *OpengistValidator) Var(field interface{}, tag string) error {
 	return cv.v.Var(field, tag)
 }
 
+// RegisterValidation adds a validation tag whose rule depends on values this package cannot import, like the config
+func (cv *OpengistValidator) RegisterValidation(tag string, fn validator.Func) error {
+	return cv.v.RegisterValidation(tag, fn)
+}
+
 func ValidationMessages(err *error, locale *i18n.Locale) string {
 	errs := (*err).(validator.ValidationErrors)
 	messages := make([]string, len(errs))
 	for i, e := range errs {
-		switch e.Tag() {
-		case "max":
-			messages[i] = locale.String("validation.is-too-long", e.Field())
-		case "required":
-			messages[i] = locale.String("validation.should-not-be-empty", e.Field())
-		case "excludes":
-			messages[i] = locale.String("validation.should-not-include-sub-directory", e.Field())
-		case "alphanum":
-			messages[i] = locale.String("validation.should-only-contain-alphanumeric-characters", e.Field())
-		case "alphanumdash":
-		case "alphanumdashorempty":
-			messages[i] = locale.String("validation.should-only-contain-alphanumeric-characters-and-dashes", e.Field())
-		case "min":
-			messages[i] = locale.String("validation.not-enough", e.Field())
-		case "notreserved":
-			messages[i] = locale.String("validation.invalid", e.Field())
-		}
+		messages[i] = validationMessage(e, locale)
 	}
 
 	return strings.Join(messages, " ; ")
 }
 
-func validateReservedKeywords(fl validator.FieldLevel) bool {
-	name := fl.Field().String()
+// ValidationFieldMessages returns the message of each invalid field, keyed by the lowercased field name like the
+// form fields are
+func ValidationFieldMessages(err error, locale *i18n.Locale) map[string]string {
+	errs := err.(validator.ValidationErrors)
+	messages := make(map[string]string, len(errs))
+	for _, e := range errs {
+		field := strings.ToLower(e.Field())
+		if _, ok := messages[field]; !ok {
+			messages[field] = validationMessage(e, locale)
+		}
+	}
+
+	return messages
+}
+
+func validationMessage(e validator.FieldError, locale *i18n.Locale) string {
+	switch e.Tag() {
+	case "max":
+		return locale.String("validation.is-too-long", e.Field())
+	case "required":
+		return locale.String("validation.should-not-be-empty", e.Field())
+	case "excludes":
+		return locale.String("validation.should-not-include-sub-directory", e.Field())
+	case "alphanum":
+		return locale.String("validation.should-only-contain-alphanumeric-characters", e.Field())
+	case "alphanumdash", "alphanumdashorempty":
+		return locale.String("validation.should-only-contain-alphanumeric-characters-and-dashes", e.Field())
+	case "min":
+		return locale.String("validation.not-enough", e.Field())
+	case "notreserved", "notreservedgist", "oneof", "http_url":
+		return locale.String("validation.invalid", e.Field())
+	case "maxfiles":
+		return locale.String("validation.too-many", e.Field())
+	case "allowedext":
+		return locale.String("validation.extension-not-allowed", e.Value())
+	case "filename":
+		return locale.String("validation.invalid-filename", e.Value())
+	case "uniquefilenames":
+		return locale.String("validation.duplicate-filename", duplicateFilename(reflect.ValueOf(e.Value())))
+	case "topics":
+		return locale.String("validation.invalid-topics", MaxTopics)
+	}
+	return ""
+}
 
-	restrictedNames := map[string]struct{}{}
-	for _, restrictedName := range []string{"assets", "register", "login", "logout", "settings", "admin-panel", "all", "search", "init", "healthcheck", "preview", "metrics"} {
-		restrictedNames[restrictedName] = struct{}{}
+// reservedKeywords are the first path segments of the routes, a username taking one of them would be shadowed
+var reservedKeywords = []string{"assets", "register", "login", "logout", "settings", "admin-panel", "all", "search",
+	"init", "healthcheck", "preview", "metrics", "api", "random", "oauth", "trash", "topics", "mfa", "healthz",
+	"readyz", "verify-email", "forgot-password", "reset-password"}
+
+// reservedGistPaths are the routes under /:user, a gist URL taking one of them would be shadowed. Gist UUIDs are
+// hexadecimal so they never match one.
+var reservedGistPaths = []string{"liked", "forked"}
+
+// IsReservedKeyword reports whether the name is used by a route, compared case-insensitively
+func IsReservedKeyword(name string) bool {
+	return containsFold(reservedKeywords, name)
+}
+
+// IsReservedGistPath reports whether the gist URL is used by a route under /:user, compared case-insensitively
+func IsReservedGistPath(name string) bool {
+	return containsFold(reservedGistPaths, name)
+}
+
+func containsFold(list []string, name string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, name) {
+			return true
+		}
 	}
+	return false
+}
+
+func validateReservedKeywords(fl validator.FieldLevel) bool {
+	return !IsReservedKeyword(fl.Field().String())
+}
 
-	// if the name is not in the restricted names, it is valid
-	_, ok := restrictedNames[name]
-	return !ok
+func validateNotReservedGistPath(fl validator.FieldLevel) bool {
+	return !IsReservedGistPath(fl.Field().String())
 }
 
 func validateAlphaNumDash(fl validator.FieldLevel) bool {
@@ -73,3 +142,90 @@ func validateAlphaNumDash(fl validator.FieldLevel) bool {
 func validateAlphaNumDashOrEmpty(fl validator.FieldLevel) bool {
 	return regexp.MustCompile(`^$|^[a-zA-Z0-9-]+$`).MatchString(fl.Field().String())
 }
+
+// maxFilenameBytes is the length limit of a filename on most filesystems, a name of fewer runes can exceed it
+const maxFilenameBytes = 255
+
+// validateFilename refuses the names that cannot be written safely on disk: invalid UTF-8, control characters, the
+// bidirectional formatting characters that make a name display differently from what it is, and . or ..
+func validateFilename(fl validator.FieldLevel) bool {
+	name := fl.Field().String()
+	if !utf8.ValidString(name) || len(name) > maxFilenameBytes || name == "." || name == ".." {
+		return false
+	}
+
+	for _, r := range name {
+		if unicode.IsControl(r) || isBidiControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func isBidiControl(r rune) bool {
+	switch {
+	case r == '\u061c', r == '\u200e', r == '\u200f':
+		return true
+	case r >= '\u202a' && r <= '\u202e':
+		return true
+	case r >= '\u2066' && r <= '\u2069':
+		return true
+	}
+	return false
+}
+
+func validateUniqueFilenames(fl validator.FieldLevel) bool {
+	return duplicateFilename(fl.Field()) == ""
+}
+
+// duplicateFilename returns the first name used twice, case-insensitively, by the files of the slice, or an empty
+// string. The elements are structs with a Filename field; as the edit form sends the final name of each file, renamed
+// files are compared under their new name.
+func duplicateFilename(files reflect.Value) string {
+	if files.Kind() != reflect.Slice {
+		return ""
+	}
+
+	seen := make(map[string]struct{}, files.Len())
+	for i := 0; i < files.Len(); i++ {
+		filename := reflect.Indirect(files.Index(i)).FieldByName("Filename").String()
+		key := strings.ToLower(filename)
+		if _, ok := seen[key]; ok {
+			return filename
+		}
+		seen[key] = struct{}{}
+	}
+	return ""
+}
+
+// MaxTopics is the number of topics a gist can be tagged with
+const MaxTopics = 10
+
+var topicRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,34}$`)
+
+// SplitTopics returns the lowercased topics of a list separated by spaces or commas, without duplicates
+func SplitTopics(topics string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(topics), func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+	return RemoveDuplicates(fields)
+}
+
+// IsValidTopic reports whether the topic is made of lowercase letters, numbers and dashes, up to 35 characters
+func IsValidTopic(topic string) bool {
+	return topicRegex.MatchString(topic)
+}
+
+func validateTopics(fl validator.FieldLevel) bool {
+	topics := SplitTopics(fl.Field().String())
+	if len(topics) > MaxTopics {
+		return false
+	}
+
+	for _, topic := range topics {
+		if !IsValidTopic(topic) {
+			return false
+		}
+	}
+	return true
+}
@@ -6,6 +6,8 @@ import (
 	"github.com/thomiceli/opengist/internal/config"
 	"github.com/thomiceli/opengist/internal/db"
 	"github.com/thomiceli/opengist/internal/git"
+	"github.com/thomiceli/opengist/internal/webhook"
+	"net/url"
 	"runtime"
 	"strconv"
 	"time"
@@ -53,15 +55,17 @@ func adminIndex(ctx echo.Context) error {
 func adminUsers(ctx echo.Context) error {
 	setData(ctx, "htmlTitle", trH(ctx, "admin.users")+" - "+trH(ctx, "admin.admin_panel"))
 	setData(ctx, "adminHeaderPage", "users")
-	pageInt := getPage(ctx)
+	page := getListPage(ctx)
+	query, queryParams := getAdminSearchQuery(ctx)
 
 	var data []*db.User
+	var total int64
 	var err error
-	if data, err = db.GetAllUsers(pageInt - 1); err != nil {
+	if data, total, err = db.GetAllUsers(page, query); err != nil {
 		return errorRes(500, "Cannot get users", err)
 	}
 
-	if err = paginate(ctx, data, pageInt, 10, "data", "admin-panel/users", 1); err != nil {
+	if err = paginateTotal(ctx, data, total, page, "data", "admin-panel/users", 1, queryParams); err != nil {
 		return errorRes(404, tr(ctx, "error.page-not-found"), nil)
 	}
 
@@ -71,21 +75,56 @@ func adminUsers(ctx echo.Context) error {
 func adminGists(ctx echo.Context) error {
 	setData(ctx, "htmlTitle", trH(ctx, "admin.gists")+" - "+trH(ctx, "admin.admin_panel"))
 	setData(ctx, "adminHeaderPage", "gists")
-	pageInt := getPage(ctx)
+	page := getListPage(ctx)
+	query, queryParams := getAdminSearchQuery(ctx)
+
+	timeRange, timeRangeParams, err := getTimeRange(ctx, false)
+	if err != nil {
+		return errorRes(400, tr(ctx, "error.invalid-time-range"), err)
+	}
 
 	var data []*db.Gist
-	var err error
-	if data, err = db.GetAllGists(pageInt - 1); err != nil {
+	var total int64
+	if data, total, err = db.GetAllGists(page, false, timeRange, query); err != nil {
 		return errorRes(500, "Cannot get gists", err)
 	}
 
-	if err = paginate(ctx, data, pageInt, 10, "data", "admin-panel/gists", 1); err != nil {
+	if err = paginateTotal(ctx, data, total, page, "data", "admin-panel/gists", 1, timeRangeParams+queryParams); err != nil {
 		return errorRes(404, tr(ctx, "error.page-not-found"), nil)
 	}
 
 	return html(ctx, "admin_gists.html")
 }
 
+// getAdminSearchQuery returns the search query of an admin listing, and the URL parameter to keep it across pages
+func getAdminSearchQuery(ctx echo.Context) (string, string) {
+	query := ctx.QueryParam("q")
+	setData(ctx, "searchQuery", query)
+	if query == "" {
+		return "", ""
+	}
+	return query, "&q=" + url.QueryEscape(query)
+}
+
+func adminAuditLogs(ctx echo.Context) error {
+	setData(ctx, "htmlTitle", trH(ctx, "admin.audit-logs")+" - "+trH(ctx, "admin.admin_panel"))
+	setData(ctx, "adminHeaderPage", "audit-logs")
+	page := getListPage(ctx)
+
+	var data []*db.AuditLog
+	var total int64
+	var err error
+	if data, total, err = db.GetAuditLogs(page); err != nil {
+		return errorRes(500, "Cannot get audit logs", err)
+	}
+
+	if err = paginateTotal(ctx, data, total, page, "data", "admin-panel/audit-logs", 1); err != nil {
+		return errorRes(404, tr(ctx, "error.page-not-found"), nil)
+	}
+
+	return html(ctx, "admin_audit_logs.html")
+}
+
 func adminUserDelete(ctx echo.Context) error {
 	userId, _ := strconv.ParseUint(ctx.Param("user"), 10, 64)
 	user, err := db.GetUserById(uint(userId))
@@ -93,7 +132,7 @@ func adminUserDelete(ctx echo.Context) error {
 		return errorRes(500, "Cannot retrieve user", err)
 	}
 
-	if err := user.Delete(); err != nil {
+	if err := user.DeleteWithGists(); err != nil {
 		return errorRes(500, "Cannot delete this user", err)
 	}
 
@@ -101,22 +140,123 @@ func adminUserDelete(ctx echo.Context) error {
 	return redirect(ctx, "/admin-panel/users")
 }
 
-func adminGistDelete(ctx echo.Context) error {
+// getAdminManagedUser returns the user targeted by an admin action, admins cannot act on their own account so they
+// cannot lock themselves out of the panel
+func getAdminManagedUser(ctx echo.Context) (*db.User, error) {
+	userId, _ := strconv.ParseUint(ctx.Param("user"), 10, 64)
+	user, err := db.GetUserById(uint(userId))
+	if err != nil {
+		return nil, notFound("User not found")
+	}
+
+	if user.ID == getUserLogged(ctx).ID {
+		addFlash(ctx, tr(ctx, "flash.admin.cannot-change-self"), "error")
+		return nil, redirect(ctx, "/admin-panel/users")
+	}
+	return user, nil
+}
+
+func adminUserToggleAdmin(ctx echo.Context) error {
+	user, err := getAdminManagedUser(ctx)
+	if user == nil {
+		return err
+	}
+
+	if user.IsAdmin {
+		err = user.RevokeAdmin()
+	} else {
+		err = user.SetAdmin()
+	}
+	if err != nil {
+		return errorRes(500, "Cannot update user", err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.admin.user-updated"), "success")
+	return redirect(ctx, "/admin-panel/users")
+}
+
+func adminUserToggleSuspend(ctx echo.Context) error {
+	user, err := getAdminManagedUser(ctx)
+	if user == nil {
+		return err
+	}
+
+	if err = user.SetSuspended(!user.Suspended); err != nil {
+		return errorRes(500, "Cannot update user", err)
+	}
+
+	if user.Suspended {
+		addFlash(ctx, tr(ctx, "flash.admin.user-suspended"), "success")
+	} else {
+		addFlash(ctx, tr(ctx, "flash.admin.user-unsuspended"), "success")
+	}
+	return redirect(ctx, "/admin-panel/users")
+}
+
+func adminGistVisibility(ctx echo.Context) error {
 	gist, err := db.GetGistByID(ctx.Param("gist"))
 	if err != nil {
-		return errorRes(500, "Cannot retrieve gist", err)
+		return notFound("Gist not found")
 	}
 
-	if err = gist.DeleteRepository(); err != nil {
-		return errorRes(500, "Cannot delete the repository", err)
+	dto := new(db.VisibilityDTO)
+	if err = ctx.Bind(dto); err != nil {
+		return errorRes(400, tr(ctx, "error.cannot-bind-data"), err)
+	}
+	if err = ctx.Validate(dto); err != nil {
+		return validationErrorRes(ctx, err)
 	}
 
-	if err = gist.Delete(); err != nil {
+	allowed, err := gist.VisibilityAllowed(dto.Private)
+	if err != nil {
+		return errorRes(500, "Error checking the visibility of the parent gist", err)
+	}
+	if !allowed {
+		addFlash(ctx, tr(ctx, "flash.gist.fork-stays-private"), "error")
+		return redirect(ctx, "/admin-panel/gists")
+	}
+
+	previous := gist.Private
+	gist.Private = dto.Private
+	if err = gist.UpdateNoTimestamps(); err != nil {
+		return errorRes(500, "Cannot update this gist", err)
+	}
+
+	if previous != gist.Private {
+		if err = db.AddAuditLog(getUserLogged(ctx), db.AuditGistVisibilityChanged, gist, map[string]any{
+			"from":     previous.String(),
+			"to":       gist.Private.String(),
+			"by_admin": true,
+		}); err != nil {
+			return errorRes(500, "Cannot record the audit log", err)
+		}
+		webhook.Trigger(webhook.GistUpdated, gist, getUserLogged(ctx))
+	}
+
+	addFlash(ctx, tr(ctx, "flash.gist.visibility-changed"), "success")
+	return redirect(ctx, "/admin-panel/gists")
+}
+
+func adminGistDelete(ctx echo.Context) error {
+	gist, err := db.GetGistByID(ctx.Param("gist"))
+	if err != nil {
+		return errorRes(500, "Cannot retrieve gist", err)
+	}
+
+	// gists removed by an admin do not go to the trash of their owner
+	if err = gist.Purge(); err != nil {
 		return errorRes(500, "Cannot delete this gist", err)
 	}
 
 	gist.RemoveFromIndex()
 
+	if err = db.AddAuditLog(getUserLogged(ctx), db.AuditGistDeleted, gist, map[string]any{
+		"by_admin": true,
+	}); err != nil {
+		return errorRes(500, "Cannot record the audit log", err)
+	}
+	webhook.Trigger(webhook.GistDeleted, gist, getUserLogged(ctx))
+
 	addFlash(ctx, tr(ctx, "flash.admin.gist-deleted"), "success")
 	return redirect(ctx, "/admin-panel/gists")
 }
@@ -192,6 +332,11 @@ func adminInvitations(ctx echo.Context) error {
 }
 
 func adminInvitationsCreate(ctx echo.Context) error {
+	if config.C.DisableInvitations {
+		addFlash(ctx, tr(ctx, "admin.invitations.disabled"), "error")
+		return redirect(ctx, "/admin-panel/invitations")
+	}
+
 	code := ctx.FormValue("code")
 	nbMax, err := strconv.ParseUint(ctx.FormValue("nbMax"), 10, 64)
 	if err != nil {
@@ -204,9 +349,10 @@ func adminInvitationsCreate(ctx echo.Context) error {
 	}
 
 	invitation := &db.Invitation{
-		Code:      code,
-		ExpiresAt: expiresAtUnix,
-		NbMax:     uint(nbMax),
+		Code:        code,
+		ExpiresAt:   expiresAtUnix,
+		NbMax:       uint(nbMax),
+		CreatedByID: getUserLogged(ctx).ID,
 	}
 
 	if err := invitation.Create(); err != nil {
@@ -231,3 +377,50 @@ func adminInvitationsDelete(ctx echo.Context) error {
 	addFlash(ctx, tr(ctx, "flash.admin.invitation-deleted"), "success")
 	return redirect(ctx, "/admin-panel/invitations")
 }
+
+func adminWebhooks(ctx echo.Context) error {
+	setData(ctx, "htmlTitle", trH(ctx, "admin.webhooks")+" - "+trH(ctx, "admin.admin_panel"))
+	setData(ctx, "adminHeaderPage", "webhooks")
+
+	webhooks, err := db.GetInstanceWebhooks()
+	if err != nil {
+		return errorRes(500, "Cannot get webhooks", err)
+	}
+
+	setData(ctx, "webhooks", webhooks)
+	setData(ctx, "webhookEvents", webhook.Events)
+	return html(ctx, "admin_webhooks.html")
+}
+
+func adminWebhooksCreate(ctx echo.Context) error {
+	return createWebhook(ctx, 0, "/admin-panel/webhooks")
+}
+
+func adminWebhooksDelete(ctx echo.Context) error {
+	hook, err := getWebhook(ctx, 0)
+	if err != nil {
+		return err
+	}
+
+	if err = hook.Delete(); err != nil {
+		return errorRes(500, "Cannot delete webhook", err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.user.webhook-deleted"), "success")
+	return redirect(ctx, "/admin-panel/webhooks")
+}
+
+func adminWebhookDeliveries(ctx echo.Context) error {
+	hook, err := getWebhook(ctx, 0)
+	if err != nil {
+		return err
+	}
+
+	if err = setWebhookDeliveries(ctx, hook); err != nil {
+		return err
+	}
+
+	setData(ctx, "htmlTitle", trH(ctx, "settings.webhook-deliveries")+" - "+trH(ctx, "admin.admin_panel"))
+	setData(ctx, "adminHeaderPage", "webhooks")
+	return html(ctx, "admin_webhook.html")
+}
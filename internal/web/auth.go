@@ -14,9 +14,12 @@ import (
 	"github.com/markbates/goth/providers/gitlab"
 	"github.com/markbates/goth/providers/openidConnect"
 	"github.com/rs/zerolog/log"
+	"github.com/thomiceli/opengist/internal/auth"
 	"github.com/thomiceli/opengist/internal/config"
 	"github.com/thomiceli/opengist/internal/db"
 	"github.com/thomiceli/opengist/internal/i18n"
+	"github.com/thomiceli/opengist/internal/mailer"
+	appmetrics "github.com/thomiceli/opengist/internal/metrics"
 	"github.com/thomiceli/opengist/internal/utils"
 	"golang.org/x/text/cases"
 	"golang.org/x/text/language"
@@ -32,6 +35,7 @@ const (
 	GitLabProvider = "gitlab"
 	GiteaProvider  = "gitea"
 	OpenIDConnect  = "openid-connect"
+	LdapProvider   = "ldap"
 )
 
 func register(ctx echo.Context) error {
@@ -39,12 +43,15 @@ func register(ctx echo.Context) error {
 	disableForm := getData(ctx, "DisableLoginForm")
 
 	code := ctx.QueryParam("code")
-	if code != "" {
-		if invitation, err := db.GetInvitationByCode(code); err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
-			return errorRes(500, "Cannot check for invitation code", err)
-		} else if invitation != nil && invitation.IsUsable() {
-			disableSignup = false
-		}
+	if invitation, err := getUsableInvitation(code); err != nil {
+		return errorRes(500, "Cannot check for invitation code", err)
+	} else if invitation != nil {
+		disableSignup = false
+
+		// the code is kept for the signups going through an OAuth provider
+		sess := getSession(ctx)
+		sess.Values["invitationCode"] = code
+		saveSession(sess, ctx)
 	}
 
 	setData(ctx, "title", trH(ctx, "auth.new-account"))
@@ -52,17 +59,18 @@ func register(ctx echo.Context) error {
 	setData(ctx, "disableForm", disableForm)
 	setData(ctx, "disableSignup", disableSignup)
 	setData(ctx, "isLoginPage", false)
-	return html(ctx, "auth_form.html")
+	return authForm(ctx, "register")
 }
 
 func processRegister(ctx echo.Context) error {
 	disableSignup := getData(ctx, "DisableSignup")
 
-	code := ctx.QueryParam("code")
-	invitation, err := db.GetInvitationByCode(code)
-	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+	invitation, err := getUsableInvitation(ctx.QueryParam("code"))
+	if err != nil {
 		return errorRes(500, "Cannot check for invitation code", err)
-	} else if invitation.ID != 0 && invitation.IsUsable() {
+	}
+	withInvitation := invitation != nil
+	if withInvitation {
 		disableSignup = false
 	}
 
@@ -74,6 +82,17 @@ func processRegister(ctx echo.Context) error {
 		return errorRes(403, tr(ctx, "error.signup-disabled-form"), nil)
 	}
 
+	if ok, err := checkCaptcha(ctx, "register"); err != nil {
+		return errorRes(500, "Cannot verify captcha", err)
+	} else if !ok {
+		addFlash(ctx, tr(ctx, "flash.auth.captcha-failed"), "error")
+		location := "/register"
+		if code := ctx.QueryParam("code"); code != "" {
+			location += "?code=" + url.QueryEscape(code)
+		}
+		return redirect(ctx, location)
+	}
+
 	setData(ctx, "title", trH(ctx, "auth.new-account"))
 	setData(ctx, "htmlTitle", trH(ctx, "auth.new-account"))
 
@@ -86,15 +105,23 @@ func processRegister(ctx echo.Context) error {
 
 	if err := ctx.Validate(dto); err != nil {
 		addFlash(ctx, utils.ValidationMessages(&err, getData(ctx, "locale").(*i18n.Locale)), "error")
-		return html(ctx, "auth_form.html")
+		return authForm(ctx, "register")
 	}
 
 	if exists, err := db.UserExists(dto.Username); err != nil || exists {
 		addFlash(ctx, tr(ctx, "flash.auth.username-exists"), "error")
-		return html(ctx, "auth_form.html")
+		return authForm(ctx, "register")
+	}
+
+	if config.C.EmailVerification && dto.Email == "" {
+		addFlash(ctx, tr(ctx, "flash.auth.email-required"), "error")
+		return authForm(ctx, "register")
 	}
 
 	user := dto.ToUser()
+	if user.Email != "" {
+		user.MD5Hash = fmt.Sprintf("%x", md5.Sum([]byte(user.Email)))
+	}
 
 	password, err := utils.Argon2id.Hash(user.Password)
 	if err != nil {
@@ -102,7 +129,14 @@ func processRegister(ctx echo.Context) error {
 	}
 	user.Password = password
 
-	if err = user.Create(); err != nil {
+	if withInvitation {
+		err = user.CreateWithInvitation(invitation)
+	} else {
+		err = user.Create()
+	}
+	if errors.Is(err, db.ErrInvitationNotUsable) {
+		return errorRes(403, tr(ctx, "error.signup-disabled"), nil)
+	} else if err != nil {
 		return errorRes(500, "Cannot create user", err)
 	}
 
@@ -112,24 +146,48 @@ func processRegister(ctx echo.Context) error {
 		}
 	}
 
-	if invitation.ID != 0 {
-		if err := invitation.Use(); err != nil {
-			return errorRes(500, "Cannot use invitation", err)
-		}
-	}
-
 	sess.Values["user"] = user.ID
 	saveSession(sess, ctx)
 
+	// the account is created even if the link cannot be sent, it can be sent again from the settings
+	if user.Email != "" && mailer.Enabled() {
+		if err = sendVerificationEmail(ctx, user); err != nil {
+			log.Error().Err(err).Msg("Cannot send verification email to " + user.Username)
+		} else {
+			addFlash(ctx, tr(ctx, "flash.user.email-verification-sent"), "success")
+		}
+	}
+
 	return redirect(ctx, "/")
 }
 
+// getUsableInvitation returns the invitation of the code if it can still be used to sign up, or nil. No invitation is
+// usable when they are disabled in the config.
+func getUsableInvitation(code string) (*db.Invitation, error) {
+	if code == "" || config.C.DisableInvitations {
+		return nil, nil
+	}
+
+	invitation, err := db.GetInvitationByCode(code)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if !invitation.IsUsable() {
+		return nil, nil
+	}
+	return invitation, nil
+}
+
 func login(ctx echo.Context) error {
 	setData(ctx, "title", trH(ctx, "auth.login"))
 	setData(ctx, "htmlTitle", trH(ctx, "auth.login"))
 	setData(ctx, "disableForm", getData(ctx, "DisableLoginForm"))
 	setData(ctx, "isLoginPage", true)
-	return html(ctx, "auth_form.html")
+	setData(ctx, "passwordReset", mailer.Enabled())
+	return authForm(ctx, "login")
 }
 
 func processLogin(ctx echo.Context) error {
@@ -137,41 +195,100 @@ func processLogin(ctx echo.Context) error {
 		return errorRes(403, tr(ctx, "error.login-disabled-form"), nil)
 	}
 
+	if ok, err := checkCaptcha(ctx, "login"); err != nil {
+		return errorRes(500, "Cannot verify captcha", err)
+	} else if !ok {
+		addFlash(ctx, tr(ctx, "flash.auth.captcha-failed"), "error")
+		return redirect(ctx, "/login")
+	}
+
 	var err error
-	sess := getSession(ctx)
 
 	dto := &db.UserDTO{}
 	if err = ctx.Bind(dto); err != nil {
 		return errorRes(400, tr(ctx, "error.cannot-bind-data"), err)
 	}
-	password := dto.Password
-
-	var user *db.User
 
-	if user, err = db.GetUserByUsername(dto.Username); err != nil {
-		if !errors.Is(err, gorm.ErrRecordNotFound) {
-			return errorRes(500, "Cannot get user", err)
-		}
+	user, err := checkCredentials(dto.Username, dto.Password)
+	if err != nil {
+		return errorRes(500, "Cannot check credentials", err)
+	}
+	if user == nil {
 		log.Warn().Msg("Invalid HTTP authentication attempt from " + ctx.RealIP())
+		appmetrics.LoginFailures.Inc("password")
 		addFlash(ctx, tr(ctx, "flash.auth.invalid-credentials"), "error")
 		return redirect(ctx, "/login")
 	}
 
+	getSession(ctx).Options.MaxAge = 60 * 60 * 24 * 365 // 1 year
+	return startSession(ctx, user)
+}
+
+// checkCredentials returns the user matching the username and password, or nil if there is none. When LDAP is
+// enabled, the users unknown to Opengist and the users coming from the directory are checked against it instead.
+func checkCredentials(username string, password string) (*db.User, error) {
+	user, err := db.GetUserByUsername(username)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	if auth.LdapEnabled() && (err != nil || user.LdapDN != "") {
+		return checkLdapCredentials(username, password)
+	}
+	if err != nil {
+		return nil, nil
+	}
+
 	if ok, err := utils.Argon2id.Verify(password, user.Password); !ok {
-		if err != nil {
-			return errorRes(500, "Cannot check for password", err)
-		}
-		log.Warn().Msg("Invalid HTTP authentication attempt from " + ctx.RealIP())
-		addFlash(ctx, tr(ctx, "flash.auth.invalid-credentials"), "error")
-		return redirect(ctx, "/login")
+		return nil, err
 	}
+	return user, nil
+}
 
-	sess.Values["user"] = user.ID
-	sess.Options.MaxAge = 60 * 60 * 24 * 365 // 1 year
-	saveSession(sess, ctx)
-	deleteCsrfCookie(ctx)
+// checkLdapCredentials returns the user of the directory entry matching the username and password, the account is
+// created on the first login
+func checkLdapCredentials(username string, password string) (*db.User, error) {
+	ldapUser, err := auth.LdapAuthenticate(username, password)
+	if err != nil || ldapUser == nil {
+		return nil, err
+	}
 
-	return redirect(ctx, "/")
+	user, err := db.GetUserByProvider(ldapUser.DN, LdapProvider)
+	if err == nil {
+		return user, nil
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	if err = utils.NewValidator().Var(ldapUser.Username, "required,max=24,alphanumdash,notreserved"); err != nil {
+		log.Warn().Msg("Cannot create the user of the LDAP entry " + ldapUser.DN + ", the username " +
+			ldapUser.Username + " is not valid")
+		return nil, nil
+	}
+
+	user = &db.User{
+		Username: ldapUser.Username,
+		Email:    ldapUser.Email,
+		MD5Hash:  fmt.Sprintf("%x", md5.Sum([]byte(strings.ToLower(strings.TrimSpace(ldapUser.Email))))),
+		LdapDN:   ldapUser.DN,
+		// the emails of the directory are managed by its administrators
+		EmailVerified: ldapUser.Email != "",
+	}
+	if err = user.Create(); err != nil {
+		// a local account already holds this username, it is not handed over to the directory entry
+		if db.IsUniqueConstraintViolation(err) {
+			log.Warn().Msg("Cannot create the user of the LDAP entry " + ldapUser.DN + ", the username " +
+				ldapUser.Username + " is taken")
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if user.ID == 1 {
+		if err = user.SetAdmin(); err != nil {
+			return nil, err
+		}
+	}
+	return user, nil
 }
 
 func oauthCallback(ctx echo.Context) error {
@@ -196,24 +313,45 @@ func oauthCallback(ctx echo.Context) error {
 	// if user is not in database, create it
 	userDB, err := db.GetUserByProvider(user.UserID, user.Provider)
 	if err != nil {
-		if getData(ctx, "DisableSignup") == true {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return errorRes(500, "Cannot get user", err)
+		}
+
+		// the invitation code comes from the signup page the user started from
+		sess := getSession(ctx)
+		code, _ := sess.Values["invitationCode"].(string)
+		invitation, err := getUsableInvitation(code)
+		if err != nil {
+			return errorRes(500, "Cannot check for invitation code", err)
+		}
+		if getData(ctx, "DisableSignup") == true && invitation == nil {
 			return errorRes(403, tr(ctx, "error.signup-disabled"), nil)
 		}
 
-		if !errors.Is(err, gorm.ErrRecordNotFound) {
-			return errorRes(500, "Cannot get user", err)
+		if db.IsReservedUsername(user.NickName) {
+			addFlash(ctx, tr(ctx, "flash.auth.username-reserved"), "error")
+			return redirect(ctx, "/login")
 		}
 
 		userDB = &db.User{
 			Username: user.NickName,
 			Email:    user.Email,
 			MD5Hash:  fmt.Sprintf("%x", md5.Sum([]byte(strings.ToLower(strings.TrimSpace(user.Email))))),
+			// the email of the provider account is trusted, it is not verified again
+			EmailVerified: user.Email != "",
 		}
 
 		// set provider id and avatar URL
 		updateUserProviderInfo(userDB, user.Provider, user)
 
-		if err = userDB.Create(); err != nil {
+		if invitation != nil {
+			err = userDB.CreateWithInvitation(invitation)
+		} else {
+			err = userDB.Create()
+		}
+		if errors.Is(err, db.ErrInvitationNotUsable) {
+			return errorRes(403, tr(ctx, "error.signup-disabled"), nil)
+		} else if err != nil {
 			if db.IsUniqueConstraintViolation(err) {
 				addFlash(ctx, tr(ctx, "flash.auth.username-exists"), "error")
 				return redirect(ctx, "/login")
@@ -222,6 +360,11 @@ func oauthCallback(ctx echo.Context) error {
 			return errorRes(500, "Cannot create user", err)
 		}
 
+		if invitation != nil {
+			delete(sess.Values, "invitationCode")
+			saveSession(sess, ctx)
+		}
+
 		if userDB.ID == 1 {
 			if err = userDB.SetAdmin(); err != nil {
 				return errorRes(500, "Cannot set user admin", err)
@@ -268,12 +411,7 @@ func oauthCallback(ctx echo.Context) error {
 		}
 	}
 
-	sess := getSession(ctx)
-	sess.Values["user"] = userDB.ID
-	saveSession(sess, ctx)
-	deleteCsrfCookie(ctx)
-
-	return redirect(ctx, "/")
+	return startSession(ctx, userDB)
 }
 
 func oauth(ctx echo.Context) error {
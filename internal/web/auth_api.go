@@ -0,0 +1,207 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/thomiceli/opengist/internal/config"
+	"github.com/thomiceli/opengist/internal/db"
+	appmetrics "github.com/thomiceli/opengist/internal/metrics"
+	"gorm.io/gorm"
+)
+
+// jwtKey signs the access tokens issued to the apps, it is read from the sessions directory
+var jwtKey []byte
+
+var errInvalidAccessToken = errors.New("invalid access token")
+
+// accessTokenClaims are the claims of an access token, sid is the ID of the refresh token of the app session so
+// revoking the session revokes its access tokens as well
+type accessTokenClaims struct {
+	SessionID uint `json:"sid"`
+	jwt.StandardClaims
+}
+
+func accessTokenValidity() time.Duration {
+	return time.Duration(config.C.JwtAccessTokenExpiry) * time.Minute
+}
+
+func refreshTokenValidity() time.Duration {
+	return time.Duration(config.C.JwtRefreshTokenExpiry) * 24 * time.Hour
+}
+
+func newAccessToken(refreshToken *db.RefreshToken) (string, error) {
+	now := time.Now()
+	claims := accessTokenClaims{
+		SessionID: refreshToken.ID,
+		StandardClaims: jwt.StandardClaims{
+			Subject:   strconv.FormatUint(uint64(refreshToken.UserID), 10),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(accessTokenValidity()).Unix(),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtKey)
+}
+
+// parseAccessToken checks the signature and the expiry of an access token, then returns the app session it was
+// issued for, which must still be active
+func parseAccessToken(plainToken string) (*db.RefreshToken, error) {
+	claims := new(accessTokenClaims)
+	_, err := jwt.ParseWithClaims(plainToken, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		return jwtKey, nil
+	})
+	if err != nil {
+		return nil, errInvalidAccessToken
+	}
+
+	refreshToken, err := db.GetRefreshTokenByID(claims.SessionID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errInvalidAccessToken
+		}
+		return nil, err
+	}
+
+	if !refreshToken.IsActive() || strconv.FormatUint(uint64(refreshToken.UserID), 10) != claims.Subject {
+		return nil, errInvalidAccessToken
+	}
+	return refreshToken, nil
+}
+
+// apiTokensRes answers a new access token along with the refresh token of the app session
+func apiTokensRes(ctx echo.Context, refreshToken *db.RefreshToken, plainRefreshToken string) error {
+	accessToken, err := newAccessToken(refreshToken)
+	if err != nil {
+		return errorRes(500, "Cannot sign access token", err)
+	}
+
+	return ctx.JSON(200, map[string]interface{}{
+		"access_token":  accessToken,
+		"token_type":    "Bearer",
+		"expires_in":    int(accessTokenValidity().Seconds()),
+		"refresh_token": plainRefreshToken,
+	})
+}
+
+// apiLogin checks the credentials of a user and opens a session for an app, labelled after the device
+func apiLogin(ctx echo.Context) error {
+	if getData(ctx, "DisableLoginForm") == true {
+		return errorRes(403, tr(ctx, "error.login-disabled-form"), nil)
+	}
+
+	dto := new(db.ApiLoginDTO)
+	if err := ctx.Bind(dto); err != nil {
+		return errorRes(400, tr(ctx, "error.cannot-bind-data"), err)
+	}
+	if err := ctx.Validate(dto); err != nil {
+		return validationErrorRes(ctx, err)
+	}
+
+	user, err := checkCredentials(dto.Username, dto.Password)
+	if err != nil {
+		return errorRes(500, "Cannot check credentials", err)
+	}
+	if user == nil {
+		log.Warn().Msg("Invalid HTTP authentication attempt from " + ctx.RealIP())
+		appmetrics.LoginFailures.Inc("password")
+		return errorRes(401, tr(ctx, "flash.auth.invalid-credentials"), nil)
+	}
+	if user.Suspended {
+		return errorRes(403, tr(ctx, "flash.auth.account-suspended"), nil)
+	}
+
+	if userTotp, err := db.GetTOTPByUserID(user.ID); err == nil {
+		if valid, err := userTotp.Verify(dto.Passcode); err != nil {
+			return errorRes(500, "Cannot verify passcode", err)
+		} else if !valid {
+			log.Warn().Msg("Invalid TOTP passcode from " + ctx.RealIP())
+			appmetrics.LoginFailures.Inc("totp")
+			return errorRes(401, tr(ctx, "flash.auth.invalid-passcode"), nil)
+		}
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return errorRes(500, "Cannot get TOTP", err)
+	} else if hasWebAuthn, err := db.UserHasWebAuthn(user.ID); err != nil {
+		return errorRes(500, "Cannot check for passkeys", err)
+	} else if hasWebAuthn {
+		// apps cannot go through a passkey ceremony, the users with passkeys only log them in with access tokens
+		return errorRes(401, tr(ctx, "error.login-needs-passkey"), nil)
+	}
+
+	label := dto.Label
+	if label == "" {
+		label = ctx.Request().UserAgent()
+	}
+
+	refreshToken := &db.RefreshToken{Label: label, UserID: user.ID}
+	plainRefreshToken, err := refreshToken.Create(refreshTokenValidity())
+	if err != nil {
+		return errorRes(500, "Cannot create refresh token", err)
+	}
+
+	return apiTokensRes(ctx, refreshToken, plainRefreshToken)
+}
+
+// apiRefresh exchanges a refresh token for a new access token and a new refresh token, the former one cannot be
+// used again
+func apiRefresh(ctx echo.Context) error {
+	dto := new(db.RefreshTokenDTO)
+	if err := ctx.Bind(dto); err != nil {
+		return errorRes(400, tr(ctx, "error.cannot-bind-data"), err)
+	}
+	if err := ctx.Validate(dto); err != nil {
+		return validationErrorRes(ctx, err)
+	}
+
+	refreshToken, err := db.GetRefreshTokenByPlainToken(dto.RefreshToken)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errorRes(401, tr(ctx, "error.invalid-refresh-token"), nil)
+		}
+		return errorRes(500, "Cannot get refresh token", err)
+	}
+	if refreshToken.User.Suspended {
+		return errorRes(403, tr(ctx, "flash.auth.account-suspended"), nil)
+	}
+
+	plainRefreshToken, err := refreshToken.Rotate(refreshTokenValidity())
+	if err != nil {
+		if errors.Is(err, db.ErrRefreshTokenNotUsable) {
+			return errorRes(401, tr(ctx, "error.invalid-refresh-token"), nil)
+		}
+		return errorRes(500, "Cannot renew refresh token", err)
+	}
+
+	return apiTokensRes(ctx, refreshToken, plainRefreshToken)
+}
+
+// apiRevoke ends the app session of the refresh token. Unknown tokens are ignored, the session is over either way.
+func apiRevoke(ctx echo.Context) error {
+	dto := new(db.RefreshTokenDTO)
+	if err := ctx.Bind(dto); err != nil {
+		return errorRes(400, tr(ctx, "error.cannot-bind-data"), err)
+	}
+	if err := ctx.Validate(dto); err != nil {
+		return validationErrorRes(ctx, err)
+	}
+
+	refreshToken, err := db.GetRefreshTokenByPlainToken(dto.RefreshToken)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ctx.NoContent(204)
+		}
+		return errorRes(500, "Cannot get refresh token", err)
+	}
+
+	if err = refreshToken.Delete(); err != nil {
+		return errorRes(500, "Cannot revoke refresh token", err)
+	}
+	return ctx.NoContent(204)
+}
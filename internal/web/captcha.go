@@ -0,0 +1,55 @@
+package web
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/thomiceli/opengist/internal/captcha"
+	"github.com/thomiceli/opengist/internal/config"
+)
+
+// captchaEnabled reports whether the form asks for a captcha, the registration form does as soon as a provider is set
+// and the login form only if configured to
+func captchaEnabled(form string) bool {
+	if config.C.CaptchaProvider == captcha.Off {
+		return false
+	}
+	return form == "register" || config.C.CaptchaLogin
+}
+
+// authForm renders the login or registration form, with the widget of the captcha provider. The challenge of the
+// proof-of-work is kept in the session until the form is sent.
+func authForm(ctx echo.Context, form string) error {
+	if captchaEnabled(form) {
+		setData(ctx, "captcha", config.C.CaptchaProvider)
+
+		if config.C.CaptchaProvider == captcha.ProofOfWork {
+			challenge, err := captcha.NewChallenge()
+			if err != nil {
+				return errorRes(500, "Cannot generate captcha challenge", err)
+			}
+			sess := getSession(ctx)
+			sess.Values["powChallenge"] = challenge
+			saveSession(sess, ctx)
+			setData(ctx, "powChallenge", challenge)
+		}
+	}
+
+	return html(ctx, "auth_form.html")
+}
+
+// checkCaptcha reports whether the captcha of the form was solved. A proof-of-work challenge can be answered once.
+func checkCaptcha(ctx echo.Context, form string) (bool, error) {
+	if !captchaEnabled(form) {
+		return true, nil
+	}
+
+	provider := config.C.CaptchaProvider
+	if provider == captcha.ProofOfWork {
+		sess := getSession(ctx)
+		challenge, _ := sess.Values["powChallenge"].(string)
+		delete(sess.Values, "powChallenge")
+		saveSession(sess, ctx)
+		return captcha.VerifyProofOfWork(challenge, ctx.FormValue("pow-nonce"), config.C.CaptchaPowDifficulty), nil
+	}
+
+	return captcha.VerifyToken(provider, config.C.CaptchaSecretKey, ctx.FormValue(captcha.ResponseFields[provider]), ctx.RealIP())
+}
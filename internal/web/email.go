@@ -0,0 +1,153 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/thomiceli/opengist/internal/db"
+	"github.com/thomiceli/opengist/internal/mailer"
+)
+
+// emailVerificationValidity is how long a verification link can be opened after it was sent
+const emailVerificationValidity = 48 * time.Hour
+
+// emailVerificationAudience keeps the verification links from being used as access tokens, and the other way around
+const emailVerificationAudience = "email-verification"
+
+var errInvalidVerificationToken = errors.New("invalid email verification token")
+
+// emailVerificationClaims are the claims of a verification link, the email is checked against the current email of
+// the user so a link sent for a previous email does not verify the new one
+type emailVerificationClaims struct {
+	Email string `json:"email"`
+	jwt.StandardClaims
+}
+
+func newEmailVerificationToken(user *db.User) (string, error) {
+	now := time.Now()
+	claims := emailVerificationClaims{
+		Email: user.Email,
+		StandardClaims: jwt.StandardClaims{
+			Audience:  emailVerificationAudience,
+			Subject:   strconv.FormatUint(uint64(user.ID), 10),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(emailVerificationValidity).Unix(),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtKey)
+}
+
+func parseEmailVerificationToken(plainToken string) (*emailVerificationClaims, error) {
+	claims := new(emailVerificationClaims)
+	_, err := jwt.ParseWithClaims(plainToken, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		return jwtKey, nil
+	})
+	if err != nil || !claims.VerifyAudience(emailVerificationAudience, true) {
+		return nil, errInvalidVerificationToken
+	}
+	return claims, nil
+}
+
+// sendVerificationEmail mails the user a signed link verifying their email
+func sendVerificationEmail(ctx echo.Context, user *db.User) error {
+	token, err := newEmailVerificationToken(user)
+	if err != nil {
+		return err
+	}
+
+	link := getData(ctx, "baseHttpUrl").(string) + "/verify-email?token=" + url.QueryEscape(token)
+	return mailer.Send(&mailer.Message{
+		To:      user.Email,
+		Subject: tr(ctx, "email.verification.subject"),
+		Body:    tr(ctx, "email.verification.body", user.Username, link, int(emailVerificationValidity.Hours())),
+	})
+}
+
+func verifyEmail(ctx echo.Context) error {
+	location := "/login"
+	if getUserLogged(ctx) != nil {
+		location = "/settings"
+	}
+
+	claims, err := parseEmailVerificationToken(ctx.QueryParam("token"))
+	if err != nil {
+		addFlash(ctx, tr(ctx, "flash.user.email-verification-invalid"), "error")
+		return redirect(ctx, location)
+	}
+
+	userId, err := strconv.ParseUint(claims.Subject, 10, 64)
+	if err != nil {
+		addFlash(ctx, tr(ctx, "flash.user.email-verification-invalid"), "error")
+		return redirect(ctx, location)
+	}
+	user, err := db.GetUserById(uint(userId))
+	if err != nil {
+		addFlash(ctx, tr(ctx, "flash.user.email-verification-invalid"), "error")
+		return redirect(ctx, location)
+	}
+
+	if ok, err := user.VerifyEmail(claims.Email); err != nil {
+		return errorRes(500, "Cannot verify email", err)
+	} else if !ok {
+		addFlash(ctx, tr(ctx, "flash.user.email-verification-invalid"), "error")
+		return redirect(ctx, location)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.user.email-verified"), "success")
+	return redirect(ctx, location)
+}
+
+func emailVerificationResend(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+	if user.Email == "" || user.EmailVerified || !mailer.Enabled() {
+		return redirect(ctx, "/settings")
+	}
+
+	if err := sendVerificationEmail(ctx, user); err != nil {
+		return errorRes(500, "Cannot send verification email", err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.user.email-verification-sent"), "success")
+	return redirect(ctx, "/settings")
+}
+
+// sendCommentEmails mails a new comment to the watchers of the gist who can still read it, but its author. Only the
+// verified emails get it, and a failure is logged without failing the comment.
+func sendCommentEmails(ctx echo.Context, gist *db.Gist, comment *db.Comment) {
+	if !mailer.Enabled() {
+		return
+	}
+
+	watchers, err := gist.GetWatchers()
+	if err != nil {
+		log.Error().Err(err).Msg("Cannot get the watchers of the gist " + gist.Uuid)
+		return
+	}
+
+	link := getData(ctx, "baseHttpUrl").(string) + "/" + gist.User.Username + "/" + gist.Identifier() +
+		"#comment-" + strconv.Itoa(int(comment.ID))
+	for _, watcher := range watchers {
+		if watcher.ID == comment.UserID || watcher.Suspended || watcher.Email == "" || !watcher.EmailVerified ||
+			!gist.CanRead(watcher) {
+			continue
+		}
+
+		err = mailer.Send(&mailer.Message{
+			To:      watcher.Email,
+			Subject: tr(ctx, "email.comment.subject", gist.Title),
+			Body:    tr(ctx, "email.comment.body", watcher.Username, comment.User.Username, gist.Title, comment.Body, link),
+		})
+		if err != nil {
+			log.Error().Err(err).Msg("Cannot send comment email to " + watcher.Username)
+		}
+	}
+}
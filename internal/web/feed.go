@@ -0,0 +1,176 @@
+package web
+
+import (
+	"encoding/xml"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/thomiceli/opengist/internal/config"
+	"github.com/thomiceli/opengist/internal/db"
+	"gorm.io/gorm"
+)
+
+// atomFeed is an Atom 1.0 document, see RFC 4287
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Author  *atomAuthor `xml:"author,omitempty"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	ID        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Updated   string      `xml:"updated"`
+	Published string      `xml:"published,omitempty"`
+	Link      atomLink    `xml:"link"`
+	Author    *atomAuthor `xml:"author,omitempty"`
+	Summary   *atomText   `xml:"summary,omitempty"`
+	Content   *atomText   `xml:"content,omitempty"`
+}
+
+func atomTime(timestamp int64) string {
+	return time.Unix(timestamp, 0).UTC().Format(time.RFC3339)
+}
+
+// newAtomFeed returns a feed whose id and alternate link is the HTML page, and self link is the feed itself
+func newAtomFeed(ctx echo.Context, title string, pageUrl string) *atomFeed {
+	return &atomFeed{
+		ID:    pageUrl,
+		Title: title,
+		Links: []atomLink{
+			{Href: pageUrl, Rel: "alternate", Type: "text/html"},
+			{Href: getData(ctx, "baseHttpUrl").(string) + ctx.Request().URL.Path, Rel: "self", Type: "application/atom+xml"},
+		},
+	}
+}
+
+func renderAtom(ctx echo.Context, feed *atomFeed) error {
+	// an empty feed is as recent as the instance, the entries are sorted from the most recent
+	feed.Updated = atomTime(time.Now().Unix())
+	if len(feed.Entries) > 0 {
+		feed.Updated = feed.Entries[0].Updated
+	}
+
+	out, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return errorRes(500, "Error rendering the feed", err)
+	}
+	return ctx.Blob(200, "application/atom+xml; charset=utf-8", append([]byte(xml.Header), out...))
+}
+
+// gistEntries lists the gists as entries, their latest files preview as content
+func gistEntries(ctx echo.Context, gists []*db.Gist) []atomEntry {
+	baseHttpUrl := getData(ctx, "baseHttpUrl").(string)
+	entries := make([]atomEntry, 0, len(gists))
+	for _, gist := range gists {
+		gistUrl := baseHttpUrl + "/" + gist.User.Username + "/" + gist.Identifier()
+		entry := atomEntry{
+			ID:        gistUrl,
+			Title:     gist.Title,
+			Updated:   atomTime(gist.CreatedAt),
+			Published: atomTime(gist.CreatedAt),
+			Link:      atomLink{Href: gistUrl, Rel: "alternate", Type: "text/html"},
+			Author:    &atomAuthor{Name: gist.User.Username, URI: baseHttpUrl + "/" + gist.User.Username},
+			Content:   &atomText{Type: "text", Body: gist.Preview},
+		}
+		if gist.Description != "" {
+			entry.Summary = &atomText{Type: "text", Body: gist.Description}
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// allGistsFeed lists the latest public gists of the instance
+func allGistsFeed(ctx echo.Context) error {
+	gists, _, err := db.GetAllGistsForCurrentUser(0, db.Page{Number: 1, Size: config.C.PaginationPageSize}, "created", "desc", "", db.TimeRange{})
+	if err != nil {
+		return errorRes(500, "Error fetching gists", err)
+	}
+
+	feed := newAtomFeed(ctx, tr(ctx, "gist.list.all"), getData(ctx, "baseHttpUrl").(string)+"/all")
+	feed.Entries = gistEntries(ctx, gists)
+	return renderAtom(ctx, feed)
+}
+
+// userGistsFeed lists the latest public gists of a user, it is served on the page of the user followed by .atom
+func userGistsFeed(ctx echo.Context, username string) error {
+	user, err := db.GetUserByUsername(username)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return notFound("User not found")
+	} else if err != nil {
+		return errorRes(500, "Error fetching user", err)
+	}
+
+	gists, _, err := db.GetAllGistsFromUser(user.ID, 0, db.Page{Number: 1, Size: config.C.PaginationPageSize}, "created", "desc", false, "", "", db.TimeRange{})
+	if err != nil {
+		return errorRes(500, "Error fetching gists", err)
+	}
+
+	userUrl := getData(ctx, "baseHttpUrl").(string) + "/" + user.Username
+	feed := newAtomFeed(ctx, tr(ctx, "gist.list.all-from", user.Username), userUrl)
+	feed.Author = &atomAuthor{Name: user.Username, URI: userUrl}
+	feed.Entries = gistEntries(ctx, gists)
+	return renderAtom(ctx, feed)
+}
+
+// revisionsFeed lists the latest revisions of a gist, the files changed by each one as content
+func revisionsFeed(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+
+	commits, err := gist.Log(0)
+	if err != nil {
+		return errorRes(500, "Error fetching commits log", err)
+	}
+	// the log holds one more commit to tell if there is a next page
+	if len(commits) > 10 {
+		commits = commits[:10]
+	}
+
+	gistUrl := getData(ctx, "baseHttpUrl").(string) + "/" + gist.User.Username + "/" + gist.Identifier()
+	feed := newAtomFeed(ctx, tr(ctx, "gist.revision-of", gist.Title), gistUrl+"/revisions")
+	feed.Author = &atomAuthor{Name: gist.User.Username}
+
+	for _, commit := range commits {
+		timestamp, _ := strconv.ParseInt(commit.Timestamp, 10, 64)
+		filenames := make([]string, 0, len(commit.Files))
+		for _, file := range commit.Files {
+			filenames = append(filenames, file.Filename)
+		}
+
+		revisionUrl := gistUrl + "/rev/" + commit.Hash
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:      revisionUrl,
+			Title:   tr(ctx, "gist.header.revision") + " " + commit.Hash[:7],
+			Updated: atomTime(timestamp),
+			Link:    atomLink{Href: revisionUrl, Rel: "alternate", Type: "text/html"},
+			Author:  &atomAuthor{Name: commit.AuthorName},
+			Content: &atomText{Type: "text", Body: strings.TrimSpace(commit.Changed + "\n" + strings.Join(filenames, "\n"))},
+		})
+	}
+
+	return renderAtom(ctx, feed)
+}
@@ -1,18 +1,22 @@
 package web
 
 import (
-	"archive/zip"
 	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
 	"html/template"
+	"io"
+	"mime"
+	"net/http"
 	"net/url"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/rs/zerolog/log"
 	"github.com/thomiceli/opengist/internal/git"
@@ -20,11 +24,13 @@ import (
 	"github.com/thomiceli/opengist/internal/index"
 	"github.com/thomiceli/opengist/internal/render"
 	"github.com/thomiceli/opengist/internal/utils"
+	"github.com/thomiceli/opengist/internal/webhook"
 
 	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 	"github.com/thomiceli/opengist/internal/config"
 	"github.com/thomiceli/opengist/internal/db"
+	"golang.org/x/text/unicode/norm"
 	"gorm.io/gorm"
 )
 
@@ -52,13 +58,15 @@ func gistInit(next echo.HandlerFunc) echo.HandlerFunc {
 			return notFound("Gist not found")
 		}
 
-		if gist.Private == db.PrivateVisibility {
-			if currUser == nil || currUser.ID != gist.UserID {
-				return notFound("Gist not found")
-			}
+		if !gist.CanRead(currUser) {
+			return notFound("Gist not found")
 		}
+		canWrite := gist.CanWrite(currUser)
 
 		setData(ctx, "gist", gist)
+		setData(ctx, "canWrite", canWrite)
+		setData(ctx, "isOwner", gist.CanManage(currUser))
+		setData(ctx, "canToggleLock", gist.CanToggleLock(currUser))
 
 		if config.C.SshGit {
 			var sshDomain string
@@ -85,6 +93,8 @@ func gistInit(next echo.HandlerFunc) echo.HandlerFunc {
 		setData(ctx, "httpCopyUrl", baseHttpUrl+"/"+userName+"/"+gistName)
 		setData(ctx, "currentUrl", template.URL(ctx.Request().URL.Path))
 		setData(ctx, "embedScript", fmt.Sprintf(`<script src="%s"></script>`, baseHttpUrl+"/"+userName+"/"+gistName+".js"))
+		setData(ctx, "embedIframe", fmt.Sprintf(`<iframe src="%s" width="100%%" height="400" style="border: 0"></iframe>`,
+			baseHttpUrl+"/"+userName+"/"+gistName+"/embed"))
 
 		nbCommits, err := gist.NbCommits()
 		if err != nil {
@@ -98,7 +108,25 @@ func gistInit(next echo.HandlerFunc) echo.HandlerFunc {
 				return errorRes(500, "Cannot get user like status", err)
 			}
 			setData(ctx, "hasLiked", hasLiked)
+
+			isWatching, err := gist.IsWatchedBy(currUser.ID)
+			if err != nil {
+				return errorRes(500, "Cannot get user watch status", err)
+			}
+			setData(ctx, "isWatching", isWatching)
+		}
+
+		nbWatchers, err := gist.CountWatchers()
+		if err != nil {
+			return errorRes(500, "Error counting watchers", err)
 		}
+		setData(ctx, "nbWatchers", nbWatchers)
+
+		languages, err := gist.Languages()
+		if err != nil {
+			return errorRes(500, "Error fetching gist languages", err)
+		}
+		setData(ctx, "languages", languages)
 
 		if gist.Private > 0 {
 			setData(ctx, "NoIndex", true)
@@ -132,13 +160,19 @@ func gistNewPushSoftInit(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
+// trendingDays is the window in which the likes of a gist count for the trending list of the all gists page
+const trendingDays = 7
+
 func allGists(ctx echo.Context) error {
 	var err error
 	var urlPage string
 
 	fromUserStr := ctx.Param("user")
+	if username, ok := strings.CutSuffix(fromUserStr, ".atom"); ok && ctx.Path() == "/:user" {
+		return userGistsFeed(ctx, username)
+	}
 	userLogged := getUserLogged(ctx)
-	pageInt := getPage(ctx)
+	page := getListPage(ctx)
 
 	sort := "created"
 	sortText := trH(ctx, "gist.list.sort-by-created")
@@ -158,7 +192,36 @@ func allGists(ctx echo.Context) error {
 	setData(ctx, "sort", sortText)
 	setData(ctx, "order", orderText)
 
+	timeRange, timeRangeParams, err := getTimeRange(ctx, sort == "updated")
+	if err != nil {
+		return errorRes(400, tr(ctx, "error.invalid-time-range"), err)
+	}
+
+	// on the page of a topic, or to filter the gists of a user
+	topic := strings.ToLower(ctx.Param("topic"))
+	if topic == "" {
+		topic = strings.ToLower(ctx.QueryParam("topic"))
+	}
+	if topic != "" {
+		if !utils.IsValidTopic(topic) {
+			return notFound("Topic not found")
+		}
+		setData(ctx, "topic", topic)
+		timeRangeParams += "&topic=" + topic
+	}
+
+	// to filter the gists of a user or of the instance
+	language := strings.TrimSpace(ctx.QueryParam("language"))
+	if language != "" {
+		if len(language) > 255 {
+			return notFound("Language not found")
+		}
+		setData(ctx, "language", language)
+		timeRangeParams += "&language=" + url.QueryEscape(language)
+	}
+
 	var gists []*db.Gist
+	var total int64
 	var currentUserId uint
 	if userLogged != nil {
 		currentUserId = userLogged.ID
@@ -168,18 +231,46 @@ func allGists(ctx echo.Context) error {
 
 	if fromUserStr == "" {
 		urlctx := ctx.Request().URL.Path
-		if strings.HasSuffix(urlctx, "search") {
+		if ctx.Param("topic") != "" {
+			setData(ctx, "htmlTitle", trH(ctx, "gist.list.topic", topic))
+			setData(ctx, "mode", "topic")
+			urlPage = "topics/" + topic
+			gists, total, err = db.GetAllGistsWithTopic(topic, page, sort, order)
+		} else if strings.HasSuffix(urlctx, "search") {
 			setData(ctx, "htmlTitle", trH(ctx, "gist.list.search-results"))
 			setData(ctx, "mode", "search")
 			setData(ctx, "searchQuery", ctx.QueryParam("q"))
 			setData(ctx, "searchQueryUrl", template.URL("&q="+ctx.QueryParam("q")))
 			urlPage = "search"
-			gists, err = db.GetAllGistsFromSearch(currentUserId, ctx.QueryParam("q"), pageInt-1, sort, order)
+			gists, total, err = db.GetAllGistsFromSearch(currentUserId, ctx.QueryParam("q"), page, sort, order)
 		} else if strings.HasSuffix(urlctx, "all") {
 			setData(ctx, "htmlTitle", trH(ctx, "gist.list.all"))
 			setData(ctx, "mode", "all")
+			setData(ctx, "atomFeed", getData(ctx, "baseHttpUrl").(string)+"/all.atom")
 			urlPage = "all"
-			gists, err = db.GetAllGistsForCurrentUser(currentUserId, pageInt-1, sort, order)
+			gists, total, err = db.GetAllGistsForCurrentUser(currentUserId, page, sort, order, language, timeRange)
+			if language != "" {
+				setData(ctx, "searchQueryUrl", template.URL("&language="+url.QueryEscape(language)))
+			}
+
+			if userLogged != nil && page.Number == 1 {
+				recentGists, err := db.GetRecentlyViewed(userLogged.ID, 5)
+				if err != nil {
+					return errorRes(500, "Error fetching recently viewed gists", err)
+				}
+				setData(ctx, "recentGists", recentGists)
+			}
+
+			if page.Number == 1 {
+				trendingGists, err := db.GetTrendingGists(trendingDays, 0)
+				if err != nil {
+					return errorRes(500, "Error fetching trending gists", err)
+				}
+				if len(trendingGists) > 5 {
+					trendingGists = trendingGists[:5]
+				}
+				setData(ctx, "trendingGists", trendingGists)
+			}
 		}
 	} else {
 		liked := false
@@ -206,39 +297,50 @@ func allGists(ctx echo.Context) error {
 		}
 		setData(ctx, "fromUser", fromUser)
 
-		if countFromUser, err := db.CountAllGistsFromUser(fromUser.ID, currentUserId); err != nil {
+		countFromUser, err := db.CountAllGistsFromUser(fromUser.ID, currentUserId, "", "", timeRange)
+		if err != nil {
 			return errorRes(500, "Error counting gists", err)
-		} else {
-			setData(ctx, "countFromUser", countFromUser)
 		}
+		setData(ctx, "countFromUser", countFromUser)
 
-		if countLiked, err := db.CountAllGistsLikedByUser(fromUser.ID, currentUserId); err != nil {
+		countLiked, err := db.CountAllGistsLikedByUser(fromUser.ID, currentUserId)
+		if err != nil {
 			return errorRes(500, "Error counting liked gists", err)
-		} else {
-			setData(ctx, "countLiked", countLiked)
 		}
+		setData(ctx, "countLiked", countLiked)
 
-		if countForked, err := db.CountAllGistsForkedByUser(fromUser.ID, currentUserId); err != nil {
+		countForked, err := db.CountAllGistsForkedByUser(fromUser.ID, currentUserId)
+		if err != nil {
 			return errorRes(500, "Error counting forked gists", err)
-		} else {
-			setData(ctx, "countForked", countForked)
 		}
+		setData(ctx, "countForked", countForked)
 
 		if liked {
 			urlPage = fromUserStr + "/liked"
 			setData(ctx, "htmlTitle", trH(ctx, "gist.list.all-liked-by", fromUserStr))
 			setData(ctx, "mode", "liked")
-			gists, err = db.GetAllGistsLikedByUser(fromUser.ID, currentUserId, pageInt-1, sort, order)
+			gists, total, err = db.GetAllGistsLikedByUser(fromUser.ID, currentUserId, page, sort, order)
 		} else if forked {
 			urlPage = fromUserStr + "/forked"
 			setData(ctx, "htmlTitle", trH(ctx, "gist.list.all-forked-by", fromUserStr))
 			setData(ctx, "mode", "forked")
-			gists, err = db.GetAllGistsForkedByUser(fromUser.ID, currentUserId, pageInt-1, sort, order)
+			gists, total, err = db.GetAllGistsForkedByUser(fromUser.ID, currentUserId, page, sort, order)
 		} else {
 			urlPage = fromUserStr
 			setData(ctx, "htmlTitle", trH(ctx, "gist.list.all-from", fromUserStr))
 			setData(ctx, "mode", "fromUser")
-			gists, err = db.GetAllGistsFromUser(fromUser.ID, currentUserId, pageInt-1, sort, order)
+			setData(ctx, "atomFeed", getData(ctx, "baseHttpUrl").(string)+"/"+fromUser.Username+".atom")
+			gists, total, err = db.GetAllGistsFromUser(fromUser.ID, currentUserId, page, sort, order, false, topic, language, timeRange)
+			filterParams := ""
+			if topic != "" {
+				filterParams += "&topic=" + topic
+			}
+			if language != "" {
+				filterParams += "&language=" + url.QueryEscape(language)
+			}
+			if filterParams != "" {
+				setData(ctx, "searchQueryUrl", template.URL(filterParams))
+			}
 		}
 	}
 
@@ -255,7 +357,15 @@ func allGists(ctx echo.Context) error {
 		return errorRes(500, "Error fetching gists", err)
 	}
 
-	if err = paginate(ctx, renderedGists, pageInt, 10, "gists", fromUserStr, 2, "&sort="+sort+"&order="+order); err != nil {
+	if err = setLikedGists(ctx, gists); err != nil {
+		return errorRes(500, "Error fetching liked gists", err)
+	}
+
+	if err = setGistsLanguages(ctx, gists); err != nil {
+		return errorRes(500, "Error fetching gists languages", err)
+	}
+
+	if err = paginateTotal(ctx, renderedGists, total, page, "gists", fromUserStr, 2, "&sort="+sort+"&order="+order+timeRangeParams); err != nil {
 		return errorRes(404, tr(ctx, "error.page-not-found"), nil)
 	}
 
@@ -308,6 +418,14 @@ func search(ctx echo.Context) error {
 		renderedGists = append(renderedGists, &rendered)
 	}
 
+	if err = setLikedGists(ctx, gists); err != nil {
+		return errorRes(500, "Error fetching liked gists", err)
+	}
+
+	if err = setGistsLanguages(ctx, gists); err != nil {
+		return errorRes(500, "Error fetching gists languages", err)
+	}
+
 	if pageInt > 1 && len(renderedGists) != 0 {
 		setData(ctx, "prevPage", pageInt-1)
 	}
@@ -326,6 +444,272 @@ func search(ctx echo.Context) error {
 	return html(ctx, "search.html")
 }
 
+// setLikedGists sets which of the listed gists are liked by the logged user, so they can be rendered accordingly
+func setLikedGists(ctx echo.Context, gists []*db.Gist) error {
+	liked := make(map[uint]bool)
+	if userLogged := getUserLogged(ctx); userLogged != nil {
+		ids := make([]uint, 0, len(gists))
+		for _, gist := range gists {
+			ids = append(ids, gist.ID)
+		}
+
+		var err error
+		if liked, err = db.GetLikedGistIDs(userLogged.ID, ids); err != nil {
+			return err
+		}
+	}
+
+	setData(ctx, "likedGists", liked)
+	return nil
+}
+
+// setGistsLanguages sets the languages of the files of each gist of the listing, by gist ID
+func setGistsLanguages(ctx echo.Context, gists []*db.Gist) error {
+	ids := make([]uint, 0, len(gists))
+	for _, gist := range gists {
+		ids = append(ids, gist.ID)
+	}
+
+	languages, err := db.GetGistsLanguages(ids)
+	if err != nil {
+		return err
+	}
+
+	setData(ctx, "gistLanguages", languages)
+	return nil
+}
+
+func suggestGists(ctx echo.Context) error {
+	var currentUserId uint
+	if userLogged := getUserLogged(ctx); userLogged != nil {
+		currentUserId = userLogged.ID
+	}
+
+	results := make([]map[string]interface{}, 0)
+
+	query := strings.TrimSpace(ctx.QueryParam("q"))
+	if query == "" {
+		return ctx.JSON(200, results)
+	}
+
+	suggestions, err := db.GetGistSuggestions(currentUserId, query)
+	if err != nil {
+		return errorRes(500, "Error fetching gist suggestions", err)
+	}
+
+	for _, suggestion := range suggestions {
+		results = append(results, map[string]interface{}{
+			"id":    suggestion.Identifier(),
+			"title": suggestion.Title,
+			"owner": suggestion.Username,
+			"url":   getData(ctx, "baseHttpUrl").(string) + "/" + suggestion.Username + "/" + suggestion.Identifier(),
+		})
+	}
+
+	return ctx.JSON(200, results)
+}
+
+// apiGists lists the public gists page by page, each response holds a next_cursor to send back as the cursor
+// query parameter to get the following page, it is empty once every gist has been listed. With lite=true the
+// descriptions are neither loaded nor sent. The since and until parameters bound the update time of the gists.
+func apiGists(ctx echo.Context) error {
+	limit := 30
+	if limitStr := ctx.QueryParam("limit"); limitStr != "" {
+		var err error
+		if limit, err = strconv.Atoi(limitStr); err != nil || limit < 1 || limit > 100 {
+			return errorRes(400, tr(ctx, "error.invalid-number"), nil)
+		}
+	}
+
+	var cursor *db.GistCursor
+	if cursorStr := ctx.QueryParam("cursor"); cursorStr != "" {
+		var err error
+		if cursor, err = db.ParseGistCursor(cursorStr); err != nil {
+			return errorRes(400, tr(ctx, "error.bad-request"), err)
+		}
+	}
+
+	lite := ctx.QueryParam("lite") == "true"
+
+	timeRange, _, err := getTimeRange(ctx, true)
+	if err != nil {
+		return errorRes(400, tr(ctx, "error.invalid-time-range"), err)
+	}
+
+	gists, nextCursor, err := db.GetGistsAfterCursor(cursor, limit, lite, timeRange)
+	if err != nil {
+		return errorRes(500, "Error fetching gists", err)
+	}
+
+	results := make([]map[string]interface{}, 0, len(gists))
+	for _, gist := range gists {
+		result := apiGist(gist)
+		if lite {
+			delete(result, "description")
+		}
+		results = append(results, result)
+	}
+
+	nextCursorStr := ""
+	if nextCursor != nil {
+		nextCursorStr = nextCursor.String()
+	}
+
+	return ctx.JSON(200, map[string]interface{}{
+		"gists":       results,
+		"next_cursor": nextCursorStr,
+	})
+}
+
+// apiGistMetadata changes the title, description and visibility of a gist without creating a commit. Fields left out
+// of the request keep their current value.
+func apiGistMetadata(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+	user := getUserLogged(ctx)
+	if gist.Locked && gist.IsWriter(user) {
+		return errorRes(403, tr(ctx, "error.gist-locked"), nil)
+	} else if !gist.CanWrite(user) {
+		return errorRes(403, tr(ctx, "error.forbidden"), nil)
+	}
+
+	dto := &db.GistDTO{
+		Title:         gist.Title,
+		Description:   gist.Description,
+		VisibilityDTO: db.VisibilityDTO{Private: gist.Private},
+	}
+	if err := ctx.Bind(dto); err != nil {
+		return errorRes(400, tr(ctx, "error.cannot-bind-data"), err)
+	}
+
+	validator := ctx.Echo().Validator.(*utils.OpengistValidator)
+	if err := validator.ValidatePartial(dto, "Title", "Description", "VisibilityDTO.Private"); err != nil {
+		return validationErrorRes(ctx, err)
+	}
+
+	// like the visibility form, only the owner can change who sees the gist
+	if dto.Private != gist.Private && !gist.CanManage(user) {
+		return errorRes(403, tr(ctx, "error.forbidden"), nil)
+	}
+	if dto.Private != gist.Private {
+		allowed, err := gist.VisibilityAllowed(dto.Private)
+		if err != nil {
+			return errorRes(500, "Error checking the visibility of the parent gist", err)
+		}
+		if !allowed {
+			return errorRes(403, tr(ctx, "flash.gist.fork-stays-private"), nil)
+		}
+		if dto.Private == db.PublicVisibility && !gist.User.CanPublish() {
+			return errorRes(403, tr(ctx, "error.verify-email-to-publish"), nil)
+		}
+	}
+
+	previous := gist.Private
+	if err := gist.UpdateMetadata(dto); err != nil {
+		return errorRes(500, "Error updating the gist", err)
+	}
+
+	if previous != gist.Private {
+		if err := db.AddAuditLog(user, db.AuditGistVisibilityChanged, gist, map[string]any{
+			"from": previous.String(),
+			"to":   gist.Private.String(),
+		}); err != nil {
+			return errorRes(500, "Error recording the audit log", err)
+		}
+	}
+
+	gist.AddInIndex()
+	webhook.Trigger(webhook.GistUpdated, gist, user)
+
+	return ctx.JSON(200, apiGist(gist))
+}
+
+// apiGistsBatch returns the gists of the refs in one response, in the order asked. The gists that do not exist or
+// are hidden to the user are listed in not_found. With files=true, the files of their latest revision are sent too.
+func apiGistsBatch(ctx echo.Context) error {
+	dto := new(db.GistBatchDTO)
+	if err := ctx.Bind(dto); err != nil {
+		return errorRes(400, tr(ctx, "error.cannot-bind-data"), err)
+	}
+	if err := ctx.Validate(dto); err != nil {
+		return validationErrorRes(ctx, err)
+	}
+
+	gists, err := db.GetGistsByRefs(dto.Gists, getUserLogged(ctx))
+	if err != nil {
+		return errorRes(500, "Error fetching gists", err)
+	}
+
+	results := make([]map[string]interface{}, 0, len(gists))
+	notFound := make([]db.GistRefDTO, 0)
+	for i, gist := range gists {
+		if gist == nil {
+			notFound = append(notFound, dto.Gists[i])
+			continue
+		}
+
+		result := apiGist(gist)
+		if dto.Files {
+			files, err := gist.Files("HEAD", true)
+			if err != nil {
+				return errorRes(500, "Error fetching files", err)
+			}
+			result["files"] = files
+		}
+		results = append(results, result)
+	}
+
+	return ctx.JSON(200, map[string]interface{}{
+		"gists":     results,
+		"not_found": notFound,
+	})
+}
+
+func apiGist(gist *db.Gist) map[string]interface{} {
+	var expiresAt *string
+	if gist.ExpiresAt != 0 {
+		date := time.Unix(gist.ExpiresAt, 0).Format(time.RFC3339)
+		expiresAt = &date
+	}
+
+	return map[string]interface{}{
+		"owner":       gist.User.Username,
+		"id":          gist.Identifier(),
+		"uuid":        gist.Uuid,
+		"title":       gist.Title,
+		"description": gist.Description,
+		"created_at":  time.Unix(gist.CreatedAt, 0).Format(time.RFC3339),
+		"updated_at":  time.Unix(gist.UpdatedAt, 0).Format(time.RFC3339),
+		"expires_at":  expiresAt,
+		"visibility":  gist.VisibilityStr(),
+		"url":         config.C.BasePath() + "/" + gist.User.Username + "/" + gist.Identifier(),
+	}
+}
+
+// gistBranch returns the branch of the branch query param, the default branch if there is none, and sets the data of
+// the branch switcher. A branch that does not exist is not found.
+func gistBranch(ctx echo.Context, gist *db.Gist) (string, error) {
+	branches, err := gist.Branches()
+	if err != nil {
+		return "", errorRes(500, "Error fetching branches", err)
+	}
+	defaultBranch, err := gist.DefaultBranch()
+	if err != nil {
+		return "", errorRes(500, "Error fetching the default branch", err)
+	}
+
+	branch := ctx.QueryParam("branch")
+	if branch == "" {
+		branch = defaultBranch
+	} else if !slices.Contains(branches, branch) {
+		return "", notFound("Branch not found")
+	}
+
+	setData(ctx, "branches", branches)
+	setData(ctx, "branch", branch)
+	setData(ctx, "defaultBranch", defaultBranch)
+	return branch, nil
+}
+
 func gistIndex(ctx echo.Context) error {
 	if getData(ctx, "gistpage") == "js" {
 		return gistJs(ctx)
@@ -337,7 +721,18 @@ func gistIndex(ctx echo.Context) error {
 	revision := ctx.Param("revision")
 
 	if revision == "" {
+		branch, err := gistBranch(ctx, gist)
+		if err != nil {
+			return err
+		}
+
 		revision = "HEAD"
+		// the files of another branch are linked by their commit, as a branch name may hold slashes
+		if branch != getData(ctx, "defaultBranch") {
+			if revision, err = gist.CommitHash("refs/heads/" + branch); err != nil {
+				return errorRes(500, "Error getting the revision", err)
+			}
+		}
 	}
 
 	files, err := gist.Files(revision, true)
@@ -347,16 +742,75 @@ func gistIndex(ctx echo.Context) error {
 		return errorRes(500, "Error fetching files", err)
 	}
 
+	// the permalinks of the files point to the commit, they do not change when the gist does
+	commitHash, err := gist.CommitHash(revision)
+	if err != nil {
+		return errorRes(500, "Error getting the revision", err)
+	}
+
 	renderedFiles := render.HighlightFiles(files)
 
+	if linesStr := ctx.QueryParam("lines"); linesStr != "" {
+		selection, err := render.ParseLineRange(linesStr)
+		if err != nil {
+			return errorRes(400, tr(ctx, "error.invalid-line-range"), err)
+		}
+		for i := range renderedFiles {
+			renderedFiles[i].Selection = selection
+		}
+	}
+
+	if userLogged := getUserLogged(ctx); userLogged != nil {
+		if err = db.RecordView(userLogged.ID, gist.ID); err != nil {
+			log.Error().Err(err).Msg("Error recording view of gist " + gist.Identifier())
+		}
+	}
+
+	comments, err := gist.GetComments()
+	if err != nil {
+		return errorRes(500, "Error fetching comments", err)
+	}
+
 	setData(ctx, "page", "code")
 	setData(ctx, "commit", revision)
+	setData(ctx, "commitHash", commitHash)
 	setData(ctx, "files", renderedFiles)
+	setData(ctx, "comments", render.MarkdownComments(comments))
 	setData(ctx, "revision", revision)
 	setData(ctx, "htmlTitle", gist.Title)
+	if gist.Private != db.PrivateVisibility {
+		setData(ctx, "openGraph", gistOpenGraph(ctx, gist))
+	}
 	return html(ctx, "gist.html")
 }
 
+// openGraphDescriptionLength is the maximum number of characters of the social preview description
+const openGraphDescriptionLength = 300
+
+type openGraph struct {
+	Title       string
+	Description string
+	Url         string
+}
+
+// gistOpenGraph returns the OpenGraph and Twitter card metadata shown by social platforms when the gist link is
+// shared. The description falls back to the first lines of the gist preview.
+func gistOpenGraph(ctx echo.Context, gist *db.Gist) openGraph {
+	description := strings.TrimSpace(gist.Description)
+	if description == "" {
+		description = strings.TrimSpace(gist.Preview)
+	}
+	if runes := []rune(description); len(runes) > openGraphDescriptionLength {
+		description = string(runes[:openGraphDescriptionLength-1]) + "…"
+	}
+
+	return openGraph{
+		Title:       gist.Title,
+		Description: description,
+		Url:         getData(ctx, "baseHttpUrl").(string) + "/" + gist.User.Username + "/" + gist.Identifier(),
+	}
+}
+
 func gistJson(ctx echo.Context) error {
 	gist := getData(ctx, "gist").(*db.Gist)
 	files, err := gist.Files("HEAD", true)
@@ -402,18 +856,42 @@ func gistJson(ctx echo.Context) error {
 	})
 }
 
+// embedFiles returns the highlighted files of an embedded gist, or only the file named by the file query param
+func embedFiles(ctx echo.Context, gist *db.Gist) ([]render.RenderedFile, error) {
+	filename := ctx.QueryParam("file")
+	if filename == "" {
+		files, err := gist.Files("HEAD", true)
+		if err != nil {
+			return nil, errorRes(500, "Error fetching files", err)
+		}
+		return render.HighlightFiles(files), nil
+	}
+
+	file, err := gist.File("HEAD", filename, true)
+	if err != nil {
+		return nil, errorRes(500, "Error fetching file", err)
+	}
+	if file == nil {
+		return nil, notFound("File not found")
+	}
+
+	rendered, err := render.HighlightFile(file)
+	if err != nil {
+		log.Error().Err(err).Msg("Error rendering embedded file " + filename)
+	}
+	return []render.RenderedFile{rendered}, nil
+}
+
 func gistJs(ctx echo.Context) error {
 	if _, exists := ctx.QueryParams()["dark"]; exists {
 		setData(ctx, "dark", "dark")
 	}
 
 	gist := getData(ctx, "gist").(*db.Gist)
-	files, err := gist.Files("HEAD", true)
+	renderedFiles, err := embedFiles(ctx, gist)
 	if err != nil {
-		return errorRes(500, "Error fetching files", err)
+		return err
 	}
-
-	renderedFiles := render.HighlightFiles(files)
 	setData(ctx, "files", renderedFiles)
 
 	htmlbuf := bytes.Buffer{}
@@ -438,6 +916,30 @@ document.write('%s')
 	return plainText(ctx, 200, js)
 }
 
+// gistEmbed renders the gist alone in a minimal page, to be shown in an iframe by other websites
+func gistEmbed(ctx echo.Context) error {
+	if _, exists := ctx.QueryParams()["dark"]; exists {
+		setData(ctx, "dark", "dark")
+	}
+
+	gist := getData(ctx, "gist").(*db.Gist)
+	renderedFiles, err := embedFiles(ctx, gist)
+	if err != nil {
+		return err
+	}
+	setData(ctx, "files", renderedFiles)
+
+	cssUrl, err := url.JoinPath(getData(ctx, "baseHttpUrl").(string), manifestEntries["embed.css"].File)
+	if err != nil {
+		return errorRes(500, "Error joining css url", err)
+	}
+	setData(ctx, "embedCss", cssUrl)
+
+	// the page is meant to be framed by any website, unlike the others
+	ctx.Response().Header().Del(echo.HeaderXFrameOptions)
+	return html(ctx, "gist_embed_frame.html")
+}
+
 func revisions(ctx echo.Context) error {
 	gist := getData(ctx, "gist").(*db.Gist)
 	userName := gist.User.Username
@@ -445,12 +947,24 @@ func revisions(ctx echo.Context) error {
 
 	pageInt := getPage(ctx)
 
-	commits, err := gist.Log((pageInt - 1) * 10)
+	branch, err := gistBranch(ctx, gist)
+	if err != nil {
+		return err
+	}
+
+	var commits []*git.Commit
+	var urlParams string
+	if branch == getData(ctx, "defaultBranch") {
+		commits, err = gist.Log((pageInt - 1) * 10)
+	} else {
+		commits, err = gist.BranchLog(branch, (pageInt-1)*10)
+		urlParams = "&branch=" + url.QueryEscape(branch)
+	}
 	if err != nil {
 		return errorRes(500, "Error fetching commits log", err)
 	}
 
-	if err := paginate(ctx, commits, pageInt, 10, "commits", userName+"/"+gistName+"/revisions", 2); err != nil {
+	if err := paginate(ctx, commits, pageInt, 10, "commits", userName+"/"+gistName+"/revisions", 2, urlParams); err != nil {
 		return errorRes(404, tr(ctx, "error.page-not-found"), nil)
 	}
 
@@ -469,6 +983,7 @@ func revisions(ctx echo.Context) error {
 
 	setData(ctx, "page", "revisions")
 	setData(ctx, "revision", "HEAD")
+	setData(ctx, "atomFeed", getData(ctx, "baseHttpUrl").(string)+"/"+userName+"/"+gistName+"/revisions.atom")
 	setData(ctx, "emails", emailsUsers)
 	setData(ctx, "htmlTitle", trH(ctx, "gist.revision-of", gist.Title))
 
@@ -477,6 +992,7 @@ func revisions(ctx echo.Context) error {
 
 func create(ctx echo.Context) error {
 	setData(ctx, "htmlTitle", trH(ctx, "gist.new.create-a-new-gist"))
+	setData(ctx, "defaultVisibility", int(getUserLogged(ctx).NewGistVisibility()))
 	return html(ctx, "create.html")
 }
 
@@ -505,6 +1021,19 @@ func processCreate(ctx echo.Context) error {
 		return errorRes(400, tr(ctx, "error.cannot-bind-data"), err)
 	}
 
+	// a gist created without a visibility gets the default one of its author
+	if isCreate {
+		if _, ok := ctx.Request().PostForm["private"]; !ok {
+			dto.Private = getUserLogged(ctx).NewGistVisibility()
+		}
+		setData(ctx, "defaultVisibility", int(dto.Private))
+	}
+
+	// refuse oversized submissions before unescaping and committing any file
+	if len(ctx.Request().PostForm["content"]) > config.C.GistMaxFiles {
+		return errorRes(400, tr(ctx, "error.too-many-files", config.C.GistMaxFiles), nil)
+	}
+
 	dto.Files = make([]db.FileDTO, 0)
 	fileCounter := 0
 	for i := 0; i < len(ctx.Request().PostForm["content"]); i++ {
@@ -521,15 +1050,16 @@ func processCreate(ctx echo.Context) error {
 			return errorRes(400, tr(ctx, "error.invalid-character-unescaped"), err)
 		}
 
+		// names typed on different systems can encode the same accented characters differently
 		dto.Files = append(dto.Files, db.FileDTO{
-			Filename: strings.Trim(name, " "),
+			Filename: norm.NFC.String(strings.Trim(name, " ")),
 			Content:  escapedValue,
 		})
 	}
 
-	err = ctx.Validate(dto)
-	if err != nil {
-		addFlash(ctx, utils.ValidationMessages(&err, getData(ctx, "locale").(*i18n.Locale)), "error")
+	// the form is shown again with the error if the files are refused
+	formError := func(message string) error {
+		addFlash(ctx, message, "error")
 		if isCreate {
 			return html(ctx, "create.html")
 		} else {
@@ -542,14 +1072,24 @@ func processCreate(ctx echo.Context) error {
 		}
 	}
 
-	if isCreate {
-		gist = dto.ToGist()
-	} else {
+	err = ctx.Validate(dto)
+	if err != nil {
+		return formError(utils.ValidationMessages(&err, getData(ctx, "locale").(*i18n.Locale)))
+	}
+
+	if isCreate && dto.Private == db.PublicVisibility && !getUserLogged(ctx).CanPublish() {
+		return formError(tr(ctx, "error.verify-email-to-publish"))
+	}
+
+	dto.FormatFiles()
+
+	if isCreate {
+		gist = dto.ToGist()
+	} else {
 		gist = dto.ToExistingGist(gist)
 	}
 
 	user := getUserLogged(ctx)
-	gist.NbFiles = len(dto.Files)
 
 	if isCreate {
 		uuidGist, err := uuid.NewRandom()
@@ -570,38 +1110,55 @@ func processCreate(ctx echo.Context) error {
 		}
 	}
 
-	if len(dto.Files) > 0 {
-		split := strings.Split(dto.Files[0].Content, "\n")
-		if len(split) > 10 {
-			gist.Preview = strings.Join(split[:10], "\n")
-		} else {
-			gist.Preview = dto.Files[0].Content
+	if err = saveGist(gist, dto.Files, user, isCreate); err != nil {
+		var rejectedErr *db.ContentRejectedError
+		if errors.As(err, &rejectedErr) {
+			return formError(tr(ctx, "flash.gist.content-rejected", rejectedErr.Error()))
 		}
+		return errorRes(500, "Error saving the gist", err)
+	}
 
-		gist.PreviewFilename = dto.Files[0].Filename
+	if err = gist.SetTopics(utils.SplitTopics(dto.Topics)); err != nil {
+		return errorRes(500, "Error saving the topics of the gist", err)
 	}
 
-	if err = gist.InitRepository(); err != nil {
-		return errorRes(500, "Error creating the repository", err)
+	if isCreate {
+		webhook.Trigger(webhook.GistCreated, gist, user)
+	} else {
+		webhook.Trigger(webhook.GistUpdated, gist, user)
 	}
 
-	if err = gist.AddAndCommitFiles(&dto.Files); err != nil {
-		return errorRes(500, "Error adding and committing files", err)
+	return redirect(ctx, "/"+gist.User.Username+"/"+gist.Identifier())
+}
+
+// saveGist commits the files to the gist and indexes it, a new gist is created along with its repository
+func saveGist(gist *db.Gist, files []db.FileDTO, user *db.User, isCreate bool) error {
+	gist.NbFiles = len(files)
+
+	previewFiles := make([]*git.File, 0, len(files))
+	for _, file := range files {
+		previewFiles = append(previewFiles, &git.File{Filename: file.Filename, Content: file.Content})
 	}
+	gist.SetPreview(previewFiles)
 
+	var err error
 	if isCreate {
-		if err = gist.Create(); err != nil {
-			return errorRes(500, "Error creating the gist", err)
-		}
+		err = gist.CreateWithFiles(files, user)
 	} else {
+		err = gist.AddAndCommitFiles(&files, user)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !isCreate {
 		if err = gist.Update(); err != nil {
-			return errorRes(500, "Error updating the gist", err)
+			return err
 		}
 	}
 
 	gist.AddInIndex()
-
-	return redirect(ctx, "/"+user.Username+"/"+gist.Identifier())
+	return nil
 }
 
 func editVisibility(ctx echo.Context) error {
@@ -612,15 +1169,128 @@ func editVisibility(ctx echo.Context) error {
 		return errorRes(400, tr(ctx, "error.cannot-bind-data"), err)
 	}
 
+	allowed, err := gist.VisibilityAllowed(dto.Private)
+	if err != nil {
+		return errorRes(500, "Error checking the visibility of the parent gist", err)
+	}
+	if !allowed {
+		addFlash(ctx, tr(ctx, "flash.gist.fork-stays-private"), "error")
+		return redirect(ctx, "/"+gist.User.Username+"/"+gist.Identifier())
+	}
+	if dto.Private == db.PublicVisibility && !gist.User.CanPublish() {
+		addFlash(ctx, tr(ctx, "error.verify-email-to-publish"), "error")
+		return redirect(ctx, "/"+gist.User.Username+"/"+gist.Identifier())
+	}
+
+	previous := gist.Private
 	gist.Private = dto.Private
 	if err := gist.UpdateNoTimestamps(); err != nil {
 		return errorRes(500, "Error updating this gist", err)
 	}
 
+	if previous != gist.Private {
+		if err := db.AddAuditLog(getUserLogged(ctx), db.AuditGistVisibilityChanged, gist, map[string]any{
+			"from": previous.String(),
+			"to":   gist.Private.String(),
+		}); err != nil {
+			return errorRes(500, "Error recording the audit log", err)
+		}
+		webhook.Trigger(webhook.GistUpdated, gist, getUserLogged(ctx))
+	}
+
 	addFlash(ctx, tr(ctx, "flash.gist.visibility-changed"), "success")
 	return redirect(ctx, "/"+gist.User.Username+"/"+gist.Identifier())
 }
 
+func toggleTemplate(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+
+	gist.Template = !gist.Template
+	if err := gist.UpdateNoTimestamps(); err != nil {
+		return errorRes(500, "Error updating this gist", err)
+	}
+
+	if gist.Template {
+		addFlash(ctx, tr(ctx, "flash.gist.template-marked"), "success")
+	} else {
+		addFlash(ctx, tr(ctx, "flash.gist.template-unmarked"), "success")
+	}
+	return redirect(ctx, "/"+gist.User.Username+"/"+gist.Identifier())
+}
+
+// toggleLock locks the gist, making it read-only, or unlocks it
+func toggleLock(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+	if !gist.CanToggleLock(getUserLogged(ctx)) {
+		return errorRes(403, tr(ctx, "error.forbidden"), nil)
+	}
+
+	gist.Locked = !gist.Locked
+	if err := gist.UpdateNoTimestamps(); err != nil {
+		return errorRes(500, "Error updating this gist", err)
+	}
+
+	if gist.Locked {
+		addFlash(ctx, tr(ctx, "flash.gist.locked"), "success")
+	} else {
+		addFlash(ctx, tr(ctx, "flash.gist.unlocked"), "success")
+	}
+	return redirect(ctx, "/"+gist.User.Username+"/"+gist.Identifier())
+}
+
+func useTemplate(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+	if !gist.Template {
+		return notFound("Gist is not a template")
+	}
+
+	placeholders, err := gist.TemplatePlaceholders()
+	if err != nil {
+		return errorRes(500, "Error fetching files from repository", err)
+	}
+
+	setData(ctx, "placeholders", placeholders)
+	setData(ctx, "htmlTitle", trH(ctx, "gist.template.use-template", gist.Title))
+	return html(ctx, "use_template.html")
+}
+
+func processUseTemplate(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+	if !gist.Template {
+		return notFound("Gist is not a template")
+	}
+
+	formValues, err := ctx.FormParams()
+	if err != nil {
+		return errorRes(400, tr(ctx, "error.cannot-bind-data"), err)
+	}
+
+	vars := make(map[string]string)
+	for key, values := range formValues {
+		if name, ok := strings.CutPrefix(key, "var_"); ok && len(values) > 0 && values[0] != "" {
+			vars[name] = values[0]
+		}
+	}
+
+	newGist, err := db.CreateFromTemplate(gist, vars, getUserLogged(ctx), ctx.FormValue("strict") == "on")
+	if err != nil {
+		var undeclaredErr *db.UndeclaredPlaceholdersError
+		if errors.As(err, &undeclaredErr) {
+			addFlash(ctx, tr(ctx, "flash.gist.template-undeclared", strings.Join(undeclaredErr.Placeholders, ", ")), "error")
+			return redirect(ctx, "/"+gist.User.Username+"/"+gist.Identifier()+"/use-template")
+		}
+		var rejectedErr *db.ContentRejectedError
+		if errors.As(err, &rejectedErr) {
+			addFlash(ctx, tr(ctx, "flash.gist.content-rejected", rejectedErr.Error()), "error")
+			return redirect(ctx, "/"+gist.User.Username+"/"+gist.Identifier()+"/use-template")
+		}
+		return errorRes(500, "Error creating the gist from this template", err)
+	}
+	webhook.Trigger(webhook.GistCreated, newGist, getUserLogged(ctx))
+
+	return redirect(ctx, "/"+newGist.User.Username+"/"+newGist.Identifier())
+}
+
 func deleteGist(ctx echo.Context) error {
 	gist := getData(ctx, "gist").(*db.Gist)
 
@@ -629,7 +1299,16 @@ func deleteGist(ctx echo.Context) error {
 	}
 	gist.RemoveFromIndex()
 
-	addFlash(ctx, tr(ctx, "flash.gist.deleted"), "success")
+	if err := db.AddAuditLog(getUserLogged(ctx), db.AuditGistDeleted, gist, nil); err != nil {
+		return errorRes(500, "Error recording the audit log", err)
+	}
+	webhook.Trigger(webhook.GistDeleted, gist, getUserLogged(ctx))
+
+	if config.C.GistTrashRetention > 0 {
+		addFlash(ctx, tr(ctx, "flash.gist.trashed"), "success")
+	} else {
+		addFlash(ctx, tr(ctx, "flash.gist.deleted"), "success")
+	}
 	return redirect(ctx, "/")
 }
 
@@ -651,6 +1330,36 @@ func like(ctx echo.Context) error {
 	if err != nil {
 		return errorRes(500, "Error liking/dislking this gist", err)
 	}
+	if !hasLiked {
+		webhook.Trigger(webhook.GistLiked, gist, currentUser)
+	}
+
+	redirectTo := "/" + gist.User.Username + "/" + gist.Identifier()
+	if r := ctx.QueryParam("redirecturl"); r != "" {
+		redirectTo = r
+	}
+	return redirect(ctx, redirectTo)
+}
+
+// watch toggles the subscription of the logged user to the gist
+func watch(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+	currentUser := getUserLogged(ctx)
+
+	isWatching, err := gist.IsWatchedBy(currentUser.ID)
+	if err != nil {
+		return errorRes(500, "Error checking if user is watching a gist", err)
+	}
+
+	if isWatching {
+		err = gist.UnwatchGist(currentUser)
+	} else {
+		err = gist.WatchGist(currentUser)
+	}
+
+	if err != nil {
+		return errorRes(500, "Error watching/unwatching this gist", err)
+	}
 
 	redirectTo := "/" + gist.User.Username + "/" + gist.Identifier()
 	if r := ctx.QueryParam("redirecturl"); r != "" {
@@ -659,10 +1368,114 @@ func like(ctx echo.Context) error {
 	return redirect(ctx, redirectTo)
 }
 
+func addComment(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+	redirectUrl := "/" + gist.User.Username + "/" + gist.Identifier()
+
+	dto := new(db.CommentDTO)
+	if err := ctx.Bind(dto); err != nil {
+		return errorRes(400, tr(ctx, "error.cannot-bind-data"), err)
+	}
+
+	if err := ctx.Validate(dto); err != nil {
+		addFlash(ctx, utils.ValidationMessages(&err, getData(ctx, "locale").(*i18n.Locale)), "error")
+		return redirect(ctx, redirectUrl+"#comments")
+	}
+
+	currentUser := getUserLogged(ctx)
+	comment := dto.ToComment(gist, currentUser)
+	if err := comment.Create(); err != nil {
+		return errorRes(500, "Error adding the comment", err)
+	}
+
+	if !dto.NoWatch {
+		if err := gist.WatchGist(currentUser); err != nil {
+			return errorRes(500, "Error watching this gist", err)
+		}
+	}
+
+	sendCommentEmails(ctx, gist, comment)
+
+	return redirect(ctx, redirectUrl+"#comment-"+strconv.Itoa(int(comment.ID)))
+}
+
+// editComment changes the body of a comment, only its author can
+func editComment(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+	redirectUrl := "/" + gist.User.Username + "/" + gist.Identifier()
+
+	comment, err := gist.GetCommentByID(ctx.Param("id"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return notFound("Comment not found")
+		}
+		return errorRes(500, "Error fetching the comment", err)
+	}
+
+	if !comment.CanEdit(getUserLogged(ctx)) {
+		return errorRes(403, tr(ctx, "error.forbidden"), nil)
+	}
+
+	dto := new(db.CommentDTO)
+	if err = ctx.Bind(dto); err != nil {
+		return errorRes(400, tr(ctx, "error.cannot-bind-data"), err)
+	}
+
+	if err = ctx.Validate(dto); err != nil {
+		addFlash(ctx, utils.ValidationMessages(&err, getData(ctx, "locale").(*i18n.Locale)), "error")
+		return redirect(ctx, redirectUrl+"#comment-"+ctx.Param("id"))
+	}
+
+	comment.Body = dto.Body
+	if err = comment.Update(); err != nil {
+		return errorRes(500, "Error updating the comment", err)
+	}
+
+	return redirect(ctx, redirectUrl+"#comment-"+ctx.Param("id"))
+}
+
+// deleteComment removes a comment, its author and the owner of the gist can
+func deleteComment(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+
+	comment, err := gist.GetCommentByID(ctx.Param("id"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return notFound("Comment not found")
+		}
+		return errorRes(500, "Error fetching the comment", err)
+	}
+
+	if !comment.CanDelete(getUserLogged(ctx), gist) {
+		return errorRes(403, tr(ctx, "error.forbidden"), nil)
+	}
+
+	if err = comment.Delete(); err != nil {
+		return errorRes(500, "Error deleting the comment", err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.gist.comment-deleted"), "success")
+	return redirect(ctx, "/"+gist.User.Username+"/"+gist.Identifier()+"#comments")
+}
+
 func fork(ctx echo.Context) error {
+	return forkGist(ctx, false)
+}
+
+// forkAndEdit forks the gist like fork does, then opens the editor on the new fork
+func forkAndEdit(ctx echo.Context) error {
+	return forkGist(ctx, true)
+}
+
+func forkGist(ctx echo.Context, edit bool) error {
 	gist := getData(ctx, "gist").(*db.Gist)
 	currentUser := getUserLogged(ctx)
 
+	// forking gives a copy of the gist, whoever cannot see it cannot fork it
+	if !gist.CanRead(currentUser) {
+		return notFound("Gist not found")
+	}
+
 	alreadyForked, err := gist.GetForkParent(currentUser)
 	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
 		return errorRes(500, "Error checking if gist is already forked", err)
@@ -674,9 +1487,27 @@ func fork(ctx echo.Context) error {
 	}
 
 	if alreadyForked.ID != 0 {
+		if edit {
+			addFlash(ctx, tr(ctx, "flash.gist.already-forked"), "error")
+		}
 		return redirect(ctx, "/"+alreadyForked.User.Username+"/"+alreadyForked.Identifier())
 	}
 
+	if !gist.AllowForks {
+		return errorRes(403, tr(ctx, "error.forks-disabled"), nil)
+	}
+
+	// forks start from the latest revision unless an older one is given
+	revision := ctx.FormValue("revision")
+	if revision != "" {
+		if revision, err = gist.CommitHash(revision); err != nil {
+			if _, ok := err.(*git.RevisionNotFoundError); ok {
+				return notFound("Revision not found")
+			}
+			return errorRes(500, "Error fetching revision", err)
+		}
+	}
+
 	uuidGist, err := uuid.NewRandom()
 	if err != nil {
 		return errorRes(500, "Error creating an UUID", err)
@@ -688,40 +1519,240 @@ func fork(ctx echo.Context) error {
 		Preview:         gist.Preview,
 		PreviewFilename: gist.PreviewFilename,
 		Description:     gist.Description,
-		Private:         gist.Private,
+		Private:         currentUser.AllowedVisibility(gist.Private),
+		AllowForks:      true,
 		UserID:          currentUser.ID,
+		User:            *currentUser,
 		ForkedID:        gist.ID,
 		NbFiles:         gist.NbFiles,
+		Size:            gist.Size,
 	}
 
-	if err = newGist.CreateForked(); err != nil {
-		return errorRes(500, "Error forking the gist in database", err)
+	if err = newGist.CreateFork(gist, revision); err != nil {
+		if errors.Is(err, db.ErrForkNotAllowed) {
+			return notFound("Gist not found")
+		}
+		return errorRes(500, "Error forking the gist", err)
 	}
-
-	if err = gist.ForkClone(currentUser.Username, newGist.Uuid); err != nil {
-		return errorRes(500, "Error cloning the repository while forking", err)
+	if revision != "" {
+		if err = newGist.UpdatePreviewAndCount(false); err != nil {
+			return errorRes(500, "Error updating the fork preview", err)
+		}
 	}
 	if err = gist.IncrementForkCount(); err != nil {
 		return errorRes(500, "Error incrementing the fork count", err)
 	}
+	webhook.TriggerFork(gist, newGist, currentUser)
 
 	addFlash(ctx, tr(ctx, "flash.gist.forked"), "success")
 
+	if edit {
+		return redirect(ctx, "/"+currentUser.Username+"/"+newGist.Identifier()+"/edit")
+	}
 	return redirect(ctx, "/"+currentUser.Username+"/"+newGist.Identifier())
 }
 
+// checkNotModified sets the caching headers for a revision of the gist, using its commit hash as a strong ETag.
+// It returns true if the client copy is still fresh and a 304 response has been written.
+// Access to the gist has already been checked by the gistInit middleware at this point.
+func checkNotModified(ctx echo.Context, gist *db.Gist, revision string) (bool, error) {
+	hash, err := gist.CommitHash(revision)
+	if err != nil {
+		return false, err
+	}
+
+	etag := `"` + hash + `"`
+	// the bytes sent differ once gzipped, so does the tag
+	if gzipAccepted(ctx) {
+		etag = `"` + hash + `-gzip"`
+	}
+	lastModified := time.Unix(gist.UpdatedAt, 0).UTC()
+
+	header := ctx.Response().Header()
+	header.Set("ETag", etag)
+	header.Set("Last-Modified", lastModified.Format(http.TimeFormat))
+	header.Set("Cache-Control", "no-cache")
+
+	// If-None-Match takes precedence over If-Modified-Since
+	if ifNoneMatch := ctx.Request().Header.Get("If-None-Match"); ifNoneMatch != "" {
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == etag || candidate == "*" {
+				return true, ctx.NoContent(http.StatusNotModified)
+			}
+		}
+		return false, nil
+	}
+
+	if ifModifiedSince := ctx.Request().Header.Get("If-Modified-Since"); ifModifiedSince != "" {
+		if t, err := http.ParseTime(ifModifiedSince); err == nil && !lastModified.After(t) {
+			return true, ctx.NoContent(http.StatusNotModified)
+		}
+	}
+
+	return false, nil
+}
+
 func rawFile(ctx echo.Context) error {
 	gist := getData(ctx, "gist").(*db.Gist)
-	file, err := gist.File(ctx.Param("revision"), ctx.Param("file"), false)
+
+	notModified, err := checkNotModified(ctx, gist, ctx.Param("revision"))
+	if _, ok := err.(*git.RevisionNotFoundError); ok {
+		return notFound("Revision not found")
+	} else if err != nil {
+		return errorRes(500, "Error getting the revision", err)
+	} else if notModified {
+		return nil
+	}
+
+	filename := ctx.Param("file")
+	file, err := gist.OpenFile(ctx.Param("revision"), filename)
 	if err != nil {
 		return errorRes(500, "Error getting file content", err)
 	}
-
 	if file == nil {
 		return notFound("File not found")
 	}
+	defer file.Close()
+
+	header := ctx.Response().Header()
+	if ctx.QueryParam("download") == "true" {
+		header.Set("Content-Disposition", attachmentDisposition(filename))
+	}
+	// the content type is not guessed again by browsers, so a text file is never run as a script or a page
+	header.Set("X-Content-Type-Options", "nosniff")
+
+	reader := bufio.NewReaderSize(file, rawSniffLength)
+	head, err := reader.Peek(rawSniffLength)
+	if err != nil && err != io.EOF {
+		return errorRes(500, "Error reading file content", err)
+	}
+	charset := detectCharset(head, uint64(len(head)) == file.Size)
+
+	mediaType := fileMediaType(filename)
+	if mediaType == "" {
+		mediaType, _, _ = mime.ParseMediaType(http.DetectContentType(head))
+	}
+
+	var contentType string
+	switch {
+	case rawInlineTypes[mediaType]:
+		contentType = mediaType
+	case rawSandboxedTypes[mediaType] && ctx.QueryParam("render") == "true" && charset != "":
+		// an opaque origin without scripts, the document cannot reach the user session
+		header.Set("Content-Security-Policy", "sandbox")
+		contentType = mediaType + "; charset=" + charset
+	case charset == "":
+		contentType = echo.MIMEOctetStream
+	case rawTextTypes[mediaType]:
+		contentType = mediaType + "; charset=" + charset
+	default:
+		contentType = "text/plain; charset=" + charset
+	}
+
+	if linesStr := ctx.QueryParam("lines"); linesStr != "" {
+		selection, err := render.ParseLineRange(linesStr)
+		if err != nil {
+			return errorRes(400, tr(ctx, "error.invalid-line-range"), err)
+		}
+		content, err := io.ReadAll(reader)
+		if err != nil {
+			return errorRes(500, "Error reading file content", err)
+		}
+		return ctx.Blob(200, contentType, []byte(selection.Slice(string(content))))
+	}
+
+	header.Set(echo.HeaderContentLength, strconv.FormatUint(file.Size, 10))
+	return ctx.Stream(200, contentType, reader)
+}
+
+// rawSniffLength is the length of the start of a raw file looked at to tell its content type and charset, the same
+// as Git to tell binaries apart
+const rawSniffLength = 8000
+
+// detectCharset returns the charset of a text starting with head, which holds the whole text if complete: UTF-16 when
+// it starts with a byte order mark, UTF-8 when it is valid UTF-8 and Latin-1 otherwise. Binaries, holding a NUL byte
+// like Git tells them apart, have none.
+func detectCharset(head []byte, complete bool) string {
+	switch {
+	case bytes.HasPrefix(head, []byte{0xFF, 0xFE}):
+		return "utf-16le"
+	case bytes.HasPrefix(head, []byte{0xFE, 0xFF}):
+		return "utf-16be"
+	case bytes.IndexByte(head, 0) != -1:
+		return ""
+	}
+
+	if !complete {
+		// the last character may be cut at the end of head
+		for i := 1; i <= utf8.UTFMax && i <= len(head); i++ {
+			if utf8.RuneStart(head[len(head)-i]) {
+				head = head[:len(head)-i]
+				break
+			}
+		}
+	}
+
+	if utf8.Valid(head) {
+		return "utf-8"
+	}
+	return "iso-8859-1"
+}
+
+// attachmentDisposition makes the browser save the response under the filename, which is encoded as per RFC 2231 when
+// it is not plain ASCII
+func attachmentDisposition(filename string) string {
+	if disposition := mime.FormatMediaType("attachment", map[string]string{"filename": filename}); disposition != "" {
+		return disposition
+	}
+	return "attachment"
+}
+
+func fileMediaType(filename string) string {
+	mediaType, _, _ := mime.ParseMediaType(mime.TypeByExtension(filepath.Ext(filename)))
+	return mediaType
+}
+
+// rawInlineTypes are the content types the raw endpoint serves as is, other texts are served as text/plain unless they
+// are rawTextTypes and other binaries as application/octet-stream
+var rawInlineTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+	"image/avif": true,
+}
+
+// rawTextTypes are the text content types the raw endpoint keeps, they are harmless when opened in a browser
+var rawTextTypes = map[string]bool{
+	"application/json": true,
+	"text/csv":         true,
+	"text/markdown":    true,
+}
+
+// rawSandboxedTypes can run scripts when opened in a browser, they are only rendered when asked
+// with the render=true query parameter, inside a CSP sandbox
+var rawSandboxedTypes = map[string]bool{
+	"text/html":     true,
+	"image/svg+xml": true,
+}
+
+func commitPatch(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
 
-	return plainText(ctx, 200, file.Content)
+	hash, found := strings.CutSuffix(ctx.Param("hash"), ".patch")
+	if !found {
+		return notFound("Commit not found")
+	}
+
+	patch, err := gist.CommitPatch(hash)
+	if _, ok := err.(*git.RevisionNotFoundError); ok {
+		return notFound("Commit not found")
+	} else if err != nil {
+		return errorRes(500, "Error getting the commit patch", err)
+	}
+
+	return ctx.Blob(200, "text/plain; charset=utf-8", patch)
 }
 
 func downloadFile(ctx echo.Context) error {
@@ -736,7 +1767,7 @@ func downloadFile(ctx echo.Context) error {
 	}
 
 	ctx.Response().Header().Set("Content-Type", "text/plain")
-	ctx.Response().Header().Set("Content-Disposition", "attachment; filename="+file.Filename)
+	ctx.Response().Header().Set("Content-Disposition", attachmentDisposition(file.Filename))
 	ctx.Response().Header().Set("Content-Length", strconv.Itoa(len(file.Content)))
 	_, err = ctx.Response().Write([]byte(file.Content))
 	if err != nil {
@@ -749,73 +1780,96 @@ func downloadFile(ctx echo.Context) error {
 func edit(ctx echo.Context) error {
 	gist := getData(ctx, "gist").(*db.Gist)
 
-	files, err := gist.Files("HEAD", false)
-	if err != nil {
+	// editing can start from an older revision, the saved files are still committed on top of HEAD
+	revision := ctx.QueryParam("revision")
+	if revision == "" {
+		revision = "HEAD"
+	}
+
+	files, err := gist.Files(revision, false)
+	if _, ok := err.(*git.RevisionNotFoundError); ok {
+		return notFound("Revision not found")
+	} else if err != nil {
 		return errorRes(500, "Error fetching files from repository", err)
 	}
 
 	setData(ctx, "files", files)
+	setData(ctx, "revision", revision)
 	setData(ctx, "htmlTitle", trH(ctx, "gist.edit.edit-gist", gist.Title))
 
 	return html(ctx, "edit.html")
 }
 
-func downloadZip(ctx echo.Context) error {
+// archiveContentTypes are the content types of the git.ArchiveFormats
+var archiveContentTypes = map[string]string{
+	"zip":    "application/zip",
+	"tar.gz": "application/gzip",
+}
+
+func downloadArchive(ctx echo.Context) error {
 	gist := getData(ctx, "gist").(*db.Gist)
 	revision := ctx.Param("revision")
 
-	files, err := gist.Files(revision, false)
-	if err != nil {
-		return errorRes(500, "Error fetching files from repository", err)
+	format := ctx.QueryParam("format")
+	if format == "" {
+		format = "zip"
 	}
-	if len(files) == 0 {
-		return notFound("No files found in this revision")
+	contentType, ok := archiveContentTypes[format]
+	if !ok {
+		return errorRes(400, tr(ctx, "error.unknown-archive-format"), nil)
 	}
 
-	zipFile := new(bytes.Buffer)
-
-	zipWriter := zip.NewWriter(zipFile)
+	notModified, err := checkNotModified(ctx, gist, revision)
+	if _, ok := err.(*git.RevisionNotFoundError); ok {
+		return notFound("Revision not found")
+	} else if err != nil {
+		return errorRes(500, "Error getting the revision", err)
+	} else if notModified {
+		return nil
+	}
 
-	for _, file := range files {
-		fh := &zip.FileHeader{
-			Name:   file.Filename,
-			Method: zip.Deflate,
-		}
-		f, err := zipWriter.CreateHeader(fh)
-		if err != nil {
-			return errorRes(500, "Error adding a file the to the zip archive", err)
-		}
-		_, err = f.Write([]byte(file.Content))
-		if err != nil {
-			return errorRes(500, "Error adding file content the to the zip archive", err)
-		}
+	archive, err := gist.Archive(revision, format)
+	if _, ok := err.(*git.RevisionNotFoundError); ok {
+		return notFound("Revision not found")
+	} else if err != nil {
+		return errorRes(500, "Error creating the archive", err)
 	}
-	err = zipWriter.Close()
+
+	ctx.Response().Header().Set("Content-Type", contentType)
+	ctx.Response().Header().Set("Content-Disposition", "attachment; filename="+gist.Identifier()+"."+format)
+	ctx.Response().Header().Set("Content-Length", strconv.Itoa(len(archive)))
+	_, err = ctx.Response().Write(archive)
 	if err != nil {
-		return errorRes(500, "Error closing the zip archive", err)
+		return errorRes(500, "Error writing the archive", err)
 	}
+	return nil
+}
 
-	ctx.Response().Header().Set("Content-Type", "application/zip")
-	ctx.Response().Header().Set("Content-Disposition", "attachment; filename="+gist.Identifier()+".zip")
-	ctx.Response().Header().Set("Content-Length", strconv.Itoa(len(zipFile.Bytes())))
-	_, err = ctx.Response().Write(zipFile.Bytes())
+func randomGist(ctx echo.Context) error {
+	gist, err := db.GetRandomPublicGist()
 	if err != nil {
-		return errorRes(500, "Error writing the zip archive", err)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			addFlash(ctx, tr(ctx, "flash.gist.no-public-gists"), "error")
+			return redirect(ctx, "/all")
+		}
+		return errorRes(500, "Error fetching a random gist", err)
 	}
-	return nil
+
+	return redirect(ctx, "/"+gist.User.Username+"/"+gist.Identifier())
 }
 
 func likes(ctx echo.Context) error {
 	gist := getData(ctx, "gist").(*db.Gist)
 
-	pageInt := getPage(ctx)
+	// the likers are shown as a grid of avatars, more of them fit in a page
+	page := db.Page{Number: max(getPage(ctx), 1), Size: 30}
 
-	likers, err := gist.GetUsersLikes(pageInt - 1)
+	likers, totalLikers, err := gist.GetUsersLikes(page)
 	if err != nil {
 		return errorRes(500, "Error getting users who liked this gist", err)
 	}
 
-	if err = paginate(ctx, likers, pageInt, 30, "likers", gist.User.Username+"/"+gist.Identifier()+"/likes", 1); err != nil {
+	if err = paginateTotal(ctx, likers, totalLikers, page, "likers", gist.User.Username+"/"+gist.Identifier()+"/likes", 1); err != nil {
 		return errorRes(404, tr(ctx, "error.page-not-found"), nil)
 	}
 
@@ -826,7 +1880,7 @@ func likes(ctx echo.Context) error {
 
 func forks(ctx echo.Context) error {
 	gist := getData(ctx, "gist").(*db.Gist)
-	pageInt := getPage(ctx)
+	page := getListPage(ctx)
 
 	currentUser := getUserLogged(ctx)
 	var fromUserID uint = 0
@@ -834,12 +1888,12 @@ func forks(ctx echo.Context) error {
 		fromUserID = currentUser.ID
 	}
 
-	forks, err := gist.GetForks(fromUserID, pageInt-1)
+	forks, totalForks, err := gist.GetForks(fromUserID, page)
 	if err != nil {
 		return errorRes(500, "Error getting users who liked this gist", err)
 	}
 
-	if err = paginate(ctx, forks, pageInt, 30, "forks", gist.User.Username+"/"+gist.Identifier()+"/forks", 2); err != nil {
+	if err = paginateTotal(ctx, forks, totalForks, page, "forks", gist.User.Username+"/"+gist.Identifier()+"/forks", 2); err != nil {
 		return errorRes(404, tr(ctx, "error.page-not-found"), nil)
 	}
 
@@ -848,6 +1902,261 @@ func forks(ctx echo.Context) error {
 	return html(ctx, "forks.html")
 }
 
+// diffRevisions returns the hashes of the from and to query params and the changes between them. The latest revision
+// is compared by default, with its parent when from is missing.
+func diffRevisions(ctx echo.Context, gist *db.Gist) (string, string, []*git.File, error) {
+	to := ctx.QueryParam("to")
+	if to == "" {
+		to = "HEAD"
+	}
+	from := ctx.QueryParam("from")
+	if from == "" {
+		from = to + "^"
+	}
+
+	fromHash, err := gist.CommitHash(from)
+	if err != nil {
+		return "", "", nil, err
+	}
+	toHash, err := gist.CommitHash(to)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	files, err := gist.DiffRevisions(fromHash, toHash)
+	return fromHash, toHash, files, err
+}
+
+// compareRevisions shows the changes between two revisions of the gist, in a unified or a split view
+func compareRevisions(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+
+	from, to, files, err := diffRevisions(ctx, gist)
+	if _, ok := err.(*git.RevisionNotFoundError); ok {
+		return notFound("Revision not found")
+	} else if err != nil {
+		return errorRes(500, "Error comparing the revisions", err)
+	}
+
+	view := "unified"
+	if ctx.QueryParam("view") == "split" {
+		view = "split"
+	}
+
+	setData(ctx, "from", from)
+	setData(ctx, "to", to)
+	setData(ctx, "files", files)
+	setData(ctx, "view", view)
+	setData(ctx, "page", "revisions")
+	setData(ctx, "revision", "HEAD")
+	setData(ctx, "htmlTitle", trH(ctx, "gist.compare.revisions-of", gist.Title))
+	return html(ctx, "revisions_compare.html")
+}
+
+// versions lists the tags of the gist, the most recent first
+func versions(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+
+	tags, err := gist.Tags()
+	if err != nil {
+		return errorRes(500, "Error fetching tags", err)
+	}
+
+	setData(ctx, "tags", tags)
+	setData(ctx, "page", "versions")
+	setData(ctx, "revision", "HEAD")
+	setData(ctx, "htmlTitle", trH(ctx, "gist.versions.of", gist.Title))
+	return html(ctx, "versions.html")
+}
+
+// blame shows who last changed each line of a file at a revision, the lines are grouped by commit
+func blame(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+
+	hash, err := gist.CommitHash(ctx.Param("revision"))
+	if _, ok := err.(*git.RevisionNotFoundError); ok {
+		return notFound("Revision not found")
+	} else if err != nil {
+		return errorRes(500, "Error getting the revision", err)
+	}
+
+	file, err := gist.File(hash, ctx.Param("file"), true)
+	if err != nil {
+		return errorRes(500, "Error getting file content", err)
+	}
+	if file == nil {
+		return notFound("File not found")
+	}
+
+	// the lines of a binary or a truncated file would not be shown as they are
+	var hunks []*git.BlameHunk
+	if !file.Truncated && !file.IsBinary() {
+		if hunks, err = gist.Blame(hash, file.Filename); err != nil {
+			return errorRes(500, "Error blaming the file", err)
+		}
+	}
+
+	emailsSet := map[string]struct{}{}
+	for _, hunk := range hunks {
+		if hunk.Commit.AuthorEmail == "" {
+			continue
+		}
+		emailsSet[strings.ToLower(hunk.Commit.AuthorEmail)] = struct{}{}
+	}
+
+	emailsUsers, err := db.GetUsersFromEmails(emailsSet)
+	if err != nil {
+		return errorRes(500, "Error fetching users emails", err)
+	}
+
+	setData(ctx, "file", file)
+	setData(ctx, "hunks", hunks)
+	setData(ctx, "emails", emailsUsers)
+	setData(ctx, "commit", hash)
+	setData(ctx, "page", "code")
+	setData(ctx, "revision", ctx.Param("revision"))
+	setData(ctx, "htmlTitle", trH(ctx, "gist.blame.of", file.Filename, gist.Title))
+	return html(ctx, "blame.html")
+}
+
+// compareFork shows the changes a fork made to the gist, the fork must be a direct one
+func compareFork(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+
+	fork, err := db.GetGist(ctx.Param("forkuser"), ctx.Param("forkname"))
+	if err != nil || fork.ForkedID != gist.ID {
+		return notFound("Fork not found")
+	}
+	if fork.Private == db.PrivateVisibility && !fork.IsWriter(getUserLogged(ctx)) {
+		return notFound("Fork not found")
+	}
+
+	files, err := gist.DiffWithFork(fork)
+	if _, ok := err.(*git.RevisionNotFoundError); ok {
+		return notFound("Revision not found")
+	} else if err != nil {
+		return errorRes(500, "Error comparing the gist with its fork", err)
+	}
+
+	setData(ctx, "fork", fork)
+	setData(ctx, "files", files)
+	setData(ctx, "revision", "HEAD")
+	setData(ctx, "htmlTitle", trH(ctx, "gist.compare.for", gist.Title))
+	return html(ctx, "compare.html")
+}
+
+type forkNetworkNode struct {
+	Gist  *db.Gist
+	Depth int
+}
+
+func forkNetwork(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+
+	currentUser := getUserLogged(ctx)
+	var fromUserID uint = 0
+	if currentUser != nil {
+		fromUserID = currentUser.ID
+	}
+
+	network, err := gist.GetForkNetwork(fromUserID)
+	if err != nil {
+		return errorRes(500, "Error getting the fork network of this gist", err)
+	}
+
+	children := make(map[uint][]*db.Gist)
+	for _, fork := range network {
+		children[fork.ForkedID] = append(children[fork.ForkedID], fork)
+	}
+
+	// flatten the tree depth-first so it can be rendered as an indented list
+	var nodes []forkNetworkNode
+	var walk func(parentID uint, depth int)
+	walk = func(parentID uint, depth int) {
+		for _, fork := range children[parentID] {
+			nodes = append(nodes, forkNetworkNode{Gist: fork, Depth: depth})
+			walk(fork.ID, depth+1)
+		}
+	}
+	walk(gist.ID, 0)
+
+	setData(ctx, "network", nodes)
+	setData(ctx, "htmlTitle", trH(ctx, "gist.forks.network-for", gist.Title))
+	setData(ctx, "revision", "HEAD")
+	return html(ctx, "fork_network.html")
+}
+
+func collaborators(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+
+	users, err := gist.GetCollaborators()
+	if err != nil {
+		return errorRes(500, "Error getting the collaborators of this gist", err)
+	}
+
+	setData(ctx, "collaborators", users)
+	setData(ctx, "htmlTitle", trH(ctx, "gist.collaborators.for", gist.Title))
+	setData(ctx, "revision", "HEAD")
+	return html(ctx, "collaborators.html")
+}
+
+func addCollaborator(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+	redirectUrl := "/" + gist.User.Username + "/" + gist.Identifier() + "/collaborators"
+
+	user, err := db.GetUserByUsername(ctx.FormValue("username"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			addFlash(ctx, tr(ctx, "flash.gist.collaborator-not-found"), "error")
+			return redirect(ctx, redirectUrl)
+		}
+		return errorRes(500, "Error fetching user", err)
+	}
+
+	if gist.IsWriter(user) {
+		addFlash(ctx, tr(ctx, "flash.gist.collaborator-exists"), "error")
+		return redirect(ctx, redirectUrl)
+	}
+
+	if err = gist.AddCollaborator(user); err != nil {
+		return errorRes(500, "Error adding the collaborator", err)
+	}
+
+	if err = db.AddAuditLog(getUserLogged(ctx), db.AuditGistCollaboratorAdded, gist, map[string]any{
+		"collaborator": user.Username,
+	}); err != nil {
+		return errorRes(500, "Error recording the audit log", err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.gist.collaborator-added", user.Username), "success")
+	return redirect(ctx, redirectUrl)
+}
+
+func removeCollaborator(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+	redirectUrl := "/" + gist.User.Username + "/" + gist.Identifier() + "/collaborators"
+
+	userId, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		return redirect(ctx, redirectUrl)
+	}
+
+	if err = gist.RemoveCollaborator(uint(userId)); err != nil {
+		return errorRes(500, "Error removing the collaborator", err)
+	}
+
+	metadata := map[string]any{"collaborator_id": userId}
+	if collaborator, err := db.GetUserById(uint(userId)); err == nil {
+		metadata["collaborator"] = collaborator.Username
+	}
+	if err = db.AddAuditLog(getUserLogged(ctx), db.AuditGistCollaboratorRemoved, gist, metadata); err != nil {
+		return errorRes(500, "Error recording the audit log", err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.gist.collaborator-removed"), "success")
+	return redirect(ctx, redirectUrl)
+}
+
 func checkbox(ctx echo.Context) error {
 	filename := ctx.FormValue("file")
 	checkboxNb := ctx.FormValue("checkbox")
@@ -873,17 +2182,70 @@ func checkbox(ctx echo.Context) error {
 	if err = gist.AddAndCommitFile(&db.FileDTO{
 		Filename: filename,
 		Content:  markdown,
-	}); err != nil {
+	}, getUserLogged(ctx)); err != nil {
+		var rejectedErr *db.ContentRejectedError
+		if errors.As(err, &rejectedErr) {
+			return errorRes(400, tr(ctx, "flash.gist.content-rejected", rejectedErr.Error()), nil)
+		}
 		return errorRes(500, "Error adding and committing files", err)
 	}
 
 	if err = gist.UpdatePreviewAndCount(true); err != nil {
 		return errorRes(500, "Error updating the gist", err)
 	}
+	webhook.Trigger(webhook.GistUpdated, gist, getUserLogged(ctx))
 
 	return plainText(ctx, 200, "ok")
 }
 
+// restoreFile commits on top of the gist a file as it was at a past revision, usually the parent of the commit that
+// deleted it
+func restoreFile(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+	revision := ctx.FormValue("revision")
+	filename := ctx.FormValue("file")
+
+	if revision == "" || strings.HasPrefix(revision, "-") || filename == "" || strings.ContainsAny(filename, "/\\") {
+		return errorRes(400, tr(ctx, "error.bad-request"), nil)
+	}
+
+	hash, err := gist.CommitHash(revision)
+	if _, ok := err.(*git.RevisionNotFoundError); ok {
+		return notFound("Revision not found")
+	} else if err != nil {
+		return errorRes(500, "Error getting the revision", err)
+	}
+
+	file, err := gist.File(hash, filename, false)
+	if err != nil {
+		return errorRes(500, "Error getting file content", err)
+	} else if file == nil {
+		return notFound("File not found")
+	}
+
+	if err = gist.AddAndCommitFile(&db.FileDTO{
+		Filename: file.Filename,
+		Content:  file.Content,
+	}, getUserLogged(ctx)); err != nil {
+		var rejectedErr *db.ContentRejectedError
+		if errors.As(err, &rejectedErr) {
+			addFlash(ctx, tr(ctx, "flash.gist.content-rejected", rejectedErr.Error()), "error")
+			return redirect(ctx, "/"+gist.User.Username+"/"+gist.Identifier())
+		}
+		return errorRes(500, "Error adding and committing files", err)
+	}
+
+	if err = gist.UpdatePreviewAndCount(true); err != nil {
+		return errorRes(500, "Error updating the gist", err)
+	}
+
+	gist.AddInIndex()
+	webhook.Trigger(webhook.GistUpdated, gist, getUserLogged(ctx))
+
+	addFlash(ctx, tr(ctx, "flash.gist.file-restored", file.Filename), "success")
+	return redirect(ctx, "/"+gist.User.Username+"/"+gist.Identifier())
+}
+
 func preview(ctx echo.Context) error {
 	content := ctx.FormValue("content")
 
@@ -0,0 +1,324 @@
+package web
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/thomiceli/opengist/internal/config"
+	"github.com/thomiceli/opengist/internal/db"
+	"github.com/thomiceli/opengist/internal/git"
+	"github.com/thomiceli/opengist/internal/utils"
+	"github.com/thomiceli/opengist/internal/webhook"
+)
+
+// apiV1Gists lists the gists of the logged user a page at a time, the most recently created first
+func apiV1Gists(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+	page := db.Page{Number: getPage(ctx), Size: config.C.PaginationPageSize}
+	if page.Number < 1 {
+		return errorRes(400, tr(ctx, "error.invalid-number"), nil)
+	}
+
+	gists, total, err := db.GetAllGistsFromUser(user.ID, user.ID, page, "created", "desc", false, "", "", db.TimeRange{})
+	if err != nil {
+		return errorRes(500, "Error fetching gists", err)
+	}
+
+	var nextPage *int
+	if int64(page.Number*page.Size) < total {
+		next := page.Number + 1
+		nextPage = &next
+	}
+
+	results := make([]map[string]interface{}, 0, len(gists))
+	for _, gist := range gists {
+		results = append(results, apiGist(gist))
+	}
+
+	return ctx.JSON(200, map[string]interface{}{
+		"gists":     results,
+		"total":     total,
+		"next_page": nextPage,
+	})
+}
+
+// apiV1Gist returns the gist with its files at the revision query param, a version of the gist for instance, the
+// latest revision if there is none
+func apiV1Gist(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+
+	revision := ctx.QueryParam("revision")
+	if revision == "" {
+		revision = "HEAD"
+	}
+
+	result, err := apiGistWithFiles(gist, revision)
+	if _, ok := err.(*git.RevisionNotFoundError); ok {
+		return notFound("Revision not found")
+	} else if err != nil {
+		return errorRes(500, "Error fetching files", err)
+	}
+
+	return ctx.JSON(200, result)
+}
+
+func apiV1CreateGist(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+
+	apiDto := new(db.GistAPIDTO)
+	if err := ctx.Bind(apiDto); err != nil {
+		return errorRes(400, tr(ctx, "error.cannot-bind-data"), err)
+	}
+	if apiDto.Visibility == nil {
+		visibility := user.NewGistVisibility().String()
+		apiDto.Visibility = &visibility
+	}
+
+	dto, err := apiDto.ToGistDTO(nil)
+	if err != nil {
+		return errorRes(422, tr(ctx, "error.invalid-visibility"), err)
+	}
+	if dto.Private == db.PublicVisibility && !user.CanPublish() {
+		return errorRes(403, tr(ctx, "error.verify-email-to-publish"), nil)
+	}
+	if err = ctx.Validate(dto); err != nil {
+		return validationErrorRes(ctx, err)
+	}
+	dto.FormatFiles()
+
+	uuidGist, err := uuid.NewRandom()
+	if err != nil {
+		return errorRes(500, "Error creating an UUID", err)
+	}
+
+	gist := dto.ToGist()
+	gist.Uuid = strings.Replace(uuidGist.String(), "-", "", -1)
+	gist.UserID = user.ID
+	gist.User = *user
+	if gist.Title == "" {
+		gist.Title = dto.Files[0].Filename
+	}
+
+	if err = saveGist(gist, dto.Files, user, true); err != nil {
+		return apiSaveGistError(ctx, err)
+	}
+	if err = gist.SetTopics(utils.SplitTopics(dto.Topics)); err != nil {
+		return errorRes(500, "Error saving the topics of the gist", err)
+	}
+	webhook.Trigger(webhook.GistCreated, gist, user)
+
+	result, err := apiGistWithFiles(gist, "HEAD")
+	if err != nil {
+		return errorRes(500, "Error fetching files", err)
+	}
+
+	return ctx.JSON(201, result)
+}
+
+// apiV1UpdateGist changes the fields of the request, a new revision is committed only if the files are sent, in which
+// case they replace all the files of the gist
+func apiV1UpdateGist(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+	user := getUserLogged(ctx)
+	if gist.Locked && gist.IsWriter(user) {
+		return errorRes(403, tr(ctx, "error.gist-locked"), nil)
+	} else if !gist.CanWrite(user) {
+		return errorRes(403, tr(ctx, "error.forbidden"), nil)
+	}
+
+	apiDto := new(db.GistAPIDTO)
+	if err := ctx.Bind(apiDto); err != nil {
+		return errorRes(400, tr(ctx, "error.cannot-bind-data"), err)
+	}
+
+	dto, err := apiDto.ToGistDTO(gist)
+	if err != nil {
+		return errorRes(422, tr(ctx, "error.invalid-visibility"), err)
+	}
+
+	if apiDto.Files != nil {
+		err = ctx.Validate(dto)
+	} else {
+		validator := ctx.Echo().Validator.(*utils.OpengistValidator)
+		err = validator.ValidatePartial(dto, "Title", "Description", "URL", "Topics", "VisibilityDTO.Private")
+	}
+	if err != nil {
+		return validationErrorRes(ctx, err)
+	}
+
+	// like the visibility form, only the owner can change who sees the gist
+	previous := gist.Private
+	if dto.Private != previous {
+		if !gist.CanManage(user) {
+			return errorRes(403, tr(ctx, "error.forbidden"), nil)
+		}
+		allowed, err := gist.VisibilityAllowed(dto.Private)
+		if err != nil {
+			return errorRes(500, "Error checking the visibility of the parent gist", err)
+		}
+		if !allowed {
+			return errorRes(403, tr(ctx, "flash.gist.fork-stays-private"), nil)
+		}
+		if dto.Private == db.PublicVisibility && !gist.User.CanPublish() {
+			return errorRes(403, tr(ctx, "error.verify-email-to-publish"), nil)
+		}
+	}
+
+	gist = dto.ToExistingGist(gist)
+	gist.Private = dto.Private
+	if gist.Title == "" {
+		if len(dto.Files) > 0 {
+			gist.Title = dto.Files[0].Filename
+		} else {
+			gist.Title = "gist:" + gist.Uuid
+		}
+	}
+
+	if apiDto.Files != nil {
+		dto.FormatFiles()
+		err = saveGist(gist, dto.Files, user, false)
+	} else if err = gist.Update(); err == nil {
+		gist.AddInIndex()
+	}
+	if err != nil {
+		return apiSaveGistError(ctx, err)
+	}
+	if err = gist.SetTopics(utils.SplitTopics(dto.Topics)); err != nil {
+		return errorRes(500, "Error saving the topics of the gist", err)
+	}
+
+	if previous != gist.Private {
+		if err := db.AddAuditLog(user, db.AuditGistVisibilityChanged, gist, map[string]any{
+			"from": previous.String(),
+			"to":   gist.Private.String(),
+		}); err != nil {
+			return errorRes(500, "Error recording the audit log", err)
+		}
+	}
+	webhook.Trigger(webhook.GistUpdated, gist, user)
+
+	result, err := apiGistWithFiles(gist, "HEAD")
+	if err != nil {
+		return errorRes(500, "Error fetching files", err)
+	}
+
+	return ctx.JSON(200, result)
+}
+
+func apiV1DeleteGist(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+	user := getUserLogged(ctx)
+	if !gist.CanManage(user) {
+		return errorRes(403, tr(ctx, "error.forbidden"), nil)
+	}
+
+	if err := gist.Delete(); err != nil {
+		return errorRes(500, "Error deleting this gist", err)
+	}
+	gist.RemoveFromIndex()
+
+	if err := db.AddAuditLog(user, db.AuditGistDeleted, gist, nil); err != nil {
+		return errorRes(500, "Error recording the audit log", err)
+	}
+	webhook.Trigger(webhook.GistDeleted, gist, user)
+
+	return ctx.NoContent(204)
+}
+
+// apiV1CompareRevisions returns the changes between two revisions of the gist, each file with its lines in the order
+// of the diff, or side by side with view=split
+func apiV1CompareRevisions(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+
+	from, to, files, err := diffRevisions(ctx, gist)
+	if _, ok := err.(*git.RevisionNotFoundError); ok {
+		return notFound("Revision not found")
+	} else if err != nil {
+		return errorRes(500, "Error comparing the revisions", err)
+	}
+
+	results := make([]map[string]interface{}, 0, len(files))
+	for _, file := range files {
+		status := "modified"
+		if file.IsCreated {
+			status = "created"
+		} else if file.IsDeleted {
+			status = "deleted"
+		} else if file.OldFilename != "" && file.OldFilename != file.Filename {
+			status = "renamed"
+		}
+
+		result := map[string]interface{}{
+			"filename":     file.Filename,
+			"old_filename": file.OldFilename,
+			"status":       status,
+			"truncated":    file.Truncated,
+			"patch":        file.Content,
+		}
+		if ctx.QueryParam("view") == "split" {
+			result["rows"] = file.SplitDiff()
+		} else {
+			result["lines"] = file.DiffLines()
+		}
+		results = append(results, result)
+	}
+
+	return ctx.JSON(200, map[string]interface{}{
+		"from":  from,
+		"to":    to,
+		"files": results,
+	})
+}
+
+// apiV1Versions returns the tags of the gist, the most recent first
+func apiV1Versions(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+
+	tags, err := gist.Tags()
+	if err != nil {
+		return errorRes(500, "Error fetching tags", err)
+	}
+
+	gistUrl := config.C.BasePath() + "/" + gist.User.Username + "/" + gist.Identifier()
+	results := make([]map[string]interface{}, 0, len(tags))
+	for _, tag := range tags {
+		timestamp, _ := strconv.ParseInt(tag.Timestamp, 10, 64)
+		results = append(results, map[string]interface{}{
+			"name":        tag.Name,
+			"commit":      tag.Hash,
+			"message":     tag.Message,
+			"created_at":  time.Unix(timestamp, 0).Format(time.RFC3339),
+			"url":         gistUrl + "/rev/" + tag.Revision(),
+			"archive_url": gistUrl + "/archive/" + tag.Revision(),
+		})
+	}
+
+	return ctx.JSON(200, map[string]interface{}{
+		"versions": results,
+	})
+}
+
+// apiGistWithFiles adds the topics and the files of a revision to the gist, truncated like on the gist page
+func apiGistWithFiles(gist *db.Gist, revision string) (map[string]interface{}, error) {
+	files, err := gist.Files(revision, true)
+	if err != nil {
+		return nil, err
+	}
+
+	result := apiGist(gist)
+	result["topics"] = gist.TopicNames()
+	result["files"] = files
+	return result, nil
+}
+
+func apiSaveGistError(ctx echo.Context, err error) error {
+	var rejectedErr *db.ContentRejectedError
+	if errors.As(err, &rejectedErr) {
+		return errorRes(422, tr(ctx, "flash.gist.content-rejected", rejectedErr.Error()), nil)
+	}
+	return errorRes(500, "Error saving the gist", err)
+}
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"compress/gzip"
 	"encoding/base64"
-	"errors"
 	"fmt"
 	"github.com/thomiceli/opengist/internal/utils"
 	"net/http"
@@ -23,7 +22,7 @@ import (
 	"github.com/thomiceli/opengist/internal/db"
 	"github.com/thomiceli/opengist/internal/git"
 	"github.com/thomiceli/opengist/internal/memdb"
-	"gorm.io/gorm"
+	appmetrics "github.com/thomiceli/opengist/internal/metrics"
 )
 
 var routes = []struct {
@@ -61,7 +60,7 @@ func gitHttp(ctx echo.Context) error {
 				strings.HasSuffix(ctx.Request().URL.Path, "git-upload-pack") ||
 				ctx.Request().Method == "GET" && !isInfoRefs
 
-			repositoryPath := git.RepositoryPath(gist.User.Username, gist.Uuid)
+			repositoryPath := git.RepositoryPath(gist.Uuid)
 			if _, err := os.Stat(repositoryPath); os.IsNotExist(err) {
 				if err != nil {
 					log.Info().Err(err).Msg("Repository directory does not exist")
@@ -110,6 +109,9 @@ func gitHttp(ctx echo.Context) error {
 					userToCheckPermissions, _ = db.GetUserByUsername(authUsername)
 				} else {
 					userToCheckPermissions = &gist.User
+					if authUser, err := db.GetUserByUsername(authUsername); err == nil && gist.IsWriter(authUser) {
+						userToCheckPermissions = authUser
+					}
 				}
 
 				if ok, err := utils.Argon2id.Verify(authPassword, userToCheckPermissions.Password); !ok {
@@ -117,25 +119,29 @@ func gitHttp(ctx echo.Context) error {
 						return errorRes(500, "Cannot verify password", err)
 					}
 					log.Warn().Msg("Invalid HTTP authentication attempt from " + ctx.RealIP())
+					appmetrics.LoginFailures.Inc("git_http")
 					return plainText(ctx, 404, "Check your credentials or make sure you have access to the Gist")
 				}
-			} else {
-				var user *db.User
-				if user, err = db.GetUserByUsername(authUsername); err != nil {
-					if !errors.Is(err, gorm.ErrRecordNotFound) {
-						return errorRes(500, "Cannot get user", err)
-					}
-					log.Warn().Msg("Invalid HTTP authentication attempt from " + ctx.RealIP())
-					return errorRes(401, "Invalid credentials", nil)
+				if userToCheckPermissions.Suspended {
+					return plainText(ctx, 403, "This account is suspended")
 				}
 
-				if ok, err := utils.Argon2id.Verify(authPassword, user.Password); !ok {
-					if err != nil {
-						return errorRes(500, "Cannot check for password", err)
-					}
+				if !isPull && gist.Locked {
+					return plainText(ctx, 403, "This gist is locked, it cannot be pushed to")
+				}
+			} else {
+				user, err := checkCredentials(authUsername, authPassword)
+				if err != nil {
+					return errorRes(500, "Cannot check credentials", err)
+				}
+				if user == nil {
 					log.Warn().Msg("Invalid HTTP authentication attempt from " + ctx.RealIP())
+					appmetrics.LoginFailures.Inc("git_http")
 					return errorRes(401, "Invalid credentials", nil)
 				}
+				if user.Suspended {
+					return errorRes(403, "This account is suspended", nil)
+				}
 
 				if isInit {
 					gist = new(db.Gist)
@@ -147,13 +153,10 @@ func gitHttp(ctx echo.Context) error {
 					}
 					gist.Uuid = strings.Replace(uuidGist.String(), "-", "", -1)
 					gist.Title = "gist:" + gist.Uuid
+					gist.AllowForks = true
 
-					if err = gist.InitRepository(); err != nil {
-						return errorRes(500, "Cannot init repository in the file system", err)
-					}
-
-					if err = gist.Create(); err != nil {
-						return errorRes(500, "Cannot init repository in database", err)
+					if err = gist.CreateWithFiles(nil, user); err != nil {
+						return errorRes(500, "Cannot init repository", err)
 					}
 
 					if err := memdb.InsertGistInit(user.ID, gist); err != nil {
@@ -169,7 +172,7 @@ func gitHttp(ctx echo.Context) error {
 
 					gist := gistFromMemdb.Gist
 					setData(ctx, "gist", gist)
-					setData(ctx, "repositoryPath", git.RepositoryPath(gist.User.Username, gist.Uuid))
+					setData(ctx, "repositoryPath", git.RepositoryPath(gist.Uuid))
 				}
 			}
 
@@ -219,6 +222,7 @@ func pack(ctx echo.Context, serviceType string) error {
 	cmd.Env = append(cmd.Env, "OPENGIST_REPOSITORY_URL_INTERNAL="+git.RepositoryUrl(ctx, gist.User.Username, gist.Identifier()))
 	cmd.Env = append(cmd.Env, "OPENGIST_REPOSITORY_ID="+strconv.Itoa(int(gist.ID)))
 
+	defer appmetrics.GitRpcDuration.ObserveSince(time.Now(), "http", serviceType)
 	if err = cmd.Run(); err != nil {
 		return errorRes(500, "Cannot run git "+serviceType+" ; "+stderr.String(), err)
 	}
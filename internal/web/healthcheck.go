@@ -1,9 +1,19 @@
 package web
 
 import (
+	"crypto/subtle"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
 	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/thomiceli/opengist/internal/config"
 	"github.com/thomiceli/opengist/internal/db"
-	"time"
+	"github.com/thomiceli/opengist/internal/git"
+	appmetrics "github.com/thomiceli/opengist/internal/metrics"
 )
 
 func healthcheck(ctx echo.Context) error {
@@ -24,8 +34,102 @@ func healthcheck(ctx echo.Context) error {
 	})
 }
 
-// metrics is a dummy handler to satisfy the /metrics endpoint (for Prometheus, Openmetrics, etc.)
-// until we have a proper metrics endpoint
+type healthCheck struct {
+	name  string
+	check func() error
+}
+
+var (
+	databaseCheck     = healthCheck{"database", db.Ping}
+	repositoriesCheck = healthCheck{"repositories", checkRepositoriesWritable}
+)
+
+// healthz is the liveness probe, it tells the process is up and reaches its database
+func healthz(ctx echo.Context) error {
+	return healthRes(ctx, databaseCheck)
+}
+
+// readyz is the readiness probe, it tells the instance can serve requests: the database is reachable and the git
+// repositories can be written
+func readyz(ctx echo.Context) error {
+	return healthRes(ctx, databaseCheck, repositoriesCheck)
+}
+
+// healthRes runs the checks and answers their results, with a 503 status code if any of them failed. The errors are
+// only logged, so the endpoints can stay public.
+func healthRes(ctx echo.Context, checks ...healthCheck) error {
+	status := "ok"
+	httpStatus := 200
+	results := make(map[string]string, len(checks))
+
+	for _, c := range checks {
+		results[c.name] = "ok"
+		if err := c.check(); err != nil {
+			log.Error().Err(err).Msg("Health check " + c.name + " failed")
+			results[c.name] = "ko"
+			status = "ko"
+			httpStatus = 503
+		}
+	}
+
+	return ctx.JSON(httpStatus, map[string]interface{}{
+		"status": status,
+		"checks": results,
+		"time":   time.Now().Format(time.RFC3339),
+	})
+}
+
+// checkRepositoriesWritable creates then removes a file in the directory of the git repositories
+func checkRepositoriesWritable() error {
+	f, err := os.CreateTemp(filepath.Join(config.GetHomeDir(), git.ReposDirectory), ".healthcheck-*")
+	if err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(f.Name())
+}
+
+// metrics writes the metrics of the instance in the Prometheus text format, the endpoint stays empty when
+// they are disabled
 func metrics(ctx echo.Context) error {
-	return ctx.String(200, "")
+	if !config.C.MetricsEnabled {
+		return ctx.String(200, "")
+	}
+
+	if config.C.MetricsPassword != "" {
+		username, password, ok := ctx.Request().BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(username), []byte(config.C.MetricsUsername)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(config.C.MetricsPassword)) != 1 {
+			ctx.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="metrics"`)
+			return ctx.NoContent(401)
+		}
+	}
+
+	ctx.Response().Header().Set(echo.HeaderContentType, "text/plain; version=0.0.4; charset=utf-8")
+	ctx.Response().WriteHeader(200)
+	return appmetrics.Write(ctx.Response())
+}
+
+// requestMetrics counts and times the HTTP requests by method, route and status
+func requestMetrics(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		start := time.Now()
+		err := next(ctx)
+
+		status := ctx.Response().Status
+		if err != nil {
+			status = 500
+			var httpErr *echo.HTTPError
+			if errors.As(err, &httpErr) {
+				status = httpErr.Code
+			}
+		}
+
+		appmetrics.HttpRequests.Inc(ctx.Request().Method, ctx.Path(), strconv.Itoa(status))
+		appmetrics.HttpRequestDuration.ObserveSince(start, ctx.Request().Method, ctx.Path())
+		return err
+	}
 }
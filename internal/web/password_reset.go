@@ -0,0 +1,133 @@
+package web
+
+import (
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/thomiceli/opengist/internal/db"
+	"github.com/thomiceli/opengist/internal/i18n"
+	"github.com/thomiceli/opengist/internal/mailer"
+	"github.com/thomiceli/opengist/internal/utils"
+	"gorm.io/gorm"
+)
+
+// passwordResetValidity is how long a reset link can be used after it was sent
+const passwordResetValidity = time.Hour
+
+// checkPasswordReset returns an error if the passwords cannot be reset, which needs the login form and an SMTP server
+func checkPasswordReset(ctx echo.Context) error {
+	if getData(ctx, "DisableLoginForm") == true {
+		return errorRes(403, tr(ctx, "error.login-disabled-form"), nil)
+	}
+	if !mailer.Enabled() {
+		return notFound("Password reset is not enabled")
+	}
+	return nil
+}
+
+func forgotPassword(ctx echo.Context) error {
+	if err := checkPasswordReset(ctx); err != nil {
+		return err
+	}
+
+	setData(ctx, "htmlTitle", trH(ctx, "auth.forgot-password"))
+	return html(ctx, "auth_password_reset.html")
+}
+
+// processForgotPassword sends a reset link to the user with the verified email. The same message is shown whether
+// a user was found or not, so the form cannot be used to find out which emails have an account.
+func processForgotPassword(ctx echo.Context) error {
+	if err := checkPasswordReset(ctx); err != nil {
+		return err
+	}
+
+	user, err := db.GetUserByVerifiedEmail(ctx.FormValue("email"))
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return errorRes(500, "Cannot get user", err)
+	}
+
+	// the password of the users coming from LDAP is checked against the directory
+	if err == nil && !user.Suspended && user.LdapDN == "" {
+		if err = sendPasswordResetEmail(ctx, user); err != nil {
+			log.Error().Err(err).Msg("Cannot send password reset email to " + user.Username)
+		}
+	}
+
+	addFlash(ctx, tr(ctx, "flash.auth.password-reset-sent"), "success")
+	return redirect(ctx, "/login")
+}
+
+// sendPasswordResetEmail mails the user a link to choose a new password
+func sendPasswordResetEmail(ctx echo.Context, user *db.User) error {
+	token, err := db.CreatePasswordResetToken(user, passwordResetValidity)
+	if err != nil {
+		return err
+	}
+
+	link := getData(ctx, "baseHttpUrl").(string) + "/reset-password?token=" + url.QueryEscape(token)
+	return mailer.Send(&mailer.Message{
+		To:      user.Email,
+		Subject: tr(ctx, "email.password-reset.subject"),
+		Body:    tr(ctx, "email.password-reset.body", user.Username, link, int(passwordResetValidity.Minutes())),
+	})
+}
+
+func resetPassword(ctx echo.Context) error {
+	if err := checkPasswordReset(ctx); err != nil {
+		return err
+	}
+
+	token := ctx.QueryParam("token")
+	if _, err := db.GetPasswordResetTokenByPlainToken(token); errors.Is(err, gorm.ErrRecordNotFound) {
+		addFlash(ctx, tr(ctx, "flash.auth.password-reset-invalid"), "error")
+		return redirect(ctx, "/forgot-password")
+	} else if err != nil {
+		return errorRes(500, "Cannot get password reset token", err)
+	}
+
+	setData(ctx, "resetToken", token)
+	setData(ctx, "htmlTitle", trH(ctx, "auth.reset-password"))
+	return html(ctx, "auth_password_reset.html")
+}
+
+func processResetPassword(ctx echo.Context) error {
+	if err := checkPasswordReset(ctx); err != nil {
+		return err
+	}
+
+	dto := new(db.PasswordResetDTO)
+	if err := ctx.Bind(dto); err != nil {
+		return errorRes(400, tr(ctx, "error.cannot-bind-data"), err)
+	}
+
+	if err := ctx.Validate(dto); err != nil {
+		addFlash(ctx, utils.ValidationMessages(&err, getData(ctx, "locale").(*i18n.Locale)), "error")
+		return redirect(ctx, "/reset-password?token="+url.QueryEscape(dto.Token))
+	}
+
+	resetToken, err := db.GetPasswordResetTokenByPlainToken(dto.Token)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		addFlash(ctx, tr(ctx, "flash.auth.password-reset-invalid"), "error")
+		return redirect(ctx, "/forgot-password")
+	} else if err != nil {
+		return errorRes(500, "Cannot get password reset token", err)
+	}
+
+	password, err := utils.Argon2id.Hash(dto.Password)
+	if err != nil {
+		return errorRes(500, "Cannot hash password", err)
+	}
+
+	if err = resetToken.Use(password); errors.Is(err, db.ErrPasswordResetTokenNotUsable) {
+		addFlash(ctx, tr(ctx, "flash.auth.password-reset-invalid"), "error")
+		return redirect(ctx, "/forgot-password")
+	} else if err != nil {
+		return errorRes(500, "Cannot reset password", err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.auth.password-reset"), "success")
+	return redirect(ctx, "/login")
+}
@@ -0,0 +1,55 @@
+package web
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/thomiceli/opengist/internal/config"
+	appmetrics "github.com/thomiceli/opengist/internal/metrics"
+	"github.com/thomiceli/opengist/internal/ratelimit"
+)
+
+// rateLimit refuses the requests of a client once it made more than limit() requests to the routes named name in the
+// current minute. The clients are counted by user when one is logged in, and by IP address otherwise.
+func rateLimit(name string, limit func() int) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			if !config.C.RateLimitEnabled {
+				return next(ctx)
+			}
+
+			key := name + ":ip:" + ctx.RealIP()
+			if user := getUserLogged(ctx); user != nil {
+				key = name + ":user:" + strconv.Itoa(int(user.ID))
+			}
+
+			allowed, retryAfter, err := ratelimit.Allow(ctx.Request().Context(), key, limit())
+			if err != nil {
+				// the requests are let through rather than refused when the counts cannot be reached
+				log.Error().Err(err).Msg("Cannot check the rate limit of " + key)
+				return next(ctx)
+			}
+			if allowed {
+				return next(ctx)
+			}
+
+			log.Warn().Msg("Rate limit of " + name + " reached by " + key)
+			appmetrics.RateLimited.Inc(name)
+			ctx.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			if strings.HasPrefix(ctx.Request().Header.Get("User-Agent"), "git/") {
+				return plainText(ctx, 429, "Too many requests, retry in a minute")
+			}
+			return errorRes(429, tr(ctx, "error.too-many-requests"), nil)
+		}
+	}
+}
+
+var (
+	loginRateLimit  = rateLimit("login", func() int { return config.C.RateLimitLogin })
+	createRateLimit = rateLimit("create", func() int { return config.C.RateLimitCreate })
+	gitRateLimit    = rateLimit("git", func() int { return config.C.RateLimitGit })
+	searchRateLimit = rateLimit("search", func() int { return config.C.RateLimitSearch })
+)
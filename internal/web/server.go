@@ -13,7 +13,6 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -22,6 +21,7 @@ import (
 	"github.com/thomiceli/opengist/internal/utils"
 	"github.com/thomiceli/opengist/templates"
 
+	"github.com/go-playground/validator/v10"
 	"github.com/gorilla/sessions"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -32,15 +32,16 @@ import (
 	"github.com/thomiceli/opengist/internal/db"
 	"github.com/thomiceli/opengist/internal/git"
 	"github.com/thomiceli/opengist/internal/i18n"
+	"github.com/thomiceli/opengist/internal/render"
 	"github.com/thomiceli/opengist/public"
 	"golang.org/x/text/language"
+	"gorm.io/gorm"
 )
 
 var (
 	dev        bool
 	flashStore *sessions.CookieStore     // session store for flash messages
 	userStore  *sessions.FilesystemStore // session store for user sessions
-	re         = regexp.MustCompile("[^a-z0-9]+")
 	fm         = template.FuncMap{
 		"split":     strings.Split,
 		"indexByte": strings.IndexByte,
@@ -59,9 +60,6 @@ var (
 		"lines": func(i string) []string {
 			return strings.Split(i, "\n")
 		},
-		"isMarkdown": func(i string) bool {
-			return strings.ToLower(filepath.Ext(i)) == ".md"
-		},
 		"isCsv": func(i string) bool {
 			return strings.ToLower(filepath.Ext(i)) == ".csv"
 		},
@@ -82,7 +80,7 @@ var (
 			return fmt.Sprint(time.Since(startTime).Nanoseconds()/1e6) + "ms"
 		},
 		"slug": func(s string) string {
-			return strings.Trim(re.ReplaceAllString(strings.ToLower(s), "-"), "-")
+			return render.Slug(s)
 		},
 		"avatarUrl": func(user *db.User, noGravatar bool) string {
 			if user.AvatarURL != "" {
@@ -169,32 +167,60 @@ func NewServer(isDev bool, sessionsPath string) *Server {
 		utils.ReadKey(path.Join(sessionsPath, "session-encrypt.key")),
 	)
 	userStore.MaxLength(10 * 1024)
+	jwtKey = utils.ReadKey(path.Join(sessionsPath, "jwt-signing.key"))
 	gothic.Store = userStore
 
 	e := echo.New()
 	e.HideBanner = true
 	e.HidePort = true
 
+	// the IP address of a client is the one of the connection, X-Forwarded-For is only read from the trusted proxies
+	// so a client cannot pick the address seen by the rate limits, the captchas and the logs
+	e.IPExtractor = echo.ExtractIPDirect()
+	if proxies, _ := config.C.TrustedProxies(); len(proxies) > 0 {
+		options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+		for _, proxy := range proxies {
+			options = append(options, echo.TrustIPRange(proxy))
+		}
+		e.IPExtractor = echo.ExtractIPFromXFFHeader(options...)
+	}
+
 	if err := i18n.Locales.LoadAll(); err != nil {
 		log.Fatal().Err(err).Msg("Failed to load locales")
 	}
 
 	e.Use(dataInit)
 	e.Use(locale)
+	e.Pre(stripBasePath)
 	e.Pre(middleware.MethodOverrideWithConfig(middleware.MethodOverrideConfig{
 		Getter: middleware.MethodFromForm("_method"),
 	}))
 	e.Pre(middleware.RemoveTrailingSlash())
-	e.Pre(middleware.CORS())
+	if origins := config.C.CorsAllowedOrigins(); len(origins) > 0 {
+		e.Pre(middleware.CORSWithConfig(middleware.CORSConfig{
+			Skipper: func(ctx echo.Context) bool {
+				return !isCorsPath(ctx.Request().URL.Path)
+			},
+			AllowOrigins:     origins,
+			AllowMethods:     []string{http.MethodGet, http.MethodHead, http.MethodPatch, http.MethodDelete},
+			AllowHeaders:     []string{echo.HeaderAuthorization, echo.HeaderContentType},
+			AllowCredentials: false,
+		}))
+	}
+	// the request ID is sent back in the X-Request-Id header, so a failing request can be found in the logs
+	e.Pre(middleware.RequestID())
 	e.Pre(middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
-		LogURI: true, LogStatus: true, LogMethod: true,
+		LogURI: true, LogStatus: true, LogMethod: true, LogRequestID: true,
 		LogValuesFunc: func(ctx echo.Context, v middleware.RequestLoggerValues) error {
 			log.Info().Str("uri", v.URI).Int("status", v.Status).Str("method", v.Method).
-				Str("ip", ctx.RealIP()).TimeDiff("duration", time.Now(), v.StartTime).
+				Str("ip", ctx.RealIP()).Str("request_id", v.RequestID).TimeDiff("duration", time.Now(), v.StartTime).
 				Msg("HTTP")
 			return nil
 		},
 	}))
+	if config.C.MetricsEnabled {
+		e.Use(requestMetrics)
+	}
 	e.Use(middleware.Recover())
 	e.Use(middleware.Secure())
 
@@ -216,6 +242,13 @@ func NewServer(isDev bool, sessionsPath string) *Server {
 
 	e.HTTPErrorHandler = func(er error, ctx echo.Context) {
 		if err, ok := er.(*echo.HTTPError); ok {
+			if wantsJSON(ctx) {
+				if errJson := jsonErrorRes(ctx, err); errJson != nil {
+					log.Fatal().Err(errJson).Send()
+				}
+				return
+			}
+
 			setData(ctx, "error", err)
 			if errHtml := htmlWithCode(ctx, err.Code, "error.html"); errHtml != nil {
 				log.Fatal().Err(errHtml).Send()
@@ -226,8 +259,20 @@ func NewServer(isDev bool, sessionsPath string) *Server {
 	}
 
 	e.Use(sessionInit)
+	e.Use(tokenInit)
+	e.Use(userLocale)
 
-	e.Validator = utils.NewValidator()
+	validate := utils.NewValidator()
+	_ = validate.RegisterValidation("maxfiles", func(fl validator.FieldLevel) bool {
+		return fl.Field().Len() <= config.C.GistMaxFiles
+	})
+	_ = validate.RegisterValidation("allowedext", func(fl validator.FieldLevel) bool {
+		return config.C.FileExtensionAllowed(fl.Field().String())
+	})
+	_ = validate.RegisterValidation("notreserved", func(fl validator.FieldLevel) bool {
+		return !db.IsReservedUsername(fl.Field().String())
+	})
+	e.Validator = validate
 
 	if !dev {
 		parseManifestEntries()
@@ -242,43 +287,85 @@ func NewServer(isDev bool, sessionsPath string) *Server {
 				CookiePath:     "/",
 				CookieHTTPOnly: true,
 				CookieSameSite: http.SameSiteStrictMode,
+				Skipper: func(ctx echo.Context) bool {
+					return getData(ctx, "token") != nil || getData(ctx, "appSession") != nil
+				},
 			}))
 			g1.Use(csrfInit)
 		}
 
 		g1.GET("/", create, logged)
-		g1.POST("/", processCreate, logged)
+		g1.POST("/", processCreate, logged, createRateLimit)
 		g1.GET("/preview", preview, logged)
 
 		g1.GET("/healthcheck", healthcheck)
+		g1.GET("/healthz", healthz)
+		g1.GET("/readyz", readyz)
 		g1.GET("/metrics", metrics)
 
 		g1.GET("/register", register)
-		g1.POST("/register", processRegister)
+		g1.POST("/register", processRegister, loginRateLimit)
 		g1.GET("/login", login)
-		g1.POST("/login", processLogin)
+		g1.POST("/login", processLogin, loginRateLimit)
+		g1.GET("/mfa", mfa)
+		g1.POST("/mfa", processMfa, loginRateLimit)
+		g1.POST("/webauthn/login/begin", webauthnLoginBegin, loginRateLimit)
+		g1.POST("/webauthn/login/finish", webauthnLoginFinish, loginRateLimit)
+		g1.GET("/forgot-password", forgotPassword)
+		g1.POST("/forgot-password", processForgotPassword, loginRateLimit)
+		g1.GET("/reset-password", resetPassword)
+		g1.POST("/reset-password", processResetPassword, loginRateLimit)
 		g1.GET("/logout", logout)
+		g1.GET("/verify-email", verifyEmail)
 		g1.GET("/oauth/:provider", oauth)
 		g1.GET("/oauth/:provider/callback", oauthCallback)
 
 		g1.GET("/settings", userSettings, logged)
 		g1.POST("/settings/email", emailProcess, logged)
+		g1.POST("/settings/email/verify", emailVerificationResend, logged)
 		g1.DELETE("/settings/account", accountDeleteProcess, logged)
 		g1.POST("/settings/ssh-keys", sshKeysProcess, logged)
 		g1.DELETE("/settings/ssh-keys/:id", sshKeysDelete, logged)
+		g1.POST("/settings/tokens", tokensProcess, logged)
+		g1.DELETE("/settings/tokens/:id", tokensDelete, logged)
+		g1.DELETE("/settings/app-sessions/:id", appSessionsDelete, logged)
+		g1.GET("/settings/export", exportGists, logged)
+		g1.POST("/settings/import-github", importGithubGists, logged)
 		g1.PUT("/settings/password", passwordProcess, logged)
 		g1.PUT("/settings/username", usernameProcess, logged)
+		g1.PUT("/settings/visibility", visibilityProcess, logged)
+		g1.GET("/settings/totp/generate", totpGenerate, logged)
+		g1.POST("/settings/totp/generate", totpGenerateProcess, logged)
+		g1.DELETE("/settings/totp", totpDelete, logged)
+		g1.POST("/settings/passkeys/begin", webauthnRegisterBegin, logged)
+		g1.POST("/settings/passkeys/finish", webauthnRegisterFinish, logged)
+		g1.DELETE("/settings/passkeys/:id", webauthnDelete, logged)
+		g1.POST("/settings/webhooks", webhooksProcess, logged, checkWebhooksEnabled)
+		g1.GET("/settings/webhooks/:id", webhookDeliveries, logged, checkWebhooksEnabled)
+		g1.DELETE("/settings/webhooks/:id", webhooksDelete, logged, checkWebhooksEnabled)
+
+		g1.GET("/trash", trash, logged)
+		g1.POST("/trash/:id/restore", restoreGist, logged)
+		g1.POST("/trash/:id/delete", purgeGist, logged)
 		g2 := g1.Group("/admin-panel")
 		{
 			g2.Use(adminPermission)
 			g2.GET("", adminIndex)
 			g2.GET("/users", adminUsers)
 			g2.POST("/users/:user/delete", adminUserDelete)
+			g2.POST("/users/:user/admin", adminUserToggleAdmin)
+			g2.POST("/users/:user/suspend", adminUserToggleSuspend)
 			g2.GET("/gists", adminGists)
+			g2.POST("/gists/:gist/visibility", adminGistVisibility)
 			g2.POST("/gists/:gist/delete", adminGistDelete)
 			g2.GET("/invitations", adminInvitations)
+			g2.GET("/audit-logs", adminAuditLogs)
 			g2.POST("/invitations", adminInvitationsCreate)
 			g2.POST("/invitations/:id/delete", adminInvitationsDelete)
+			g2.GET("/webhooks", adminWebhooks, checkWebhooksEnabled)
+			g2.POST("/webhooks", adminWebhooksCreate, checkWebhooksEnabled)
+			g2.GET("/webhooks/:id", adminWebhookDeliveries, checkWebhooksEnabled)
+			g2.POST("/webhooks/:id/delete", adminWebhooksDelete, checkWebhooksEnabled)
 			g2.POST("/sync-fs", adminSyncReposFromFS)
 			g2.POST("/sync-db", adminSyncReposFromDB)
 			g2.POST("/gc-repos", adminGcRepos)
@@ -290,15 +377,29 @@ func NewServer(isDev bool, sessionsPath string) *Server {
 		}
 
 		if config.C.HttpGit {
-			e.Any("/init/*", gitHttp, gistNewPushSoftInit)
+			e.Any("/init/*", gitHttp, gitRateLimit, gistNewPushSoftInit)
 		}
 
 		g1.GET("/all", allGists, checkRequireLogin)
+		g1.GET("/all.atom", allGistsFeed, checkRequireLogin)
+		g1.GET("/topics/:topic", allGists, checkRequireLogin)
+		g1.GET("/api/suggest", suggestGists, checkRequireLogin, searchRateLimit)
+		g1.GET("/api/gists", apiGists, checkRequireLogin)
+		g1.POST("/api/gists/batch", apiGistsBatch, checkRequireLogin)
+		g1.PATCH("/api/gists/:user/:gistname/metadata", apiGistMetadata, makeCheckRequireLogin(true), gistInit, logged)
+		g1.GET("/api/v1/gists", apiV1Gists, logged)
+		g1.POST("/api/v1/gists", apiV1CreateGist, logged, createRateLimit)
+		g1.GET("/api/v1/gists/:user/:gistname", apiV1Gist, makeCheckRequireLogin(true), gistInit)
+		g1.PATCH("/api/v1/gists/:user/:gistname", apiV1UpdateGist, makeCheckRequireLogin(true), gistInit, logged)
+		g1.DELETE("/api/v1/gists/:user/:gistname", apiV1DeleteGist, makeCheckRequireLogin(true), gistInit, logged)
+		g1.GET("/api/v1/gists/:user/:gistname/compare", apiV1CompareRevisions, makeCheckRequireLogin(true), gistInit)
+		g1.GET("/api/v1/gists/:user/:gistname/versions", apiV1Versions, makeCheckRequireLogin(true), gistInit)
+		g1.GET("/random", randomGist, checkRequireLogin)
 
 		if index.Enabled() {
-			g1.GET("/search", search, checkRequireLogin)
+			g1.GET("/search", search, checkRequireLogin, searchRateLimit)
 		} else {
-			g1.GET("/search", allGists, checkRequireLogin)
+			g1.GET("/search", allGists, checkRequireLogin, searchRateLimit)
 		}
 
 		g1.GET("/:user", allGists, checkRequireLogin)
@@ -311,21 +412,47 @@ func NewServer(isDev bool, sessionsPath string) *Server {
 			g3.GET("", gistIndex)
 			g3.GET("/rev/:revision", gistIndex)
 			g3.GET("/revisions", revisions)
-			g3.GET("/archive/:revision", downloadZip)
-			g3.POST("/visibility", editVisibility, logged, writePermission)
-			g3.POST("/delete", deleteGist, logged, writePermission)
-			g3.GET("/raw/:revision/:file", rawFile)
-			g3.GET("/download/:revision/:file", downloadFile)
+			g3.GET("/revisions.atom", revisionsFeed)
+			g3.GET("/revisions/compare", compareRevisions)
+			g3.GET("/versions", versions)
+			g3.GET("/commit/:hash", commitPatch)
+			g3.GET("/archive/:revision", downloadArchive)
+			g3.GET("/embed", gistEmbed)
+			g3.POST("/visibility", editVisibility, logged, ownerPermission)
+			g3.POST("/delete", deleteGist, logged, ownerPermission)
+			g3.POST("/template", toggleTemplate, logged, ownerPermission)
+			g3.POST("/lock", toggleLock, logged)
+			g3.GET("/collaborators", collaborators, logged, ownerPermission)
+			g3.POST("/collaborators", addCollaborator, logged, ownerPermission)
+			g3.POST("/collaborators/:id/delete", removeCollaborator, logged, ownerPermission)
+			g3.GET("/use-template", useTemplate, logged)
+			g3.POST("/use-template", processUseTemplate, logged, createRateLimit)
+			g3.GET("/raw/:revision/:file", rawFile, compressText)
+			g3.GET("/download/:revision/:file", downloadFile, compressText)
+			g3.GET("/blame/:revision/:file", blame)
 			g3.GET("/edit", edit, logged, writePermission)
 			g3.POST("/edit", processCreate, logged, writePermission)
 			g3.POST("/like", like, logged)
+			g3.POST("/watch", watch, logged)
+			g3.POST("/comments", addComment, logged)
+			g3.POST("/comments/:id/edit", editComment, logged)
+			g3.POST("/comments/:id/delete", deleteComment, logged)
 			g3.GET("/likes", likes, checkRequireLogin)
-			g3.POST("/fork", fork, logged)
+			g3.POST("/fork", fork, logged, createRateLimit)
+			g3.POST("/fork-and-edit", forkAndEdit, logged, createRateLimit)
 			g3.GET("/forks", forks, checkRequireLogin)
+			g3.GET("/forks/network", forkNetwork, checkRequireLogin)
+			g3.GET("/compare/:forkuser/:forkname", compareFork, checkRequireLogin)
 			g3.PUT("/checkbox", checkbox, logged, writePermission)
+			g3.POST("/restore", restoreFile, logged, writePermission)
 		}
 	}
 
+	// Authentication of the apps, they send no cookie so these routes are not protected against CSRF
+	e.POST("/api/auth/login", apiLogin, loginRateLimit)
+	e.POST("/api/auth/refresh", apiRefresh, loginRateLimit)
+	e.POST("/api/auth/revoke", apiRevoke)
+
 	customFs := os.DirFS(filepath.Join(config.GetHomeDir(), "custom"))
 	e.GET("/assets/*", func(ctx echo.Context) error {
 		if _, err := public.Files.Open(path.Join("assets", ctx.Param("*"))); !dev && err == nil {
@@ -348,7 +475,7 @@ func NewServer(isDev bool, sessionsPath string) *Server {
 
 	// Git HTTP routes
 	if config.C.HttpGit {
-		e.Any("/:user/:gistname/*", gitHttp, gistSoftInit)
+		e.Any("/:user/:gistname/*", gitHttp, gitRateLimit, gistSoftInit)
 	}
 
 	e.Any("/*", noRouteFound)
@@ -412,6 +539,41 @@ func dataInit(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
+// stripBasePath routes the requests made under the path of the external URL as if they were made at the root, so
+// Opengist can be served under a subpath whether the reverse proxy strips it or not
+func stripBasePath(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		base := config.C.BasePath()
+		req := ctx.Request()
+		if base != "" && (req.URL.Path == base || strings.HasPrefix(req.URL.Path, base+"/")) {
+			req.URL.Path = "/" + strings.TrimPrefix(req.URL.Path[len(base):], "/")
+			if req.URL.RawPath != "" {
+				req.URL.RawPath = "/" + strings.TrimPrefix(strings.TrimPrefix(req.URL.RawPath, base), "/")
+			}
+		}
+
+		return next(ctx)
+	}
+}
+
+// gzipMinLength is the size in bytes under which a response is not worth compressing
+const gzipMinLength = 1024
+
+// compressText gzips the content of the files for the clients accepting it. Images are already compressed and sent
+// as is.
+var compressText = middleware.GzipWithConfig(middleware.GzipConfig{
+	Skipper: func(ctx echo.Context) bool {
+		return !config.C.HttpCompression || rawInlineTypes[fileMediaType(ctx.Param("file"))]
+	},
+	MinLength: gzipMinLength,
+})
+
+// gzipAccepted reports whether the response is gzipped by compressText, provided it is long enough
+func gzipAccepted(ctx echo.Context) bool {
+	return strings.Contains(ctx.Response().Header().Get(echo.HeaderVary), echo.HeaderAcceptEncoding) &&
+		strings.Contains(ctx.Request().Header.Get(echo.HeaderAcceptEncoding), "gzip")
+}
+
 func locale(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(ctx echo.Context) error {
 		// Check URL arguments
@@ -455,6 +617,54 @@ func locale(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
+// userLocale applies the language preference of the logged user over the cookie and the browser languages, a
+// language picked from the language menu becomes the new preference
+func userLocale(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		user := getUserLogged(ctx)
+		if user == nil {
+			return next(ctx)
+		}
+
+		if lang := ctx.QueryParam("lang"); lang != "" && i18n.Locales.HasLocale(lang) {
+			if lang != user.Locale {
+				if err := user.SetLocale(lang); err != nil {
+					return errorRes(500, "Cannot save the language", err)
+				}
+			}
+			return next(ctx)
+		}
+
+		if user.Locale != "" && i18n.Locales.HasLocale(user.Locale) {
+			localeUsed, err := i18n.Locales.GetLocale(user.Locale)
+			if err != nil {
+				return errorRes(500, "Cannot get locale", err)
+			}
+			setData(ctx, "localeName", localeUsed.Name)
+			setData(ctx, "locale", localeUsed)
+		}
+
+		return next(ctx)
+	}
+}
+
+// isCorsPath reports whether the path is one of the raw file, gist JSON, embed or API routes that can be called
+// cross-origin. It runs before routing, so the path is matched by hand.
+func isCorsPath(urlPath string) bool {
+	parts := strings.Split(strings.Trim(urlPath, "/"), "/")
+	switch {
+	case parts[0] == "api":
+		return true
+	case len(parts) == 2 && (strings.HasSuffix(parts[1], ".json") || strings.HasSuffix(parts[1], ".js")):
+		return true
+	case len(parts) == 3 && parts[2] == "embed":
+		return true
+	case len(parts) == 5 && parts[2] == "raw":
+		return true
+	}
+	return false
+}
+
 func sessionInit(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(ctx echo.Context) error {
 		sess := getSession(ctx)
@@ -468,6 +678,13 @@ func sessionInit(next echo.HandlerFunc) echo.HandlerFunc {
 				setData(ctx, "userLogged", nil)
 				return redirect(ctx, "/all")
 			}
+			if user.Suspended {
+				sess.Values["user"] = nil
+				saveSession(sess, ctx)
+				setData(ctx, "userLogged", nil)
+				addFlash(ctx, tr(ctx, "flash.auth.account-suspended"), "error")
+				return redirect(ctx, "/login")
+			}
 			if user != nil {
 				setData(ctx, "userLogged", user)
 			}
@@ -479,6 +696,148 @@ func sessionInit(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
+// tokenScopes maps the routes reachable with an access token to the scope they require,
+// any other route is refused to token authenticated requests
+var tokenScopes = map[string]string{
+	"GET /all":                          db.ScopeGistRead,
+	"GET /all.atom":                     db.ScopeGistRead,
+	"GET /search":                       db.ScopeGistRead,
+	"GET /api/suggest":                  db.ScopeGistRead,
+	"GET /api/gists":                    db.ScopeGistRead,
+	"POST /api/gists/batch":             db.ScopeGistRead,
+	"GET /api/v1/gists":                 db.ScopeGistRead,
+	"GET /api/v1/gists/:user/:gistname": db.ScopeGistRead,
+	"GET /api/v1/gists/:user/:gistname/compare":  db.ScopeGistRead,
+	"GET /api/v1/gists/:user/:gistname/versions": db.ScopeGistRead,
+	"GET /random":                                   db.ScopeGistRead,
+	"GET /settings/export":                          db.ScopeGistRead,
+	"GET /:user":                                    db.ScopeGistRead,
+	"GET /:user/liked":                              db.ScopeGistRead,
+	"GET /:user/forked":                             db.ScopeGistRead,
+	"GET /:user/:gistname":                          db.ScopeGistRead,
+	"GET /:user/:gistname/rev/:revision":            db.ScopeGistRead,
+	"GET /:user/:gistname/revisions":                db.ScopeGistRead,
+	"GET /:user/:gistname/revisions.atom":           db.ScopeGistRead,
+	"GET /:user/:gistname/revisions/compare":        db.ScopeGistRead,
+	"GET /:user/:gistname/versions":                 db.ScopeGistRead,
+	"GET /:user/:gistname/commit/:hash":             db.ScopeGistRead,
+	"GET /:user/:gistname/archive/:revision":        db.ScopeGistRead,
+	"GET /:user/:gistname/embed":                    db.ScopeGistRead,
+	"GET /:user/:gistname/raw/:revision/:file":      db.ScopeGistRead,
+	"GET /:user/:gistname/download/:revision/:file": db.ScopeGistRead,
+	"GET /:user/:gistname/blame/:revision/:file":    db.ScopeGistRead,
+	"GET /:user/:gistname/likes":                    db.ScopeGistRead,
+	"GET /:user/:gistname/forks":                    db.ScopeGistRead,
+	"GET /:user/:gistname/forks/network":            db.ScopeGistRead,
+	"POST /":                                        db.ScopeGistWrite,
+	"POST /:user/:gistname/edit":                    db.ScopeGistWrite,
+	"POST /:user/:gistname/visibility":              db.ScopeGistWrite,
+	"POST /:user/:gistname/template":                db.ScopeGistWrite,
+	"POST /:user/:gistname/lock":                    db.ScopeGistWrite,
+	"POST /:user/:gistname/use-template":            db.ScopeGistWrite,
+	"POST /:user/:gistname/like":                    db.ScopeGistWrite,
+	"POST /:user/:gistname/watch":                   db.ScopeGistWrite,
+	"POST /:user/:gistname/comments":                db.ScopeGistWrite,
+	"POST /:user/:gistname/comments/:id/edit":       db.ScopeGistWrite,
+	"POST /:user/:gistname/comments/:id/delete":     db.ScopeGistWrite,
+	"POST /:user/:gistname/fork":                    db.ScopeGistWrite,
+	"POST /:user/:gistname/fork-and-edit":           db.ScopeGistWrite,
+	"PUT /:user/:gistname/checkbox":                 db.ScopeGistWrite,
+	"POST /:user/:gistname/restore":                 db.ScopeGistWrite,
+	"PATCH /api/gists/:user/:gistname/metadata":     db.ScopeGistWrite,
+	"POST /api/v1/gists":                            db.ScopeGistWrite,
+	"PATCH /api/v1/gists/:user/:gistname":           db.ScopeGistWrite,
+	"POST /:user/:gistname/delete":                  db.ScopeGistDelete,
+	"DELETE /api/v1/gists/:user/:gistname":          db.ScopeGistDelete,
+	"GET /admin-panel":                              db.ScopeAdmin,
+	"GET /admin-panel/users":                        db.ScopeAdmin,
+	"POST /admin-panel/users/:user/delete":          db.ScopeAdmin,
+	"POST /admin-panel/users/:user/admin":           db.ScopeAdmin,
+	"POST /admin-panel/users/:user/suspend":         db.ScopeAdmin,
+	"GET /admin-panel/gists":                        db.ScopeAdmin,
+	"POST /admin-panel/gists/:gist/visibility":      db.ScopeAdmin,
+	"POST /admin-panel/gists/:gist/delete":          db.ScopeAdmin,
+	"GET /admin-panel/invitations":                  db.ScopeAdmin,
+	"POST /admin-panel/invitations":                 db.ScopeAdmin,
+	"POST /admin-panel/invitations/:id/delete":      db.ScopeAdmin,
+	"GET /admin-panel/webhooks":                     db.ScopeAdmin,
+	"POST /admin-panel/webhooks":                    db.ScopeAdmin,
+	"GET /admin-panel/webhooks/:id":                 db.ScopeAdmin,
+	"POST /admin-panel/webhooks/:id/delete":         db.ScopeAdmin,
+	"GET /admin-panel/audit-logs":                   db.ScopeAdmin,
+	"POST /admin-panel/sync-fs":                     db.ScopeAdmin,
+	"POST /admin-panel/sync-db":                     db.ScopeAdmin,
+	"POST /admin-panel/gc-repos":                    db.ScopeAdmin,
+	"POST /admin-panel/sync-previews":               db.ScopeAdmin,
+	"POST /admin-panel/reset-hooks":                 db.ScopeAdmin,
+	"POST /admin-panel/index-gists":                 db.ScopeAdmin,
+
+	// the fork is compared with the gist it was forked from, both must be readable
+	"GET /:user/:gistname/compare/:forkuser/:forkname": db.ScopeGistRead,
+}
+
+func tokenInit(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		authorization := ctx.Request().Header.Get(echo.HeaderAuthorization)
+		plainToken, found := strings.CutPrefix(authorization, "Bearer ")
+		if !found {
+			return next(ctx)
+		}
+
+		plainToken = strings.TrimSpace(plainToken)
+
+		// personal access tokens start with og_, anything else is an access token issued to an app
+		if !strings.HasPrefix(plainToken, "og_") {
+			refreshToken, err := parseAccessToken(plainToken)
+			if err != nil {
+				if errors.Is(err, errInvalidAccessToken) {
+					return errorRes(401, "Invalid access token", nil)
+				}
+				return errorRes(500, "Cannot get app session", err)
+			}
+
+			// apps get the gist scopes, the admin panel needs a personal access token
+			if scope, ok := tokenScopes[ctx.Request().Method+" "+ctx.Path()]; !ok || scope == db.ScopeAdmin {
+				return errorRes(403, "This route cannot be reached with an access token", nil)
+			}
+			if refreshToken.User.Suspended {
+				return errorRes(403, tr(ctx, "flash.auth.account-suspended"), nil)
+			}
+
+			setData(ctx, "appSession", refreshToken)
+			setData(ctx, "userLogged", &refreshToken.User)
+			return next(ctx)
+		}
+
+		token, err := db.GetTokenByPlainToken(plainToken)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errorRes(401, "Invalid access token", nil)
+			}
+			return errorRes(500, "Cannot get access token", err)
+		}
+		if token.IsExpired() {
+			return errorRes(401, "Access token expired", nil)
+		}
+		if token.User.Suspended {
+			return errorRes(403, tr(ctx, "flash.auth.account-suspended"), nil)
+		}
+
+		scope, ok := tokenScopes[ctx.Request().Method+" "+ctx.Path()]
+		if !ok || !token.HasScope(scope) {
+			return errorRes(403, "Access token is missing the required scope", nil)
+		}
+
+		if err = token.SetLastUsedNow(); err != nil {
+			return errorRes(500, "Cannot update access token", err)
+		}
+
+		setData(ctx, "token", token)
+		setData(ctx, "userLogged", &token.User)
+		return next(ctx)
+	}
+}
+
 func csrfInit(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(ctx echo.Context) error {
 		setCsrfHtmlForm(ctx)
@@ -486,11 +845,25 @@ func csrfInit(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
+func ownerPermission(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		gist := getData(ctx, "gist")
+		user := getUserLogged(ctx)
+		if !gist.(*db.Gist).CanManage(user) {
+			return redirect(ctx, "/"+gist.(*db.Gist).User.Username+"/"+gist.(*db.Gist).Identifier())
+		}
+		return next(ctx)
+	}
+}
+
 func writePermission(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(ctx echo.Context) error {
 		gist := getData(ctx, "gist")
 		user := getUserLogged(ctx)
 		if !gist.(*db.Gist).CanWrite(user) {
+			if gist.(*db.Gist).Locked && gist.(*db.Gist).IsWriter(user) {
+				addFlash(ctx, tr(ctx, "flash.gist.is-locked"), "error")
+			}
 			return redirect(ctx, "/"+gist.(*db.Gist).User.Username+"/"+gist.(*db.Gist).Identifier())
 		}
 		return next(ctx)
@@ -513,6 +886,13 @@ func logged(next echo.HandlerFunc) echo.HandlerFunc {
 		if user != nil {
 			return next(ctx)
 		}
+		if wantsJSON(ctx) {
+			return errorRes(401, tr(ctx, "error.unauthorized"), nil)
+		}
+		if config.C.PrivateInstance {
+			addFlash(ctx, tr(ctx, "flash.auth.must-be-logged-in"), "error")
+			return redirect(ctx, "/login")
+		}
 		return redirect(ctx, "/all")
 	}
 }
@@ -530,6 +910,9 @@ func makeCheckRequireLogin(isSingleGistAccess bool) echo.MiddlewareFunc {
 			}
 
 			if !allow {
+				if wantsJSON(ctx) {
+					return errorRes(401, tr(ctx, "error.unauthorized"), nil)
+				}
 				addFlash(ctx, tr(ctx, "flash.auth.must-be-logged-in"), "error")
 				return redirect(ctx, "/login")
 			}
@@ -2,18 +2,20 @@ package web
 
 import (
 	"crypto/md5"
+	"errors"
 	"fmt"
-	"github.com/thomiceli/opengist/internal/config"
-	"github.com/thomiceli/opengist/internal/git"
 	"github.com/thomiceli/opengist/internal/i18n"
+	"github.com/thomiceli/opengist/internal/importer"
+	"github.com/thomiceli/opengist/internal/mailer"
 	"github.com/thomiceli/opengist/internal/utils"
-	"os"
-	"path/filepath"
+	"github.com/thomiceli/opengist/internal/webhook"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
 	"github.com/thomiceli/opengist/internal/db"
 	"golang.org/x/crypto/ssh"
 )
@@ -26,9 +28,43 @@ func userSettings(ctx echo.Context) error {
 		return errorRes(500, "Cannot get SSH keys", err)
 	}
 
+	tokens, err := db.GetTokensByUserID(user.ID)
+	if err != nil {
+		return errorRes(500, "Cannot get access tokens", err)
+	}
+
+	appSessions, err := db.GetRefreshTokensByUserID(user.ID)
+	if err != nil {
+		return errorRes(500, "Cannot get app sessions", err)
+	}
+
+	hasTotp, err := db.UserHasTOTP(user.ID)
+	if err != nil {
+		return errorRes(500, "Cannot check for TOTP", err)
+	}
+
+	passkeys, err := db.GetWebAuthnCredentialsByUserID(user.ID)
+	if err != nil {
+		return errorRes(500, "Cannot get passkeys", err)
+	}
+
+	webhooks, err := db.GetWebhooksByUserID(user.ID)
+	if err != nil {
+		return errorRes(500, "Cannot get webhooks", err)
+	}
+
 	setData(ctx, "email", user.Email)
+	setData(ctx, "mailerEnabled", mailer.Enabled())
 	setData(ctx, "sshKeys", keys)
+	setData(ctx, "tokens", tokens)
+	setData(ctx, "appSessions", appSessions)
+	setData(ctx, "tokenScopes", tokenScopesFor(user))
+	setData(ctx, "tokenExpirations", db.TokenExpirations)
 	setData(ctx, "hasPassword", user.Password != "")
+	setData(ctx, "hasTotp", hasTotp)
+	setData(ctx, "passkeys", passkeys)
+	setData(ctx, "webhooks", webhooks)
+	setData(ctx, "webhookEvents", webhook.Events)
 	setData(ctx, "disableForm", getData(ctx, "DisableLoginForm"))
 	setData(ctx, "htmlTitle", trH(ctx, "settings"))
 	return html(ctx, "settings.html")
@@ -46,6 +82,11 @@ func emailProcess(ctx echo.Context) error {
 		hash = fmt.Sprintf("%x", md5.Sum([]byte(strings.ToLower(strings.TrimSpace(email)))))
 	}
 
+	// a new email has to be verified again
+	changed := user.Email != strings.ToLower(email)
+	if changed {
+		user.EmailVerified = false
+	}
 	user.Email = strings.ToLower(email)
 	user.MD5Hash = hash
 
@@ -53,6 +94,14 @@ func emailProcess(ctx echo.Context) error {
 		return errorRes(500, "Cannot update email", err)
 	}
 
+	if changed && user.Email != "" && mailer.Enabled() {
+		if err := sendVerificationEmail(ctx, user); err != nil {
+			return errorRes(500, "Cannot send verification email", err)
+		}
+		addFlash(ctx, tr(ctx, "flash.user.email-verification-sent"), "success")
+		return redirect(ctx, "/settings")
+	}
+
 	addFlash(ctx, tr(ctx, "flash.user.email-updated"), "success")
 	return redirect(ctx, "/settings")
 }
@@ -60,7 +109,7 @@ func emailProcess(ctx echo.Context) error {
 func accountDeleteProcess(ctx echo.Context) error {
 	user := getUserLogged(ctx)
 
-	if err := user.Delete(); err != nil {
+	if err := user.DeleteWithGists(); err != nil {
 		return errorRes(500, "Cannot delete this user", err)
 	}
 
@@ -79,6 +128,14 @@ func sshKeysProcess(ctx echo.Context) error {
 		addFlash(ctx, utils.ValidationMessages(&err, getData(ctx, "locale").(*i18n.Locale)), "error")
 		return redirect(ctx, "/settings")
 	}
+
+	if ok, err := checkPasscode(ctx); err != nil {
+		return errorRes(500, "Cannot verify passcode", err)
+	} else if !ok {
+		addFlash(ctx, tr(ctx, "flash.auth.invalid-passcode"), "error")
+		return redirect(ctx, "/settings")
+	}
+
 	key := dto.ToSSHKey()
 
 	key.UserID = user.ID
@@ -127,6 +184,137 @@ func sshKeysDelete(ctx echo.Context) error {
 	return redirect(ctx, "/settings")
 }
 
+func tokensProcess(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+
+	dto := new(db.TokenDTO)
+	if err := ctx.Bind(dto); err != nil {
+		return errorRes(400, tr(ctx, "error.cannot-bind-data"), err)
+	}
+
+	if err := ctx.Validate(dto); err != nil {
+		addFlash(ctx, utils.ValidationMessages(&err, getData(ctx, "locale").(*i18n.Locale)), "error")
+		return redirect(ctx, "/settings")
+	}
+
+	if ok, err := checkPasscode(ctx); err != nil {
+		return errorRes(500, "Cannot verify passcode", err)
+	} else if !ok {
+		addFlash(ctx, tr(ctx, "flash.auth.invalid-passcode"), "error")
+		return redirect(ctx, "/settings")
+	}
+
+	if slices.Contains(dto.Scopes, db.ScopeAdmin) && !user.IsAdmin {
+		addFlash(ctx, tr(ctx, "flash.user.token-admin-scope"), "error")
+		return redirect(ctx, "/settings")
+	}
+
+	token := dto.ToToken()
+	token.UserID = user.ID
+
+	plainToken, err := token.Create()
+	if err != nil {
+		return errorRes(500, "Cannot create access token", err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.user.token-created", plainToken), "success")
+	return redirect(ctx, "/settings")
+}
+
+// tokenScopesFor returns the scopes the user can grant to their tokens, only the admins can reach the admin panel
+func tokenScopesFor(user *db.User) []string {
+	if user.IsAdmin {
+		return db.AllScopes
+	}
+	return slices.DeleteFunc(slices.Clone(db.AllScopes), func(scope string) bool {
+		return scope == db.ScopeAdmin
+	})
+}
+
+func tokensDelete(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+	tokenId, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		return redirect(ctx, "/settings")
+	}
+
+	token, err := db.GetTokenByID(uint(tokenId))
+
+	if err != nil || token.UserID != user.ID {
+		return redirect(ctx, "/settings")
+	}
+
+	if err := token.Delete(); err != nil {
+		return errorRes(500, "Cannot revoke access token", err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.user.token-revoked"), "success")
+	return redirect(ctx, "/settings")
+}
+
+func appSessionsDelete(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+	refreshTokenId, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		return redirect(ctx, "/settings")
+	}
+
+	refreshToken, err := db.GetRefreshTokenByID(uint(refreshTokenId))
+
+	if err != nil || refreshToken.UserID != user.ID {
+		return redirect(ctx, "/settings")
+	}
+
+	if err := refreshToken.Delete(); err != nil {
+		return errorRes(500, "Cannot revoke app session", err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.user.app-session-revoked"), "success")
+	return redirect(ctx, "/settings")
+}
+
+func exportGists(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+
+	ctx.Response().Header().Set("Content-Type", "application/zip")
+	ctx.Response().Header().Set("Content-Disposition", "attachment; filename="+user.Username+"-gists.zip")
+	ctx.Response().WriteHeader(200)
+
+	// the archive is streamed, past this point the status can't be changed anymore
+	if err := user.ExportAll(ctx.Response()); err != nil {
+		log.Error().Err(err).Msg("Error exporting the gists of " + user.Username)
+	}
+	return nil
+}
+
+// importGithubGists imports the gists of a GitHub user, the ones that fail are logged and counted in the flash
+func importGithubGists(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+
+	dto := new(importer.GithubImportDTO)
+	if err := ctx.Bind(dto); err != nil {
+		return errorRes(400, tr(ctx, "error.cannot-bind-data"), err)
+	}
+
+	if err := ctx.Validate(dto); err != nil {
+		addFlash(ctx, utils.ValidationMessages(&err, getData(ctx, "locale").(*i18n.Locale)), "error")
+		return redirect(ctx, "/settings")
+	}
+
+	result, err := importer.ImportGithubGists(user, dto)
+	if err != nil {
+		log.Warn().Err(err).Msg("Cannot fetch the GitHub gists for " + user.Username)
+		addFlash(ctx, tr(ctx, "flash.user.github-import-error"), "error")
+		return redirect(ctx, "/settings")
+	}
+
+	if len(result.Failed) > 0 {
+		addFlash(ctx, tr(ctx, "flash.user.github-import-failed", len(result.Failed)), "error")
+	}
+	addFlash(ctx, tr(ctx, "flash.user.github-imported", len(result.Imported)), "success")
+	return redirect(ctx, "/settings")
+}
+
 func passwordProcess(ctx echo.Context) error {
 	user := getUserLogged(ctx)
 
@@ -155,6 +343,18 @@ func passwordProcess(ctx echo.Context) error {
 	return redirect(ctx, "/settings")
 }
 
+// visibilityProcess saves the visibility the create form starts with, an empty one follows the instance default
+func visibilityProcess(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+
+	if err := user.SetDefaultVisibility(ctx.FormValue("visibility")); err != nil {
+		return errorRes(400, tr(ctx, "error.invalid-visibility"), err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.user.default-visibility-updated"), "success")
+	return redirect(ctx, "/settings")
+}
+
 func usernameProcess(ctx echo.Context) error {
 	user := getUserLogged(ctx)
 
@@ -169,24 +369,15 @@ func usernameProcess(ctx echo.Context) error {
 		return redirect(ctx, "/settings")
 	}
 
-	if exists, err := db.UserExists(dto.Username); err != nil || exists {
-		addFlash(ctx, tr(ctx, "flash.auth.username-exists"), "error")
-		return redirect(ctx, "/settings")
-	}
-
-	sourceDir := filepath.Join(config.GetHomeDir(), git.ReposDirectory, strings.ToLower(user.Username))
-	destinationDir := filepath.Join(config.GetHomeDir(), git.ReposDirectory, strings.ToLower(dto.Username))
-
-	if _, err := os.Stat(sourceDir); !os.IsNotExist(err) {
-		err := os.Rename(sourceDir, destinationDir)
-		if err != nil {
-			return errorRes(500, "Cannot rename user directory", err)
+	if err := user.Rename(dto.Username); err != nil {
+		if errors.Is(err, db.ErrUsernameExists) {
+			addFlash(ctx, tr(ctx, "flash.auth.username-exists"), "error")
+			return redirect(ctx, "/settings")
+		}
+		if errors.Is(err, db.ErrUsernameReserved) {
+			addFlash(ctx, tr(ctx, "flash.auth.username-reserved"), "error")
+			return redirect(ctx, "/settings")
 		}
-	}
-
-	user.Username = dto.Username
-
-	if err := user.Update(); err != nil {
 		return errorRes(500, "Cannot update username", err)
 	}
 
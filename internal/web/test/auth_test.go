@@ -1,14 +1,29 @@
 package test
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"github.com/pquerna/otp/totp"
 	"github.com/stretchr/testify/require"
+	"github.com/thomiceli/opengist/internal/captcha"
 	"github.com/thomiceli/opengist/internal/config"
 	"github.com/thomiceli/opengist/internal/db"
+	"github.com/thomiceli/opengist/internal/mailer"
+	"github.com/thomiceli/opengist/internal/ratelimit"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path"
+	"regexp"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func TestRegister(t *testing.T) {
@@ -20,8 +35,9 @@ func TestRegister(t *testing.T) {
 	err = s.request("GET", "/", nil, 302)
 	require.NoError(t, err)
 
-	err = s.request("GET", "/register", nil, 200)
+	res, err := s.requestWithResponse("GET", "/register", nil, 200)
 	require.NoError(t, err)
+	require.NotEmpty(t, res.Header().Get("X-Request-Id"), "Responses should carry a request ID")
 
 	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
 	register(t, s, user1)
@@ -85,6 +101,350 @@ func TestLogin(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestLdapLogin(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+	s.sessionCookie = ""
+
+	// nothing listens there, the directory cannot be reached
+	config.C.LdapUrl = "ldap://127.0.0.1:1"
+	defer func() { config.C.LdapUrl = "" }()
+
+	// local accounts are not checked against the directory
+	login(t, s, user1)
+	require.NotEmpty(t, s.sessionCookie)
+	s.sessionCookie = ""
+
+	err = s.request("POST", "/login", db.UserDTO{Username: "thomas", Password: "azeaze"}, 302)
+	require.Error(t, err)
+	require.Empty(t, s.sessionCookie)
+
+	// an empty password is refused before binding, as servers take it for an anonymous bind
+	err = s.request("POST", "/login", db.UserDTO{Username: "alice", Password: ""}, 302)
+	require.Error(t, err)
+	require.Empty(t, s.sessionCookie)
+
+	// the other users are checked against the directory
+	res, _ := s.requestWithResponse("POST", "/login", db.UserDTO{Username: "alice", Password: "alice"}, 500)
+	require.Equal(t, 500, res.Code)
+	require.Empty(t, s.sessionCookie)
+
+	exists, err := db.UserExists("alice")
+	require.NoError(t, err)
+	require.False(t, exists)
+}
+
+type passcodeForm struct {
+	Passcode string `form:"passcode"`
+	Method   string `form:"_method"`
+}
+
+type sshKeyForm struct {
+	Title    string `form:"title"`
+	Content  string `form:"content"`
+	Passcode string `form:"passcode"`
+}
+
+func TestTotp(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	res, err := s.requestWithResponse("GET", "/settings/totp/generate", nil, 200)
+	require.NoError(t, err)
+	secret := regexp.MustCompile(`<span class="code">([A-Z2-7]+)</span>`).FindStringSubmatch(res.Body.String())
+	require.Len(t, secret, 2)
+
+	// the secret is not stored until a passcode of the app is given
+	err = s.request("POST", "/settings/totp/generate", passcodeForm{Passcode: "000000"}, 200)
+	require.NoError(t, err)
+	hasTotp, err := db.UserHasTOTP(1)
+	require.NoError(t, err)
+	require.False(t, hasTotp)
+
+	code, err := totp.GenerateCode(secret[1], time.Now())
+	require.NoError(t, err)
+	res, err = s.requestWithResponse("POST", "/settings/totp/generate", passcodeForm{Passcode: code}, 200)
+	require.NoError(t, err)
+	recoveryCodes := regexp.MustCompile(`<li>([0-9a-f]{5}-[0-9a-f]{5})</li>`).FindAllStringSubmatch(res.Body.String(), -1)
+	require.Len(t, recoveryCodes, 8)
+	hasTotp, err = db.UserHasTOTP(1)
+	require.NoError(t, err)
+	require.True(t, hasTotp)
+
+	// sensitive actions need the passcode
+	key := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHwOkCzKkvkCoK8fAmQDEyDhH7rvuUwYrVnhbqRRCrVW"
+	err = s.request("POST", "/settings/ssh-keys", sshKeyForm{Title: "key", Content: key, Passcode: "000000"}, 302)
+	require.NoError(t, err)
+	keys, err := db.GetSSHKeysByUserID(1)
+	require.NoError(t, err)
+	require.Empty(t, keys)
+
+	code, err = totp.GenerateCode(secret[1], time.Now())
+	require.NoError(t, err)
+	err = s.request("POST", "/settings/ssh-keys", sshKeyForm{Title: "key", Content: key, Passcode: code}, 302)
+	require.NoError(t, err)
+	keys, err = db.GetSSHKeysByUserID(1)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+
+	// the password alone doesn't log the user in
+	s.sessionCookie = ""
+	res, err = s.requestWithResponse("POST", "/login", user1, 302)
+	require.NoError(t, err)
+	require.Equal(t, "/mfa", res.Header().Get("Location"))
+	err = s.request("GET", "/settings", nil, 302)
+	require.NoError(t, err)
+
+	res, err = s.requestWithResponse("POST", "/mfa", passcodeForm{Passcode: "000000"}, 302)
+	require.NoError(t, err)
+	require.Equal(t, "/mfa", res.Header().Get("Location"))
+
+	// a recovery code can be used once
+	res, err = s.requestWithResponse("POST", "/mfa", passcodeForm{Passcode: recoveryCodes[0][1]}, 302)
+	require.NoError(t, err)
+	require.Equal(t, "/", res.Header().Get("Location"))
+	err = s.request("GET", "/settings", nil, 200)
+	require.NoError(t, err)
+
+	s.sessionCookie = ""
+	login(t, s, user1)
+	res, err = s.requestWithResponse("POST", "/mfa", passcodeForm{Passcode: recoveryCodes[0][1]}, 302)
+	require.NoError(t, err)
+	require.Equal(t, "/mfa", res.Header().Get("Location"))
+
+	code, err = totp.GenerateCode(secret[1], time.Now())
+	require.NoError(t, err)
+	res, err = s.requestWithResponse("POST", "/mfa", passcodeForm{Passcode: code}, 302)
+	require.NoError(t, err)
+	require.Equal(t, "/", res.Header().Get("Location"))
+
+	// the API login needs the passcode too
+	apiLogin := db.ApiLoginDTO{Username: "thomas", Password: "thomas"}
+	res, _ = s.requestWithResponse("POST", "/api/auth/login", apiLogin, 401)
+	require.Equal(t, 401, res.Code)
+	apiLogin.Passcode = recoveryCodes[1][1]
+	res, _ = s.requestWithResponse("POST", "/api/auth/login", apiLogin, 200)
+	require.Equal(t, 200, res.Code)
+
+	err = s.request("POST", "/settings/totp", passcodeForm{Passcode: "000000", Method: "DELETE"}, 302)
+	require.NoError(t, err)
+	hasTotp, err = db.UserHasTOTP(1)
+	require.NoError(t, err)
+	require.True(t, hasTotp)
+
+	err = s.request("POST", "/settings/totp", passcodeForm{Passcode: recoveryCodes[2][1], Method: "DELETE"}, 302)
+	require.NoError(t, err)
+	hasTotp, err = db.UserHasTOTP(1)
+	require.NoError(t, err)
+	require.False(t, hasTotp)
+}
+
+// softAuthenticator answers the passkey ceremonies like a security key, with a P-256 key and no attestation
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialId []byte
+	userHandle   []byte
+	counter      uint32
+}
+
+type passkeyForm struct {
+	Name       string `form:"name"`
+	Credential string `form:"credential"`
+}
+
+type webauthnOptions struct {
+	PublicKey struct {
+		Challenge string `json:"challenge"`
+		User      struct {
+			ID string `json:"id"`
+		} `json:"user"`
+		AllowCredentials []struct {
+			ID string `json:"id"`
+		} `json:"allowCredentials"`
+	} `json:"publicKey"`
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	credentialId := make([]byte, 16)
+	_, err = rand.Read(credentialId)
+	require.NoError(t, err)
+	return &softAuthenticator{key: key, credentialId: credentialId}
+}
+
+// authenticatorData holds the hash of the relying party ID, the user present and verified flags and the counter, then
+// the credential when it is created
+func (a *softAuthenticator) authenticatorData(created bool) []byte {
+	rpIdHash := sha256.Sum256([]byte("localhost"))
+	data := append(rpIdHash[:], 0x05)
+	if created {
+		data[32] |= 0x40
+	}
+	data = binary.BigEndian.AppendUint32(data, a.counter)
+	if !created {
+		return data
+	}
+
+	data = append(data, make([]byte, 16)...) // AAGUID
+	data = binary.BigEndian.AppendUint16(data, uint16(len(a.credentialId)))
+	data = append(data, a.credentialId...)
+	// COSE EC2 key in CBOR: {1: 2, 3: -7, -1: 1, -2: x, -3: y}
+	data = append(data, 0xa5, 0x01, 0x02, 0x03, 0x26, 0x20, 0x01, 0x21, 0x58, 0x20)
+	data = append(data, a.key.X.FillBytes(make([]byte, 32))...)
+	data = append(data, 0x22, 0x58, 0x20)
+	return append(data, a.key.Y.FillBytes(make([]byte, 32))...)
+}
+
+func (a *softAuthenticator) clientData(ceremony string, options []byte) (webauthnOptions, []byte) {
+	var o webauthnOptions
+	_ = json.Unmarshal(options, &o)
+	return o, []byte(fmt.Sprintf(`{"type":%q,"challenge":%q,"origin":"http://localhost:6157"}`, ceremony, o.PublicKey.Challenge))
+}
+
+func (a *softAuthenticator) create(t *testing.T, options []byte) string {
+	o, clientData := a.clientData("webauthn.create", options)
+	userHandle, err := base64.RawURLEncoding.DecodeString(o.PublicKey.User.ID)
+	require.NoError(t, err)
+	a.userHandle = userHandle
+
+	authData := a.authenticatorData(true)
+	// CBOR: {"fmt": "none", "attStmt": {}, "authData": authData}
+	attestation := []byte("\xa3\x63fmt\x64none\x67attStmt\xa0\x68authData\x58")
+	attestation = append(attestation, byte(len(authData)))
+	attestation = append(attestation, authData...)
+
+	credential, err := json.Marshal(map[string]interface{}{
+		"id":    base64.RawURLEncoding.EncodeToString(a.credentialId),
+		"rawId": base64.RawURLEncoding.EncodeToString(a.credentialId),
+		"type":  "public-key",
+		"response": map[string]string{
+			"attestationObject": base64.RawURLEncoding.EncodeToString(attestation),
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+		},
+	})
+	require.NoError(t, err)
+	return string(credential)
+}
+
+func (a *softAuthenticator) get(t *testing.T, options []byte) string {
+	_, clientData := a.clientData("webauthn.get", options)
+	a.counter++
+
+	authData := a.authenticatorData(false)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	require.NoError(t, err)
+
+	credential, err := json.Marshal(map[string]interface{}{
+		"id":    base64.RawURLEncoding.EncodeToString(a.credentialId),
+		"rawId": base64.RawURLEncoding.EncodeToString(a.credentialId),
+		"type":  "public-key",
+		"response": map[string]string{
+			"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+			"signature":         base64.RawURLEncoding.EncodeToString(signature),
+			"userHandle":        base64.RawURLEncoding.EncodeToString(a.userHandle),
+		},
+	})
+	require.NoError(t, err)
+	return string(credential)
+}
+
+func TestWebAuthn(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+	authenticator := newSoftAuthenticator(t)
+
+	err = s.request("POST", "/settings/passkeys/begin", passkeyForm{}, 422)
+	require.NoError(t, err)
+
+	res, err := s.requestWithResponse("POST", "/settings/passkeys/begin", passkeyForm{Name: "My key"}, 200)
+	require.NoError(t, err)
+	credential := authenticator.create(t, res.Body.Bytes())
+	err = s.request("POST", "/settings/passkeys/finish", passkeyForm{Name: "My key", Credential: credential}, 200)
+	require.NoError(t, err)
+
+	// the challenge can be answered once
+	err = s.request("POST", "/settings/passkeys/finish", passkeyForm{Name: "My key", Credential: credential}, 400)
+	require.NoError(t, err)
+
+	passkeys, err := db.GetWebAuthnCredentialsByUserID(1)
+	require.NoError(t, err)
+	require.Len(t, passkeys, 1)
+	require.Equal(t, "My key", passkeys[0].Name)
+
+	// passwordless login
+	s.sessionCookie = ""
+	res, err = s.requestWithResponse("POST", "/webauthn/login/begin", nil, 200)
+	require.NoError(t, err)
+	_, err = s.requestWithResponse("POST", "/webauthn/login/finish", passkeyForm{Credential: authenticator.get(t, res.Body.Bytes())}, 200)
+	require.NoError(t, err)
+	err = s.request("GET", "/settings", nil, 200)
+	require.NoError(t, err)
+
+	// a signature of another key is refused
+	s.sessionCookie = ""
+	res, err = s.requestWithResponse("POST", "/webauthn/login/begin", nil, 200)
+	require.NoError(t, err)
+	impostor := newSoftAuthenticator(t)
+	impostor.credentialId, impostor.userHandle = authenticator.credentialId, authenticator.userHandle
+	_, err = s.requestWithResponse("POST", "/webauthn/login/finish", passkeyForm{Credential: impostor.get(t, res.Body.Bytes())}, 401)
+	require.NoError(t, err)
+	err = s.request("GET", "/settings", nil, 302)
+	require.NoError(t, err)
+
+	// the passkey is the second factor of a password login
+	s.sessionCookie = ""
+	res, err = s.requestWithResponse("POST", "/login", user1, 302)
+	require.NoError(t, err)
+	require.Equal(t, "/mfa", res.Header().Get("Location"))
+	res, err = s.requestWithResponse("POST", "/mfa", passcodeForm{Passcode: "000000"}, 302)
+	require.NoError(t, err)
+	require.Equal(t, "/mfa", res.Header().Get("Location"))
+
+	res, err = s.requestWithResponse("POST", "/webauthn/login/begin", nil, 200)
+	require.NoError(t, err)
+	var options webauthnOptions
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &options))
+	require.Len(t, options.PublicKey.AllowCredentials, 1)
+	_, err = s.requestWithResponse("POST", "/webauthn/login/finish", passkeyForm{Credential: authenticator.get(t, res.Body.Bytes())}, 200)
+	require.NoError(t, err)
+	err = s.request("GET", "/settings", nil, 200)
+	require.NoError(t, err)
+
+	passkeys, err = db.GetWebAuthnCredentialsByUserID(1)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), passkeys[0].SignCount)
+	require.NotZero(t, passkeys[0].LastUsedAt)
+
+	// apps cannot use passkeys
+	res, _ = s.requestWithResponse("POST", "/api/auth/login", db.ApiLoginDTO{Username: "thomas", Password: "thomas"}, 401)
+	require.Equal(t, 401, res.Code)
+
+	err = s.request("POST", "/settings/passkeys/1", passcodeForm{Method: "DELETE"}, 302)
+	require.NoError(t, err)
+	hasWebAuthn, err := db.UserHasWebAuthn(1)
+	require.NoError(t, err)
+	require.False(t, hasWebAuthn)
+}
+
 func register(t *testing.T, s *testServer, user db.UserDTO) {
 	err := s.request("POST", "/register", user, 302)
 	require.NoError(t, err)
@@ -153,6 +513,188 @@ func TestAnonymous(t *testing.T) {
 
 }
 
+func TestPrivateInstance(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user)
+
+	err = s.request("PUT", "/admin-panel/set-config", settingSet{"allow-gists-without-login", "1"}, 200)
+	require.NoError(t, err)
+
+	gist1 := db.GistDTO{
+		Title: "gist1",
+		VisibilityDTO: db.VisibilityDTO{
+			Private: db.PublicVisibility,
+		},
+		Name:    []string{"gist1.txt"},
+		Content: []string{"yeah"},
+	}
+	err = s.request("POST", "/", gist1, 302)
+	require.NoError(t, err)
+
+	gist1db, err := db.GetGistByID("1")
+	require.NoError(t, err)
+	gistUrl := "/" + gist1db.User.Username + "/" + gist1db.Uuid
+
+	config.C.PrivateInstance = true
+	defer func() { config.C.PrivateInstance = false }()
+
+	err = s.request("GET", gistUrl, nil, 200)
+	require.NoError(t, err)
+
+	s.sessionCookie = ""
+
+	for _, uri := range []string{"/", "/all", "/search?q=gist", "/thomas", gistUrl, gistUrl + "/raw/HEAD/gist1.txt", gistUrl + ".json"} {
+		res, err := s.requestWithResponse("GET", uri, nil, 302)
+		require.NoError(t, err, uri)
+		require.Equal(t, "/login", res.Header().Get("Location"), uri)
+	}
+	err = s.request("GET", "/api/gists", nil, 401)
+	require.NoError(t, err)
+
+	err = s.request("POST", "/", gist1, 302)
+	require.NoError(t, err)
+	count, err := db.CountAll(db.Gist{})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), count, "Anonymous users should not be able to create gists")
+
+	err = clientGitClone(":", "thomas", gist1db.Uuid)
+	require.Error(t, err)
+}
+
+func TestDisableSignup(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	admin := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, admin)
+
+	config.C.DisableSignup = true
+	defer func() { config.C.DisableSignup = false }()
+
+	err = s.request("POST", "/admin-panel/invitations", struct {
+		NbMax string `form:"nbMax"`
+	}{"1"}, 302)
+	require.NoError(t, err)
+
+	invitations, err := db.GetAllInvitations()
+	require.NoError(t, err)
+	require.Len(t, invitations, 1)
+	invitation := invitations[0]
+	require.Equal(t, uint(1), invitation.CreatedByID)
+
+	s.sessionCookie = ""
+
+	// refused signups set no session cookie, so only the status code is checked
+	res, _ := s.requestWithResponse("POST", "/register", db.UserDTO{Username: "kaguya", Password: "kaguya"}, 403)
+	require.Equal(t, 403, res.Code)
+	res, _ = s.requestWithResponse("POST", "/register?code=notacode", db.UserDTO{Username: "kaguya", Password: "kaguya"}, 403)
+	require.Equal(t, 403, res.Code)
+
+	err = s.request("POST", "/register?code="+invitation.Code, db.UserDTO{Username: "kaguya", Password: "kaguya"}, 302)
+	require.NoError(t, err)
+
+	user, err := db.GetUserByUsername("kaguya")
+	require.NoError(t, err)
+	require.Equal(t, invitation.ID, user.InvitationID)
+
+	invitation, err = db.GetInvitationByID(invitation.ID)
+	require.NoError(t, err)
+	require.Equal(t, uint(1), invitation.NbUsed)
+
+	// the code allowed a single signup
+	s.sessionCookie = ""
+	res, _ = s.requestWithResponse("POST", "/register?code="+invitation.Code, db.UserDTO{Username: "noriaki", Password: "noriaki"}, 403)
+	require.Equal(t, 403, res.Code)
+
+	err = (&db.User{Username: "noriaki"}).CreateWithInvitation(invitation)
+	require.ErrorIs(t, err, db.ErrInvitationNotUsable)
+	exists, err := db.UserExists("noriaki")
+	require.NoError(t, err)
+	require.False(t, exists, "The user should not be created with a used up invitation")
+
+	// the instance is closed, the invitations cannot be used nor created anymore
+	invitation2 := &db.Invitation{ExpiresAt: time.Now().Add(time.Hour).Unix(), NbMax: 10}
+	err = invitation2.Create()
+	require.NoError(t, err)
+
+	config.C.DisableInvitations = true
+	defer func() { config.C.DisableInvitations = false }()
+
+	res, _ = s.requestWithResponse("POST", "/register?code="+invitation2.Code, db.UserDTO{Username: "noriaki", Password: "noriaki"}, 403)
+	require.Equal(t, 403, res.Code)
+
+	login(t, s, admin)
+	err = s.request("POST", "/admin-panel/invitations", struct {
+		NbMax string `form:"nbMax"`
+	}{"1"}, 302)
+	require.NoError(t, err)
+
+	invitations, err = db.GetAllInvitations()
+	require.NoError(t, err)
+	require.Len(t, invitations, 2)
+}
+
+func TestReservedUsernames(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	config.C.ReservedUsernames = "root, Support"
+	defer func() { config.C.ReservedUsernames = "" }()
+
+	// names used by the routes are reserved whatever their case, as well as the configured ones
+	for _, username := range []string{"api", "API", "oauth", "Settings", "root", "support"} {
+		res, _ := s.requestWithResponse("POST", "/register", db.UserDTO{Username: username, Password: "thomas"}, 200)
+		require.Equal(t, 200, res.Code)
+
+		exists, err := db.UserExists(username)
+		require.NoError(t, err)
+		require.False(t, exists, "The user %s should not be created", username)
+	}
+
+	register(t, s, db.UserDTO{Username: "thomas", Password: "thomas"})
+
+	user, err := db.GetUserByUsername("thomas")
+	require.NoError(t, err)
+
+	err = user.Rename("Assets")
+	require.ErrorIs(t, err, db.ErrUsernameReserved)
+	err = user.Rename("ROOT")
+	require.ErrorIs(t, err, db.ErrUsernameReserved)
+	require.Equal(t, "thomas", user.Username)
+
+	err = s.request("PUT", "/settings/username", db.UserDTO{Username: "login"}, 302)
+	require.NoError(t, err)
+	_, err = db.GetUserByUsername("thomas")
+	require.NoError(t, err)
+
+	// a custom URL cannot shadow the routes under /:user
+	gist := db.GistDTO{
+		URL:           "liked",
+		VisibilityDTO: db.VisibilityDTO{Private: db.PublicVisibility},
+		Name:          []string{"file.txt"},
+		Content:       []string{"hello"},
+	}
+	err = s.request("POST", "/", gist, 302)
+	require.Error(t, err)
+
+	count, err := db.CountAll(db.Gist{})
+	require.NoError(t, err)
+	require.Equal(t, int64(0), count)
+
+	gist.URL = "likes"
+	err = s.request("POST", "/", gist, 302)
+	require.NoError(t, err)
+}
+
 func TestGitOperations(t *testing.T) {
 	setup(t)
 	s, err := newTestServer()
@@ -316,3 +858,232 @@ func clientCheckRepo(url string, file string) error {
 	_, err := os.ReadFile(path.Join(config.GetHomeDir(), "tmp", url, file))
 	return err
 }
+
+func TestRateLimit(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	config.C.RateLimitEnabled = true
+	config.C.RateLimitLogin = 3
+	config.C.RateLimitCreate = 1
+	config.C.RateLimitSearch = 1
+	require.NoError(t, ratelimit.Setup(""))
+	defer func() {
+		config.C.RateLimitEnabled = false
+		config.C.RateLimitLogin = 10
+		config.C.RateLimitCreate = 20
+		config.C.RateLimitSearch = 60
+	}()
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+	s.sessionCookie = ""
+
+	// failed logins set no session cookie, so only the status code is checked
+	res, _ := s.requestWithResponse("POST", "/login", db.UserDTO{Username: "thomas", Password: "wrong"}, 302)
+	require.Equal(t, 302, res.Code)
+	res, _ = s.requestWithResponse("POST", "/login", db.UserDTO{Username: "thomas", Password: "wrong"}, 302)
+	require.Equal(t, 302, res.Code)
+
+	// the fourth attempt of the minute is refused, even with the right password
+	res, _ = s.requestWithResponse("POST", "/login", user1, 429)
+	require.Equal(t, 429, res.Code)
+	require.NotEmpty(t, res.Header().Get("Retry-After"))
+
+	res, _ = s.requestWithResponse("POST", "/api/auth/login", user1, 429)
+	require.Equal(t, 429, res.Code)
+	require.Contains(t, res.Body.String(), `"code":"too_many_requests"`)
+
+	// the limits are not applied when disabled
+	config.C.RateLimitEnabled = false
+	login(t, s, user1)
+	config.C.RateLimitEnabled = true
+
+	gist1 := db.GistDTO{
+		Title:         "gist1",
+		VisibilityDTO: db.VisibilityDTO{Private: db.PublicVisibility},
+		Name:          []string{"file.txt"},
+		Content:       []string{"hello world"},
+	}
+	err = s.request("POST", "/", gist1, 302)
+	require.NoError(t, err)
+	err = s.request("POST", "/", gist1, 429)
+	require.NoError(t, err)
+
+	count, err := db.CountAll(db.Gist{})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), count)
+
+	// the logged user is counted on their own, apart from the other clients of their IP address
+	err = s.request("GET", "/search?q=gist1", nil, 200)
+	require.NoError(t, err)
+	err = s.request("GET", "/search?q=gist1", nil, 429)
+	require.NoError(t, err)
+
+	s.sessionCookie = ""
+	err = s.request("GET", "/search?q=gist1", nil, 200)
+	require.NoError(t, err)
+
+	// a client that is not a trusted proxy cannot pick its IP address with the X-Forwarded-For header
+	req := httptest.NewRequest("GET", "http://localhost:6157/search?q=gist1", nil)
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	req.Header.Set("X-Real-IP", "203.0.113.7")
+	w := httptest.NewRecorder()
+	s.server.ServeHTTP(w, req)
+	require.Equal(t, 429, w.Code)
+}
+
+func TestCaptcha(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	config.C.CaptchaProvider = "pow"
+	config.C.CaptchaPowDifficulty = 4
+	defer func() {
+		config.C.CaptchaProvider = "off"
+		config.C.CaptchaPowDifficulty = 18
+		config.C.CaptchaLogin = false
+	}()
+
+	type captchaUserDTO struct {
+		Username string `form:"username"`
+		Password string `form:"password"`
+		Nonce    string `form:"pow-nonce"`
+	}
+
+	// the challenge is given by the form and kept in the session
+	getChallenge := func(uri string) string {
+		res, err := s.requestWithResponse("GET", uri, nil, 200)
+		require.NoError(t, err)
+		for _, cookie := range res.Result().Cookies() {
+			if cookie.Name == "session" {
+				s.sessionCookie = cookie.Value
+			}
+		}
+		matches := regexp.MustCompile(`data-challenge="([0-9a-f]+)"`).FindStringSubmatch(res.Body.String())
+		require.Len(t, matches, 2)
+		return matches[1]
+	}
+	solve := func(challenge string) string {
+		nonce := 0
+		for !captcha.VerifyProofOfWork(challenge, strconv.Itoa(nonce), 4) {
+			nonce++
+		}
+		return strconv.Itoa(nonce)
+	}
+
+	getChallenge("/register")
+	res, _ := s.requestWithResponse("POST", "/register", captchaUserDTO{Username: "thomas", Password: "thomas"}, 302)
+	require.Equal(t, 302, res.Code)
+	require.Equal(t, "/register", res.Header().Get("Location"))
+	exists, err := db.UserExists("thomas")
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	nonce := solve(getChallenge("/register"))
+	err = s.request("POST", "/register", captchaUserDTO{Username: "thomas", Password: "thomas", Nonce: nonce}, 302)
+	require.NoError(t, err)
+	exists, err = db.UserExists("thomas")
+	require.NoError(t, err)
+	require.True(t, exists)
+
+	// a solved challenge cannot be used again
+	s.sessionCookie = ""
+	res, _ = s.requestWithResponse("POST", "/register", captchaUserDTO{Username: "kaguya", Password: "kaguya", Nonce: nonce}, 302)
+	require.Equal(t, "/register", res.Header().Get("Location"))
+	exists, err = db.UserExists("kaguya")
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	// the login form asks for the captcha only if configured to
+	login(t, s, db.UserDTO{Username: "thomas", Password: "thomas"})
+	s.sessionCookie = ""
+
+	config.C.CaptchaLogin = true
+	res, _ = s.requestWithResponse("POST", "/login", captchaUserDTO{Username: "thomas", Password: "thomas"}, 302)
+	require.Equal(t, "/login", res.Header().Get("Location"))
+
+	nonce = solve(getChallenge("/login"))
+	err = s.request("POST", "/login", captchaUserDTO{Username: "thomas", Password: "thomas", Nonce: nonce}, 302)
+	require.NoError(t, err)
+	err = s.request("GET", "/", nil, 200)
+	require.NoError(t, err)
+}
+
+func TestPasswordReset(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	// the passwords cannot be reset without an SMTP server
+	err = s.request("GET", "/forgot-password", nil, 404)
+	require.NoError(t, err)
+
+	mails := new(recordingMailer)
+	mailer.SetMailer(mails)
+	defer mailer.SetMailer(nil)
+
+	register(t, s, db.UserDTO{Username: "thomas", Password: "thomas", Email: "thomas@example.com"})
+	s.sessionCookie = ""
+
+	type emailForm struct {
+		Email string `form:"email"`
+	}
+
+	// only the verified emails get a link
+	err = s.request("POST", "/forgot-password", emailForm{"thomas@example.com"}, 302)
+	require.NoError(t, err)
+	require.Len(t, mails.messages, 1)
+
+	user, err := db.GetUserByUsername("thomas")
+	require.NoError(t, err)
+	ok, err := user.VerifyEmail("thomas@example.com")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	err = s.request("POST", "/forgot-password", emailForm{"kaguya@example.com"}, 302)
+	require.NoError(t, err)
+	require.Len(t, mails.messages, 1)
+
+	err = s.request("POST", "/forgot-password", emailForm{"Thomas@Example.com"}, 302)
+	require.NoError(t, err)
+	require.Len(t, mails.messages, 2)
+	require.Equal(t, "thomas@example.com", mails.messages[1].To)
+
+	matches := regexp.MustCompile(`/reset-password\?token=([0-9a-f]+)`).FindStringSubmatch(mails.messages[1].Body)
+	require.Len(t, matches, 2)
+	token := matches[1]
+
+	res, err := s.requestWithResponse("GET", "/reset-password?token=invalid", nil, 302)
+	require.NoError(t, err)
+	require.Equal(t, "/forgot-password", res.Header().Get("Location"))
+
+	err = s.request("GET", "/reset-password?token="+token, nil, 200)
+	require.NoError(t, err)
+
+	res, err = s.requestWithResponse("POST", "/reset-password", db.PasswordResetDTO{Token: token, Password: "kaguya"}, 302)
+	require.NoError(t, err)
+	require.Equal(t, "/login", res.Header().Get("Location"))
+
+	res, _ = s.requestWithResponse("POST", "/login", db.UserDTO{Username: "thomas", Password: "thomas"}, 302)
+	require.Equal(t, "/login", res.Header().Get("Location"))
+	login(t, s, db.UserDTO{Username: "thomas", Password: "kaguya"})
+
+	// a link can be used once
+	res, err = s.requestWithResponse("POST", "/reset-password", db.PasswordResetDTO{Token: token, Password: "thomas"}, 302)
+	require.NoError(t, err)
+	require.Equal(t, "/forgot-password", res.Header().Get("Location"))
+
+	// the links are deleted along their user
+	_, err = db.CreatePasswordResetToken(user, time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, user.Delete())
+	count, err := db.CountAll(db.PasswordResetToken{})
+	require.NoError(t, err)
+	require.Equal(t, int64(0), count)
+}
@@ -27,6 +27,7 @@ import (
 type testServer struct {
 	server        *web.Server
 	sessionCookie string
+	bearerToken   string
 }
 
 func newTestServer() (*testServer, error) {
@@ -47,8 +48,13 @@ func (s *testServer) stop() {
 }
 
 func (s *testServer) request(method, uri string, data interface{}, expectedCode int) error {
+	_, err := s.requestWithResponse(method, uri, data, expectedCode)
+	return err
+}
+
+func (s *testServer) requestWithResponse(method, uri string, data interface{}, expectedCode int) (*httptest.ResponseRecorder, error) {
 	var bodyReader io.Reader
-	if method == http.MethodPost || method == http.MethodPut {
+	if method == http.MethodPost || method == http.MethodPut || method == http.MethodPatch {
 		values := structToURLValues(data)
 		bodyReader = strings.NewReader(values.Encode())
 	}
@@ -56,7 +62,7 @@ func (s *testServer) request(method, uri string, data interface{}, expectedCode
 	req := httptest.NewRequest(method, "http://localhost:6157"+uri, bodyReader)
 	w := httptest.NewRecorder()
 
-	if method == http.MethodPost || method == http.MethodPut {
+	if method == http.MethodPost || method == http.MethodPut || method == http.MethodPatch {
 		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	}
 
@@ -64,10 +70,14 @@ func (s *testServer) request(method, uri string, data interface{}, expectedCode
 		req.AddCookie(&http.Cookie{Name: "session", Value: s.sessionCookie})
 	}
 
+	if s.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.bearerToken)
+	}
+
 	s.server.ServeHTTP(w, req)
 
 	if w.Code != expectedCode {
-		return fmt.Errorf("unexpected status code %d, expected %d", w.Code, expectedCode)
+		return w, fmt.Errorf("unexpected status code %d, expected %d", w.Code, expectedCode)
 	}
 
 	if method == http.MethodPost {
@@ -82,7 +92,7 @@ func (s *testServer) request(method, uri string, data interface{}, expectedCode
 				}
 			}
 			if cookie == "" {
-				return errors.New("unable to find access session token in response headers")
+				return w, errors.New("unable to find access session token in response headers")
 			}
 			s.sessionCookie = strings.TrimPrefix(cookie, "session=")
 		} else if strings.Contains(uri, "/logout") {
@@ -90,7 +100,7 @@ func (s *testServer) request(method, uri string, data interface{}, expectedCode
 		}
 	}
 
-	return nil
+	return w, nil
 }
 
 func structToURLValues(s interface{}) url.Values {
@@ -111,6 +121,12 @@ func structToURLValues(s interface{}) url.Values {
 			if field.Type.Kind() == reflect.Int {
 				fieldValue := rValue.Field(i).Int()
 				v.Add(tag, strconv.FormatInt(fieldValue, 10))
+			} else if field.Type.Kind() == reflect.Bool {
+				v.Add(tag, strconv.FormatBool(rValue.Field(i).Bool()))
+			} else if field.Type.Kind() == reflect.Ptr {
+				if !rValue.Field(i).IsNil() && field.Type.Elem().Kind() == reflect.Bool {
+					v.Add(tag, strconv.FormatBool(rValue.Field(i).Elem().Bool()))
+				}
 			} else if field.Type.Kind() == reflect.Slice {
 				fieldValue := rValue.Field(i).Interface().([]string)
 				for _, va := range fieldValue {
@@ -141,6 +157,7 @@ func setup(t *testing.T) {
 	require.NoError(t, err, "Could not create Opengist home directory")
 
 	git.ReposDirectory = path.Join("tests")
+	git.TrashDirectory = path.Join("tests-trash")
 
 	config.C.IndexEnabled = false
 	config.C.LogLevel = "debug"
@@ -174,6 +191,9 @@ func teardown(t *testing.T, s *testServer) {
 	err = os.RemoveAll(path.Join(config.GetHomeDir(), "tests"))
 	require.NoError(t, err, "Could not remove repos directory")
 
+	err = os.RemoveAll(path.Join(config.GetHomeDir(), "tests-trash"))
+	require.NoError(t, err, "Could not remove trash directory")
+
 	err = os.RemoveAll(path.Join(config.GetHomeDir(), "tmp", "repos"))
 	require.NoError(t, err, "Could not remove repos directory")
 
@@ -0,0 +1,868 @@
+package test
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thomiceli/opengist/internal/config"
+	"github.com/thomiceli/opengist/internal/db"
+	"github.com/thomiceli/opengist/internal/git"
+	"github.com/thomiceli/opengist/internal/importer"
+	"github.com/thomiceli/opengist/internal/mailer"
+)
+
+func TestRenameUser(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	for _, title := range []string{"gist1", "gist2"} {
+		gist := db.GistDTO{
+			Title: title,
+			VisibilityDTO: db.VisibilityDTO{
+				Private: db.PublicVisibility,
+			},
+			Name:    []string{"file.txt"},
+			Content: []string{title},
+		}
+		err = s.request("POST", "/", gist, 302)
+		require.NoError(t, err)
+	}
+
+	s.sessionCookie = ""
+	user2 := db.UserDTO{Username: "kaguya", Password: "kaguya"}
+	register(t, s, user2)
+
+	user1db, err := db.GetUserByUsername("thomas")
+	require.NoError(t, err)
+
+	err = user1db.Rename("Kaguya")
+	require.ErrorIs(t, err, db.ErrUsernameExists)
+	require.Equal(t, "thomas", user1db.Username)
+
+	err = user1db.Rename("not valid")
+	require.Error(t, err)
+
+	err = user1db.Rename("thomas2")
+	require.NoError(t, err)
+
+	_, err = db.GetUserByUsername("thomas")
+	require.Error(t, err)
+
+	for _, id := range []string{"1", "2"} {
+		gistdb, err := db.GetGistByID(id)
+		require.NoError(t, err)
+		require.Equal(t, "thomas2", gistdb.User.Username)
+
+		err = s.request("GET", "/thomas2/"+gistdb.Uuid, nil, 200)
+		require.NoError(t, err)
+
+		content, _, err := git.GetFileContent(gistdb.Uuid, "HEAD", "file.txt", false)
+		require.NoError(t, err)
+		require.Equal(t, gistdb.Title, content)
+	}
+}
+
+func TestDeleteUserWithGists(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	gist1 := db.GistDTO{
+		Title: "gist1",
+		VisibilityDTO: db.VisibilityDTO{
+			Private: db.PublicVisibility,
+		},
+		Name:    []string{"file.txt"},
+		Content: []string{"gist1"},
+	}
+	err = s.request("POST", "/", gist1, 302)
+	require.NoError(t, err)
+
+	s.sessionCookie = ""
+	user2 := db.UserDTO{Username: "kaguya", Password: "kaguya"}
+	register(t, s, user2)
+
+	err = s.request("POST", "/", gist1, 302)
+	require.NoError(t, err)
+
+	gist1db, err := db.GetGistByID("1")
+	require.NoError(t, err)
+	err = s.request("POST", "/"+gist1db.User.Username+"/"+gist1db.Uuid+"/fork", nil, 302)
+	require.NoError(t, err)
+
+	gist1db, err = db.GetGistByID("1")
+	require.NoError(t, err)
+	require.Equal(t, 1, gist1db.NbForks)
+
+	gist2db, err := db.GetGistByID("2")
+	require.NoError(t, err)
+	gist3db, err := db.GetGistByID("3")
+	require.NoError(t, err)
+	require.DirExists(t, git.RepositoryPath(gist2db.Uuid))
+	require.DirExists(t, git.RepositoryPath(gist3db.Uuid))
+
+	err = s.request("DELETE", "/settings/account", nil, 302)
+	require.NoError(t, err)
+
+	count, err := db.CountAll(db.Gist{})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), count)
+	require.NoDirExists(t, git.RepositoryPath(gist2db.Uuid))
+	require.NoDirExists(t, git.RepositoryPath(gist3db.Uuid))
+	require.DirExists(t, git.RepositoryPath(gist1db.Uuid))
+
+	gist1db, err = db.GetGistByID("1")
+	require.NoError(t, err)
+	require.Equal(t, 0, gist1db.NbForks)
+
+	_, err = db.GetUserByUsername(user2.Username)
+	require.Error(t, err)
+}
+
+func TestAdminUsers(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+	user2 := db.UserDTO{Username: "kaguya", Password: "kaguya"}
+	register(t, s, user2)
+
+	user2db, err := db.GetUserByUsername("kaguya")
+	require.NoError(t, err)
+	user2Url := "/admin-panel/users/" + strconv.Itoa(int(user2db.ID))
+
+	err = s.request("POST", user2Url+"/suspend", nil, 404)
+	require.NoError(t, err)
+
+	login(t, s, user1)
+
+	users, total, err := db.GetAllUsers(firstPage, "kag")
+	require.NoError(t, err)
+	require.Equal(t, int64(1), total)
+	require.Equal(t, "kaguya", users[0].Username)
+
+	// the wildcards of the query are matched as is
+	for _, query := range []string{"%", "k_guya"} {
+		_, total, err = db.GetAllUsers(firstPage, query)
+		require.NoError(t, err)
+		require.Equal(t, int64(0), total, query)
+	}
+
+	res, err := s.requestWithResponse("GET", "/admin-panel/users?q=kag", nil, 200)
+	require.NoError(t, err)
+	require.Contains(t, res.Body.String(), "/kaguya")
+
+	// admins cannot change their own account
+	err = s.request("POST", "/admin-panel/users/1/admin", nil, 302)
+	require.NoError(t, err)
+	user1db, err := db.GetUserByUsername("thomas")
+	require.NoError(t, err)
+	require.True(t, user1db.IsAdmin)
+
+	err = s.request("POST", user2Url+"/admin", nil, 302)
+	require.NoError(t, err)
+	user2db, err = db.GetUserByUsername("kaguya")
+	require.NoError(t, err)
+	require.True(t, user2db.IsAdmin)
+
+	err = s.request("POST", user2Url+"/admin", nil, 302)
+	require.NoError(t, err)
+	user2db, err = db.GetUserByUsername("kaguya")
+	require.NoError(t, err)
+	require.False(t, user2db.IsAdmin)
+
+	user2Token := &db.Token{Name: "read", Scopes: db.ScopeGistRead, UserID: user2db.ID}
+	user2Plain, err := user2Token.Create()
+	require.NoError(t, err)
+
+	// the open session of a suspended user is closed
+	login(t, s, user2)
+	err = user2db.SetSuspended(true)
+	require.NoError(t, err)
+	err = s.request("GET", "/settings", nil, 302)
+	require.NoError(t, err)
+	err = user2db.SetSuspended(false)
+	require.NoError(t, err)
+	err = s.request("GET", "/settings", nil, 302)
+	require.NoError(t, err)
+
+	login(t, s, user1)
+	err = s.request("POST", user2Url+"/suspend", nil, 302)
+	require.NoError(t, err)
+	user2db, err = db.GetUserByUsername("kaguya")
+	require.NoError(t, err)
+	require.True(t, user2db.Suspended)
+
+	// the login of a suspended user does not open a session
+	res, _ = s.requestWithResponse("POST", "/login", user2, 302)
+	require.Equal(t, "/login", res.Header().Get("Location"))
+
+	s.sessionCookie = ""
+	s.bearerToken = user2Plain
+	err = s.request("GET", "/all", nil, 403)
+	require.NoError(t, err)
+	s.bearerToken = ""
+
+	login(t, s, user1)
+	err = s.request("POST", user2Url+"/suspend", nil, 302)
+	require.NoError(t, err)
+
+	login(t, s, user2)
+	err = s.request("GET", "/settings", nil, 200)
+	require.NoError(t, err)
+}
+
+func TestAccessToken(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	gist := db.GistDTO{
+		Title: "gist1",
+		VisibilityDTO: db.VisibilityDTO{
+			Private: db.PrivateVisibility,
+		},
+		Name:    []string{"file.txt"},
+		Content: []string{"hello"},
+	}
+	err = s.request("POST", "/", gist, 302)
+	require.NoError(t, err)
+
+	gist1db, err := db.GetGistByID("1")
+	require.NoError(t, err)
+
+	user1db, err := db.GetUserByUsername("thomas")
+	require.NoError(t, err)
+
+	readToken := &db.Token{Name: "read", Scopes: db.ScopeGistRead, UserID: user1db.ID}
+	readPlain, err := readToken.Create()
+	require.NoError(t, err)
+	require.NotEqual(t, readPlain, readToken.Hash)
+
+	s.sessionCookie = ""
+
+	s.bearerToken = "og_invalid"
+	err = s.request("GET", "/thomas/"+gist1db.Uuid, nil, 401)
+	require.NoError(t, err)
+
+	s.bearerToken = readPlain
+	err = s.request("GET", "/thomas/"+gist1db.Uuid, nil, 200)
+	require.NoError(t, err)
+
+	readTokendb, err := db.GetTokenByID(readToken.ID)
+	require.NoError(t, err)
+	require.NotZero(t, readTokendb.LastUsedAt)
+
+	err = s.request("POST", "/thomas/"+gist1db.Uuid+"/delete", nil, 403)
+	require.NoError(t, err)
+
+	err = s.request("GET", "/settings", nil, 403)
+	require.NoError(t, err)
+
+	deleteToken := &db.Token{Name: "delete", Scopes: db.ScopeGistRead + "," + db.ScopeGistDelete, UserID: user1db.ID}
+	deletePlain, err := deleteToken.Create()
+	require.NoError(t, err)
+
+	s.bearerToken = deletePlain
+	err = s.request("POST", "/thomas/"+gist1db.Uuid+"/delete", nil, 302)
+	require.NoError(t, err)
+
+	_, err = db.GetGistByID("1")
+	require.Error(t, err)
+
+	err = readToken.Delete()
+	require.NoError(t, err)
+
+	s.bearerToken = readPlain
+	err = s.request("GET", "/all", nil, 401)
+	require.NoError(t, err)
+
+	expiredToken := &db.Token{Name: "expired", Scopes: db.ScopeGistRead, UserID: user1db.ID, ExpiresAt: time.Now().Add(-time.Minute).Unix()}
+	expiredPlain, err := expiredToken.Create()
+	require.NoError(t, err)
+
+	s.bearerToken = expiredPlain
+	err = s.request("GET", "/all", nil, 401)
+	require.NoError(t, err)
+
+	// the admin panel needs the admin scope
+	s.bearerToken = deletePlain
+	err = s.request("GET", "/admin-panel/users", nil, 403)
+	require.NoError(t, err)
+
+	adminToken := &db.Token{Name: "admin", Scopes: db.ScopeAdmin, UserID: user1db.ID}
+	adminPlain, err := adminToken.Create()
+	require.NoError(t, err)
+
+	s.bearerToken = adminPlain
+	err = s.request("GET", "/admin-panel/users", nil, 200)
+	require.NoError(t, err)
+
+	s.bearerToken = ""
+}
+
+type tokenForm struct {
+	Name       string   `form:"name"`
+	Scopes     []string `form:"scopes"`
+	Expiration int      `form:"expiration"`
+}
+
+func TestAccessTokenCreate(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	register(t, s, db.UserDTO{Username: "thomas", Password: "thomas"})
+
+	err = s.request("POST", "/settings/tokens", tokenForm{Name: "read", Scopes: []string{db.ScopeGistRead}, Expiration: 7}, 302)
+	require.NoError(t, err)
+	err = s.request("POST", "/settings/tokens", tokenForm{Name: "admin", Scopes: []string{db.ScopeAdmin}, Expiration: 0}, 302)
+	require.NoError(t, err)
+	err = s.request("POST", "/settings/tokens", tokenForm{Name: "odd", Scopes: []string{db.ScopeGistRead}, Expiration: 3}, 302)
+	require.NoError(t, err)
+
+	tokens, err := db.GetTokensByUserID(1)
+	require.NoError(t, err)
+	require.Len(t, tokens, 2)
+	require.InDelta(t, time.Now().AddDate(0, 0, 7).Unix(), tokens[0].ExpiresAt, 5)
+	require.Zero(t, tokens[1].ExpiresAt)
+
+	// only the admins can grant the admin scope
+	s.sessionCookie = ""
+	register(t, s, db.UserDTO{Username: "kaguya", Password: "kaguya"})
+	err = s.request("POST", "/settings/tokens", tokenForm{Name: "admin", Scopes: []string{db.ScopeAdmin}}, 302)
+	require.NoError(t, err)
+
+	tokens, err = db.GetTokensByUserID(2)
+	require.NoError(t, err)
+	require.Empty(t, tokens)
+}
+
+type appTokens struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+func TestAppSessions(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	gist := db.GistDTO{
+		Title: "gist1",
+		VisibilityDTO: db.VisibilityDTO{
+			Private: db.PrivateVisibility,
+		},
+		Name:    []string{"file.txt"},
+		Content: []string{"hello"},
+	}
+	err = s.request("POST", "/", gist, 302)
+	require.NoError(t, err)
+
+	gist1db, err := db.GetGistByID("1")
+	require.NoError(t, err)
+	gistUrl := "/thomas/" + gist1db.Identifier()
+
+	apiRequest := func(method, uri, body, bearer string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://localhost:6157"+uri, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		w := httptest.NewRecorder()
+		s.server.ServeHTTP(w, req)
+		return w
+	}
+	decode := func(res *httptest.ResponseRecorder) appTokens {
+		require.Equal(t, 200, res.Code, res.Body.String())
+		var tokens appTokens
+		require.NoError(t, json.Unmarshal(res.Body.Bytes(), &tokens))
+		require.Equal(t, "Bearer", tokens.TokenType)
+		require.Equal(t, 15*60, tokens.ExpiresIn)
+		require.NotEmpty(t, tokens.AccessToken)
+		require.NotEmpty(t, tokens.RefreshToken)
+		return tokens
+	}
+
+	res := apiRequest("POST", "/api/auth/login", `{"username":"thomas","password":"wrong"}`, "")
+	require.Equal(t, 401, res.Code)
+	res = apiRequest("POST", "/api/auth/login", `{"username":"thomas"}`, "")
+	require.Equal(t, 422, res.Code)
+
+	tokens := decode(apiRequest("POST", "/api/auth/login", `{"username":"thomas","password":"thomas","label":"my phone"}`, ""))
+
+	refreshTokens, err := db.GetRefreshTokensByUserID(1)
+	require.NoError(t, err)
+	require.Len(t, refreshTokens, 1)
+	require.Equal(t, "my phone", refreshTokens[0].Label)
+	require.NotEqual(t, tokens.RefreshToken, refreshTokens[0].Hash)
+
+	require.Equal(t, 200, apiRequest("GET", gistUrl, "", tokens.AccessToken).Code)
+	require.Equal(t, 200, apiRequest("GET", "/api/gists", "", tokens.AccessToken).Code)
+	require.Equal(t, 403, apiRequest("GET", "/settings", "", tokens.AccessToken).Code)
+	require.Equal(t, 401, apiRequest("GET", gistUrl, "", tokens.AccessToken+"x").Code)
+	require.Equal(t, 401, apiRequest("GET", gistUrl, "", "not.a.token").Code)
+
+	// a refresh token is used once, the access tokens stay valid as long as the session is
+	refreshed := decode(apiRequest("POST", "/api/auth/refresh", `{"refresh_token":"`+tokens.RefreshToken+`"}`, ""))
+	require.NotEqual(t, tokens.RefreshToken, refreshed.RefreshToken)
+	res = apiRequest("POST", "/api/auth/refresh", `{"refresh_token":"`+tokens.RefreshToken+`"}`, "")
+	require.Equal(t, 401, res.Code)
+	require.Equal(t, 200, apiRequest("GET", gistUrl, "", tokens.AccessToken).Code)
+	require.Equal(t, 200, apiRequest("GET", gistUrl, "", refreshed.AccessToken).Code)
+
+	res = apiRequest("POST", "/api/auth/revoke", `{"refresh_token":"`+refreshed.RefreshToken+`"}`, "")
+	require.Equal(t, 204, res.Code)
+	require.Equal(t, 401, apiRequest("GET", gistUrl, "", refreshed.AccessToken).Code)
+	require.Equal(t, 401, apiRequest("GET", gistUrl, "", tokens.AccessToken).Code)
+	res = apiRequest("POST", "/api/auth/refresh", `{"refresh_token":"`+refreshed.RefreshToken+`"}`, "")
+	require.Equal(t, 401, res.Code)
+
+	// sessions are listed and revoked from the settings, by their owner only
+	other := decode(apiRequest("POST", "/api/auth/login", `{"username":"thomas","password":"thomas","label":"my laptop"}`, ""))
+	res, err = s.requestWithResponse("GET", "/settings", nil, 200)
+	require.NoError(t, err)
+	require.Contains(t, res.Body.String(), "my laptop")
+	require.NotContains(t, res.Body.String(), "my phone")
+
+	refreshTokens, err = db.GetRefreshTokensByUserID(1)
+	require.NoError(t, err)
+	require.Len(t, refreshTokens, 1)
+	sessionUrl := "/settings/app-sessions/" + strconv.Itoa(int(refreshTokens[0].ID))
+
+	user2 := db.UserDTO{Username: "kaguya", Password: "kaguya"}
+	register(t, s, user2)
+	err = s.request("DELETE", sessionUrl, nil, 302)
+	require.NoError(t, err)
+	require.Equal(t, 200, apiRequest("GET", gistUrl, "", other.AccessToken).Code)
+
+	login(t, s, user1)
+	err = s.request("DELETE", sessionUrl, nil, 302)
+	require.NoError(t, err)
+	require.Equal(t, 401, apiRequest("GET", gistUrl, "", other.AccessToken).Code)
+
+	// the sessions of a deleted user stop working
+	deleted := decode(apiRequest("POST", "/api/auth/login", `{"username":"kaguya","password":"kaguya"}`, ""))
+	user2db, err := db.GetUserByUsername("kaguya")
+	require.NoError(t, err)
+	require.NoError(t, user2db.Delete())
+	require.Equal(t, 401, apiRequest("GET", "/api/gists", "", deleted.AccessToken).Code)
+	res = apiRequest("POST", "/api/auth/refresh", `{"refresh_token":"`+deleted.RefreshToken+`"}`, "")
+	require.Equal(t, 401, res.Code)
+	refreshTokens, err = db.GetRefreshTokensByUserID(user2db.ID)
+	require.NoError(t, err)
+	require.Len(t, refreshTokens, 0)
+}
+
+func TestExportGists(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user2 := db.UserDTO{Username: "kaguya", Password: "kaguya"}
+	register(t, s, user2)
+
+	gist1 := db.GistDTO{
+		Title: "other gist",
+		VisibilityDTO: db.VisibilityDTO{
+			Private: db.PublicVisibility,
+		},
+		Name:    []string{"other.txt"},
+		Content: []string{"not mine"},
+	}
+	err = s.request("POST", "/", gist1, 302)
+	require.NoError(t, err)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	gist1.Title = "public gist"
+	gist1.Name = []string{"file1.txt", "file2.txt"}
+	gist1.Content = []string{"one", "two"}
+	err = s.request("POST", "/", gist1, 302)
+	require.NoError(t, err)
+
+	gist1.Title = "private gist"
+	gist1.Private = db.PrivateVisibility
+	gist1.Name = []string{"secret.txt"}
+	gist1.Content = []string{"secret"}
+	err = s.request("POST", "/", gist1, 302)
+	require.NoError(t, err)
+
+	publicdb, err := db.GetGistByID("2")
+	require.NoError(t, err)
+	privatedb, err := db.GetGistByID("3")
+	require.NoError(t, err)
+
+	res, err := s.requestWithResponse("GET", "/settings/export", nil, 200)
+	require.NoError(t, err)
+	require.Equal(t, "application/zip", res.Header().Get("Content-Type"))
+
+	archive, err := zip.NewReader(bytes.NewReader(res.Body.Bytes()), int64(res.Body.Len()))
+	require.NoError(t, err)
+
+	contents := make(map[string]string)
+	for _, f := range archive.File {
+		rc, err := f.Open()
+		require.NoError(t, err)
+		content, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		_ = rc.Close()
+		contents[f.Name] = string(content)
+	}
+
+	require.Len(t, contents, 4)
+	require.Equal(t, "one", contents[publicdb.Uuid+"/file1.txt"])
+	require.Equal(t, "two", contents[publicdb.Uuid+"/file2.txt"])
+	require.Equal(t, "secret", contents[privatedb.Uuid+"/secret.txt"])
+
+	var manifest []db.ExportedGist
+	err = json.Unmarshal([]byte(contents["gists.json"]), &manifest)
+	require.NoError(t, err)
+	require.Len(t, manifest, 2)
+	require.Equal(t, "public gist", manifest[0].Title)
+	require.Equal(t, []string{"file1.txt", "file2.txt"}, manifest[0].Files)
+	require.Equal(t, "private", manifest[1].Visibility)
+}
+
+func TestUserLocale(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	res, err := s.requestWithResponse("GET", "/all", nil, 200)
+	require.NoError(t, err)
+	require.Contains(t, res.Body.String(), `<html lang="en-US"`)
+
+	err = s.request("GET", "/all?lang=fr-FR", nil, 200)
+	require.NoError(t, err)
+
+	user1db, err := db.GetUserByUsername("thomas")
+	require.NoError(t, err)
+	require.Equal(t, "fr-FR", user1db.Locale)
+
+	// the test client does not keep the lang cookie, the preference comes from the user
+	res, err = s.requestWithResponse("GET", "/all", nil, 200)
+	require.NoError(t, err)
+	require.Contains(t, res.Body.String(), `<html lang="fr-FR"`)
+	require.Contains(t, res.Body.String(), "Déconnexion")
+
+	err = s.request("GET", "/all?lang=xx-XX", nil, 200)
+	require.NoError(t, err)
+	user1db, err = db.GetUserByUsername("thomas")
+	require.NoError(t, err)
+	require.Equal(t, "fr-FR", user1db.Locale, "Unknown languages should be ignored")
+
+	s.sessionCookie = ""
+	res, err = s.requestWithResponse("GET", "/all", nil, 200)
+	require.NoError(t, err)
+	require.Contains(t, res.Body.String(), `<html lang="en-US"`)
+}
+
+// gistWithoutVisibility is a creation form leaving the visibility to the default of the author
+type gistWithoutVisibility struct {
+	Title   string   `form:"title"`
+	Name    []string `form:"name"`
+	Content []string `form:"content"`
+}
+
+func TestDefaultVisibility(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	register(t, s, db.UserDTO{Username: "thomas", Password: "thomas"})
+
+	config.C.GistDefaultVisibility = "unlisted"
+	defer func() { config.C.GistDefaultVisibility = "public" }()
+
+	createGist := func(id string) *db.Gist {
+		err := s.request("POST", "/", gistWithoutVisibility{Title: "gist" + id, Name: []string{"file.txt"}, Content: []string{"hello"}}, 302)
+		require.NoError(t, err)
+		gist, err := db.GetGistByID(id)
+		require.NoError(t, err)
+		return gist
+	}
+
+	// without a preference, the instance default applies
+	res, err := s.requestWithResponse("GET", "/", nil, 200)
+	require.NoError(t, err)
+	require.Contains(t, res.Body.String(), `name="private" value="1"`)
+	require.Equal(t, db.UnlistedVisibility, createGist("1").Private)
+
+	err = s.request("PUT", "/settings/visibility", struct {
+		Visibility string `form:"visibility"`
+	}{"private"}, 302)
+	require.NoError(t, err)
+
+	user, err := db.GetUserByUsername("thomas")
+	require.NoError(t, err)
+	require.Equal(t, "private", user.DefaultVisibility)
+
+	res, err = s.requestWithResponse("GET", "/", nil, 200)
+	require.NoError(t, err)
+	require.Contains(t, res.Body.String(), `name="private" value="2" data-visibility-default="2"`)
+	require.Equal(t, db.PrivateVisibility, createGist("2").Private)
+
+	// a visibility picked in the form wins over the preference
+	err = s.request("POST", "/", db.GistDTO{
+		Title:         "gist3",
+		VisibilityDTO: db.VisibilityDTO{Private: db.PublicVisibility},
+		Name:          []string{"file.txt"},
+		Content:       []string{"hello"},
+	}, 302)
+	require.NoError(t, err)
+	gist3, err := db.GetGistByID("3")
+	require.NoError(t, err)
+	require.Equal(t, db.PublicVisibility, gist3.Private)
+
+	err = s.request("PUT", "/settings/visibility", struct {
+		Visibility string `form:"visibility"`
+	}{"secret"}, 400)
+	require.NoError(t, err)
+
+	err = s.request("PUT", "/settings/visibility", struct {
+		Visibility string `form:"visibility"`
+	}{""}, 302)
+	require.NoError(t, err)
+	require.Equal(t, db.UnlistedVisibility, createGist("4").Private)
+}
+
+type githubImport struct {
+	Username string `form:"github_username"`
+	Token    string `form:"github_token"`
+}
+
+func TestImportGithubGists(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	var githubUrl string
+	githubGist := func(id string, public bool, files ...string) map[string]interface{} {
+		githubFiles := make(map[string]interface{})
+		for _, file := range files {
+			githubFiles[file] = map[string]string{"filename": file, "raw_url": githubUrl + "/raw/" + id + "/" + file}
+		}
+		return map[string]interface{}{
+			"id":          id,
+			"description": "gist " + id,
+			"public":      public,
+			"created_at":  "2020-01-02T03:04:05Z",
+			"files":       githubFiles,
+		}
+	}
+
+	github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/users/octocat/gists":
+			_ = json.NewEncoder(w).Encode([]interface{}{
+				githubGist("aaa", true, "b.txt", "a.txt"),
+			})
+		case r.URL.Path == "/gists" && r.Header.Get("Authorization") == "Bearer secret":
+			_ = json.NewEncoder(w).Encode([]interface{}{
+				githubGist("aaa", true, "b.txt", "a.txt"),
+				githubGist("bbb", false, "secret.md"),
+				githubGist("ccc", true, "missing.txt"),
+			})
+		case strings.HasPrefix(r.URL.Path, "/raw/") && !strings.HasSuffix(r.URL.Path, "missing.txt"):
+			_, _ = w.Write([]byte("content of " + r.URL.Path))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer github.Close()
+	githubUrl = github.URL
+
+	previousUrl := importer.GithubAPIURL
+	importer.GithubAPIURL = github.URL
+	defer func() { importer.GithubAPIURL = previousUrl }()
+
+	register(t, s, db.UserDTO{Username: "thomas", Password: "thomas"})
+
+	err = s.request("POST", "/settings/import-github", githubImport{}, 302)
+	require.NoError(t, err)
+	err = s.request("POST", "/settings/import-github", githubImport{Username: "nobody"}, 302)
+	require.NoError(t, err)
+	_, err = db.GetGistByID("1")
+	require.Error(t, err, "Nothing should be imported without a valid user")
+
+	err = s.request("POST", "/settings/import-github", githubImport{Username: "octocat"}, 302)
+	require.NoError(t, err)
+
+	gist1db, err := db.GetGistByID("1")
+	require.NoError(t, err)
+	require.Equal(t, "a.txt", gist1db.Title)
+	require.Equal(t, "gist aaa", gist1db.Description)
+	require.Equal(t, db.PublicVisibility, gist1db.Private)
+	require.Equal(t, int64(1577934245), gist1db.CreatedAt)
+	require.Equal(t, 2, gist1db.NbFiles)
+
+	files, err := gist1db.Files("HEAD", false)
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	require.Equal(t, "a.txt", files[0].Filename)
+	require.Equal(t, "content of /raw/aaa/a.txt", files[0].Content)
+
+	err = s.request("POST", "/settings/import-github", githubImport{Token: "secret"}, 302)
+	require.NoError(t, err)
+
+	gist3db, err := db.GetGistByID("3")
+	require.NoError(t, err)
+	require.Equal(t, "secret.md", gist3db.Title)
+	require.Equal(t, db.UnlistedVisibility, gist3db.Private, "Secret gists should be unlisted")
+
+	_, err = db.GetGistByID("4")
+	require.Error(t, err, "A gist whose files cannot be fetched should be skipped")
+}
+
+// recordingMailer keeps the messages instead of sending them
+type recordingMailer struct {
+	messages []*mailer.Message
+}
+
+func (m *recordingMailer) Send(msg *mailer.Message) error {
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+func TestEmailVerification(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	mails := new(recordingMailer)
+	mailer.SetMailer(mails)
+	config.C.EmailVerification = true
+	config.C.EmailRestrictPublic = true
+	defer func() {
+		mailer.SetMailer(nil)
+		config.C.EmailVerification = false
+		config.C.EmailRestrictPublic = false
+	}()
+
+	// an email is needed to register
+	res, _ := s.requestWithResponse("POST", "/register", db.UserDTO{Username: "thomas", Password: "thomas"}, 200)
+	require.Equal(t, 200, res.Code)
+	exists, err := db.UserExists("thomas")
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	register(t, s, db.UserDTO{Username: "thomas", Password: "thomas", Email: "Thomas@Example.com"})
+	user, err := db.GetUserByUsername("thomas")
+	require.NoError(t, err)
+	require.Equal(t, "thomas@example.com", user.Email)
+	require.False(t, user.EmailVerified)
+	require.Len(t, mails.messages, 1)
+	require.Equal(t, "thomas@example.com", mails.messages[0].To)
+
+	// public gists are refused until the email is verified, the default visibility falls back to unlisted
+	publicGist := db.GistDTO{
+		Title:         "gist1",
+		VisibilityDTO: db.VisibilityDTO{Private: db.PublicVisibility},
+		Name:          []string{"file.txt"},
+		Content:       []string{"hello"},
+	}
+	err = s.request("POST", "/", publicGist, 200)
+	require.NoError(t, err)
+	_, err = db.GetGistByID("1")
+	require.Error(t, err)
+
+	err = s.request("POST", "/", gistWithoutVisibility{Title: "gist1", Name: []string{"file.txt"}, Content: []string{"hello"}}, 302)
+	require.NoError(t, err)
+	gist1, err := db.GetGistByID("1")
+	require.NoError(t, err)
+	require.Equal(t, db.UnlistedVisibility, gist1.Private)
+
+	err = s.request("POST", "/thomas/"+gist1.Uuid+"/visibility", db.VisibilityDTO{Private: db.PublicVisibility}, 302)
+	require.NoError(t, err)
+	gist1, err = db.GetGistByID("1")
+	require.NoError(t, err)
+	require.Equal(t, db.UnlistedVisibility, gist1.Private)
+
+	matches := regexp.MustCompile(`/verify-email\?token=(\S+)`).FindStringSubmatch(mails.messages[0].Body)
+	require.Len(t, matches, 2)
+	token, err := url.QueryUnescape(matches[1])
+	require.NoError(t, err)
+
+	err = s.request("GET", "/verify-email?token=invalid", nil, 302)
+	require.NoError(t, err)
+	user, err = db.GetUserByUsername("thomas")
+	require.NoError(t, err)
+	require.False(t, user.EmailVerified)
+
+	err = s.request("GET", "/verify-email?token="+url.QueryEscape(token), nil, 302)
+	require.NoError(t, err)
+	user, err = db.GetUserByUsername("thomas")
+	require.NoError(t, err)
+	require.True(t, user.EmailVerified)
+
+	err = s.request("POST", "/", publicGist, 302)
+	require.NoError(t, err)
+	gist2, err := db.GetGistByID("2")
+	require.NoError(t, err)
+	require.Equal(t, db.PublicVisibility, gist2.Private)
+
+	// changing the email needs a new verification, the previous link does not verify the new email
+	err = s.request("POST", "/settings/email", struct {
+		Email string `form:"email"`
+	}{"kaguya@example.com"}, 302)
+	require.NoError(t, err)
+	user, err = db.GetUserByUsername("thomas")
+	require.NoError(t, err)
+	require.False(t, user.EmailVerified)
+	require.Len(t, mails.messages, 2)
+
+	err = s.request("GET", "/verify-email?token="+url.QueryEscape(token), nil, 302)
+	require.NoError(t, err)
+	user, err = db.GetUserByUsername("thomas")
+	require.NoError(t, err)
+	require.False(t, user.EmailVerified)
+
+	err = s.request("POST", "/settings/email/verify", nil, 302)
+	require.NoError(t, err)
+	require.Len(t, mails.messages, 3)
+	require.Equal(t, "kaguya@example.com", mails.messages[2].To)
+}
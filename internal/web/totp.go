@@ -0,0 +1,212 @@
+package web
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"image/png"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"github.com/rs/zerolog/log"
+	"github.com/thomiceli/opengist/internal/db"
+	appmetrics "github.com/thomiceli/opengist/internal/metrics"
+	"gorm.io/gorm"
+)
+
+// startSession logs the user in, unless they have enabled TOTP or registered a passkey: the session then waits for
+// the second factor and the user is sent to its form. Suspended users are sent back to the login form.
+func startSession(ctx echo.Context, user *db.User) error {
+	if user.Suspended {
+		log.Warn().Msg("Login attempt of the suspended user " + user.Username + " from " + ctx.RealIP())
+		addFlash(ctx, tr(ctx, "flash.auth.account-suspended"), "error")
+		return redirect(ctx, "/login")
+	}
+
+	hasTotp, err := db.UserHasTOTP(user.ID)
+	if err != nil {
+		return errorRes(500, "Cannot check for TOTP", err)
+	}
+	hasWebAuthn, err := db.UserHasWebAuthn(user.ID)
+	if err != nil {
+		return errorRes(500, "Cannot check for passkeys", err)
+	}
+
+	sess := getSession(ctx)
+	if hasTotp || hasWebAuthn {
+		sess.Values["mfaUser"] = user.ID
+		saveSession(sess, ctx)
+		return redirect(ctx, "/mfa")
+	}
+
+	sess.Values["user"] = user.ID
+	saveSession(sess, ctx)
+	deleteCsrfCookie(ctx)
+	return redirect(ctx, "/")
+}
+
+func mfa(ctx echo.Context) error {
+	userId, ok := getSession(ctx).Values["mfaUser"].(uint)
+	if !ok {
+		return redirect(ctx, "/login")
+	}
+
+	hasTotp, err := db.UserHasTOTP(userId)
+	if err != nil {
+		return errorRes(500, "Cannot check for TOTP", err)
+	}
+	hasWebAuthn, err := db.UserHasWebAuthn(userId)
+	if err != nil {
+		return errorRes(500, "Cannot check for passkeys", err)
+	}
+
+	setData(ctx, "hasTotp", hasTotp)
+	setData(ctx, "hasWebAuthn", hasWebAuthn)
+	setData(ctx, "htmlTitle", trH(ctx, "auth.mfa"))
+	return html(ctx, "auth_mfa.html")
+}
+
+func processMfa(ctx echo.Context) error {
+	sess := getSession(ctx)
+	userId, ok := sess.Values["mfaUser"].(uint)
+	if !ok {
+		return redirect(ctx, "/login")
+	}
+
+	// the users with passkeys only have no passcode to give
+	valid := false
+	userTotp, err := db.GetTOTPByUserID(userId)
+	if err == nil {
+		if valid, err = userTotp.Verify(ctx.FormValue("passcode")); err != nil {
+			return errorRes(500, "Cannot verify passcode", err)
+		}
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return errorRes(500, "Cannot get TOTP", err)
+	}
+
+	if !valid {
+		log.Warn().Msg("Invalid TOTP passcode from " + ctx.RealIP())
+		appmetrics.LoginFailures.Inc("totp")
+		addFlash(ctx, tr(ctx, "flash.auth.invalid-passcode"), "error")
+		return redirect(ctx, "/mfa")
+	}
+
+	delete(sess.Values, "mfaUser")
+	sess.Values["user"] = userId
+	sess.Options.MaxAge = 60 * 60 * 24 * 365 // 1 year
+	saveSession(sess, ctx)
+	deleteCsrfCookie(ctx)
+
+	return redirect(ctx, "/")
+}
+
+// checkPasscode asks for the passcode of the logged user before a sensitive action, if they have enabled TOTP. It
+// returns false when the passcode is wrong.
+func checkPasscode(ctx echo.Context) (bool, error) {
+	user := getUserLogged(ctx)
+	userTotp, err := db.GetTOTPByUserID(user.ID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return userTotp.Verify(ctx.FormValue("passcode"))
+}
+
+func totpGenerate(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+	if hasTotp, err := db.UserHasTOTP(user.ID); err != nil {
+		return errorRes(500, "Cannot check for TOTP", err)
+	} else if hasTotp {
+		return redirect(ctx, "/settings")
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: "Opengist", AccountName: user.Username})
+	if err != nil {
+		return errorRes(500, "Cannot generate TOTP secret", err)
+	}
+
+	// the secret is only stored once the user proved their app generates the right codes
+	sess := getSession(ctx)
+	sess.Values["totpKey"] = key.String()
+	saveSession(sess, ctx)
+
+	return totpEnrollment(ctx, key)
+}
+
+func totpGenerateProcess(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+	sess := getSession(ctx)
+	keyUrl, ok := sess.Values["totpKey"].(string)
+	if !ok {
+		return redirect(ctx, "/settings/totp/generate")
+	}
+	key, err := otp.NewKeyFromURL(keyUrl)
+	if err != nil {
+		return errorRes(500, "Cannot read TOTP secret", err)
+	}
+
+	if !totp.Validate(ctx.FormValue("passcode"), key.Secret()) {
+		addFlash(ctx, tr(ctx, "flash.auth.invalid-passcode"), "error")
+		return totpEnrollment(ctx, key)
+	}
+
+	userTotp := &db.TOTP{UserID: user.ID, Secret: key.Secret()}
+	recoveryCodes, err := userTotp.Create()
+	if err != nil {
+		return errorRes(500, "Cannot enable TOTP", err)
+	}
+
+	delete(sess.Values, "totpKey")
+	saveSession(sess, ctx)
+
+	addFlash(ctx, tr(ctx, "flash.user.totp-enabled"), "success")
+	setData(ctx, "recoveryCodes", recoveryCodes)
+	setData(ctx, "htmlTitle", trH(ctx, "settings.totp"))
+	return html(ctx, "totp.html")
+}
+
+// totpEnrollment shows the QR code of the secret to scan with an authenticator app, with the form to check the first
+// passcode
+func totpEnrollment(ctx echo.Context, key *otp.Key) error {
+	image, err := key.Image(200, 200)
+	if err != nil {
+		return errorRes(500, "Cannot generate QR code", err)
+	}
+	var buf bytes.Buffer
+	if err = png.Encode(&buf, image); err != nil {
+		return errorRes(500, "Cannot encode QR code", err)
+	}
+
+	setData(ctx, "qrCode", template.URL("data:image/png;base64,"+base64.StdEncoding.EncodeToString(buf.Bytes())))
+	setData(ctx, "secret", key.Secret())
+	setData(ctx, "htmlTitle", trH(ctx, "settings.totp"))
+	return html(ctx, "totp.html")
+}
+
+func totpDelete(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+	userTotp, err := db.GetTOTPByUserID(user.ID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return redirect(ctx, "/settings")
+	} else if err != nil {
+		return errorRes(500, "Cannot get TOTP", err)
+	}
+
+	if valid, err := userTotp.Verify(ctx.FormValue("passcode")); err != nil {
+		return errorRes(500, "Cannot verify passcode", err)
+	} else if !valid {
+		addFlash(ctx, tr(ctx, "flash.auth.invalid-passcode"), "error")
+		return redirect(ctx, "/settings")
+	}
+
+	if err = userTotp.Delete(); err != nil {
+		return errorRes(500, "Cannot disable TOTP", err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.user.totp-disabled"), "success")
+	return redirect(ctx, "/settings")
+}
@@ -0,0 +1,77 @@
+package web
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/thomiceli/opengist/internal/db"
+	"gorm.io/gorm"
+)
+
+func trash(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+	page := getListPage(ctx)
+
+	gists, total, err := db.GetTrashedGistsFromUser(user.ID, page)
+	if err != nil {
+		return errorRes(500, "Error fetching trashed gists", err)
+	}
+
+	if err = paginateTotal(ctx, gists, total, page, "gists", "trash", 1); err != nil {
+		return errorRes(404, tr(ctx, "error.page-not-found"), nil)
+	}
+
+	setData(ctx, "htmlTitle", trH(ctx, "trash"))
+	return html(ctx, "trash.html")
+}
+
+func restoreGist(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+	gist, err := getTrashedGist(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	if err = gist.Restore(); err != nil {
+		return errorRes(500, "Error restoring this gist", err)
+	}
+	gist.AddInIndex()
+
+	if err = db.AddAuditLog(user, db.AuditGistRestored, gist, nil); err != nil {
+		return errorRes(500, "Error recording the audit log", err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.gist.restored"), "success")
+	return redirect(ctx, "/"+user.Username+"/"+gist.Identifier())
+}
+
+func purgeGist(ctx echo.Context) error {
+	gist, err := getTrashedGist(ctx, getUserLogged(ctx))
+	if err != nil {
+		return err
+	}
+
+	if err = gist.Purge(); err != nil {
+		return errorRes(500, "Error deleting this gist", err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.gist.purged"), "success")
+	return redirect(ctx, "/trash")
+}
+
+func getTrashedGist(ctx echo.Context, user *db.User) (*db.Gist, error) {
+	id, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		return nil, notFound("Gist not found")
+	}
+
+	gist, err := db.GetTrashedGistFromUser(user.ID, uint(id))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, notFound("Gist not found")
+	} else if err != nil {
+		return nil, errorRes(500, "Error fetching gist", err)
+	}
+
+	return gist, nil
+}
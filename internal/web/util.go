@@ -3,12 +3,14 @@ package web
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/gorilla/sessions"
 	"github.com/labstack/echo/v4"
 	"github.com/rs/zerolog/log"
 	"github.com/thomiceli/opengist/internal/config"
 	"github.com/thomiceli/opengist/internal/db"
 	"github.com/thomiceli/opengist/internal/i18n"
+	"github.com/thomiceli/opengist/internal/utils"
 	"golang.org/x/text/cases"
 	"golang.org/x/text/language"
 	"html/template"
@@ -67,6 +69,45 @@ func errorRes(code int, message string, err error) error {
 	return &echo.HTTPError{Code: code, Message: message, Internal: err}
 }
 
+// fieldErrors holds the message of each invalid field of a request, sent along the JSON error responses
+type fieldErrors map[string]string
+
+func (f fieldErrors) Error() string {
+	messages := make([]string, 0, len(f))
+	for field, message := range f {
+		messages = append(messages, field+": "+message)
+	}
+	return strings.Join(messages, " ; ")
+}
+
+// validationErrorRes is the 422 error of a request whose fields did not pass validation
+func validationErrorRes(ctx echo.Context, err error) error {
+	locale := getData(ctx, "locale").(*i18n.Locale)
+	return errorRes(422, utils.ValidationMessages(&err, locale), fieldErrors(utils.ValidationFieldMessages(err, locale)))
+}
+
+// wantsJSON reports whether errors should be sent as JSON rather than as an HTML page, which is the case for the API
+// routes and for clients asking for JSON
+func wantsJSON(ctx echo.Context) bool {
+	return strings.HasPrefix(ctx.Request().URL.Path, "/api/") ||
+		strings.Contains(ctx.Request().Header.Get("Accept"), "application/json")
+}
+
+// jsonErrorRes writes the error as {"error": {"code", "message"}}, with a "fields" object for validation errors
+func jsonErrorRes(ctx echo.Context, err *echo.HTTPError) error {
+	body := map[string]interface{}{
+		"code":    strings.ReplaceAll(strings.ToLower(http.StatusText(err.Code)), " ", "_"),
+		"message": fmt.Sprint(err.Message),
+	}
+
+	var fields fieldErrors
+	if errors.As(err.Internal, &fields) {
+		body["fields"] = fields
+	}
+
+	return ctx.JSON(err.Code, map[string]interface{}{"error": body})
+}
+
 func getUserLogged(ctx echo.Context) *db.User {
 	user := getData(ctx, "userLogged")
 	if user != nil {
@@ -127,6 +168,11 @@ func loadSettings(ctx echo.Context) error {
 		s = cases.Title(language.English).String(s)
 		setData(ctx, strings.ReplaceAll(s, " ", ""), value == "1")
 	}
+
+	// the config closes the signups whatever the admin panel settings are
+	if config.C.DisableSignup {
+		setData(ctx, "DisableSignup", true)
+	}
 	return nil
 }
 
@@ -144,16 +190,72 @@ func getPage(ctx echo.Context) int {
 	return pageInt
 }
 
+// getListPage returns the page of a listing asked in the query, holding the number of items set in the config
+func getListPage(ctx echo.Context) db.Page {
+	return db.Page{Number: max(getPage(ctx), 1), Size: config.C.PaginationPageSize}
+}
+
+// getTimeRange reads the since and until query parameters, Unix timestamps bounding the creation time of the listed
+// gists, or their update time if updated is set. It also returns them as URL parameters to keep across pages.
+func getTimeRange(ctx echo.Context, updated bool) (db.TimeRange, string, error) {
+	timeRange := db.TimeRange{Updated: updated}
+	urlParams := ""
+
+	for _, param := range []string{"since", "until"} {
+		value := ctx.QueryParam(param)
+		if value == "" {
+			continue
+		}
+		timestamp, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || timestamp < 0 {
+			return timeRange, "", fmt.Errorf("invalid %s parameter %q", param, value)
+		}
+		if param == "since" {
+			timeRange.Since = timestamp
+		} else {
+			timeRange.Until = timestamp
+		}
+		urlParams += "&" + param + "=" + value
+	}
+
+	if !timeRange.Valid() {
+		return timeRange, "", errors.New("since is after until")
+	}
+	return timeRange, urlParams, nil
+}
+
+// paginate exposes a page of data fetched with one more item than perPage, telling there is a next page. It is meant
+// for the listings that can't be counted cheaply, the others use paginateTotal.
 func paginate[T any](ctx echo.Context, data []*T, pageInt int, perPage int, templateDataName string, urlPage string, labels int, urlParams ...string) error {
 	lenData := len(data)
 	if lenData == 0 && pageInt != 1 {
 		return errors.New("page not found")
 	}
 
-	if lenData > perPage {
-		if lenData > 1 {
-			data = data[:lenData-1]
-		}
+	hasNext := lenData > perPage
+	if hasNext {
+		data = data[:perPage]
+	}
+
+	setPagination(ctx, pageInt, hasNext, urlPage, labels, urlParams...)
+	setData(ctx, templateDataName, data)
+	return nil
+}
+
+// paginateTotal exposes a page of data out of total items, with links to jump to the other pages
+func paginateTotal[T any](ctx echo.Context, data []*T, total int64, page db.Page, templateDataName string, urlPage string, labels int, urlParams ...string) error {
+	if len(data) == 0 && page.Number != 1 {
+		return errors.New("page not found")
+	}
+
+	setPagination(ctx, page.Number, int64(page.Number*page.Size) < total, urlPage, labels, urlParams...)
+	setTotalPages(ctx, page, total)
+	setData(ctx, templateDataName, data)
+	return nil
+}
+
+func setPagination(ctx echo.Context, pageInt int, hasNext bool, urlPage string, labels int, urlParams ...string) {
+	if hasNext {
 		setData(ctx, "nextPage", pageInt+1)
 	}
 	if pageInt > 1 {
@@ -174,8 +276,28 @@ func paginate[T any](ctx echo.Context, data []*T, pageInt int, perPage int, temp
 	}
 
 	setData(ctx, "urlPage", urlPage)
-	setData(ctx, templateDataName, data)
-	return nil
+}
+
+// setTotalPages exposes the current page, the number of pages needed to list total items and the pages to link to:
+// the first and the last ones, and the ones around the current page. A 0 stands for the pages left out in between.
+func setTotalPages(ctx echo.Context, page db.Page, total int64) {
+	totalPages := int((total + int64(page.Size) - 1) / int64(page.Size))
+	if totalPages < 1 {
+		totalPages = 1
+	}
+
+	pageLinks := make([]int, 0, 7)
+	for p := 1; p <= totalPages; p++ {
+		if p == 1 || p == totalPages || (p >= page.Number-2 && p <= page.Number+2) {
+			pageLinks = append(pageLinks, p)
+		} else if pageLinks[len(pageLinks)-1] != 0 {
+			pageLinks = append(pageLinks, 0)
+		}
+	}
+
+	setData(ctx, "currentPage", page.Number)
+	setData(ctx, "totalPages", totalPages)
+	setData(ctx, "pageLinks", pageLinks)
 }
 
 func trH(ctx echo.Context, key string, args ...any) template.HTML {
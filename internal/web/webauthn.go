@@ -0,0 +1,283 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/thomiceli/opengist/internal/config"
+	"github.com/thomiceli/opengist/internal/db"
+	appmetrics "github.com/thomiceli/opengist/internal/metrics"
+)
+
+var errNoWebAuthnCeremony = errors.New("no passkey ceremony was started in this session")
+
+// newWebAuthn returns the relying party of the ceremonies, the passkeys are bound to the host Opengist is reached at
+func newWebAuthn(ctx echo.Context) (*webauthn.WebAuthn, error) {
+	baseUrl, err := url.Parse(getData(ctx, "baseHttpUrl").(string))
+	if err != nil {
+		return nil, err
+	}
+
+	return webauthn.New(&webauthn.Config{
+		RPID:          baseUrl.Hostname(),
+		RPDisplayName: "Opengist",
+		RPOrigins:     []string{baseUrl.Scheme + "://" + baseUrl.Host},
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementPreferred,
+			UserVerification: protocol.VerificationPreferred,
+		},
+		Timeouts: webauthn.TimeoutsConfig{
+			Login:        webauthn.TimeoutConfig{Enforce: true},
+			Registration: webauthn.TimeoutConfig{Enforce: true},
+		},
+	})
+}
+
+// saveWebAuthnSession keeps the challenge of a ceremony in the session until the browser answers it
+func saveWebAuthnSession(ctx echo.Context, key string, data *webauthn.SessionData) error {
+	value, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	sess := getSession(ctx)
+	sess.Values[key] = string(value)
+	saveSession(sess, ctx)
+	return nil
+}
+
+// popWebAuthnSession returns the challenge of the ceremony and removes it from the session, so it can be answered once
+func popWebAuthnSession(ctx echo.Context, key string) (*webauthn.SessionData, error) {
+	sess := getSession(ctx)
+	value, ok := sess.Values[key].(string)
+	if !ok {
+		return nil, errNoWebAuthnCeremony
+	}
+	delete(sess.Values, key)
+	saveSession(sess, ctx)
+
+	data := new(webauthn.SessionData)
+	return data, json.Unmarshal([]byte(value), data)
+}
+
+func webauthnRegisterBegin(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+
+	dto := new(db.WebAuthnCredentialDTO)
+	if err := ctx.Bind(dto); err != nil {
+		return errorRes(400, tr(ctx, "error.cannot-bind-data"), err)
+	}
+	if err := ctx.Validate(dto); err != nil {
+		return validationErrorRes(ctx, err)
+	}
+
+	if ok, err := checkPasscode(ctx); err != nil {
+		return errorRes(500, "Cannot verify passcode", err)
+	} else if !ok {
+		return errorRes(401, tr(ctx, "flash.auth.invalid-passcode"), nil)
+	}
+
+	wa, err := newWebAuthn(ctx)
+	if err != nil {
+		return errorRes(500, "Cannot configure passkeys", err)
+	}
+	waUser, err := db.GetWebAuthnUser(user)
+	if err != nil {
+		return errorRes(500, "Cannot get passkeys", err)
+	}
+
+	exclusions := make([]protocol.CredentialDescriptor, len(waUser.Credentials))
+	for i, credential := range waUser.WebAuthnCredentials() {
+		exclusions[i] = credential.Descriptor()
+	}
+
+	creation, data, err := wa.BeginRegistration(waUser, webauthn.WithExclusions(exclusions))
+	if err != nil {
+		return errorRes(500, "Cannot begin passkey registration", err)
+	}
+	if err = saveWebAuthnSession(ctx, "webauthnRegistration", data); err != nil {
+		return errorRes(500, "Cannot save passkey registration", err)
+	}
+
+	return ctx.JSON(200, creation)
+}
+
+func webauthnRegisterFinish(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+
+	dto := new(db.WebAuthnCredentialDTO)
+	if err := ctx.Bind(dto); err != nil {
+		return errorRes(400, tr(ctx, "error.cannot-bind-data"), err)
+	}
+	if err := ctx.Validate(dto); err != nil {
+		return validationErrorRes(ctx, err)
+	}
+
+	data, err := popWebAuthnSession(ctx, "webauthnRegistration")
+	if err != nil {
+		return errorRes(400, tr(ctx, "error.passkey-ceremony-expired"), err)
+	}
+
+	wa, err := newWebAuthn(ctx)
+	if err != nil {
+		return errorRes(500, "Cannot configure passkeys", err)
+	}
+	waUser, err := db.GetWebAuthnUser(user)
+	if err != nil {
+		return errorRes(500, "Cannot get passkeys", err)
+	}
+
+	response, err := protocol.ParseCredentialCreationResponseBody(strings.NewReader(ctx.FormValue("credential")))
+	if err != nil {
+		return errorRes(400, tr(ctx, "error.invalid-passkey"), err)
+	}
+	credential, err := wa.CreateCredential(waUser, *data, response)
+	if err != nil {
+		return errorRes(400, tr(ctx, "error.invalid-passkey"), err)
+	}
+
+	if err = db.NewWebAuthnCredential(dto.Name, user.ID, credential).Create(); err != nil {
+		return errorRes(500, "Cannot create passkey", err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.user.passkey-added"), "success")
+	return ctx.JSON(200, map[string]string{"redirect": config.C.ExternalUrl + "/settings"})
+}
+
+func webauthnDelete(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+	credentialId, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		return redirect(ctx, "/settings")
+	}
+
+	credential, err := db.GetWebAuthnCredentialByID(uint(credentialId))
+	if err != nil || credential.UserID != user.ID {
+		return redirect(ctx, "/settings")
+	}
+
+	if err = credential.Delete(); err != nil {
+		return errorRes(500, "Cannot delete passkey", err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.user.passkey-deleted"), "success")
+	return redirect(ctx, "/settings")
+}
+
+// webauthnLoginBegin starts a passwordless login with a passkey, or asks for a passkey of the user as the second factor
+// of a password login
+func webauthnLoginBegin(ctx echo.Context) error {
+	wa, err := newWebAuthn(ctx)
+	if err != nil {
+		return errorRes(500, "Cannot configure passkeys", err)
+	}
+
+	var assertion *protocol.CredentialAssertion
+	var data *webauthn.SessionData
+	if userId, ok := getSession(ctx).Values["mfaUser"].(uint); ok {
+		waUser, err := getWebAuthnUserById(userId)
+		if err != nil {
+			return errorRes(500, "Cannot get passkeys", err)
+		}
+		if len(waUser.Credentials) == 0 {
+			return errorRes(400, tr(ctx, "error.invalid-passkey"), nil)
+		}
+		assertion, data, err = wa.BeginLogin(waUser)
+		if err != nil {
+			return errorRes(500, "Cannot begin passkey login", err)
+		}
+	} else {
+		if getData(ctx, "DisableLoginForm") == true {
+			return errorRes(403, tr(ctx, "error.login-disabled-form"), nil)
+		}
+		// without a password, the passkey has to check the user is themselves to count as two factors
+		assertion, data, err = wa.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+		if err != nil {
+			return errorRes(500, "Cannot begin passkey login", err)
+		}
+	}
+
+	if err = saveWebAuthnSession(ctx, "webauthnLogin", data); err != nil {
+		return errorRes(500, "Cannot save passkey login", err)
+	}
+
+	return ctx.JSON(200, assertion)
+}
+
+func webauthnLoginFinish(ctx echo.Context) error {
+	data, err := popWebAuthnSession(ctx, "webauthnLogin")
+	if err != nil {
+		return errorRes(400, tr(ctx, "error.passkey-ceremony-expired"), err)
+	}
+
+	wa, err := newWebAuthn(ctx)
+	if err != nil {
+		return errorRes(500, "Cannot configure passkeys", err)
+	}
+
+	response, err := protocol.ParseCredentialRequestResponseBody(strings.NewReader(ctx.FormValue("credential")))
+	if err != nil {
+		return errorRes(400, tr(ctx, "error.invalid-passkey"), err)
+	}
+
+	sess := getSession(ctx)
+	var waUser *db.WebAuthnUser
+	var credential *webauthn.Credential
+	if data.UserID != nil {
+		userId, ok := sess.Values["mfaUser"].(uint)
+		if !ok {
+			return errorRes(400, tr(ctx, "error.passkey-ceremony-expired"), nil)
+		}
+		if waUser, err = getWebAuthnUserById(userId); err != nil {
+			return errorRes(500, "Cannot get passkeys", err)
+		}
+		credential, err = wa.ValidateLogin(waUser, *data, response)
+	} else {
+		credential, err = wa.ValidateDiscoverableLogin(func(_, userHandle []byte) (webauthn.User, error) {
+			if waUser, err = db.GetWebAuthnUserByHandle(userHandle); err != nil {
+				return nil, err
+			}
+			return waUser, nil
+		}, *data, response)
+	}
+	if err != nil {
+		log.Warn().Err(err).Msg("Invalid passkey login attempt from " + ctx.RealIP())
+		appmetrics.LoginFailures.Inc("passkey")
+		return errorRes(401, tr(ctx, "error.invalid-passkey"), nil)
+	}
+	if credential.Authenticator.CloneWarning {
+		log.Warn().Msg("Passkey login attempt with a cloned authenticator from " + ctx.RealIP())
+		appmetrics.LoginFailures.Inc("passkey")
+		return errorRes(401, tr(ctx, "error.invalid-passkey"), nil)
+	}
+	if waUser.User.Suspended {
+		return errorRes(403, tr(ctx, "flash.auth.account-suspended"), nil)
+	}
+
+	if err = waUser.Credential(credential.ID).UpdateAfterLogin(credential); err != nil {
+		return errorRes(500, "Cannot update passkey", err)
+	}
+
+	delete(sess.Values, "mfaUser")
+	sess.Values["user"] = waUser.User.ID
+	sess.Options.MaxAge = 60 * 60 * 24 * 365 // 1 year
+	saveSession(sess, ctx)
+	deleteCsrfCookie(ctx)
+
+	return ctx.JSON(200, map[string]string{"redirect": config.C.ExternalUrl + "/"})
+}
+
+func getWebAuthnUserById(userId uint) (*db.WebAuthnUser, error) {
+	user, err := db.GetUserById(userId)
+	if err != nil {
+		return nil, err
+	}
+	return db.GetWebAuthnUser(user)
+}
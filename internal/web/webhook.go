@@ -0,0 +1,103 @@
+package web
+
+import (
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/thomiceli/opengist/internal/config"
+	"github.com/thomiceli/opengist/internal/db"
+	"github.com/thomiceli/opengist/internal/i18n"
+	"github.com/thomiceli/opengist/internal/utils"
+	"github.com/thomiceli/opengist/internal/webhook"
+)
+
+func checkWebhooksEnabled(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		if !config.C.WebhookEnabled {
+			return notFound("Webhooks are not enabled")
+		}
+		return next(ctx)
+	}
+}
+
+// createWebhook adds the webhook of the form for the user, 0 for an instance webhook, then redirects to location.
+// The secret is only shown once, in the flash message.
+func createWebhook(ctx echo.Context, userId uint, location string) error {
+	dto := new(db.WebhookDTO)
+	if err := ctx.Bind(dto); err != nil {
+		return errorRes(400, tr(ctx, "error.cannot-bind-data"), err)
+	}
+
+	if err := ctx.Validate(dto); err != nil {
+		addFlash(ctx, utils.ValidationMessages(&err, getData(ctx, "locale").(*i18n.Locale)), "error")
+		return redirect(ctx, location)
+	}
+
+	hook := dto.ToWebhook()
+	hook.UserID = userId
+	if err := hook.Create(); err != nil {
+		return errorRes(500, "Cannot create webhook", err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.user.webhook-created", hook.Secret), "success")
+	return redirect(ctx, location)
+}
+
+// getWebhook returns the webhook of the id param if it belongs to the user, 0 for the instance webhooks
+func getWebhook(ctx echo.Context, userId uint) (*db.Webhook, error) {
+	id, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		return nil, notFound("Webhook not found")
+	}
+
+	hook, err := db.GetWebhookByID(uint(id))
+	if err != nil || hook.UserID != userId {
+		return nil, notFound("Webhook not found")
+	}
+	return hook, nil
+}
+
+// setWebhookDeliveries sets the data of the delivery log of the webhook
+func setWebhookDeliveries(ctx echo.Context, hook *db.Webhook) error {
+	deliveries, err := db.GetWebhookDeliveries(hook.ID)
+	if err != nil {
+		return errorRes(500, "Cannot get webhook deliveries", err)
+	}
+
+	setData(ctx, "webhook", hook)
+	setData(ctx, "deliveries", deliveries)
+	setData(ctx, "webhookRetries", len(webhook.RetryDelays))
+	return nil
+}
+
+func webhooksProcess(ctx echo.Context) error {
+	return createWebhook(ctx, getUserLogged(ctx).ID, "/settings")
+}
+
+func webhooksDelete(ctx echo.Context) error {
+	hook, err := getWebhook(ctx, getUserLogged(ctx).ID)
+	if err != nil {
+		return err
+	}
+
+	if err = hook.Delete(); err != nil {
+		return errorRes(500, "Cannot delete webhook", err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.user.webhook-deleted"), "success")
+	return redirect(ctx, "/settings")
+}
+
+func webhookDeliveries(ctx echo.Context) error {
+	hook, err := getWebhook(ctx, getUserLogged(ctx).ID)
+	if err != nil {
+		return err
+	}
+
+	if err = setWebhookDeliveries(ctx, hook); err != nil {
+		return err
+	}
+
+	setData(ctx, "htmlTitle", trH(ctx, "settings.webhook-deliveries"))
+	return html(ctx, "webhook.html")
+}
@@ -0,0 +1,274 @@
+// Package webhook sends the events of the gists to the webhooks of their owner and of the instance. The events are
+// saved as deliveries in the database, so they can be queued from the Git hooks processes too, and are sent in the
+// background by the server.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/thomiceli/opengist/internal/config"
+	"github.com/thomiceli/opengist/internal/db"
+)
+
+const (
+	GistCreated = "gist-created"
+	GistUpdated = "gist-updated"
+	GistDeleted = "gist-deleted"
+	GistForked  = "gist-forked"
+	GistLiked   = "gist-liked"
+)
+
+// Events are the names of the events a webhook can be sent
+var Events = []string{GistCreated, GistUpdated, GistDeleted, GistForked, GistLiked}
+
+// RetryDelays are the waits before attempting again a failed delivery, it is given up once they are all spent
+var RetryDelays = []time.Duration{time.Minute, 10 * time.Minute, time.Hour}
+
+// pollInterval is how often the deliveries queued by other processes, and the retries, are looked for
+const pollInterval = 30 * time.Second
+
+// batchSize is the number of deliveries fetched at once
+const batchSize = 20
+
+var errLocalAddress = errors.New("webhook address is local")
+
+var (
+	mutex sync.Mutex
+	wake  = make(chan struct{}, 1)
+
+	client = &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout: 5 * time.Second,
+				Control: checkAddress,
+			}).DialContext,
+			TLSHandshakeTimeout: 5 * time.Second,
+		},
+		// a redirection would send the payload to an address that was not checked when the webhook was added
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+)
+
+type gistPayload struct {
+	Owner       string `json:"owner"`
+	ID          string `json:"id"`
+	Uuid        string `json:"uuid"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Visibility  string `json:"visibility"`
+	URL         string `json:"url"`
+	CreatedAt   string `json:"created_at"`
+	UpdatedAt   string `json:"updated_at"`
+}
+
+type userPayload struct {
+	Username string `json:"username"`
+}
+
+// Payload is the JSON body sent to the webhooks
+type Payload struct {
+	Event     string       `json:"event"`
+	Gist      gistPayload  `json:"gist"`
+	Fork      *gistPayload `json:"fork,omitempty"`
+	Sender    *userPayload `json:"sender,omitempty"`
+	CreatedAt string       `json:"created_at"`
+}
+
+func newGistPayload(gist *db.Gist) gistPayload {
+	return gistPayload{
+		Owner:       gist.User.Username,
+		ID:          gist.Identifier(),
+		Uuid:        gist.Uuid,
+		Title:       gist.Title,
+		Description: gist.Description,
+		Visibility:  gist.VisibilityStr(),
+		URL:         config.C.ExternalUrl + "/" + gist.User.Username + "/" + gist.Identifier(),
+		CreatedAt:   time.Unix(gist.CreatedAt, 0).Format(time.RFC3339),
+		UpdatedAt:   time.Unix(gist.UpdatedAt, 0).Format(time.RFC3339),
+	}
+}
+
+// Trigger queues the event of the gist for the webhooks of its owner, and for the instance ones if the gist is public.
+// The sender is the user behind the event, nil if unknown. Errors are logged, they do not fail the event itself.
+func Trigger(event string, gist *db.Gist, sender *db.User) {
+	payload := &Payload{Event: event, Gist: newGistPayload(gist)}
+	queue(payload, gist, sender)
+}
+
+// TriggerFork queues the forked event of the parent gist, the payload holds the new fork too
+func TriggerFork(parent *db.Gist, fork *db.Gist, sender *db.User) {
+	forkPayload := newGistPayload(fork)
+	payload := &Payload{Event: GistForked, Gist: newGistPayload(parent), Fork: &forkPayload}
+	queue(payload, parent, sender)
+}
+
+func queue(payload *Payload, gist *db.Gist, sender *db.User) {
+	if !config.C.WebhookEnabled {
+		return
+	}
+
+	webhooks, err := db.GetWebhooksForEvent(payload.Event, gist.UserID, gist.Private == db.PublicVisibility)
+	if err != nil {
+		log.Error().Err(err).Msgf("Cannot get the webhooks of gist %d", gist.ID)
+		return
+	}
+	if len(webhooks) == 0 {
+		return
+	}
+
+	if sender != nil {
+		payload.Sender = &userPayload{Username: sender.Username}
+	}
+	payload.CreatedAt = time.Now().Format(time.RFC3339)
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Error().Err(err).Msg("Cannot encode the webhook payload")
+		return
+	}
+
+	for _, webhook := range webhooks {
+		if err = webhook.QueueDelivery(payload.Event, string(data)); err != nil {
+			log.Error().Err(err).Msgf("Cannot queue the delivery of webhook %d", webhook.ID)
+		}
+	}
+
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run sends the queued deliveries until the context is done, right after they are triggered by the server and
+// periodically for the others
+func Run(ctx context.Context) {
+	if !config.C.WebhookEnabled {
+		return
+	}
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		DeliverPending()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-wake:
+		}
+	}
+}
+
+// DeliverPending sends the deliveries whose attempt is due
+func DeliverPending() {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for {
+		deliveries, err := db.GetDueWebhookDeliveries(batchSize)
+		if err != nil {
+			log.Error().Err(err).Msg("Cannot get the webhook deliveries")
+			return
+		}
+
+		for _, delivery := range deliveries {
+			deliver(delivery)
+		}
+
+		// a failed delivery is planned later, so the next batch only holds new ones
+		if len(deliveries) < batchSize {
+			return
+		}
+	}
+}
+
+func deliver(delivery *db.WebhookDelivery) {
+	delivery.Attempts++
+	statusCode, err := send(delivery)
+	delivery.StatusCode = statusCode
+	delivery.Delivered = err == nil
+	delivery.NextAttemptAt = 0
+	delivery.Error = ""
+
+	if err != nil {
+		delivery.Error = err.Error()
+		if delivery.Attempts <= len(RetryDelays) {
+			delivery.NextAttemptAt = time.Now().Add(RetryDelays[delivery.Attempts-1]).Unix()
+		}
+		log.Warn().Err(err).Msgf("Cannot deliver %s event to webhook %d", delivery.Event, delivery.WebhookID)
+	}
+
+	if err = delivery.Update(); err != nil {
+		log.Error().Err(err).Msgf("Cannot update webhook delivery %d", delivery.ID)
+	}
+}
+
+func send(delivery *db.WebhookDelivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, delivery.Webhook.URL, bytes.NewBufferString(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Opengist-Webhook/"+config.OpengistVersion)
+	req.Header.Set("X-Opengist-Event", delivery.Event)
+	req.Header.Set("X-Opengist-Delivery", strconv.FormatUint(uint64(delivery.ID), 10))
+	req.Header.Set("X-Opengist-Signature-256", "sha256="+Sign(delivery.Webhook.Secret, []byte(delivery.Payload)))
+
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of the payload with the secret of the webhook
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkAddress refuses to connect to the addresses of the host and of its networks, unless they are allowed
+func checkAddress(network string, address string, _ syscall.RawConn) error {
+	if config.C.WebhookAllowLocal {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified() {
+		return errLocalAddress
+	}
+	return nil
+}
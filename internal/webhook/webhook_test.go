@@ -0,0 +1,27 @@
+package webhook
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thomiceli/opengist/internal/config"
+)
+
+func TestSign(t *testing.T) {
+	// RFC 4231 test case 2
+	require.Equal(t, "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843",
+		Sign("Jefe", []byte("what do ya want for nothing?")))
+}
+
+func TestCheckAddress(t *testing.T) {
+	require.NoError(t, config.InitConfig("", io.Discard))
+
+	for _, address := range []string{"127.0.0.1:80", "[::1]:443", "10.0.0.1:80", "192.168.1.1:80", "169.254.169.254:80", "0.0.0.0:80"} {
+		require.ErrorIs(t, checkAddress("tcp", address, nil), errLocalAddress, address)
+	}
+	require.NoError(t, checkAddress("tcp", "93.184.216.34:443", nil))
+
+	config.C.WebhookAllowLocal = true
+	require.NoError(t, checkAddress("tcp", "127.0.0.1:80", nil))
+}
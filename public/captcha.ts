@@ -0,0 +1,42 @@
+// Proof-of-work captcha: the browser looks for a nonce such that the SHA-256 hash of the challenge followed by the
+// nonce starts with the asked number of zero bits. It starts when the page loads, the form is sent once it is found.
+
+const leadingZeroBits = (hash: Uint8Array): number => {
+    let count = 0;
+    for (const byte of hash) {
+        if (byte !== 0) {
+            return count + Math.clz32(byte) - 24;
+        }
+        count += 8;
+    }
+    return count;
+};
+
+const solve = async (challenge: string, difficulty: number): Promise<string> => {
+    const encoder = new TextEncoder();
+    for (let nonce = 0; ; nonce++) {
+        const hash = await crypto.subtle.digest('SHA-256', encoder.encode(challenge + nonce));
+        if (leadingZeroBits(new Uint8Array(hash)) >= difficulty) {
+            return nonce.toString();
+        }
+    }
+};
+
+document.addEventListener('DOMContentLoaded', () => {
+    document.querySelectorAll<HTMLElement>('.pow-captcha').forEach((box) => {
+        const form = box.closest('form');
+        const input = box.querySelector<HTMLInputElement>('input[name="pow-nonce"]');
+        const solution = solve(box.dataset.challenge, parseInt(box.dataset.difficulty)).then((nonce) => {
+            input.value = nonce;
+        });
+
+        form.addEventListener('submit', (event) => {
+            if (input.value !== '') {
+                return;
+            }
+            event.preventDefault();
+            box.querySelector('.pow-status').classList.remove('hidden');
+            solution.then(() => form.submit());
+        });
+    });
+});
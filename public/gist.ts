@@ -1,23 +1,74 @@
+const selectLines = (table: HTMLElement, from: number, to: number) => {
+    Array.from(document.querySelectorAll('.table-code .selected')).forEach((el) => el.classList.remove('selected'));
+    table.querySelectorAll<HTMLElement>('.line-num').forEach((el) => {
+        const line = parseInt(el.textContent);
+        if (line >= from && line <= to && el.nextSibling instanceof HTMLElement) {
+            el.nextSibling.classList.add('selected');
+        }
+    });
+};
+
+let lastClickedLine = 0;
 document.querySelectorAll<HTMLElement>('.table-code').forEach((el) => {
     el.addEventListener('click', event => {
         if (event.target && (event.target as HTMLElement).matches('.line-num')) {
-            Array.from(document.querySelectorAll('.table-code .selected')).forEach((el) => el.classList.remove('selected'));
-
-            const nextSibling = (event.target as HTMLElement).nextSibling;
-            if (nextSibling instanceof HTMLElement) {
-                nextSibling.classList.add('selected');
+            const line = parseInt((event.target as HTMLElement).textContent);
+            let from = line, to = line;
+            if (event.shiftKey && lastClickedLine !== 0) {
+                from = Math.min(lastClickedLine, line);
+                to = Math.max(lastClickedLine, line);
+            } else {
+                lastClickedLine = line;
             }
+            selectLines(el, from, to);
 
             const filename = el.dataset.filenameSlug;
-            const line = (event.target as HTMLElement).textContent;
-            const url = location.protocol + '//' + location.host + location.pathname;
-            const hash = '#file-' + filename + '-' + line;
+            const url = location.protocol + '//' + location.host + location.pathname + location.search;
+            const hash = '#file-' + filename + '-L' + from + (to !== from ? '-L' + to : '');
             window.history.pushState(null, null, url + hash);
-            location.hash = hash;
+
+            // the permalink of the file points to the selected lines too
+            const permalink = el.closest<HTMLElement>('div[data-file]')?.querySelector<HTMLAnchorElement>('.permalink');
+            if (permalink) {
+                permalink.hash = hash;
+            }
         }
     });
 });
 
+// rendered files (Markdown...) show their preview first, their source can be shown instead
+const showRenderedView = (file: HTMLElement, view: string) => {
+    file.querySelector('.rendered-preview').classList.toggle('hidden', view !== 'preview');
+    file.querySelector('.rendered-source').classList.toggle('hidden', view !== 'source');
+    file.querySelectorAll<HTMLElement>('.render-toggle button').forEach((button) => {
+        const active = button.dataset.view === view;
+        button.classList.toggle('bg-gray-100', active);
+        button.classList.toggle('dark:bg-gray-700', active);
+        button.classList.toggle('bg-white', !active);
+        button.classList.toggle('dark:bg-gray-600', !active);
+    });
+};
+
+document.querySelectorAll<HTMLElement>('.render-toggle button').forEach((button) => {
+    button.addEventListener('click', () => {
+        showRenderedView(button.closest<HTMLElement>('div[data-file]'), button.dataset.view);
+    });
+});
+
+// #file-main-go-L10 or #file-main-go-L10-L20
+const hashMatch = location.hash.match(/^#file-(.+?)-L(\d+)(?:-L(\d+))?$/);
+if (hashMatch) {
+    const table = document.querySelector<HTMLElement>(`.table-code[data-filename-slug="${CSS.escape(hashMatch[1])}"]`);
+    if (table) {
+        // lines of a rendered file can only be pointed at in its source
+        if (table.closest('.rendered-source')) {
+            showRenderedView(table.closest<HTMLElement>('div[data-file]'), 'source');
+        }
+        const from = parseInt(hashMatch[2]);
+        selectLines(table, from, hashMatch[3] ? parseInt(hashMatch[3]) : from);
+    }
+}
+
 let copybtnhtml = `<button type="button" style="top: 1em !important; right: 1em !important;" class="md-code-copy-btn absolute focus-within:z-auto rounded-md dark:border-gray-600 px-2 py-2 opacity-80 font-medium text-slate-700 bg-gray-100 dark:bg-gray-700 dark:text-slate-300 hover:bg-gray-200 dark:hover:bg-gray-600 hover:border-gray-500 hover:text-slate-700 dark:hover:text-slate-300 focus:border-primary-500 focus:outline-none focus:ring-1 focus:ring-primary-500"><svg xmlns="http://www.w3.org/2000/svg" fill="none" viewBox="0 0 24 24" stroke-width="1.5" stroke="currentColor" class="w-5 h-5"><path stroke-linecap="round" stroke-linejoin="round" d="M8.25 7.5V6.108c0-1.135.845-2.098 1.976-2.192.373-.03.748-.057 1.123-.08M15.75 18H18a2.25 2.25 0 002.25-2.25V6.108c0-1.135-.845-2.098-1.976-2.192a48.424 48.424 0 00-1.123-.08M15.75 18.75v-1.875a3.375 3.375 0 00-3.375-3.375h-1.5a1.125 1.125 0 01-1.125-1.125v-1.5A3.375 3.375 0 006.375 7.5H5.25m11.9-3.664A2.251 2.251 0 0015 2.25h-1.5a2.251 2.251 0 00-2.15 1.586m5.8 0c.065.21.1.433.1.664v.75h-6V4.5c0-.231.035-.454.1-.664M6.75 7.5H4.875c-.621 0-1.125.504-1.125 1.125v12c0 .621.504 1.125 1.125 1.125h9.75c.621 0 1.125-.504 1.125-1.125V16.5a9 9 0 00-9-9z" /></svg></button>`;
 
 document.querySelectorAll<HTMLElement>('.markdown-body pre').forEach((el) => {
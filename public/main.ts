@@ -178,7 +178,8 @@ document.addEventListener('DOMContentLoaded', () => {
         document.getElementById('gist-visibility-menu-button')!.onclick = () => {
             gistmenuvisibility!.classList.toggle('hidden');
         }
-        const lastVisibility = localStorage.getItem('visibility');
+        // the default visibility picked in the settings wins over the last one used
+        const lastVisibility = submitgistbutton.dataset.visibilityDefault || localStorage.getItem('visibility');
         Array.from(document.querySelectorAll('.gist-visibility-option')).forEach((el) => {
             const visibility = (el as HTMLElement).dataset.visibility || '0';
             (el as HTMLElement).onclick = () => {
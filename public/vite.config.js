@@ -14,7 +14,9 @@ export default defineConfig({
                 './public/editor.ts',
                 './public/admin.ts',
                 './public/gist.ts',
-                './public/embed.ts'
+                './public/embed.ts',
+                './public/webauthn.ts',
+                './public/captcha.ts'
             ]
         },
         assetsInlineLimit: 0,
@@ -0,0 +1,116 @@
+// Passkey ceremonies: the server sends the options of the browser WebAuthn API, with binary values encoded in
+// base64url, and checks the answer of the authenticator.
+
+// @ts-ignore
+const baseUrl = window.opengist_base_url || '';
+
+const decode = (value: string): ArrayBuffer => {
+    const base64 = value.replace(/-/g, '+').replace(/_/g, '/');
+    return Uint8Array.from(atob(base64), (c) => c.charCodeAt(0)).buffer;
+};
+
+const encode = (value: ArrayBuffer): string => {
+    return btoa(String.fromCharCode(...new Uint8Array(value)))
+        .replace(/\+/g, '-')
+        .replace(/\//g, '_')
+        .replace(/=+$/, '');
+};
+
+const post = async (path: string, data: FormData) => {
+    const res = await fetch(`${baseUrl}${path}`, {
+        method: 'POST',
+        credentials: 'same-origin',
+        headers: {'Accept': 'application/json'},
+        body: data,
+    });
+    const body = await res.json();
+    if (!res.ok) {
+        throw new Error(body.error?.message || res.statusText);
+    }
+    return body;
+};
+
+const csrfData = (): FormData => {
+    const data = new FormData();
+    if (document.getElementsByName('_csrf').length !== 0) {
+        data.append('_csrf', (document.getElementsByName('_csrf')[0] as HTMLInputElement).value);
+    }
+    return data;
+};
+
+const showError = (box: HTMLElement, err: Error) => {
+    const el = box.querySelector<HTMLElement>('.webauthn-error');
+    // the user closed the browser prompt
+    el.textContent = err.name === 'NotAllowedError' ? '' : err.message;
+    el.classList.toggle('hidden', el.textContent === '');
+};
+
+const register = async (form: HTMLFormElement) => {
+    const options = await post('/settings/passkeys/begin', new FormData(form));
+    const publicKey = options.publicKey;
+    publicKey.challenge = decode(publicKey.challenge);
+    publicKey.user.id = decode(publicKey.user.id);
+    (publicKey.excludeCredentials || []).forEach((c: any) => c.id = decode(c.id));
+
+    const credential = await navigator.credentials.create({publicKey}) as PublicKeyCredential;
+    const response = credential.response as AuthenticatorAttestationResponse;
+
+    const data = new FormData(form);
+    data.delete('passcode');
+    data.append('credential', JSON.stringify({
+        id: credential.id,
+        rawId: encode(credential.rawId),
+        type: credential.type,
+        response: {
+            attestationObject: encode(response.attestationObject),
+            clientDataJSON: encode(response.clientDataJSON),
+            transports: response.getTransports ? response.getTransports() : [],
+        },
+    }));
+    const res = await post('/settings/passkeys/finish', data);
+    window.location.href = res.redirect;
+};
+
+const login = async () => {
+    const options = await post('/webauthn/login/begin', csrfData());
+    const publicKey = options.publicKey;
+    publicKey.challenge = decode(publicKey.challenge);
+    (publicKey.allowCredentials || []).forEach((c: any) => c.id = decode(c.id));
+
+    const credential = await navigator.credentials.get({publicKey}) as PublicKeyCredential;
+    const response = credential.response as AuthenticatorAssertionResponse;
+
+    const data = csrfData();
+    data.append('credential', JSON.stringify({
+        id: credential.id,
+        rawId: encode(credential.rawId),
+        type: credential.type,
+        response: {
+            authenticatorData: encode(response.authenticatorData),
+            clientDataJSON: encode(response.clientDataJSON),
+            signature: encode(response.signature),
+            userHandle: response.userHandle ? encode(response.userHandle) : null,
+        },
+    }));
+    const res = await post('/webauthn/login/finish', data);
+    window.location.href = res.redirect;
+};
+
+document.addEventListener('DOMContentLoaded', () => {
+    if (!window.PublicKeyCredential) {
+        return;
+    }
+
+    const form = document.getElementById('webauthn-register') as HTMLFormElement;
+    form?.addEventListener('submit', (event) => {
+        event.preventDefault();
+        register(form).catch((err) => showError(form, err));
+    });
+
+    document.querySelectorAll<HTMLElement>('.webauthn-login').forEach((box) => {
+        box.classList.remove('hidden');
+        box.querySelector('button').addEventListener('click', () => {
+            login().catch((err) => showError(box, err));
+        });
+    });
+});